@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+)
+
+// Whether the request carries the admin token
+func isAdmin(r *http.Request) bool {
+	return config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(config.AdminToken)) == 1
+}
+
+// Middleware restricting admin endpoints to callers presenting ADMIN_TOKEN.
+// The admin API is disabled entirely when no token is configured.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			http.Error(w, "Admin API is disabled", http.StatusForbidden)
+			slog.WarnContext(r.Context(), "Rejected admin request: ADMIN_TOKEN is not configured", "path", r.URL.Path)
+			return
+		}
+		if !isAdmin(r) {
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			slog.WarnContext(r.Context(), "Rejected admin request: invalid admin token", "path", r.URL.Path, "client_ip", clientIP(r))
+			return
+		}
+		handler(w, r)
+	}
+}
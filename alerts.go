@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// How often alert thresholds are evaluated
+const alertCheckInterval = 30 * time.Second
+
+// Fires notifications when the error rate or p95 latency stay above their thresholds
+// for the alert window, at most once per cooldown period for each kind of alert
+type alerter struct {
+	notifiers []Notifier
+	lastFired map[string]time.Time
+}
+
+func startAlerting() {
+	notifiers := configuredNotifiers()
+	if len(notifiers) == 0 {
+		return
+	}
+	a := &alerter{notifiers: notifiers, lastFired: make(map[string]time.Time)}
+	slog.Info("Alerting enabled", "error_rate_percent", config.AlertErrorRate*100, "p95_latency", config.AlertLatency, "window", config.AlertWindow)
+	go func() {
+		for range time.Tick(alertCheckInterval) {
+			a.check(metrics.window(config.AlertWindow))
+		}
+	}()
+}
+
+func (a *alerter) check(stats WindowStats) {
+	if stats.Requests < config.AlertMinRequests {
+		return
+	}
+
+	if rate := stats.ErrorRate(); rate >= config.AlertErrorRate {
+		a.fire(Notification{
+			Key:      "receipt-processor-error-rate",
+			Title:    "Receipt Processor error rate is high",
+			Message:  fmt.Sprintf("%.1f%% of requests failed over the last %s", rate*100, config.AlertWindow),
+			Severity: severityCritical,
+			Details: map[string]string{
+				"requests":  fmt.Sprint(stats.Requests),
+				"errors":    fmt.Sprint(stats.Errors),
+				"threshold": fmt.Sprintf("%.1f%%", config.AlertErrorRate*100),
+			},
+		})
+	}
+
+	if p95 := stats.Latency.Quantile(0.95); p95 >= config.AlertLatency {
+		a.fire(Notification{
+			Key:      "receipt-processor-latency",
+			Title:    "Receipt Processor is slow",
+			Message:  fmt.Sprintf("p95 latency was %s over the last %s", p95, config.AlertWindow),
+			Severity: severityWarning,
+			Details: map[string]string{
+				"requests":  fmt.Sprint(stats.Requests),
+				"threshold": config.AlertLatency.String(),
+			},
+		})
+	}
+}
+
+func (a *alerter) fire(n Notification) {
+	if last, found := a.lastFired[n.Key]; found && time.Since(last) < config.AlertCooldown {
+		return
+	}
+	a.lastFired[n.Key] = time.Now()
+
+	slog.Warn("Alert", "title", n.Title, "message", n.Message)
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := notifyAll(ctx, a.notifiers, n); err != nil {
+		slog.Error("Error sending alert", "error", err)
+	}
+}
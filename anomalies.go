@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	anomalyMaxResults = 20
+	// Users need this many receipts in the last day before a jump counts as a spike
+	anomalyMinVolume = 5
+	// Retailers need this many receipts before their average total is meaningful
+	anomalyMinRetailerReceipts = 3
+	anomalySpikeWindow         = 24 * time.Hour
+	anomalyBaselineDays        = 7
+)
+
+type ReceiptAnomaly struct {
+	ID       string  `json:"id"`
+	Retailer string  `json:"retailer"`
+	Points   int     `json:"points"`
+	ZScore   float64 `json:"zScore"`
+}
+
+type UserAnomaly struct {
+	UserID   string  `json:"userId"`
+	Recent   int     `json:"recentReceipts"`
+	Baseline float64 `json:"baselineDailyReceipts"`
+	Ratio    float64 `json:"ratio"`
+}
+
+type RetailerAnomaly struct {
+	Retailer     string  `json:"retailer"`
+	Receipts     int     `json:"receipts"`
+	AverageTotal string  `json:"averageTotal"`
+	ZScore       float64 `json:"zScore"`
+}
+
+type AnomalyReport struct {
+	GeneratedAt  time.Time         `json:"generatedAt"`
+	Receipts     int               `json:"receipts"`
+	MeanPoints   float64           `json:"meanPoints"`
+	StdDevPoints float64           `json:"stdDevPoints"`
+	Threshold    float64           `json:"threshold"`
+	HighPoints   []ReceiptAnomaly  `json:"highPoints"`
+	UserSpikes   []UserAnomaly     `json:"userSpikes"`
+	Retailers    []RetailerAnomaly `json:"retailers"`
+}
+
+var anomalyReport *AnomalyReport
+var anomalyMutex = &sync.RWMutex{}
+
+// Recompute the anomaly report in the background every ANOMALY_INTERVAL
+func startAnomalyDetection() {
+	if config.AnomalyInterval == 0 {
+		return
+	}
+	go func() {
+		for {
+			refreshAnomalies(context.Background())
+			time.Sleep(config.AnomalyInterval)
+		}
+	}()
+}
+
+func refreshAnomalies(ctx context.Context) {
+	receipts, err := store.List(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error listing receipts for anomaly detection", "error", err)
+		return
+	}
+	report := detectAnomalies(receipts, config.AnomalyThreshold, time.Now().UTC())
+
+	anomalyMutex.Lock()
+	anomalyReport = &report
+	anomalyMutex.Unlock()
+	slog.InfoContext(ctx, "Anomaly report", "high_point_receipts", len(report.HighPoints), "user_spikes", len(report.UserSpikes), "retailers", len(report.Retailers))
+}
+
+func detectAnomalies(receipts []Receipt, threshold float64, now time.Time) AnomalyReport {
+	report := AnomalyReport{
+		GeneratedAt: now,
+		Receipts:    len(receipts),
+		Threshold:   threshold,
+		HighPoints:  []ReceiptAnomaly{},
+		UserSpikes:  []UserAnomaly{},
+		Retailers:   []RetailerAnomaly{},
+	}
+
+	// Receipts scoring far above the mean
+	points := make([]float64, len(receipts))
+	for i, receipt := range receipts {
+		points[i] = float64(receipt.Points)
+	}
+	mean, stdDev := meanStdDev(points)
+	report.MeanPoints, report.StdDevPoints = round2(mean), round2(stdDev)
+	if stdDev > 0 {
+		for _, receipt := range receipts {
+			if z := (float64(receipt.Points) - mean) / stdDev; z >= threshold {
+				report.HighPoints = append(report.HighPoints, ReceiptAnomaly{receipt.ID, receipt.Retailer, receipt.Points, round2(z)})
+			}
+		}
+	}
+	sort.Slice(report.HighPoints, func(i, j int) bool { return report.HighPoints[i].ZScore > report.HighPoints[j].ZScore })
+
+	// Users whose last day is well above their daily average for the week before
+	recentStart := now.Add(-anomalySpikeWindow)
+	baselineStart := recentStart.Add(-anomalyBaselineDays * anomalySpikeWindow)
+	recent, baseline := map[string]int{}, map[string]int{}
+	for _, receipt := range receipts {
+		switch {
+		case receipt.UserID == "":
+		case !receipt.ReceivedAt.Before(recentStart):
+			recent[receipt.UserID]++
+		case !receipt.ReceivedAt.Before(baselineStart):
+			baseline[receipt.UserID]++
+		}
+	}
+	for userID, count := range recent {
+		if count < anomalyMinVolume {
+			continue
+		}
+		daily := float64(baseline[userID]) / anomalyBaselineDays
+		ratio := float64(count) / math.Max(daily, 1)
+		if ratio >= threshold {
+			report.UserSpikes = append(report.UserSpikes, UserAnomaly{userID, count, round2(daily), round2(ratio)})
+		}
+	}
+	sort.Slice(report.UserSpikes, func(i, j int) bool { return report.UserSpikes[i].Ratio > report.UserSpikes[j].Ratio })
+
+	// Retailers whose average total is far from what other retailers see
+	type retailerTotals struct {
+		receipts int
+		cents    int64
+	}
+	retailers := map[string]*retailerTotals{}
+	for _, receipt := range receipts {
+		cents, ok := parseCents(receipt.Total)
+		if !ok {
+			continue
+		}
+		totals := retailers[receipt.Retailer]
+		if totals == nil {
+			totals = &retailerTotals{}
+			retailers[receipt.Retailer] = totals
+		}
+		totals.receipts++
+		totals.cents += cents
+	}
+	var averages []float64
+	for retailer, totals := range retailers {
+		if totals.receipts < anomalyMinRetailerReceipts {
+			delete(retailers, retailer)
+			continue
+		}
+		averages = append(averages, float64(totals.cents)/float64(totals.receipts))
+	}
+	if mean, stdDev := meanStdDev(averages); stdDev > 0 {
+		for retailer, totals := range retailers {
+			average := float64(totals.cents) / float64(totals.receipts)
+			if z := (average - mean) / stdDev; math.Abs(z) >= threshold {
+				report.Retailers = append(report.Retailers, RetailerAnomaly{retailer, totals.receipts, formatCents(int64(math.Round(average))), round2(z)})
+			}
+		}
+	}
+	sort.Slice(report.Retailers, func(i, j int) bool {
+		return math.Abs(report.Retailers[i].ZScore) > math.Abs(report.Retailers[j].ZScore)
+	})
+
+	report.HighPoints = report.HighPoints[:min(len(report.HighPoints), anomalyMaxResults)]
+	report.UserSpikes = report.UserSpikes[:min(len(report.UserSpikes), anomalyMaxResults)]
+	report.Retailers = report.Retailers[:min(len(report.Retailers), anomalyMaxResults)]
+	return report
+}
+
+// Population mean and standard deviation
+func meanStdDev(values []float64) (float64, float64) {
+	if len(values) == 0 {
+		return 0, 0
+	}
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	mean := sum / float64(len(values))
+	variance := 0.0
+	for _, value := range values {
+		variance += (value - mean) * (value - mean)
+	}
+	return mean, math.Sqrt(variance / float64(len(values)))
+}
+
+func round2(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+func getAnomalies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	anomalyMutex.RLock()
+	report := anomalyReport
+	anomalyMutex.RUnlock()
+	if report == nil {
+		http.Error(w, "Anomaly report has not been computed yet", http.StatusServiceUnavailable)
+		slog.WarnContext(r.Context(), "Anomaly report requested before the first run")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type apiKeyNameKey struct{}
+
+// The name of the API key the request ctx belongs to authenticated with, empty outside of
+// requests or without API_KEYS
+func apiKeyName(ctx context.Context) string {
+	name, _ := ctx.Value(apiKeyNameKey{}).(string)
+	return name
+}
+
+// Middleware requiring an Authorization: Bearer header on every route once API keys or JWT
+// verification are configured. It carries either one of the API keys, whose name is logged
+// with everything logged for the request and which may be bound to a tenant by
+// API_KEY_TENANTS, or a signed JWT, which scopes the request to the receipts of its subject.
+// Health probes stay open for load balancers, and pre-signed submission URLs and
+// enrichment callback URLs carry their own credential. Admin endpoints need the admin
+// token as well.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (len(config.APIKeys) == 0 && !jwtEnabled()) || isProbePath(r.URL.Path) || hasURLCredential(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || key == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="receipt-processor"`)
+			http.Error(w, "Authentication is required: send Authorization: Bearer <API key or token>", http.StatusUnauthorized)
+			slog.WarnContext(r.Context(), "Rejected request without credentials", "path", r.URL.Path, "client_ip", clientIP(r))
+			return
+		}
+		if jwtEnabled() && isJWT(key) {
+			subject, err := verifyJWT(key, time.Now())
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="receipt-processor", error="invalid_token"`)
+				http.Error(w, "Invalid token: "+err.Error(), http.StatusUnauthorized)
+				slog.WarnContext(r.Context(), "Rejected request with an invalid token", "path", r.URL.Path, "client_ip", clientIP(r), "error", err)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authSubjectKey{}, subject)))
+			return
+		}
+		name, valid := lookupAPIKey(key)
+		if !valid {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="receipt-processor", error="invalid_token"`)
+			http.Error(w, "Invalid API key", http.StatusUnauthorized)
+			slog.WarnContext(r.Context(), "Rejected request with an invalid API key", "path", r.URL.Path, "client_ip", clientIP(r))
+			return
+		}
+		ctx := context.WithValue(r.Context(), apiKeyNameKey{}, name)
+		// A key bound to a tenant decides it, like a pre-signed URL does, so the rest of the
+		// request sees it in X-Tenant-ID
+		if tenant, bound := config.APIKeyTenants[name]; bound {
+			if requested := r.Header.Get("X-Tenant-ID"); requested != "" && requested != tenant {
+				http.Error(w, "X-Tenant-ID doesn't match the tenant of the API key", http.StatusForbidden)
+				slog.WarnContext(ctx, "Rejected request for another tenant", "tenant", requested, "key_tenant", tenant)
+				return
+			}
+			r.Header.Set("X-Tenant-ID", tenant)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Every key is compared, in constant time, so the time taken doesn't give away how much
+// of a key was right or which key matched
+func lookupAPIKey(key string) (string, bool) {
+	matched := ""
+	for name, candidate := range config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(candidate)) == 1 {
+			matched = name
+		}
+	}
+	return matched, matched != ""
+}
+
+func hasURLCredential(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if strings.EqualFold(r.URL.Path, apiVersion+"/enrichment/callbacks") {
+		return token != ""
+	}
+	return strings.EqualFold(r.URL.Path, apiVersion+"/receipts/process") && isUsableSubmissionToken(token)
+}
+
+// API keys as name=key pairs, from API_KEYS and then API_KEYS_FILE (one per line, with #
+// comments), so keys can be rotated by editing a mounted secret rather than the environment
+func loadAPIKeys(errs *[]error) map[string]string {
+	keys := map[string]string{}
+	add := func(source, entry string) {
+		name, key, _ := strings.Cut(entry, "=")
+		name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+		if name == "" || len(key) < 16 {
+			*errs = append(*errs, fmt.Errorf("%s entries must be name=key with a key of at least 16 characters, got an entry for %q", source, name))
+			return
+		}
+		if _, exists := keys[name]; exists {
+			*errs = append(*errs, fmt.Errorf("%s names API key %q more than once", source, name))
+			return
+		}
+		keys[name] = key
+	}
+
+	for _, entry := range getEnvList("API_KEYS") {
+		add("API_KEYS", entry)
+	}
+	path := getEnv("API_KEYS_FILE", "")
+	if path == "" {
+		return keys
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("API_KEYS_FILE could not be read: %v", err))
+		return keys
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			add("API_KEYS_FILE", line)
+		}
+	}
+	return keys
+}
+
+// Parse API_KEY_TENANTS entries such as "partner_portal=acme", binding an API key, by name,
+// to the tenant every request made with it belongs to
+func getEnvAPIKeyTenants(key string, keys map[string]string, errs *[]error) map[string]string {
+	tenants := map[string]string{}
+	for _, entry := range getEnvList(key) {
+		name, tenant, _ := strings.Cut(entry, "=")
+		name, tenant = strings.TrimSpace(name), strings.TrimSpace(tenant)
+		if name == "" || tenant == "" {
+			*errs = append(*errs, fmt.Errorf("%s entries must be name=tenant, got %q", key, entry))
+			continue
+		}
+		if _, exists := keys[name]; !exists {
+			*errs = append(*errs, fmt.Errorf("%s names API key %q, which isn't in API_KEYS or API_KEYS_FILE", key, name))
+			continue
+		}
+		tenants[name] = tenant
+	}
+	return tenants
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const (
+	rawArchiveQueueSize = 1000
+	rawArchiveAttempts  = 3
+)
+
+type archivedPayload struct {
+	id   string
+	body []byte
+}
+
+// Uploads original request bodies to RAW_ARCHIVE in the background, one object per receipt ID
+type rawArchiver struct {
+	client *s3Client
+	bucket string
+	prefix string
+	queue  chan archivedPayload
+}
+
+var archiver *rawArchiver
+
+func startRawArchive() error {
+	if config.RawArchive == "" {
+		return nil
+	}
+	bucket, prefix, err := parseS3URL(config.RawArchive)
+	if err != nil {
+		return err
+	}
+	client, err := newS3Client(config)
+	if err != nil {
+		return err
+	}
+	archiver = &rawArchiver{client: client, bucket: bucket, prefix: prefix, queue: make(chan archivedPayload, rawArchiveQueueSize)}
+	go archiver.run()
+	slog.Info("Archiving raw payloads", "destination", config.RawArchive)
+	return nil
+}
+
+// Queue a processed receipt's original body for archival without holding up the response
+func archiveRawPayload(id string, body []byte) {
+	if archiver == nil {
+		return
+	}
+	select {
+	case archiver.queue <- archivedPayload{id, body}:
+	default:
+		slog.Warn("Raw archive queue is full, not archiving payload", "receipt_id", id)
+	}
+}
+
+func (a *rawArchiver) key(id string) string {
+	return strings.TrimPrefix(a.prefix+"/"+id+".json", "/")
+}
+
+func (a *rawArchiver) run() {
+	for payload := range a.queue {
+		var err error
+		for attempt := 1; attempt <= rawArchiveAttempts; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err = a.client.PutObject(ctx, a.bucket, a.key(payload.id), "application/json", payload.body)
+			cancel()
+			if err == nil {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err != nil {
+			slog.Error("Error archiving raw payload", "receipt_id", payload.id, "error", err)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Breakdown views
+const (
+	breakdownViewFull    = "full"
+	breakdownViewGrouped = "grouped"
+	breakdownViewSummary = "summary"
+)
+
+// Per-rule subtotal returned by the summary view
+type RuleSummary struct {
+	Rule    string `json:"rule"`
+	Applied int    `json:"applied"`
+	Points  int    `json:"points"`
+}
+
+type breakdownQuery struct {
+	Rules  map[string]bool
+	View   string
+	Limit  int
+	Offset int
+}
+
+func parseBreakdownQuery(query url.Values) (breakdownQuery, error) {
+	q := breakdownQuery{View: query.Get("view")}
+	if q.View == "" {
+		q.View = breakdownViewFull
+	}
+	if q.View != breakdownViewFull && q.View != breakdownViewGrouped && q.View != breakdownViewSummary {
+		return q, fmt.Errorf("view must be %q, %q or %q", breakdownViewFull, breakdownViewGrouped, breakdownViewSummary)
+	}
+
+	// ?rule= may be repeated or comma-separated
+	for _, value := range query["rule"] {
+		for _, rule := range strings.Split(value, ",") {
+			if rule = strings.TrimSpace(rule); rule != "" {
+				if q.Rules == nil {
+					q.Rules = make(map[string]bool)
+				}
+				q.Rules[rule] = true
+			}
+		}
+	}
+
+	var err error
+	if q.Limit, q.Offset, err = parsePagination(query); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// Parse ?limit= and ?offset=; a limit of 0 means no limit
+func parsePagination(query url.Values) (int, int, error) {
+	limit, offset := 0, 0
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return 0, 0, errors.New("limit must be a positive integer")
+		}
+		limit = n
+	}
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// Apply rule filtering, grouping and pagination; returns the page and the number of matching entries
+func selectBreakdown(breakdown []RuleResult, q breakdownQuery) ([]RuleResult, int) {
+	selected := filterBreakdown(breakdown, q.Rules)
+
+	if q.View == breakdownViewGrouped {
+		selected = groupItemResults(selected)
+	}
+
+	total := len(selected)
+	if q.Offset >= total {
+		return []RuleResult{}, total
+	}
+	selected = selected[q.Offset:]
+	if q.Limit > 0 && q.Limit < len(selected) {
+		selected = selected[:q.Limit]
+	}
+	return selected, total
+}
+
+func filterBreakdown(breakdown []RuleResult, rules map[string]bool) []RuleResult {
+	selected := []RuleResult{}
+	for _, result := range breakdown {
+		if rules == nil || rules[result.Rule] {
+			selected = append(selected, result)
+		}
+	}
+	return selected
+}
+
+// Subtotal points per rule, in the order the rules first applied
+func summarizeBreakdown(breakdown []RuleResult) []RuleSummary {
+	summary := []RuleSummary{}
+	positions := make(map[string]int)
+	for _, result := range breakdown {
+		position, found := positions[result.Rule]
+		if !found {
+			position = len(summary)
+			positions[result.Rule] = position
+			summary = append(summary, RuleSummary{Rule: result.Rule})
+		}
+		summary[position].Applied++
+		summary[position].Points += result.Points
+	}
+	return summary
+}
+
+// Collapse per-item description entries into a single entry with a count and subtotal
+func groupItemResults(breakdown []RuleResult) []RuleResult {
+	grouped := []RuleResult{}
+	count, subtotal, position := 0, 0, -1
+	for _, result := range breakdown {
+		if result.Rule != ruleItemDescription {
+			grouped = append(grouped, result)
+			continue
+		}
+		if position < 0 {
+			position = len(grouped)
+			grouped = append(grouped, RuleResult{Rule: ruleItemDescription})
+		}
+		count++
+		subtotal += result.Points
+	}
+
+	if position >= 0 {
+		grouped[position].Points = subtotal
+		grouped[position].Description = fmt.Sprintf("%d points - %d items have a description length that is a multiple of 3", subtotal, count)
+	}
+	return grouped
+}
+
+func breakdownDescriptions(breakdown []RuleResult) []string {
+	descriptions := make([]string, 0, len(breakdown))
+	for _, result := range breakdown {
+		descriptions = append(descriptions, result.Description)
+	}
+	return descriptions
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Set caching headers for a scored receipt and report whether the client's copy is still current.
+// Scored results only change when a receipt is recalculated, which moves its ScoredAt forward.
+// Receipts are only served to their tenant and user, so shared caches mustn't keep them.
+func checkNotModified(w http.ResponseWriter, r *http.Request, scoredAt time.Time) bool {
+	if config.CacheMaxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(config.CacheMaxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	w.Header().Add("Vary", "Authorization, X-Tenant-ID")
+
+	// HTTP dates have second precision
+	lastModified := scoredAt.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The fields a partial receipt can be captured or enriched with; everything is optional
+// until the receipt is finalized
+type partialReceipt struct {
+	Retailer     string `json:"retailer,omitempty"`
+	PurchaseDate string `json:"purchaseDate,omitempty"`
+	PurchaseTime string `json:"purchaseTime,omitempty"`
+	PurchasedAt  string `json:"purchasedAt,omitempty"`
+	Items        []Item `json:"items,omitempty"`
+	Total        string `json:"total,omitempty"`
+	UserID       string `json:"userId,omitempty"`
+}
+
+type captureResponse struct {
+	ID      string   `json:"id"`
+	Status  string   `json:"status"`
+	Missing []string `json:"missing"`
+}
+
+// Fields a partial receipt still needs before it can be finalized
+func missingFields(receipt Receipt) []string {
+	missing := []string{}
+	if receipt.Retailer == "" {
+		missing = append(missing, "retailer")
+	}
+	if receipt.PurchasedAt == "" {
+		if receipt.PurchaseDate == "" {
+			missing = append(missing, "purchaseDate")
+		}
+		if receipt.PurchaseTime == "" {
+			missing = append(missing, "purchaseTime")
+		}
+	}
+	if len(receipt.Items) == 0 {
+		missing = append(missing, "items")
+	}
+	if receipt.Total == "" {
+		missing = append(missing, "total")
+	}
+	return missing
+}
+
+// Copy the fields present in partial onto receipt; items are added to those already captured
+func applyPartial(receipt *Receipt, partial partialReceipt) {
+	if partial.Retailer != "" {
+		receipt.Retailer = partial.Retailer
+	}
+	if partial.PurchaseDate != "" {
+		receipt.PurchaseDate = partial.PurchaseDate
+	}
+	if partial.PurchaseTime != "" {
+		receipt.PurchaseTime = partial.PurchaseTime
+	}
+	if partial.PurchasedAt != "" {
+		receipt.PurchasedAt = partial.PurchasedAt
+	}
+	if partial.Total != "" {
+		receipt.Total = partial.Total
+	}
+	if partial.UserID != "" {
+		receipt.UserID = partial.UserID
+	}
+	receipt.Items = append(receipt.Items, partial.Items...)
+}
+
+// Copy the fields a receipt doesn't have yet from partial, an enrichment provider's result.
+// The user isn't one of them: providers aren't told it, and don't choose who is credited.
+func fillMissing(receipt *Receipt, partial partialReceipt) {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&receipt.Retailer, partial.Retailer)
+	fill(&receipt.PurchaseDate, partial.PurchaseDate)
+	fill(&receipt.PurchaseTime, partial.PurchaseTime)
+	fill(&receipt.PurchasedAt, partial.PurchasedAt)
+	fill(&receipt.Total, partial.Total)
+	if len(receipt.Items) == 0 {
+		receipt.Items = partial.Items
+	}
+}
+
+// The submission a finalized partial receipt is validated and scored as
+func partialBody(receipt Receipt) []byte {
+	body, _ := json.Marshal(partialReceipt{
+		Retailer:     receipt.Retailer,
+		PurchaseDate: receipt.PurchaseDate,
+		PurchaseTime: receipt.PurchaseTime,
+		PurchasedAt:  receipt.PurchasedAt,
+		Items:        receipt.Items,
+		Total:        receipt.Total,
+		UserID:       receipt.UserID,
+	})
+	return body
+}
+
+// Answer 409 for a receipt that hasn't been finalized and so has no points yet
+func rejectUnscored(w http.ResponseWriter, r *http.Request, receipt Receipt, action string) bool {
+	if receiptStatus(receipt) != statusNeedsEnrichment {
+		return false
+	}
+	http.Error(w, "Receipt is awaiting enrichment; finalize it before requesting its "+action, http.StatusConflict)
+	slog.WarnContext(r.Context(), "Rejected action on receipt: receipt needs enrichment", "action", action, "receipt_id", receipt.ID)
+	return true
+}
+
+// POST /receipts/capture: store whatever a photo or a quick manual entry yielded, as
+// little as a retailer or a total. The receipt waits in needs_enrichment, without
+// points, until the rest is added with /enrich, or by the enrichment providers, and it
+// is scored with /finalize.
+func captureReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "POST")
+		return
+	}
+	if !checkChannel(w, r) {
+		return
+	}
+
+	body, raw, ok := readPartial(w, r)
+	if !ok {
+		return
+	}
+
+	// Retries carrying the same Idempotency-Key get the original response instead of a duplicate receipt
+	stored := false
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	scope := idempotencyScope(r, idempotencyKey)
+	if idempotencyKey != "" {
+		if !claimIdempotencyKey(w, r, scope, idempotencyKey, raw) {
+			return
+		}
+		defer func() {
+			if !stored {
+				releaseIdempotencyKey(scope)
+			}
+		}()
+	}
+
+	if body.Retailer == "" && body.Total == "" {
+		http.Error(w, "A captured receipt needs at least a retailer or a total", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Rejected capture without a retailer or total")
+		return
+	}
+
+	var receipt Receipt
+	applyPartial(&receipt, body)
+	receipt.ID = newReceiptID(r.Header.Get("X-Tenant-ID"))
+	receipt.Source = requestSource(r)
+	receipt.ReceivedAt = time.Now().UTC()
+	receipt.Tenant = r.Header.Get("X-Tenant-ID")
+	receipt.Status = statusNeedsEnrichment
+	if !assignOwner(w, r, &receipt) {
+		return
+	}
+	if !commitBeforeDeadline(r) {
+		return
+	}
+
+	if err := store.Put(r.Context(), receipt); err != nil {
+		http.Error(w, "Error storing receipt", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error storing receipt", "receipt_id", receipt.ID, "error", err)
+		return
+	}
+	stored = true
+
+	if len(enrichmentStages) > 0 {
+		go requestEnrichment(receipt.ID, 0)
+	}
+
+	slog.InfoContext(r.Context(), "Partial receipt captured", "receipt_id", receipt.ID)
+	response := captureResponse{receipt.ID, receipt.Status, missingFields(receipt)}
+	if idempotencyKey != "" {
+		finishIdempotencyKey(scope, receipt.ID, http.StatusCreated, response)
+	}
+	writeJSON(w, http.StatusCreated, response)
+}
+
+// POST /receipts/{id}/enrich: add fields to a captured receipt, replacing those given
+// and appending items
+func enrichReceipt(w http.ResponseWriter, r *http.Request, id string) {
+	body, _, ok := readPartial(w, r)
+	if !ok {
+		return
+	}
+
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	receipt, ok := findPartialReceipt(w, r, id, "enrich")
+	if !ok {
+		return
+	}
+	applyPartial(&receipt, body)
+	if !assignOwner(w, r, &receipt) {
+		return
+	}
+	if !commitBeforeDeadline(r) {
+		return
+	}
+	if err := store.Put(r.Context(), receipt); err != nil {
+		http.Error(w, "Error storing receipt", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error storing receipt", "receipt_id", id, "error", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Receipt enriched", "receipt_id", id)
+	writeJSON(w, http.StatusOK, captureResponse{receipt.ID, receipt.Status, missingFields(receipt)})
+}
+
+// POST /receipts/{id}/finalize: validate and score a captured receipt like a new
+// submission, making it active and crediting its points
+func finalizeReceipt(w http.ResponseWriter, r *http.Request, id string) {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	partial, ok := findPartialReceipt(w, r, id, "finalize")
+	if !ok || !assignOwner(w, r, &partial) {
+		return
+	}
+	receipt, err := scorePartial(r.Context(), partial, requestSubject(r))
+	if err != nil {
+		http.Error(w, err.Error(), receiptErrorStatus(err))
+		return
+	}
+	if !commitBeforeDeadline(r) {
+		return
+	}
+	if err := storeFinalized(r.Context(), receipt); err != nil {
+		if duplicate := (*duplicateError)(nil); errors.As(err, &duplicate) {
+			http.Error(w, duplicateMessage(r, duplicate.existing), http.StatusConflict)
+			slog.WarnContext(r.Context(), "Rejected finalization of duplicate receipt", "receipt_id", id, "duplicate_of", duplicate.existing)
+			return
+		}
+		http.Error(w, "Error storing receipt", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error storing receipt", "receipt_id", id, "error", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Receipt finalized", "receipt_id", id, "points", receipt.Points)
+	writeJSON(w, http.StatusOK, receipt)
+}
+
+// Validate and score a captured receipt that has every field. Returned errors are
+// client errors suitable for a 400 response.
+func scorePartial(ctx context.Context, partial Receipt, subject FeatureSubject) (Receipt, error) {
+	if missing := missingFields(partial); len(missing) > 0 {
+		slog.WarnContext(ctx, "Rejected finalization of receipt: fields missing", "receipt_id", partial.ID, "missing", missing)
+		return partial, errors.New("Receipt is missing " + strings.Join(missing, ", "))
+	}
+	receipt, err := prepareReceipt(ctx, partialBody(partial), subject, partial.Source)
+	if err != nil {
+		return partial, err
+	}
+	// A captured receipt keeps the user it was captured for until it earns points, which
+	// go to the user that one was merged into, if it was
+	receipt.UserID = ledger.ResolveUser(partial.Tenant, receipt.UserID)
+	receipt.ID = partial.ID
+	receipt.ReceivedAt = partial.ReceivedAt
+	receipt.Tenant = partial.Tenant
+	receipt.Status = statusActive
+	return receipt, nil
+}
+
+// Store a finalized receipt, crediting its points and announcing it like a new submission.
+// A duplicate of another stored receipt fails with a *duplicateError, per DUPLICATE_RECEIPTS.
+func storeFinalized(ctx context.Context, receipt Receipt) error {
+	releaseDuplicates := lockDuplicates()
+	defer releaseDuplicates()
+	if err := checkDuplicate(receipt); err != nil {
+		return err
+	}
+	if err := store.Put(ctx, receipt); err != nil {
+		return err
+	}
+	releaseDuplicates()
+	if receipt.UserID != "" && receipt.Points > 0 {
+		if _, err := ledger.Earn(receipt.Tenant, receipt.UserID, receipt.ID, receipt.Points); err != nil {
+			slog.ErrorContext(ctx, "Error crediting points for receipt", "receipt_id", receipt.ID, "error", err)
+		}
+	}
+	traceScoring(ctx, receipt, eventReceiptProcessed)
+	publishWebhook(WebhookEvent{Type: eventReceiptProcessed, Receipt: receipt})
+	return nil
+}
+
+// Read a partial receipt body, checking its signature like any other submission
+func readPartial(w http.ResponseWriter, r *http.Request) (partialReceipt, []byte, bool) {
+	var partial partialReceipt
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error reading request body", "error", err)
+		return partial, nil, false
+	}
+	if !checkPartnerSignature(w, r, body) {
+		return partial, nil, false
+	}
+	if err := json.Unmarshal(body, &partial); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error decoding partial receipt", "error", err)
+		return partial, nil, false
+	}
+	return partial, body, true
+}
+
+// Look up a receipt that is still awaiting enrichment, answering 409 for any other
+func findPartialReceipt(w http.ResponseWriter, r *http.Request, id, action string) (Receipt, bool) {
+	receipt, ok := findReceipt(w, r, id)
+	if !ok {
+		return receipt, false
+	}
+	if status := receiptStatus(receipt); status != statusNeedsEnrichment {
+		http.Error(w, "Cannot "+action+" a receipt that is "+status, http.StatusConflict)
+		slog.WarnContext(r.Context(), "Rejected action on receipt", "action", action, "receipt_id", id, "status", status)
+		return receipt, false
+	}
+	return receipt, true
+}
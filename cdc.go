@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Change operations
+const (
+	changeCreate = "create"
+	changeUpdate = "update"
+	changeDelete = "delete"
+)
+
+// A change to a stored receipt with its state before and after
+type ChangeEvent struct {
+	Seq    int64     `json:"seq"`
+	Op     string    `json:"op"`
+	ID     string    `json:"id"`
+	At     time.Time `json:"at"`
+	Before *Receipt  `json:"before"`
+	After  *Receipt  `json:"after"`
+}
+
+// Bounded log of recent changes that consumers resume from by sequence number
+type changeLog struct {
+	mu      sync.Mutex
+	events  []ChangeEvent
+	nextSeq int64
+	// Closed and replaced whenever an event is appended, waking followers
+	appended chan struct{}
+}
+
+var changes = &changeLog{nextSeq: 1, appended: make(chan struct{})}
+
+func (l *changeLog) append(op, id string, before, after *Receipt) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, ChangeEvent{Seq: l.nextSeq, Op: op, ID: id, At: time.Now().UTC(), Before: before, After: after})
+	l.nextSeq++
+	if limit := max(config.CDCRetention, 1); len(l.events) > limit {
+		l.events = append([]ChangeEvent(nil), l.events[len(l.events)-limit:]...)
+	}
+	close(l.appended)
+	l.appended = make(chan struct{})
+}
+
+// The sequence number of the latest change, 0 before the first
+func (l *changeLog) latest() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.nextSeq - 1
+}
+
+// Events after seq, whether seq is still covered by the retained log, and a channel closed on the next append
+func (l *changeLog) since(seq int64) ([]ChangeEvent, bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.events) > 0 && seq < l.events[0].Seq-1 {
+		return nil, false, l.appended
+	}
+	var events []ChangeEvent
+	for _, event := range l.events {
+		if event.Seq > seq {
+			events = append(events, event)
+		}
+	}
+	return events, true, l.appended
+}
+
+// Store decorator recording every write in the change log
+type cdcStore struct {
+	Store
+	log *changeLog
+}
+
+func (s *cdcStore) Put(ctx context.Context, receipt Receipt) error {
+	previous, found, err := s.Store.Get(ctx, receipt.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Put(ctx, receipt); err != nil {
+		return err
+	}
+	if found {
+		s.log.append(changeUpdate, receipt.ID, &previous, &receipt)
+	} else {
+		s.log.append(changeCreate, receipt.ID, nil, &receipt)
+	}
+	return nil
+}
+
+func (s *cdcStore) Delete(ctx context.Context, id string) (bool, error) {
+	previous, found, err := s.Store.Get(ctx, id)
+	if err != nil || !found {
+		return false, err
+	}
+	deleted, err := s.Store.Delete(ctx, id)
+	if deleted {
+		s.log.append(changeDelete, id, &previous, nil)
+	}
+	return deleted, err
+}
+
+// Stream changes after ?since=<seq> as newline-delimited JSON, following new changes until the client disconnects
+func streamChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	seq := int64(0)
+	if value := r.URL.Query().Get("since"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "since must be a non-negative sequence number", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid CDC since", "since", value)
+			return
+		}
+		seq = parsed
+	}
+	follow := r.URL.Query().Get("follow") != "false"
+
+	controller := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+	for first := true; ; first = false {
+		events, ok, appended := changes.since(seq)
+		if !ok && !first {
+			// A follower that fell behind the log mid-stream already has its 200; ending the
+			// stream makes it reconnect from its last sequence and get the 410 below
+			slog.WarnContext(r.Context(), "CDC consumer fell behind the retained log", "sequence", seq)
+			return
+		}
+		if !ok {
+			// Too far behind the retained log; the consumer has to re-sync from a full export
+			http.Error(w, "Changes since that sequence number are no longer retained", http.StatusGone)
+			slog.WarnContext(r.Context(), "CDC consumer requested expired sequence", "sequence", seq)
+			return
+		}
+		if first {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+		}
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				slog.InfoContext(r.Context(), "CDC consumer disconnected", "error", err)
+				return
+			}
+			seq = event.Seq
+		}
+		controller.Flush()
+		if !follow {
+			return
+		}
+
+		select {
+		case <-appended:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -1,15 +1,56 @@
+//go:build ignore
+
 package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
+// Reported to the server in User-Agent and X-Client-Version
+const clientVersion = "1.0.0"
+
 func main() {
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "watch":
+			err = runWatch(os.Args[2:])
+		case "convert":
+			err = runConvert(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q; run without arguments to process payload.json, or use watch <dir> or convert <file.csv>", os.Args[1])
+		}
+		if err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+	processPayloadFile()
+}
+
+// Submit payload.json and print its points and breakdown
+func processPayloadFile() {
 	log.Println("Client started. Processing receipt...")
 
 	// Read the JSON payload from a file
@@ -21,9 +62,16 @@ func main() {
 	}
 
 	// Process a Receipt (POST request)
-	postURL := "http://localhost:8080/receipts/process"
+	postURL := "http://localhost:8080/v1/receipts/process"
 	log.Printf("Sending POST request to: %s", postURL)
-	resp, err := http.Post(postURL, "application/json", bytes.NewBuffer(payloadBytes))
+	req, err := http.NewRequest(http.MethodPost, postURL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		log.Fatalf("Error creating POST request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "receipt-processor-client/"+clientVersion)
+	req.Header.Set("X-Client-Version", clientVersion)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		log.Fatalf("Error sending POST request: %v", err)
 	}
@@ -40,7 +88,13 @@ func main() {
 
 	log.Printf("POST request sent successfully. Reading response...")
 	// Parse the POST response
-	var postResponse map[string]string
+	var postResponse struct {
+		ID       string `json:"id"`
+		Warnings []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"warnings"`
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Fatalf("Error reading POST response: %v", err)
@@ -50,15 +104,24 @@ func main() {
 	}
 
 	// Retrieve the receipt ID
-	receiptID, exists := postResponse["id"]
-	if !exists {
+	receiptID := postResponse.ID
+	if receiptID == "" {
 		log.Fatalf("POST response does not contain 'id'")
 	}
 	log.Printf("Receipt processed successfully. Received ID: %s\n", receiptID)
 	fmt.Printf("\nReceipt Processed. ID: %s\n\n", receiptID)
 
+	// Output any data-quality warnings
+	if len(postResponse.Warnings) > 0 {
+		fmt.Printf("Warnings:\n")
+		for _, warning := range postResponse.Warnings {
+			fmt.Printf("- [%s] %s\n", warning.Code, warning.Message)
+		}
+		fmt.Println()
+	}
+
 	// Get Breakdown (GET request)
-	breakdownURL := fmt.Sprintf("http://localhost:8080/receipts/%s/breakdown", receiptID)
+	breakdownURL := fmt.Sprintf("http://localhost:8080/v1/receipts/%s/breakdown", receiptID)
 	log.Printf("Sending GET request to: %s", breakdownURL)
 	getResp, err := http.Get(breakdownURL)
 	if err != nil {
@@ -99,3 +162,419 @@ func main() {
 	}
 	log.Println("Client processing completed successfully.")
 }
+
+// A payload file seen by watch, and its size and modification time when it was last seen
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// watch [-server URL] [-interval 2s] [-token key] <dir>: submit every *.json file dropped
+// into dir, renaming it to .json.done once the receipt is processed or .json.failed if the
+// server rejects it. Files are only submitted once they are unchanged between two scans,
+// so half-written exports aren't sent, and files that fail for a transient reason (the
+// server unreachable, a 5xx or 429 response, a 401 until the key is fixed, or a 409 while
+// an earlier submission of the file is still being processed) are retried on the next scan.
+func runWatch(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	server := flags.String("server", "http://localhost:8080", "receipt processor base URL")
+	interval := flags.Duration("interval", 2*time.Second, "how often to scan the directory")
+	token := flags.String("token", os.Getenv("API_KEY"), "API key or JWT sent as a bearer token, defaulting to $API_KEY")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: watch [-server URL] [-interval 2s] [-token key] <dir>")
+	}
+	dir := flags.Arg(0)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	log.Printf("Watching %s for receipts to submit to %s", dir, *server)
+	seen := map[string]watchedFile{}
+	for {
+		paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		current := map[string]watchedFile{}
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			file := watchedFile{size: info.Size(), modTime: info.ModTime()}
+			current[path] = file
+			if previous, found := seen[path]; !found || previous != file {
+				continue
+			}
+			if submitWatchedFile(ctx, *server, *token, path) {
+				delete(current, path)
+			}
+		}
+		seen = current
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopped watching %s", dir)
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// Submit a payload file and rename it after the outcome. Reports false when it should be
+// retried.
+func submitWatchedFile(ctx context.Context, server, token, path string) bool {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("%s: error reading file: %v", path, err)
+		return false
+	}
+	// The same file resubmitted, e.g. after the client stopped before renaming it, is
+	// answered with the receipt it already created
+	hash := sha256.Sum256(append([]byte(filepath.Base(path)+"\x00"), payload...))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(server, "/")+"/v1/receipts/process", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("%s: error creating request: %v", path, err)
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "receipt-processor-client/"+clientVersion)
+	req.Header.Set("X-Client-Version", clientVersion)
+	req.Header.Set("Idempotency-Key", "watch-"+hex.EncodeToString(hash[:16]))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("%s: error submitting, will retry: %v", path, err)
+		return false
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	// A 401 is a missing or expired key rather than a bad file, and a 409 with Retry-After
+	// means an earlier submission of the file holds the Idempotency-Key and hasn't finished
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusUnauthorized ||
+		resp.StatusCode == http.StatusConflict && resp.Header.Get("Retry-After") != ""
+	if retry {
+		log.Printf("%s: server answered %s, will retry: %s", path, resp.Status, strings.TrimSpace(string(body)))
+		return false
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("%s: rejected with %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+		renameWatchedFile(path, ".failed")
+		return true
+	}
+
+	var response struct {
+		ID       string `json:"id"`
+		Warnings []struct {
+			Code string `json:"code"`
+		} `json:"warnings"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil || response.ID == "" {
+		log.Printf("%s: unexpected response, will retry: %s", path, strings.TrimSpace(string(body)))
+		return false
+	}
+	warnings := []string{}
+	for _, warning := range response.Warnings {
+		warnings = append(warnings, warning.Code)
+	}
+	log.Printf("%s: processed as receipt %s, warnings: %v", path, response.ID, warnings)
+	renameWatchedFile(path, ".done")
+	return true
+}
+
+func renameWatchedFile(path, suffix string) {
+	if err := os.Rename(path, path+suffix); err != nil {
+		log.Printf("%s: error renaming to %s: %v", path, path+suffix, err)
+	}
+}
+
+// convert [-out receipts] [-receipt-column receipt] [-schema schema/receipt.json] <file.csv>:
+// turn a spreadsheet of line items, one row per item, into a receipt JSON file per value
+// of the receipt column, ready for watch or the API. The header row names the columns:
+// retailer, purchaseDate, purchaseTime, total and userId are repeated on every row of a
+// receipt (total, if left out, is the sum of its prices), shortDescription and price
+// describe the item. Names are matched ignoring case, spaces and underscores. Every
+// receipt is checked against the published schema first, and only valid ones are written.
+func runConvert(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	out := flags.String("out", "receipts", "directory to write the receipt files to")
+	receiptColumn := flags.String("receipt-column", "receipt", "column grouping the rows into receipts")
+	schemaSource := flags.String("schema", "schema/receipt.json", "receipt schema file, or its URL on a server, e.g. http://localhost:8080/v1/schema/receipt.json")
+	// Flags may follow the input file, as in convert items.csv -out receipts/
+	var inputs []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		inputs = append(inputs, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	if len(inputs) != 1 {
+		return errors.New("usage: convert [-out receipts] [-receipt-column receipt] [-schema schema/receipt.json] <file.csv>")
+	}
+
+	schema, err := loadReceiptSchema(*schemaSource)
+	if err != nil {
+		return fmt.Errorf("loading schema %s: %w", *schemaSource, err)
+	}
+	file, err := os.Open(inputs[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	receipts, err := readReceiptRows(file, *receiptColumn)
+	if err != nil {
+		return fmt.Errorf("%s: %w", inputs[0], err)
+	}
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		return err
+	}
+
+	written, invalid := 0, 0
+	names := fileNames{}
+	for _, receipt := range receipts {
+		if err := receipt.validate(schema); err != nil {
+			log.Printf("%s: receipt %q (line %d): %v", inputs[0], receipt.key, receipt.line, err)
+			invalid++
+			continue
+		}
+		name := names.unique(receiptFileName(receipt.key))
+		path := filepath.Join(*out, name+".json")
+		if err := writeReceiptFile(path, receipt.fields); err != nil {
+			return err
+		}
+		log.Printf("Wrote receipt %q with %d items to %s", receipt.key, len(receipt.fields["items"].([]map[string]string)), path)
+		written++
+	}
+	log.Printf("Converted %d of %d receipts from %s", written, len(receipts), inputs[0])
+	if invalid > 0 {
+		return fmt.Errorf("%d receipts failed validation and were not written", invalid)
+	}
+	return nil
+}
+
+// A receipt assembled from rows, as the JSON object that is submitted
+type convertedReceipt struct {
+	key string
+	// Line of the receipt's first row
+	line   int
+	fields map[string]any
+	// Set when the rows of the receipt disagree or are incomplete
+	err error
+}
+
+// Receipt fields taken from columns, by normalized column name, and item fields likewise
+var (
+	receiptColumns = map[string]string{"retailer": "retailer", "purchasedate": "purchaseDate", "purchasetime": "purchaseTime", "purchasedat": "purchasedAt", "total": "total", "userid": "userId"}
+	itemColumns    = map[string]string{"shortdescription": "shortDescription", "description": "shortDescription", "price": "price"}
+)
+
+func normalizeColumn(name string) string {
+	return strings.NewReplacer(" ", "", "_", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// Group the rows by receipt column, in the order receipts first appear
+func readReceiptRows(r io.Reader, receiptColumn string) ([]*convertedReceipt, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	keyIndex := -1
+	fields := make([]string, len(header))
+	for i, name := range header {
+		name = normalizeColumn(strings.TrimPrefix(name, "\ufeff"))
+		switch {
+		case name == normalizeColumn(receiptColumn):
+			keyIndex = i
+		case receiptColumns[name] != "":
+			fields[i] = receiptColumns[name]
+		case itemColumns[name] != "":
+			fields[i] = itemColumns[name]
+		default:
+			log.Printf("Ignoring column %q", header[i])
+		}
+	}
+	if keyIndex < 0 {
+		return nil, fmt.Errorf("no %q column to group rows into receipts", receiptColumn)
+	}
+
+	var receipts []*convertedReceipt
+	byKey := map[string]*convertedReceipt{}
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		key := strings.TrimSpace(row[keyIndex])
+		if key == "" {
+			return nil, fmt.Errorf("line %d: %s is empty", line, receiptColumn)
+		}
+		receipt := byKey[key]
+		if receipt == nil {
+			receipt = &convertedReceipt{key: key, line: line, fields: map[string]any{"items": []map[string]string{}}}
+			byKey[key] = receipt
+			receipts = append(receipts, receipt)
+		}
+		item := map[string]string{}
+		for i, value := range row {
+			value = strings.TrimSpace(value)
+			if fields[i] == "" || value == "" {
+				continue
+			}
+			if fields[i] == "shortDescription" || fields[i] == "price" {
+				item[fields[i]] = value
+				continue
+			}
+			if previous, found := receipt.fields[fields[i]]; found && previous != value && receipt.err == nil {
+				receipt.err = fmt.Errorf("line %d: %s is %q, but %q on an earlier row", line, fields[i], value, previous)
+			}
+			receipt.fields[fields[i]] = value
+		}
+		// Rows carrying only receipt fields, e.g. a total, add no item
+		if len(item) > 0 {
+			receipt.fields["items"] = append(receipt.fields["items"].([]map[string]string), item)
+		}
+	}
+	if len(receipts) == 0 {
+		return nil, errors.New("no rows after the header")
+	}
+
+	for _, receipt := range receipts {
+		if _, found := receipt.fields["total"]; !found && receipt.err == nil {
+			receipt.fields["total"], receipt.err = sumPrices(receipt.fields["items"].([]map[string]string))
+		}
+	}
+	return receipts, nil
+}
+
+// The total of the item prices, for spreadsheets without a total column
+func sumPrices(items []map[string]string) (string, error) {
+	cents := int64(0)
+	for _, item := range items {
+		dollars, fraction, ok := strings.Cut(item["price"], ".")
+		whole, err := strconv.ParseInt(dollars, 10, 64)
+		part, fractionErr := strconv.ParseInt(fraction, 10, 64)
+		if !ok || len(fraction) != 2 || err != nil || fractionErr != nil || whole < 0 || part < 0 {
+			return "", fmt.Errorf("can't total price %q of %q; add a total column", item["price"], item["shortDescription"])
+		}
+		cents += whole*100 + part
+	}
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100), nil
+}
+
+func (receipt *convertedReceipt) validate(schema *jsonschema.Schema) error {
+	if receipt.err != nil {
+		return receipt.err
+	}
+	// Validate the document as it will be submitted
+	payload, err := json.Marshal(receipt.fields)
+	if err != nil {
+		return err
+	}
+	var document any
+	if err := json.Unmarshal(payload, &document); err != nil {
+		return err
+	}
+	if err := schema.Validate(document); err != nil {
+		if validationErr, ok := err.(*jsonschema.ValidationError); ok {
+			leaf := validationErr
+			for len(leaf.Causes) > 0 {
+				leaf = leaf.Causes[0]
+			}
+			return fmt.Errorf("'%s' does not validate with receipt.json#%s: %s", leaf.InstanceLocation, leaf.KeywordLocation, leaf.Message)
+		}
+		return err
+	}
+	return nil
+}
+
+// Compile the receipt schema from a file or from the server publishing it
+func loadReceiptSchema(source string) (*jsonschema.Schema, error) {
+	var document []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		var resp *http.Response
+		if resp, err = http.Get(source); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("server answered %s", resp.Status)
+		}
+		document, err = io.ReadAll(resp.Body)
+	} else {
+		document, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat = true
+	if err := compiler.AddResource("receipt.json", bytes.NewReader(document)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile("receipt.json")
+}
+
+// A file name from the receipt column, which may be an order number or a description
+func receiptFileName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, key)
+	if name = strings.TrimLeft(name, "."); name == "" {
+		return "receipt"
+	}
+	return name
+}
+
+// File names already written in a run, in lower case since some file systems ignore it
+type fileNames map[string]bool
+
+// name, or name with the first free -2, -3, … suffix when keys such as A/1 and A_1 map
+// to a name already written
+func (names fileNames) unique(name string) string {
+	candidate := name
+	for n := 2; names[strings.ToLower(candidate)]; n++ {
+		candidate = fmt.Sprintf("%s-%d", name, n)
+	}
+	names[strings.ToLower(candidate)] = true
+	if candidate != name {
+		log.Printf("File name %s.json is taken by another receipt; using %s.json", name, candidate)
+	}
+	return candidate
+}
+
+// Write through a temporary file, so watch never picks up a half-written receipt
+func writeReceiptFile(path string, receipt map[string]any) error {
+	payload, err := json.MarshalIndent(receipt, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, append(payload, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, path)
+}
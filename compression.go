@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codecs for stored receipt documents, selected with STORAGE_COMPRESSION
+const (
+	compressionNone   = "none"
+	compressionSnappy = "snappy"
+	compressionZstd   = "zstd"
+)
+
+// Compressed documents start with a codec byte; uncompressed JSON always starts with '{',
+// so documents written before compression was enabled stay readable
+const (
+	codecSnappy byte = 1
+	codecZstd   byte = 2
+)
+
+// Created by loadConfig, which fails if either can't be
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+
+// Documents written with zstd are read whatever STORAGE_COMPRESSION is now, so both codecs
+// are always created
+func initZstd(errs *[]error) {
+	var err error
+	if zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault)); err != nil {
+		*errs = append(*errs, fmt.Errorf("STORAGE_COMPRESSION: creating the zstd encoder: %w", err))
+	}
+	if zstdDecoder, err = zstd.NewReader(nil); err != nil {
+		*errs = append(*errs, fmt.Errorf("STORAGE_COMPRESSION: creating the zstd decoder: %w", err))
+	}
+}
+
+// Bytes written to storage before and after compression
+type compressionCounters struct {
+	documents   atomic.Int64
+	rawBytes    atomic.Int64
+	storedBytes atomic.Int64
+}
+
+var compressionStats = &compressionCounters{}
+
+// Encode a JSON document for storage with the configured codec
+func compressDocument(document []byte) []byte {
+	var stored []byte
+	switch config.StorageCompression {
+	case compressionSnappy:
+		stored = append([]byte{codecSnappy}, s2.EncodeSnappy(nil, document)...)
+	case compressionZstd:
+		stored = zstdEncoder.EncodeAll(document, []byte{codecZstd})
+	default:
+		stored = document
+	}
+	compressionStats.documents.Add(1)
+	compressionStats.rawBytes.Add(int64(len(document)))
+	compressionStats.storedBytes.Add(int64(len(stored)))
+	return stored
+}
+
+// Decode a stored document, whichever codec it was written with
+func decompressDocument(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return stored, nil
+	}
+	switch stored[0] {
+	case codecSnappy:
+		return s2.Decode(nil, stored[1:])
+	case codecZstd:
+		return zstdDecoder.DecodeAll(stored[1:], nil)
+	}
+	return stored, nil
+}
+
+func parseCompression(value string, errs *[]error) string {
+	switch value {
+	case compressionNone, compressionSnappy, compressionZstd:
+		return value
+	}
+	*errs = append(*errs, fmt.Errorf("STORAGE_COMPRESSION must be %q, %q or %q, got %q", compressionNone, compressionSnappy, compressionZstd, value))
+	return compressionNone
+}
+
+func getCompressionStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	rawBytes, storedBytes := compressionStats.rawBytes.Load(), compressionStats.storedBytes.Load()
+	ratio := 0.0
+	if storedBytes > 0 {
+		ratio = round2(float64(rawBytes) / float64(storedBytes))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"codec":       config.StorageCompression,
+		"documents":   compressionStats.documents.Load(),
+		"rawBytes":    rawBytes,
+		"storedBytes": storedBytes,
+		"ratio":       ratio,
+	})
+}
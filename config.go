@@ -0,0 +1,514 @@
+package main
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Validation modes for incoming receipts
+const (
+	validationStrict  = "strict"
+	validationLenient = "lenient"
+)
+
+type Config struct {
+	ValidationMode      string
+	TotalToleranceCents int64
+	CacheMaxAge         time.Duration
+	TrustedProxies      []*net.IPNet
+	BasePath            string
+	AdminToken          string
+	PublicAllowCIDRs    []*net.IPNet
+	PublicDenyCIDRs     []*net.IPNet
+	AdminAllowCIDRs     []*net.IPNet
+	AdminDenyCIDRs      []*net.IPNet
+
+	StorageBackend     string
+	StorageDSN         string
+	StorageOldBackend  string
+	StorageOldDSN      string
+	SnapshotInterval   time.Duration
+	LedgerSnapshotFile string
+	RedisTTL           time.Duration
+	StorageCompression string
+	UserIDKey          []byte
+
+	MinClientVersion        string
+	DeprecatedClientVersion string
+	ClientSunsetDate        time.Time
+
+	RawCapture          bool
+	RawCaptureKey       []byte
+	RawCaptureMaxBytes  int
+	RawCaptureRetention time.Duration
+	RawArchive          string
+
+	SlackWebhookURL     string
+	PagerDutyRoutingKey string
+	AlertErrorRate      float64
+	AlertLatency        time.Duration
+	AlertWindow         time.Duration
+	AlertCooldown       time.Duration
+	AlertMinRequests    int
+	// Email notifications go to ALERT_EMAIL_TO through the SMTP server at SMTP_ADDR
+	AlertEmailTo []string
+	SMTPAddr     string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+
+	FeatureFlags map[string]Flag
+	ShadowRules  *RuleSet
+
+	PointsExpiry time.Duration
+
+	MaxTotalCents     int64
+	MaxItemPriceCents int64
+
+	AWSRegion          string
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSSessionToken    string
+	S3Endpoint         string
+
+	CDCRetention int
+
+	AnomalyInterval  time.Duration
+	AnomalyThreshold float64
+
+	TenantIDPrefixes map[string]string
+
+	ReceiptRetention      time.Duration
+	ReceiptRetentionBasis string
+
+	MaxRequestTimeout time.Duration
+
+	PartnerSecrets   map[string]string
+	SignatureMaxSkew time.Duration
+
+	EnrichmentProviders []enrichmentEndpoint
+
+	DuplicateReceipts string
+
+	JobWorkers   int
+	JobQueueSize int
+
+	SLOWindow        time.Duration
+	SLOAvailability  float64
+	SLOLatency       time.Duration
+	SLOLatencyTarget float64
+
+	TraceSampleRate float64
+	TraceTenants    []string
+	TraceReceiptIDs []string
+	TraceBuffer     int
+
+	HealthCheckTimeout time.Duration
+
+	Warmup        bool
+	WarmupTimeout time.Duration
+	WarmupWindow  time.Duration
+	WarmupPaths   []string
+
+	LuckyRate      float64
+	LuckySeed      string
+	LuckyMinPoints int
+	LuckyMaxPoints int
+
+	LogFormat string
+	LogLevel  slog.Level
+
+	CORSAllowedOrigins []string
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+	CORSMaxAge         time.Duration
+
+	ExternalRules               []enrichmentEndpoint
+	ExternalRuleFallback        string
+	ExternalRuleMaxPoints       int
+	ExternalRuleBreakerFailures int
+	ExternalRuleBreakerCooldown time.Duration
+
+	RateLimit      float64
+	RateLimitBurst int
+
+	// API key by name, from API_KEYS and API_KEYS_FILE
+	APIKeys map[string]string
+	// Tenant by API key name, from API_KEY_TENANTS
+	APIKeyTenants map[string]string
+
+	JWTSecret    string
+	JWTPublicKey crypto.PublicKey
+	JWTIssuer    string
+	JWTAudience  string
+
+	// Points awarded per submission channel, from CHANNEL_BONUSES
+	ChannelBonuses map[string]int
+
+	RecalculationChunkSize int
+	RecalculationStateFile string
+
+	// Honor Prefer: score-comparison on submissions
+	ScoreComparison bool
+
+	WebhookURLs     []string
+	WebhookEvents   []string
+	WebhookSecret   string
+	WebhookAttempts int
+
+	// Operational summary reports sent through the notifiers: daily or weekly at ReportTime UTC
+	ReportSchedule     string
+	ReportTime         string
+	ReportTopRetailers int
+
+	// Compare a sample of the in-memory indexes with storage this often, 0 to never
+	ConsistencyCheckInterval time.Duration
+	ConsistencyCheckSample   int
+
+	// Serve the gRPC API on this address as well, e.g. :9090
+	GRPCAddr string
+
+	// Partner by API key name, from API_KEY_PARTNERS
+	APIKeyPartners map[string]string
+
+	// The scheme and host clients reach this deployment at, for URLs handed to other services
+	PublicBaseURL string
+}
+
+var config Config
+
+// Load configuration from environment variables, collecting every problem found
+func loadConfig() (Config, error) {
+	var errs []error
+
+	cfg := Config{
+		ValidationMode:      getEnv("VALIDATION_MODE", validationStrict),
+		TotalToleranceCents: getEnvCents("TOTAL_TOLERANCE", 1, &errs),
+		CacheMaxAge:         getEnvDuration("CACHE_MAX_AGE", time.Minute, &errs),
+		TrustedProxies:      getEnvCIDRs("TRUSTED_PROXIES", &errs),
+		BasePath:            strings.TrimSuffix(getEnv("BASE_PATH", ""), "/"),
+		AdminToken:          getEnv("ADMIN_TOKEN", ""),
+		PublicAllowCIDRs:    getEnvCIDRs("PUBLIC_ALLOW_CIDRS", &errs),
+		PublicDenyCIDRs:     getEnvCIDRs("PUBLIC_DENY_CIDRS", &errs),
+		AdminAllowCIDRs:     getEnvCIDRs("ADMIN_ALLOW_CIDRS", &errs),
+		AdminDenyCIDRs:      getEnvCIDRs("ADMIN_DENY_CIDRS", &errs),
+
+		StorageBackend:     getEnv("STORAGE_BACKEND", backendMemory),
+		StorageDSN:         getEnv("STORAGE_DSN", ""),
+		StorageOldBackend:  getEnv("STORAGE_OLD_BACKEND", ""),
+		StorageOldDSN:      getEnv("STORAGE_OLD_DSN", ""),
+		SnapshotInterval:   getEnvDuration("SNAPSHOT_INTERVAL", 5*time.Minute, &errs),
+		RedisTTL:           getEnvDuration("REDIS_TTL", 0, &errs),
+		StorageCompression: parseCompression(getEnv("STORAGE_COMPRESSION", compressionNone), &errs),
+		UserIDKey:          parseUserIDKey(getEnv("USER_ID_KEY", ""), &errs),
+
+		MinClientVersion:        getEnv("MIN_CLIENT_VERSION", ""),
+		DeprecatedClientVersion: getEnv("DEPRECATED_CLIENT_VERSION", ""),
+		ClientSunsetDate:        parseSunsetDate(getEnv("CLIENT_SUNSET_DATE", ""), &errs),
+
+		RawCapture:          getEnvBool("RAW_CAPTURE", false, &errs),
+		RawCaptureMaxBytes:  getEnvInt("RAW_CAPTURE_MAX_BYTES", 64*1024, &errs),
+		RawCaptureRetention: getEnvDuration("RAW_CAPTURE_RETENTION", 72*time.Hour, &errs),
+		RawArchive:          getEnv("RAW_ARCHIVE", ""),
+
+		SlackWebhookURL:     getEnv("ALERT_SLACK_WEBHOOK_URL", ""),
+		PagerDutyRoutingKey: getEnv("ALERT_PAGERDUTY_ROUTING_KEY", ""),
+		AlertErrorRate:      getEnvFloat("ALERT_ERROR_RATE", 0.05, &errs),
+		AlertLatency:        getEnvDuration("ALERT_LATENCY", time.Second, &errs),
+		AlertWindow:         getEnvDuration("ALERT_WINDOW", 5*time.Minute, &errs),
+		AlertCooldown:       getEnvDuration("ALERT_COOLDOWN", 15*time.Minute, &errs),
+		AlertMinRequests:    getEnvInt("ALERT_MIN_REQUESTS", 20, &errs),
+		AlertEmailTo:        getEnvList("ALERT_EMAIL_TO"),
+		SMTPAddr:            getEnv("SMTP_ADDR", ""),
+		SMTPFrom:            getEnv("SMTP_FROM", ""),
+		SMTPUsername:        getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:        getEnv("SMTP_PASSWORD", ""),
+
+		FeatureFlags: getEnvFlags("FEATURE_FLAGS", &errs),
+		ShadowRules:  loadShadowRules(getEnv("SHADOW_RULES_FILE", ""), &errs),
+
+		PointsExpiry: getEnvDuration("POINTS_EXPIRY", 0, &errs),
+
+		MaxTotalCents:     getEnvCents("MAX_TOTAL", 100000000, &errs),
+		MaxItemPriceCents: getEnvCents("MAX_ITEM_PRICE", 100000000, &errs),
+
+		AWSRegion:          getEnv("AWS_REGION", "us-east-1"),
+		AWSAccessKeyID:     getEnv("AWS_ACCESS_KEY_ID", ""),
+		AWSSecretAccessKey: getEnv("AWS_SECRET_ACCESS_KEY", ""),
+		AWSSessionToken:    getEnv("AWS_SESSION_TOKEN", ""),
+		S3Endpoint:         getEnv("S3_ENDPOINT", ""),
+
+		CDCRetention: getEnvInt("CDC_RETENTION", 10000, &errs),
+
+		AnomalyInterval:  getEnvDuration("ANOMALY_INTERVAL", 15*time.Minute, &errs),
+		AnomalyThreshold: getEnvFloat("ANOMALY_THRESHOLD", 3, &errs),
+
+		TenantIDPrefixes: getEnvIDPrefixes("TENANT_ID_PREFIXES", &errs),
+
+		ReceiptRetention:      getEnvDuration("RECEIPT_RETENTION", 0, &errs),
+		ReceiptRetentionBasis: parseRetentionBasis(getEnv("RECEIPT_RETENTION_BASIS", retentionReceived), &errs),
+
+		MaxRequestTimeout: getEnvDuration("MAX_REQUEST_TIMEOUT", 30*time.Second, &errs),
+
+		PartnerSecrets:   getEnvPartnerSecrets("PARTNER_SECRETS", &errs),
+		SignatureMaxSkew: getEnvDuration("SIGNATURE_MAX_SKEW", 5*time.Minute, &errs),
+
+		DuplicateReceipts: parseDuplicateMode(getEnv("DUPLICATE_RECEIPTS", duplicatesAllow), &errs),
+
+		JobWorkers:   getEnvInt("JOB_WORKERS", 4, &errs),
+		JobQueueSize: getEnvInt("JOB_QUEUE_SIZE", 1000, &errs),
+
+		SLOWindow:        getEnvDuration("SLO_WINDOW", 30*24*time.Hour, &errs),
+		SLOAvailability:  getEnvFloat("SLO_AVAILABILITY", 0.999, &errs),
+		SLOLatency:       getEnvDuration("SLO_LATENCY", 500*time.Millisecond, &errs),
+		SLOLatencyTarget: getEnvFloat("SLO_LATENCY_TARGET", 0.99, &errs),
+
+		TraceSampleRate: getEnvFloat("TRACE_SAMPLE_RATE", 0, &errs),
+		TraceTenants:    getEnvList("TRACE_TENANTS"),
+		TraceReceiptIDs: getEnvList("TRACE_RECEIPT_IDS"),
+		TraceBuffer:     getEnvInt("TRACE_BUFFER", 1000, &errs),
+
+		HealthCheckTimeout: getEnvDuration("HEALTH_CHECK_TIMEOUT", 2*time.Second, &errs),
+
+		Warmup:        getEnvBool("WARMUP", false, &errs),
+		WarmupTimeout: getEnvDuration("WARMUP_TIMEOUT", 2*time.Minute, &errs),
+		WarmupWindow:  getEnvDuration("WARMUP_WINDOW", 7*24*time.Hour, &errs),
+		WarmupPaths:   getEnvList("WARMUP_PATHS"),
+
+		LuckyRate:      getEnvFloat("LUCKY_RECEIPT_RATE", 0, &errs),
+		LuckySeed:      getEnv("LUCKY_RECEIPT_SEED", ""),
+		LuckyMinPoints: getEnvInt("LUCKY_RECEIPT_MIN_POINTS", 10, &errs),
+		LuckyMaxPoints: getEnvInt("LUCKY_RECEIPT_MAX_POINTS", 100, &errs),
+
+		LogFormat: getEnv("LOG_FORMAT", "text"),
+		LogLevel:  parseLogLevel(getEnv("LOG_LEVEL", "info"), &errs),
+
+		CORSAllowedOrigins: getEnvList("CORS_ALLOWED_ORIGINS"),
+		CORSAllowedMethods: getEnvList("CORS_ALLOWED_METHODS"),
+		CORSAllowedHeaders: getEnvList("CORS_ALLOWED_HEADERS"),
+		CORSMaxAge:         getEnvDuration("CORS_MAX_AGE", 10*time.Minute, &errs),
+
+		ExternalRuleFallback:        parseExternalFallback(getEnv("EXTERNAL_RULE_FALLBACK", externalFallbackSkip), &errs),
+		ExternalRuleMaxPoints:       getEnvInt("EXTERNAL_RULE_MAX_POINTS", 100, &errs),
+		ExternalRuleBreakerFailures: getEnvInt("EXTERNAL_RULE_BREAKER_FAILURES", 5, &errs),
+		ExternalRuleBreakerCooldown: getEnvDuration("EXTERNAL_RULE_BREAKER_COOLDOWN", 30*time.Second, &errs),
+
+		RateLimit:      getEnvFloat("RATE_LIMIT", 0, &errs),
+		RateLimitBurst: getEnvInt("RATE_LIMIT_BURST", 20, &errs),
+
+		APIKeys: loadAPIKeys(&errs),
+
+		JWTSecret:    getEnv("JWT_SECRET", ""),
+		JWTPublicKey: loadJWTPublicKey(getEnv("JWT_PUBLIC_KEY_FILE", ""), &errs),
+		JWTIssuer:    getEnv("JWT_ISSUER", ""),
+		JWTAudience:  getEnv("JWT_AUDIENCE", ""),
+
+		ChannelBonuses: getEnvChannelBonuses("CHANNEL_BONUSES", &errs),
+
+		RecalculationChunkSize: getEnvInt("RECALCULATION_CHUNK_SIZE", 100, &errs),
+		RecalculationStateFile: getEnv("RECALCULATION_STATE_FILE", ""),
+
+		ScoreComparison: getEnvBool("SCORE_COMPARISON", false, &errs),
+
+		WebhookURLs:     getEnvList("WEBHOOK_URLS"),
+		WebhookEvents:   getEnvList("WEBHOOK_EVENTS"),
+		WebhookSecret:   getEnv("WEBHOOK_SECRET", ""),
+		WebhookAttempts: getEnvInt("WEBHOOK_ATTEMPTS", 3, &errs),
+
+		ReportSchedule:     strings.ToLower(getEnv("REPORT_SCHEDULE", "")),
+		ReportTime:         getEnv("REPORT_TIME", "06:00"),
+		ReportTopRetailers: getEnvInt("REPORT_TOP_RETAILERS", 10, &errs),
+
+		ConsistencyCheckInterval: getEnvDuration("CONSISTENCY_CHECK_INTERVAL", 0, &errs),
+		ConsistencyCheckSample:   getEnvInt("CONSISTENCY_CHECK_SAMPLE", 100, &errs),
+
+		GRPCAddr: getEnv("GRPC_ADDR", ""),
+	}
+	enrichmentTimeout := getEnvDuration("ENRICHMENT_TIMEOUT", time.Minute, &errs)
+	if enrichmentTimeout == 0 {
+		errs = append(errs, errors.New("ENRICHMENT_TIMEOUT must be positive"))
+	}
+	cfg.EnrichmentProviders = getEnvEnrichmentProviders("ENRICHMENT_PROVIDERS", "ENRICHMENT_TIMEOUTS", []string{"http", "https"}, enrichmentTimeout, &errs)
+	externalRuleTimeout := getEnvDuration("EXTERNAL_RULE_TIMEOUT", 500*time.Millisecond, &errs)
+	if externalRuleTimeout == 0 {
+		errs = append(errs, errors.New("EXTERNAL_RULE_TIMEOUT must be positive"))
+	}
+	cfg.ExternalRules = getEnvEnrichmentProviders("EXTERNAL_RULES", "EXTERNAL_RULE_TIMEOUTS", externalRuleSchemes, externalRuleTimeout, &errs)
+	cfg.APIKeyTenants = getEnvAPIKeyTenants("API_KEY_TENANTS", cfg.APIKeys, &errs)
+	cfg.RawCaptureKey = parseRawCaptureKey(getEnv("RAW_CAPTURE_KEY", ""), cfg.RawCapture, &errs)
+	cfg.APIKeyPartners = getEnvAPIKeyPartners("API_KEY_PARTNERS", cfg.APIKeys, cfg.PartnerSecrets, &errs)
+	cfg.PublicBaseURL = strings.TrimSuffix(getEnv("PUBLIC_BASE_URL", ""), "/")
+	cfg.LedgerSnapshotFile = getEnv("LEDGER_SNAPSHOT_FILE", defaultLedgerSnapshotFile(cfg))
+	initZstd(&errs)
+
+	if cfg.ValidationMode != validationStrict && cfg.ValidationMode != validationLenient {
+		errs = append(errs, fmt.Errorf("VALIDATION_MODE must be %q or %q, got %q", validationStrict, validationLenient, cfg.ValidationMode))
+	}
+
+	if cfg.BasePath != "" && !strings.HasPrefix(cfg.BasePath, "/") {
+		errs = append(errs, fmt.Errorf("BASE_PATH must start with '/', got %q", cfg.BasePath))
+	}
+
+	if cfg.HealthCheckTimeout <= 0 {
+		errs = append(errs, errors.New("HEALTH_CHECK_TIMEOUT must be positive"))
+	}
+
+	if cfg.JobWorkers < 1 || cfg.JobQueueSize < 1 {
+		errs = append(errs, fmt.Errorf("JOB_WORKERS and JOB_QUEUE_SIZE must be at least 1, got %d and %d", cfg.JobWorkers, cfg.JobQueueSize))
+	}
+
+	errs = append(errs, validateVersionConfig(cfg)...)
+	errs = append(errs, validateSLOConfig(cfg)...)
+	errs = append(errs, validateTraceConfig(cfg)...)
+	errs = append(errs, validateWarmupConfig(cfg)...)
+	errs = append(errs, validateLuckyConfig(cfg)...)
+	errs = append(errs, validateLoggingConfig(cfg)...)
+	errs = append(errs, validateCORSConfig(cfg)...)
+	errs = append(errs, validateExternalRulesConfig(cfg)...)
+	errs = append(errs, validateRateLimitConfig(cfg)...)
+	errs = append(errs, validateEnrichmentConfig(cfg)...)
+	errs = append(errs, validateJWTConfig(cfg)...)
+	errs = append(errs, validateRecalculationConfig(cfg)...)
+	errs = append(errs, validateWebhookConfig(cfg)...)
+	errs = append(errs, validateReportConfig(cfg)...)
+	errs = append(errs, validateConsistencyConfig(cfg)...)
+
+	if cfg.AlertWindow < metricsResolution || cfg.AlertWindow > metricsHistory {
+		errs = append(errs, fmt.Errorf("ALERT_WINDOW must be between %s and %s, got %s", metricsResolution, metricsHistory, cfg.AlertWindow))
+	}
+	if len(cfg.AlertEmailTo) > 0 && (cfg.SMTPAddr == "" || cfg.SMTPFrom == "") {
+		errs = append(errs, errors.New("ALERT_EMAIL_TO requires SMTP_ADDR and SMTP_FROM"))
+	}
+
+	return cfg, errors.Join(errs...)
+}
+
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Comma-separated values, with blanks dropped
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvDuration(key string, fallback time.Duration, errs *[]error) time.Duration {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		*errs = append(*errs, fmt.Errorf("%s must be a non-negative duration such as 30s or 5m, got %q", key, value))
+		return fallback
+	}
+	return duration
+}
+
+// Parse a comma-separated list of CIDRs; bare IPs are treated as single-host networks
+func getEnvCIDRs(key string, errs *[]error) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, value := range strings.Split(getEnv(key, ""), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s contains an invalid CIDR %q", key, value))
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func getEnvCents(key string, fallback int64, errs *[]error) int64 {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	cents, ok := parseCents(value)
+	if !ok {
+		*errs = append(*errs, fmt.Errorf("%s must be an amount such as 0.05, got %q", key, value))
+		return fallback
+	}
+	return cents
+}
+
+func getEnvBool(key string, fallback bool, errs *[]error) bool {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s must be true or false, got %q", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvInt(key string, fallback int, errs *[]error) int {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		*errs = append(*errs, fmt.Errorf("%s must be a non-negative integer, got %q", key, value))
+		return fallback
+	}
+	return parsed
+}
+
+// Decode a 32-byte key given as hex or base64
+func decodeKey(key, value string, errs *[]error) []byte {
+	decoded, err := hex.DecodeString(value)
+	if err != nil {
+		decoded, err = base64.StdEncoding.DecodeString(value)
+	}
+	if err != nil || len(decoded) != 32 {
+		*errs = append(*errs, fmt.Errorf("%s must be a 32-byte key encoded as hex or base64", key))
+		return nil
+	}
+	return decoded
+}
+
+func getEnvFloat(key string, fallback float64, errs *[]error) float64 {
+	value := getEnv(key, "")
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 {
+		*errs = append(*errs, fmt.Errorf("%s must be a non-negative number, got %q", key, value))
+		return fallback
+	}
+	return parsed
+}
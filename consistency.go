@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How an index entry can disagree with the stored receipt
+const (
+	// Stored, but not in the index, e.g. written by another instance
+	divergenceMissing = "missing"
+	// In the index, but no longer stored, e.g. deleted by another instance or expired by Redis
+	divergenceStale = "stale"
+	// Indexed from another version of the receipt than the one stored
+	divergenceChanged = "changed"
+)
+
+// An in-memory index built from the store at startup and kept current by the writes made
+// through this instance, which the consistency checker compares with the store
+type checkedIndex interface {
+	// Up to n of the indexed IDs, starting from a random one
+	sampleIDs(n int) []string
+	// The entry held for id, and the entry receipt should have, each if there is one
+	entry(id string) (string, bool)
+	expectedEntry(receipt Receipt) (string, bool)
+	add(receipt Receipt)
+	remove(id string)
+}
+
+// The indexes in use, by name
+func checkedIndexes() map[string]checkedIndex {
+	indexes := map[string]checkedIndex{"search": receiptIndex}
+	if config.DuplicateReceipts != duplicatesAllow {
+		indexes["duplicates"] = duplicateIndex
+	}
+	return indexes
+}
+
+type IndexConsistency struct {
+	Index   string `json:"index"`
+	Checked int64  `json:"checked"`
+	Missing int64  `json:"missing"`
+	Stale   int64  `json:"stale"`
+	Changed int64  `json:"changed"`
+	Healed  int64  `json:"healed"`
+}
+
+// Totals since startup, and how the last check went
+type ConsistencyStats struct {
+	Interval      string             `json:"interval"`
+	Sample        int                `json:"sample"`
+	Runs          int64              `json:"runs"`
+	Errors        int64              `json:"errors"`
+	LastRunAt     *time.Time         `json:"lastRunAt,omitempty"`
+	LastDivergent int                `json:"lastDivergent"`
+	LastError     string             `json:"lastError,omitempty"`
+	Indexes       []IndexConsistency `json:"indexes"`
+}
+
+var consistency = struct {
+	// Held for a whole check, so checks don't overlap
+	mutex sync.Mutex
+	stats ConsistencyStats
+	// Counters by index name
+	indexes map[string]*IndexConsistency
+}{indexes: map[string]*IndexConsistency{}}
+
+// Check a sample of receipts every CONSISTENCY_CHECK_INTERVAL
+func startConsistencyChecks() {
+	if config.ConsistencyCheckInterval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(config.ConsistencyCheckInterval) {
+			checkConsistency(context.Background(), false)
+		}
+	}()
+}
+
+// Compare the entries of CONSISTENCY_CHECK_SAMPLE indexed IDs of each index with the
+// receipts stored under them, read by ID, healing the entries that disagree. A full check
+// lists every stored receipt instead, so it also finds receipts no index holds and checks
+// the stats counters.
+func checkConsistency(ctx context.Context, full bool) int {
+	consistency.mutex.Lock()
+	defer consistency.mutex.Unlock()
+
+	now := time.Now().UTC()
+	consistency.stats.Runs++
+	consistency.stats.LastRunAt = &now
+	var divergent int
+	var err error
+	if full {
+		divergent, err = checkAllReceipts(ctx)
+	} else {
+		divergent, err = checkIndexes(ctx, config.ConsistencyCheckSample)
+	}
+	consistency.stats.LastDivergent = divergent
+	consistency.stats.LastError = ""
+	if err != nil {
+		consistency.stats.Errors++
+		consistency.stats.LastError = err.Error()
+		slog.Error("Error checking index consistency", "error", err)
+		return divergent
+	}
+	if divergent > 0 {
+		slog.Warn("Healed index entries that disagreed with storage", "divergent", divergent)
+	}
+	return divergent
+}
+
+// Sampled IDs are read one at a time, so a check costs the same however many receipts are
+// stored. An ID sampled from one index is checked in every index, which finds those
+// missing from the others.
+func checkIndexes(ctx context.Context, sample int) (int, error) {
+	indexes := checkedIndexes()
+	sampled := map[string]bool{}
+	for _, index := range indexes {
+		for _, id := range index.sampleIDs(sample) {
+			sampled[id] = true
+		}
+	}
+
+	divergent := 0
+	for id := range sampled {
+		receipt, found, err := store.Get(ctx, id)
+		if err != nil {
+			return divergent, fmt.Errorf("reading receipt %s: %w", id, err)
+		}
+		for name, index := range indexes {
+			healed, err := checkEntry(ctx, name, index, id, receipt, found)
+			if err != nil {
+				return divergent, err
+			}
+			if healed {
+				divergent++
+			}
+		}
+	}
+	return divergent, nil
+}
+
+// Compare every stored receipt, and every indexed ID, with the indexes, and the stats
+// counters of every tenant with the stored receipts
+func checkAllReceipts(ctx context.Context) (int, error) {
+	writes := counters.finished.Load()
+	receipts, err := store.List(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("listing receipts: %w", err)
+	}
+	stored := make(map[string]Receipt, len(receipts))
+	for _, receipt := range receipts {
+		stored[receipt.ID] = receipt
+	}
+
+	divergent := 0
+	for name, index := range checkedIndexes() {
+		ids := index.sampleIDs(math.MaxInt)
+		for id := range stored {
+			ids = append(ids, id)
+		}
+		checked := map[string]bool{}
+		for _, id := range ids {
+			if checked[id] {
+				continue
+			}
+			checked[id] = true
+			receipt, found := stored[id]
+			healed, err := checkEntry(ctx, name, index, id, receipt, found)
+			if err != nil {
+				return divergent, err
+			}
+			if healed {
+				divergent++
+			}
+		}
+	}
+	return divergent + checkCounters(receipts, writes), nil
+}
+
+func indexConsistency(name string) *IndexConsistency {
+	counts := consistency.indexes[name]
+	if counts == nil {
+		counts = &IndexConsistency{Index: name}
+		consistency.indexes[name] = counts
+	}
+	return counts
+}
+
+// Compare an index's entry for id with the receipt read for it, healing it from storage
+// if a second read still disagrees; reports whether it was healed
+func checkEntry(ctx context.Context, name string, index checkedIndex, id string, receipt Receipt, found bool) (bool, error) {
+	counts := indexConsistency(name)
+	counts.Checked++
+	if divergence(index, id, receipt, found) == "" {
+		return false, nil
+	}
+	// The receipt may have been written since it was read, so only heal what a fresh
+	// read still disagrees with
+	receipt, found, err := store.Get(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("reading receipt %s: %w", id, err)
+	}
+	kind := divergence(index, id, receipt, found)
+	switch kind {
+	case "":
+		return false, nil
+	case divergenceMissing:
+		counts.Missing++
+	case divergenceStale:
+		counts.Stale++
+	case divergenceChanged:
+		counts.Changed++
+	}
+	slog.Warn("Index entry disagrees with storage", "index", name, "receipt_id", id, "divergence", kind)
+	if found {
+		index.add(receipt)
+	} else {
+		index.remove(id)
+	}
+	counts.Healed++
+	return true, nil
+}
+
+// Recount each tenant's receipts and points from a listing, replacing the counters of the
+// tenants whose totals disagree, e.g. after receipts expired by REDIS_TTL. writes is how
+// many writes had finished before the listing; if any other was started since, the
+// listing may be missing it or the counters not have it yet, so nothing is replaced and
+// the next full check tries again.
+func checkCounters(receipts []Receipt, writes int64) int {
+	recounted := &tenantCounters{}
+	for _, receipt := range receipts {
+		recounted.add(receipt, 1)
+	}
+	tenants := map[string]bool{}
+	for _, totals := range []*tenantCounters{counters, recounted} {
+		totals.tenants.Range(func(key, _ interface{}) bool {
+			tenants[key.(string)] = true
+			return true
+		})
+	}
+
+	counts := indexConsistency("counters")
+	divergent := 0
+	// Writes count themselves while holding this for reading, so none can land in the
+	// counters being replaced
+	counters.replacing.Lock()
+	defer counters.replacing.Unlock()
+	if counters.started.Load() != writes {
+		slog.Info("Skipping stats counters check: receipts were written during it", "writes", counters.started.Load()-writes)
+		return 0
+	}
+	for tenant := range tenants {
+		counts.Checked++
+		current, expected := counters.tenant(tenant), recounted.tenant(tenant)
+		if current.receipts.Load() == expected.receipts.Load() && current.points.Load() == expected.points.Load() {
+			continue
+		}
+		slog.Warn("Stats counters disagree with storage", "tenant", tenant,
+			"receipts", current.receipts.Load(), "stored_receipts", expected.receipts.Load(),
+			"points", current.points.Load(), "stored_points", expected.points.Load())
+		counters.tenants.Store(tenant, expected)
+		counts.Changed++
+		counts.Healed++
+		divergent++
+	}
+	return divergent
+}
+
+// How the index entry for id disagrees with the stored receipt, if it does
+func divergence(index checkedIndex, id string, receipt Receipt, stored bool) string {
+	held, indexed := index.entry(id)
+	expected, shouldIndex := "", false
+	if stored {
+		expected, shouldIndex = index.expectedEntry(receipt)
+	}
+	switch {
+	case indexed == shouldIndex && held == expected:
+		return ""
+	case !indexed:
+		return divergenceMissing
+	case !shouldIndex:
+		return divergenceStale
+	default:
+		return divergenceChanged
+	}
+}
+
+func consistencySnapshot() ConsistencyStats {
+	stats := consistency.stats
+	stats.Interval = config.ConsistencyCheckInterval.String()
+	stats.Sample = config.ConsistencyCheckSample
+	stats.Indexes = []IndexConsistency{}
+	names := []string{"counters"}
+	for name := range checkedIndexes() {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		counts := IndexConsistency{Index: name}
+		if consistency.indexes[name] != nil {
+			counts = *consistency.indexes[name]
+		}
+		stats.Indexes = append(stats.Indexes, counts)
+	}
+	slices.SortFunc(stats.Indexes, func(a, b IndexConsistency) int { return strings.Compare(a.Index, b.Index) })
+	return stats
+}
+
+// GET /admin/storage/consistency: checker totals; POST runs a check now, a full one with
+// ?full=true, and returns them after it
+func handleConsistency(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		full := r.URL.Query().Get("full") == "true"
+		divergent := checkConsistency(r.Context(), full)
+		slog.InfoContext(r.Context(), "Ran index consistency check", "full", full, "divergent", divergent)
+	}
+	consistency.mutex.Lock()
+	stats := consistencySnapshot()
+	consistency.mutex.Unlock()
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func validateConsistencyConfig(cfg Config) []error {
+	var errs []error
+	if cfg.ConsistencyCheckSample < 1 {
+		errs = append(errs, fmt.Errorf("CONSISTENCY_CHECK_SAMPLE must be at least 1, got %d", cfg.ConsistencyCheckSample))
+	}
+	return errs
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Request headers browsers may send cross-origin unless CORS_ALLOWED_HEADERS is set
+var defaultCORSHeaders = []string{"Authorization", "Content-Type", "Idempotency-Key", "If-Modified-Since", "Prefer", "X-Client-Version", "X-Request-ID", "X-Submission-Channel", "X-Tenant-ID"}
+
+// Response headers of the public API that scripts on other origins may read, besides the
+// ones browsers always expose such as Content-Type and Last-Modified
+var corsExposedHeaders = []string{"Idempotent-Replayed", "Link", "Location", "Preference-Applied", "Retry-After", "Sunset", "X-API-Deprecation", "X-Request-ID"}
+
+// Middleware letting browser frontends on CORS_ALLOWED_ORIGINS call the public API.
+// Preflight OPTIONS requests are answered here, for the methods the route serves (and
+// CORS_ALLOWED_METHODS allows) and the allowed request headers; other requests get the
+// headers that let the browser hand the response to the calling script. Requests from
+// origins that aren't allowed are served without them, so the browser withholds the
+// response. The admin endpoints are never opened to other origins.
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || len(config.CORSAllowedOrigins) == 0 || isAdminPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowOrigin, allowed := corsAllowOrigin(origin)
+		if !allowed {
+			slog.WarnContext(r.Context(), "Cross-origin request from an origin that isn't allowed", "origin", origin, "path", r.URL.Path)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || method == "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Preflight: browsers don't follow redirects or accept errors here, so paths that
+		// aren't canonical routes get routeGuard's answer without CORS headers
+		w.Header().Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+		matched, canonical, found := matchRoute(r.URL.Path)
+		if !found || canonical != r.URL.Path {
+			next.ServeHTTP(w, r)
+			return
+		}
+		methods := matched.methods
+		if len(config.CORSAllowedMethods) > 0 {
+			methods = slices.DeleteFunc(slices.Clone(methods), func(m string) bool { return !slices.Contains(config.CORSAllowedMethods, m) })
+		}
+		if !slices.Contains(methods, method) {
+			http.Error(w, method+" is not allowed cross-origin for this endpoint", http.StatusForbidden)
+			slog.WarnContext(r.Context(), "Rejected CORS preflight", "origin", origin, "path", r.URL.Path, "method", method)
+			return
+		}
+		headers := config.CORSAllowedHeaders
+		if len(headers) == 0 {
+			headers = defaultCORSHeaders
+		}
+		for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			header = strings.TrimSpace(header)
+			if header != "" && !slices.ContainsFunc(headers, func(h string) bool { return strings.EqualFold(h, header) }) {
+				http.Error(w, "Header "+header+" is not allowed cross-origin", http.StatusForbidden)
+				slog.WarnContext(r.Context(), "Rejected CORS preflight", "origin", origin, "path", r.URL.Path, "header", header)
+				return
+			}
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(config.CORSMaxAge.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// The Access-Control-Allow-Origin value for an origin, if it's allowed. Entries are
+// origins such as https://app.example.com, https://*.example.com for its subdomains,
+// or * for any origin.
+func corsAllowOrigin(origin string) (string, bool) {
+	for _, allowed := range config.CORSAllowedOrigins {
+		if allowed == "*" {
+			return "*", true
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok {
+			prefix := scheme + "://"
+			host := strings.ToLower(strings.TrimPrefix(origin, prefix))
+			if len(origin) > len(prefix) && strings.EqualFold(origin[:len(prefix)], prefix) && strings.HasSuffix(host, "."+strings.ToLower(domain)) {
+				return origin, true
+			}
+		}
+	}
+	return "", false
+}
+
+func validateCORSConfig(cfg Config) []error {
+	var errs []error
+	for _, origin := range cfg.CORSAllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		parsed, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" || parsed.RawQuery != "" || parsed.User != nil {
+			errs = append(errs, fmt.Errorf("CORS_ALLOWED_ORIGINS entry %q is not an origin such as https://app.example.com, https://*.example.com or *", origin))
+		}
+	}
+	for _, method := range cfg.CORSAllowedMethods {
+		if method != strings.ToUpper(method) || !slices.ContainsFunc(routes, func(r route) bool { return slices.Contains(r.methods, method) }) {
+			errs = append(errs, fmt.Errorf("CORS_ALLOWED_METHODS entry %q is not a method the API serves, such as GET or POST", method))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+// How often a rule fires across the corpus and how many points it awards when it does
+type RuleCoverage struct {
+	Rule string `json:"rule"`
+	// Receipts where the rule awarded any points
+	Triggered int     `json:"triggered"`
+	Percent   float64 `json:"percent"`
+	Points    int     `json:"points"`
+	// Share of all points awarded that came from this rule
+	ShareOfPoints float64 `json:"shareOfPoints"`
+	// Per-receipt points among the receipts that triggered the rule
+	Distribution PointsDistribution `json:"distribution"`
+}
+
+type PointsDistribution struct {
+	Min  int     `json:"min"`
+	P50  int     `json:"p50"`
+	P90  int     `json:"p90"`
+	Max  int     `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+type CoverageReport struct {
+	Receipts int            `json:"receipts"`
+	Points   int            `json:"points"`
+	Rules    []RuleCoverage `json:"rules"`
+}
+
+func ruleCoverage(receipts []Receipt) CoverageReport {
+	rules := scoredRules()
+	perRule := make(map[string][]int, len(rules))
+	report := CoverageReport{Receipts: len(receipts), Rules: []RuleCoverage{}}
+	for _, receipt := range receipts {
+		// Item rules contribute one entry per item; count them once per receipt
+		points := make(map[string]int)
+		for _, result := range receipt.Breakdown {
+			points[result.Rule] += result.Points
+		}
+		for rule, awarded := range points {
+			if awarded > 0 {
+				perRule[rule] = append(perRule[rule], awarded)
+				report.Points += awarded
+			}
+		}
+	}
+
+	for _, rule := range rules {
+		awarded := perRule[rule]
+		coverage := RuleCoverage{Rule: rule, Triggered: len(awarded)}
+		if len(awarded) > 0 {
+			sort.Ints(awarded)
+			for _, points := range awarded {
+				coverage.Points += points
+			}
+			coverage.Percent = round2(float64(len(awarded)) / float64(len(receipts)) * 100)
+			coverage.ShareOfPoints = round2(float64(coverage.Points) / float64(report.Points) * 100)
+			coverage.Distribution = PointsDistribution{
+				Min:  awarded[0],
+				P50:  awarded[(len(awarded)-1)*50/100],
+				P90:  awarded[(len(awarded)-1)*90/100],
+				Max:  awarded[len(awarded)-1],
+				Mean: round2(float64(coverage.Points) / float64(len(awarded))),
+			}
+		}
+		report.Rules = append(report.Rules, coverage)
+	}
+	return report
+}
+
+func getRuleCoverage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	receipts, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Failed to list receipts", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing receipts for rule coverage", "error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ruleCoverage(receipts))
+}
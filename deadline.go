@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parse a request timeout header: a Go duration such as 250ms or a number of seconds
+func parseRequestTimeout(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), seconds > 0
+	}
+	timeout, err := time.ParseDuration(value)
+	return timeout, err == nil && timeout > 0
+}
+
+// Middleware honoring X-Request-Timeout (or Request-Timeout) from trusted proxies, so an
+// upstream budget bounds the time spent here. The request context carries the deadline,
+// and callers get a 504 if the handler hasn't finished by then, unless it had already
+// started storing its result (see commitBeforeDeadline). Timeouts are capped at
+// MAX_REQUEST_TIMEOUT. Streams are left alone, as they are answered as they go and stay
+// open for as long as the client watches.
+func requestDeadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isStreamingPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		value := r.Header.Get("X-Request-Timeout")
+		if value == "" {
+			value = r.Header.Get("Request-Timeout")
+		}
+		if value == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		peer, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			peer = r.RemoteAddr
+		}
+		if !isTrustedProxy(peer) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeout, ok := parseRequestTimeout(value)
+		if !ok {
+			http.Error(w, "Request timeout must be a positive duration such as 500ms or a number of seconds", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid request timeout", "timeout", value)
+			return
+		}
+		timeout = min(timeout, config.MaxRequestTimeout)
+
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		buffered := &deadlineWriter{header: make(http.Header)}
+		ctx = context.WithValue(ctx, deadlineWriterKey{}, buffered)
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(buffered, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+		case <-done:
+		case <-ctx.Done():
+			buffered.mu.Lock()
+			committed := buffered.committed
+			buffered.timedOut = !committed
+			buffered.mu.Unlock()
+			if !committed {
+				http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+				slog.WarnContext(ctx, "Request exceeded its deadline", "path", r.URL.Path, "timeout", timeout)
+				return
+			}
+			// The handler was already storing its result, so the caller gets its response
+			// rather than a 504 it would retry
+			slog.WarnContext(ctx, "Request exceeded its deadline while storing its result", "path", r.URL.Path, "timeout", timeout)
+			select {
+			case p := <-panicked:
+				panic(p)
+			case <-done:
+			}
+		}
+
+		buffered.mu.Lock()
+		defer buffered.mu.Unlock()
+		for key, values := range buffered.header {
+			w.Header()[key] = values
+		}
+		if buffered.status == 0 {
+			buffered.status = http.StatusOK
+		}
+		w.WriteHeader(buffered.status)
+		w.Write(buffered.body.Bytes())
+	})
+}
+
+// The receipt stream, live points feed and change feed
+func isStreamingPath(path string) bool {
+	return path == apiVersion+"/receipts/stream" || path == apiVersion+"/receipts/live" || path == "/admin/cdc"
+}
+
+type deadlineWriterKey struct{}
+
+// Called by handlers just before their first lasting change, such as storing a receipt or
+// posting to the ledger. Reports false, so the handler stops, if the caller has given up
+// or was already answered with a 504; otherwise the request is committed and answered
+// with the handler's response even if its deadline passes meanwhile.
+func commitBeforeDeadline(r *http.Request) bool {
+	ctx := r.Context()
+	buffered, deadlined := ctx.Value(deadlineWriterKey{}).(*deadlineWriter)
+	if !deadlined {
+		if err := ctx.Err(); err != nil {
+			slog.InfoContext(ctx, "Abandoned request the caller gave up on", "path", r.URL.Path, "reason", err)
+			return false
+		}
+		return true
+	}
+	buffered.mu.Lock()
+	defer buffered.mu.Unlock()
+	if buffered.timedOut {
+		slog.InfoContext(ctx, "Abandoned request past its deadline", "path", r.URL.Path)
+		return false
+	}
+	buffered.committed = true
+	return true
+}
+
+// Holds the response until the handler finishes, discarding it if the deadline passes
+// before the handler commits
+type deadlineWriter struct {
+	mu        sync.Mutex
+	header    http.Header
+	body      bytes.Buffer
+	status    int
+	committed bool
+	timedOut  bool
+}
+
+func (w *deadlineWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *deadlineWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(data)
+}
+
+func (w *deadlineWriter) WriteHeader(status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut || w.status != 0 {
+		return
+	}
+	w.status = status
+}
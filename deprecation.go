@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Middleware enforcing the client version policy. Clients older than MIN_CLIENT_VERSION get 426;
+// clients older than DEPRECATED_CLIENT_VERSION get an X-API-Deprecation header ahead of removal.
+// Requests without X-Client-Version are not affected.
+func clientVersionGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		version := strings.TrimSpace(r.Header.Get("X-Client-Version"))
+		if version == "" || (config.MinClientVersion == "" && config.DeprecatedClientVersion == "") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		parsed, ok := parseVersion(version)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if config.MinClientVersion != "" && compareVersions(parsed, mustParseVersion(config.MinClientVersion)) < 0 {
+			slog.WarnContext(r.Context(), "Rejected client version below minimum", "version", version, "minimum", config.MinClientVersion)
+			writeJSON(w, http.StatusUpgradeRequired, map[string]string{
+				"error":          "client_version_unsupported",
+				"message":        fmt.Sprintf("client version %s is no longer supported, upgrade to %s or later", version, config.MinClientVersion),
+				"clientVersion":  version,
+				"minimumVersion": config.MinClientVersion,
+			})
+			return
+		}
+
+		if config.DeprecatedClientVersion != "" && compareVersions(parsed, mustParseVersion(config.DeprecatedClientVersion)) < 0 {
+			notice := fmt.Sprintf("version=%q; supported=%q", version, config.DeprecatedClientVersion)
+			if !config.ClientSunsetDate.IsZero() {
+				notice += fmt.Sprintf("; sunset=%q", config.ClientSunsetDate.Format("2006-01-02"))
+				w.Header().Set("Sunset", config.ClientSunsetDate.UTC().Format(http.TimeFormat))
+			}
+			w.Header().Set("X-API-Deprecation", notice)
+			slog.InfoContext(r.Context(), "Deprecated client version used", "version", version, "path", r.URL.Path)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Parse a dotted numeric version such as "1.4.2" or "v2.0"; pre-release and build suffixes are ignored
+func parseVersion(version string) ([]int, bool) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if cut := strings.IndexAny(version, "-+"); cut >= 0 {
+		version = version[:cut]
+	}
+	var parts []int
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
+
+func mustParseVersion(version string) []int {
+	parts, _ := parseVersion(version)
+	return parts
+}
+
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func validateVersionConfig(cfg Config) []error {
+	var errs []error
+	for key, value := range map[string]string{"MIN_CLIENT_VERSION": cfg.MinClientVersion, "DEPRECATED_CLIENT_VERSION": cfg.DeprecatedClientVersion} {
+		if _, ok := parseVersion(value); value != "" && !ok {
+			errs = append(errs, fmt.Errorf("%s must be a dotted version such as 1.2.0, got %q", key, value))
+		}
+	}
+	return errs
+}
+
+func parseSunsetDate(value string, errs *[]error) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("CLIENT_SUNSET_DATE must be a YYYY-MM-DD date, got %q", value))
+	}
+	return date
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Digest periods and how far back each one looks
+var digestPeriods = map[string]time.Duration{
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+}
+
+const digestTopRetailers = 5
+
+type RetailerSummary struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+	Points   int    `json:"points"`
+}
+
+type Digest struct {
+	UserID         string            `json:"userId"`
+	Period         string            `json:"period"`
+	From           time.Time         `json:"from"`
+	To             time.Time         `json:"to"`
+	Receipts       int               `json:"receipts"`
+	Points         int               `json:"points"`
+	TopRetailers   []RetailerSummary `json:"topRetailers"`
+	ExpiringPoints int               `json:"expiringPoints"`
+	ExpiringBefore *time.Time        `json:"expiringBefore,omitempty"`
+}
+
+// When a receipt's points expire under POINTS_EXPIRY; zero if they never do
+func pointsExpireAt(receipt Receipt) time.Time {
+	if config.PointsExpiry == 0 {
+		return time.Time{}
+	}
+	return receipt.ReceivedAt.Add(config.PointsExpiry)
+}
+
+// Summarize a user's receipts received in the period ending now, plus points due to expire during the next one
+func buildDigest(receipts []Receipt, tenant, userID, period string, now time.Time) Digest {
+	length := digestPeriods[period]
+	digest := Digest{UserID: userID, Period: period, From: now.Add(-length), To: now, TopRetailers: []RetailerSummary{}}
+	if config.PointsExpiry > 0 {
+		expiringBefore := now.Add(length)
+		digest.ExpiringBefore = &expiringBefore
+	}
+
+	retailers := map[string]*RetailerSummary{}
+	for _, receipt := range receipts {
+		if receipt.Tenant != tenant || receipt.UserID != userID {
+			continue
+		}
+
+		if expiresAt := pointsExpireAt(receipt); !expiresAt.IsZero() && expiresAt.After(now) && !expiresAt.After(now.Add(length)) {
+			digest.ExpiringPoints += receipt.Points
+		}
+
+		if receipt.ReceivedAt.Before(digest.From) || receipt.ReceivedAt.After(now) {
+			continue
+		}
+		digest.Receipts++
+		digest.Points += receipt.Points
+		if retailers[receipt.Retailer] == nil {
+			retailers[receipt.Retailer] = &RetailerSummary{Retailer: receipt.Retailer}
+		}
+		retailers[receipt.Retailer].Receipts++
+		retailers[receipt.Retailer].Points += receipt.Points
+	}
+
+	for _, summary := range retailers {
+		digest.TopRetailers = append(digest.TopRetailers, *summary)
+	}
+	sort.Slice(digest.TopRetailers, func(i, j int) bool {
+		a, b := digest.TopRetailers[i], digest.TopRetailers[j]
+		if a.Points != b.Points {
+			return a.Points > b.Points
+		}
+		return a.Retailer < b.Retailer
+	})
+	if len(digest.TopRetailers) > digestTopRetailers {
+		digest.TopRetailers = digest.TopRetailers[:digestTopRetailers]
+	}
+	return digest
+}
+
+func getDigest(w http.ResponseWriter, r *http.Request, userID string) {
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "week"
+	}
+	if _, ok := digestPeriods[period]; !ok {
+		http.Error(w, "period must be week or month", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid digest period", "period", period)
+		return
+	}
+
+	receipts, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Error reading receipts", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing receipts for digest", "error", err)
+		return
+	}
+
+	digest := buildDigest(receipts, r.Header.Get("X-Tenant-ID"), userID, period, time.Now().UTC())
+	slog.InfoContext(r.Context(), "Digest for user", "user_id", userID, "receipts", digest.Receipts, "points", digest.Points)
+	writeJSON(w, http.StatusOK, digest)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// What to do with a submission identical to a stored receipt, selected with DUPLICATE_RECEIPTS
+const (
+	duplicatesAllow    = "allow"
+	duplicatesReject   = "reject"
+	duplicatesExisting = "existing"
+)
+
+// Hash of what makes two submissions the same purchase: tenant, retailer, purchase date and
+// time, total and items, whatever their order
+func contentHash(receipt Receipt) string {
+	items := make([]string, len(receipt.Items))
+	for i, item := range receipt.Items {
+		items[i] = item.ShortDescription + "\x00" + item.Price
+	}
+	sort.Strings(items)
+
+	hash := sha256.New()
+	for _, field := range []string{receipt.Tenant, receipt.Retailer, receipt.PurchaseDate, receipt.PurchaseTime, receipt.Total} {
+		hash.Write([]byte(field + "\x00"))
+	}
+	hash.Write([]byte(strings.Join(items, "\x01")))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Receipt IDs by content hash, kept alongside the store
+type contentIndex struct {
+	mutex  sync.RWMutex
+	byHash map[string][]string
+	hashes map[string]string // receipt ID -> content hash
+}
+
+var duplicateIndex = &contentIndex{byHash: make(map[string][]string), hashes: make(map[string]string)}
+
+// Serializes the duplicate check and store of submissions so identical ones sent at the
+// same time can't both be stored
+var duplicateMutex = &sync.Mutex{}
+
+func (x *contentIndex) add(receipt Receipt) {
+	x.remove(receipt.ID)
+	// Captured receipts aren't complete enough to compare until they are finalized
+	if receipt.Status == statusNeedsEnrichment {
+		return
+	}
+	hash := contentHash(receipt)
+	x.mutex.Lock()
+	x.byHash[hash] = append(x.byHash[hash], receipt.ID)
+	x.hashes[receipt.ID] = hash
+	x.mutex.Unlock()
+}
+
+func (x *contentIndex) remove(id string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	hash, found := x.hashes[id]
+	if !found {
+		return
+	}
+	delete(x.hashes, id)
+	ids := x.byHash[hash]
+	for i, candidate := range ids {
+		if candidate == id {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(x.byHash, hash)
+	} else {
+		x.byHash[hash] = ids
+	}
+}
+
+// The first other stored receipt with the same content, if any
+func (x *contentIndex) find(receipt Receipt) (string, bool) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	for _, id := range x.byHash[contentHash(receipt)] {
+		if id != receipt.ID {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// A finalized or updated receipt identical to another stored receipt. There's no new
+// receipt to answer with the original instead, so it is rejected in existing mode too.
+type duplicateError struct {
+	existing string
+}
+
+func (e *duplicateError) Error() string {
+	return "receipt is a duplicate of " + e.existing
+}
+
+// Take duplicateMutex, when duplicates are checked, for a check and the store that
+// follows; the returned release may be called more than once
+func lockDuplicates() func() {
+	if config.DuplicateReceipts == duplicatesAllow {
+		return func() {}
+	}
+	duplicateMutex.Lock()
+	return sync.OnceFunc(duplicateMutex.Unlock)
+}
+
+// Fail with a *duplicateError when duplicates are checked and another stored receipt has
+// the same content
+func checkDuplicate(receipt Receipt) error {
+	if config.DuplicateReceipts == duplicatesAllow {
+		return nil
+	}
+	if existing, found := duplicateIndex.find(receipt); found {
+		return &duplicateError{existing}
+	}
+	return nil
+}
+
+// The 409 message for a duplicate of existing, naming it only to a caller who may read it
+func duplicateMessage(r *http.Request, existing string) string {
+	original, found, err := store.Get(r.Context(), existing)
+	if err == nil && found && ownsReceipt(r, original) {
+		return "Receipt is a duplicate of " + existing
+	}
+	return "Receipt is a duplicate of a stored receipt"
+}
+
+func (x *contentIndex) sampleIDs(n int) []string {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	ids := make([]string, 0, min(n, len(x.hashes)))
+	for id := range x.hashes {
+		if len(ids) == n {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (x *contentIndex) entry(id string) (string, bool) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	hash, found := x.hashes[id]
+	return hash, found
+}
+
+func (x *contentIndex) expectedEntry(receipt Receipt) (string, bool) {
+	if receipt.Status == statusNeedsEnrichment {
+		return "", false
+	}
+	return contentHash(receipt), true
+}
+
+type contentIndexedStore struct {
+	Store
+	index *contentIndex
+}
+
+func newContentIndexedStore(ctx context.Context, backing Store, index *contentIndex) (*contentIndexedStore, error) {
+	receipts, err := backing.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, receipt := range receipts {
+		index.add(receipt)
+	}
+	return &contentIndexedStore{Store: backing, index: index}, nil
+}
+
+func (s *contentIndexedStore) Put(ctx context.Context, receipt Receipt) error {
+	if err := s.Store.Put(ctx, receipt); err != nil {
+		return err
+	}
+	s.index.add(receipt)
+	return nil
+}
+
+func (s *contentIndexedStore) Delete(ctx context.Context, id string) (bool, error) {
+	found, err := s.Store.Delete(ctx, id)
+	if found {
+		s.index.remove(id)
+	}
+	return found, err
+}
+
+func parseDuplicateMode(value string, errs *[]error) string {
+	switch value {
+	case duplicatesAllow, duplicatesReject, duplicatesExisting:
+		return value
+	}
+	*errs = append(*errs, fmt.Errorf("DUPLICATE_RECEIPTS must be %q, %q or %q, got %q", duplicatesAllow, duplicatesReject, duplicatesExisting, value))
+	return duplicatesAllow
+}
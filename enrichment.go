@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A service that fills in what a captured receipt is missing: OCR of the photo, a catalog
+// lookup, a human review queue. Enrich either returns the fields it found right away, or
+// returns nil and posts them to request.CallbackURL once it has them.
+type EnrichmentProvider interface {
+	Name() string
+	Enrich(ctx context.Context, request EnrichmentRequest) (*partialReceipt, error)
+}
+
+// What a provider is asked to enrich. The receipt doesn't carry its user.
+type EnrichmentRequest struct {
+	Receipt     Receipt  `json:"receipt"`
+	Missing     []string `json:"missing"`
+	CallbackURL string   `json:"callbackUrl"`
+}
+
+// An ENRICHMENT_PROVIDERS entry
+type enrichmentEndpoint struct {
+	name    string
+	url     string
+	timeout time.Duration
+}
+
+// Calls an HTTP service with the request as JSON. It answers 200 with the fields it found,
+// or 202 Accepted and posts them to the callback URL later.
+type httpEnrichmentProvider struct {
+	name string
+	url  string
+}
+
+var enrichmentClient = &http.Client{}
+
+func (p *httpEnrichmentProvider) Name() string {
+	return p.name
+}
+
+func (p *httpEnrichmentProvider) Enrich(ctx context.Context, request EnrichmentRequest) (*partialReceipt, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := enrichmentClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result partialReceipt
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return nil, fmt.Errorf("decoding response from %s: %w", p.url, err)
+		}
+		return &result, nil
+	case http.StatusAccepted:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("%s responded with %s", p.url, resp.Status)
+}
+
+// A provider in the order they are tried, with its timeout and counters
+type enrichmentStage struct {
+	provider EnrichmentProvider
+	timeout  time.Duration
+	stats    enrichmentCounters
+}
+
+type enrichmentCounters struct {
+	requests  atomic.Int64
+	results   atomic.Int64
+	errors    atomic.Int64
+	timeouts  atomic.Int64
+	finalized atomic.Int64
+	latency   atomic.Int64 // total nanoseconds from request to result
+}
+
+var enrichmentStages []*enrichmentStage
+
+// An enrichment request waiting for its result, keyed by the token in its callback URL
+type enrichmentJob struct {
+	receiptID   string
+	stage       int
+	requestedAt time.Time
+	timer       *time.Timer
+}
+
+var enrichmentJobs = make(map[string]*enrichmentJob)
+var enrichmentMutex = &sync.Mutex{}
+
+func startEnrichment() {
+	for _, endpoint := range config.EnrichmentProviders {
+		registerEnrichmentProvider(&httpEnrichmentProvider{name: endpoint.name, url: endpoint.url}, endpoint.timeout)
+	}
+}
+
+// Add a provider after those already registered
+func registerEnrichmentProvider(provider EnrichmentProvider, timeout time.Duration) {
+	enrichmentStages = append(enrichmentStages, &enrichmentStage{provider: provider, timeout: timeout})
+	slog.Info("Enriching captured receipts", "provider", provider.Name(), "timeout", timeout)
+}
+
+// Ask providers in turn, starting with stage, for what a captured receipt is missing until
+// it can be finalized. Each result is applied as it arrives; a provider that fails or
+// doesn't answer within its timeout is skipped.
+func requestEnrichment(id string, stage int) {
+	for ; stage < len(enrichmentStages); stage++ {
+		receipt, found, err := store.Get(context.Background(), id)
+		if err != nil {
+			slog.Error("Error reading receipt for enrichment", "receipt_id", id, "error", err)
+			return
+		}
+		if !found || receiptStatus(receipt) != statusNeedsEnrichment {
+			return
+		}
+
+		current := enrichmentStages[stage]
+		token := newEnrichmentToken()
+		job := &enrichmentJob{receiptID: id, stage: stage, requestedAt: time.Now()}
+		enrichmentMutex.Lock()
+		enrichmentJobs[token] = job
+		job.timer = time.AfterFunc(current.timeout, func() { expireEnrichment(token) })
+		enrichmentMutex.Unlock()
+
+		receipt.UserID, receipt.UserIDHash = "", ""
+		request := EnrichmentRequest{Receipt: receipt, Missing: missingFields(receipt), CallbackURL: enrichmentCallbackURL(token)}
+		current.stats.requests.Add(1)
+		ctx, cancel := context.WithTimeout(context.Background(), current.timeout)
+		result, err := current.provider.Enrich(ctx, request)
+		cancel()
+		if err == nil && result == nil {
+			slog.Info("Enrichment of receipt pending", "receipt_id", id, "provider", current.provider.Name())
+			return
+		}
+		// The timeout may have taken the job over already
+		if _, ok := takeEnrichmentJob(token); !ok {
+			return
+		}
+		if err != nil {
+			current.stats.errors.Add(1)
+			slog.Error("Error enriching receipt", "receipt_id", id, "provider", current.provider.Name(), "error", err)
+			continue
+		}
+		if done := applyEnrichment(job, *result); done {
+			return
+		}
+	}
+	if stage == len(enrichmentStages) && len(enrichmentStages) > 0 {
+		slog.Warn("Receipt still needs enrichment after every provider", "receipt_id", id)
+	}
+}
+
+// Remove a job that is still pending; whoever takes it carries on with the receipt
+func takeEnrichmentJob(token string) (*enrichmentJob, bool) {
+	enrichmentMutex.Lock()
+	defer enrichmentMutex.Unlock()
+	job, found := enrichmentJobs[token]
+	if found {
+		job.timer.Stop()
+		delete(enrichmentJobs, token)
+	}
+	return job, found
+}
+
+// From PUBLIC_BASE_URL rather than the capture request's Host, which the client chose and
+// would otherwise decide where providers send their results
+func enrichmentCallbackURL(token string) string {
+	return config.PublicBaseURL + config.BasePath + apiVersion + "/enrichment/callbacks?token=" + token
+}
+
+func expireEnrichment(token string) {
+	job, found := takeEnrichmentJob(token)
+	if !found {
+		return
+	}
+	current := enrichmentStages[job.stage]
+	current.stats.timeouts.Add(1)
+	slog.Warn("Enrichment of receipt timed out", "receipt_id", job.receiptID, "provider", current.provider.Name(), "timeout", current.timeout)
+	go requestEnrichment(job.receiptID, job.stage+1)
+}
+
+// Fill in the fields a receipt is still missing from a provider's result, finalizing it
+// once nothing is missing. Reports whether enrichment is over for the receipt.
+func applyEnrichment(job *enrichmentJob, result partialReceipt) bool {
+	current := enrichmentStages[job.stage]
+	current.stats.results.Add(1)
+	current.stats.latency.Add(int64(time.Since(job.requestedAt)))
+
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	ctx := context.Background()
+	receipt, found, err := store.Get(ctx, job.receiptID)
+	if err != nil {
+		slog.Error("Error reading receipt for enrichment", "receipt_id", job.receiptID, "error", err)
+		return true
+	}
+	if !found || receiptStatus(receipt) != statusNeedsEnrichment {
+		return true
+	}
+
+	// Fields already captured or added by an earlier provider take precedence
+	fillMissing(&receipt, result)
+	slog.Info("Receipt enriched", "receipt_id", receipt.ID, "provider", current.provider.Name())
+
+	if len(missingFields(receipt)) > 0 {
+		if err := store.Put(ctx, receipt); err != nil {
+			slog.Error("Error storing receipt", "receipt_id", receipt.ID, "error", err)
+			return true
+		}
+		return false
+	}
+	finalized, err := scorePartial(ctx, receipt, FeatureSubject{Tenant: receipt.Tenant})
+	if err != nil {
+		// Keep what was found so it can be corrected with /enrich
+		slog.Warn("Enriched receipt can't be finalized", "receipt_id", receipt.ID, "error", err)
+		if err := store.Put(ctx, receipt); err != nil {
+			slog.Error("Error storing receipt", "receipt_id", receipt.ID, "error", err)
+		}
+		return true
+	}
+	if err := storeFinalized(ctx, finalized); err != nil {
+		if duplicate := (*duplicateError)(nil); errors.As(err, &duplicate) {
+			// Kept awaiting enrichment, with what was found, so it can be looked at
+			slog.Warn("Enriched receipt duplicates a stored receipt", "receipt_id", receipt.ID, "duplicate_of", duplicate.existing)
+			if err := store.Put(ctx, receipt); err != nil {
+				slog.Error("Error storing receipt", "receipt_id", receipt.ID, "error", err)
+			}
+			return true
+		}
+		slog.Error("Error storing receipt", "receipt_id", receipt.ID, "error", err)
+		return true
+	}
+	current.stats.finalized.Add(1)
+	slog.Info("Receipt finalized after enrichment", "receipt_id", receipt.ID, "provider", current.provider.Name(), "points", finalized.Points)
+	return true
+}
+
+func newEnrichmentToken() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return base64.RawURLEncoding.EncodeToString(secret)
+}
+
+// POST /enrichment/callbacks?token=...: a provider's asynchronous result, the fields it
+// found or {"error": "..."} if it couldn't enrich the receipt
+func handleEnrichmentCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "POST")
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	var result struct {
+		partialReceipt
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&result); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error decoding enrichment callback", "error", err)
+		return
+	}
+
+	job, found := takeEnrichmentJob(token)
+	if !found {
+		http.Error(w, "Enrichment request not found, or it timed out", http.StatusGone)
+		slog.WarnContext(r.Context(), "Rejected enrichment callback for an unknown or expired request")
+		return
+	}
+
+	current := enrichmentStages[job.stage]
+	if result.Error != "" {
+		current.stats.errors.Add(1)
+		slog.WarnContext(r.Context(), "Provider couldn't enrich receipt", "provider", current.provider.Name(), "receipt_id", job.receiptID, "error", result.Error)
+		go requestEnrichment(job.receiptID, job.stage+1)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if done := applyEnrichment(job, result.partialReceipt); !done {
+		go requestEnrichment(job.receiptID, job.stage+1)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Per-provider enrichment metrics
+type EnrichmentProviderStats struct {
+	Name             string `json:"name"`
+	Timeout          string `json:"timeout"`
+	Requests         int64  `json:"requests"`
+	Results          int64  `json:"results"`
+	Errors           int64  `json:"errors"`
+	Timeouts         int64  `json:"timeouts"`
+	Pending          int    `json:"pending"`
+	Finalized        int64  `json:"finalized"`
+	AverageLatencyMs int64  `json:"averageLatencyMs"`
+}
+
+// GET /admin/enrichment
+func getEnrichmentStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	pending := make([]int, len(enrichmentStages))
+	enrichmentMutex.Lock()
+	for _, job := range enrichmentJobs {
+		pending[job.stage]++
+	}
+	enrichmentMutex.Unlock()
+
+	providers := []EnrichmentProviderStats{}
+	for i, stage := range enrichmentStages {
+		stats := EnrichmentProviderStats{
+			Name:      stage.provider.Name(),
+			Timeout:   stage.timeout.String(),
+			Requests:  stage.stats.requests.Load(),
+			Results:   stage.stats.results.Load(),
+			Errors:    stage.stats.errors.Load(),
+			Timeouts:  stage.stats.timeouts.Load(),
+			Pending:   pending[i],
+			Finalized: stage.stats.finalized.Load(),
+		}
+		if stats.Results > 0 {
+			stats.AverageLatencyMs = time.Duration(stage.stats.latency.Load() / stats.Results).Milliseconds()
+		}
+		providers = append(providers, stats)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"providers": providers})
+}
+
+// Parse ENRICHMENT_PROVIDERS entries such as "ocr=https://ocr.internal/enrich", in the
+// order they are tried, with timeouts from ENRICHMENT_TIMEOUTS entries such as "ocr=30s"
+func validateEnrichmentConfig(cfg Config) []error {
+	if cfg.PublicBaseURL == "" {
+		if len(cfg.EnrichmentProviders) > 0 {
+			return []error{errors.New("PUBLIC_BASE_URL is required with ENRICHMENT_PROVIDERS, for their callback URLs")}
+		}
+		return nil
+	}
+	parsed, err := url.Parse(cfg.PublicBaseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" || parsed.Path != "" || parsed.RawQuery != "" {
+		return []error{fmt.Errorf("PUBLIC_BASE_URL must be an http or https URL without a path, such as https://api.example.com, got %q", cfg.PublicBaseURL)}
+	}
+	return nil
+}
+
+func getEnvEnrichmentProviders(key, timeoutsKey string, schemes []string, fallback time.Duration, errs *[]error) []enrichmentEndpoint {
+	timeouts := map[string]time.Duration{}
+	for _, entry := range strings.Split(getEnv(timeoutsKey, ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		timeout, err := time.ParseDuration(value)
+		if name == "" || err != nil || timeout <= 0 {
+			*errs = append(*errs, fmt.Errorf("%s entries must be name=duration such as ocr=30s, got %q", timeoutsKey, entry))
+			continue
+		}
+		timeouts[name] = timeout
+	}
+
+	var endpoints []enrichmentEndpoint
+	seen := map[string]bool{}
+	for _, entry := range strings.Split(getEnv(key, ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, target, _ := strings.Cut(entry, "=")
+		parsed, err := url.Parse(target)
+		if name == "" || err != nil || !slices.Contains(schemes, parsed.Scheme) || parsed.Host == "" {
+			*errs = append(*errs, fmt.Errorf("%s entries must be name=url with an absolute %s URL, got %q", key, strings.Join(schemes, ", "), entry))
+			continue
+		}
+		if seen[name] {
+			*errs = append(*errs, fmt.Errorf("%s lists %q more than once", key, name))
+			continue
+		}
+		seen[name] = true
+		timeout, ok := timeouts[name]
+		if !ok {
+			timeout = fallback
+		}
+		endpoints = append(endpoints, enrichmentEndpoint{name: name, url: target, timeout: timeout})
+	}
+	for name := range timeouts {
+		if !seen[name] {
+			*errs = append(*errs, fmt.Errorf("%s sets a timeout for %q, which isn't in %s", timeoutsKey, name, key))
+		}
+	}
+	return endpoints
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Example values for the IDs in paths, by the collection they follow
+var pathExamples = map[string]string{
+	"receipts": "adb6b560-0eef-42bc-9d16-df48f30e89b2",
+	"users":    "user-123",
+	"groups":   "5f1c2a9e-7d3b-4c8e-9a61-2b4f0d8e3c17",
+	"jobs":     "0c9e4b7a-3f21-4d5e-8b6a-91d2e7f43a08",
+}
+
+// The component or schema a "#/components/schemas/..." reference points at
+func resolveSchema(document map[string]interface{}, schema map[string]interface{}) map[string]interface{} {
+	for schema != nil {
+		name, ok := schema["$ref"].(string)
+		if !ok {
+			break
+		}
+		name, _ = strings.CutPrefix(name, "#/components/schemas/")
+		components, _ := document["components"].(map[string]interface{})
+		schemas, _ := components["schemas"].(map[string]interface{})
+		schema, _ = schemas[name].(map[string]interface{})
+	}
+	return schema
+}
+
+// The properties an example object fills in: the required ones in the order listed, then
+// those the first anyOf alternative requires, e.g. purchaseDate and purchaseTime, or all
+// of them by name when none are required
+func exampleProperties(schema map[string]interface{}) []string {
+	names := []string{}
+	// Generated components list them as []string, the decoded receipt schema as []interface{}
+	add := func(required interface{}) {
+		list, _ := required.([]string)
+		if decoded, ok := required.([]interface{}); ok {
+			for _, name := range decoded {
+				name, _ := name.(string)
+				list = append(list, name)
+			}
+		}
+		for _, name := range list {
+			if !slices.Contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	add(schema["required"])
+	if alternatives, ok := schema["anyOf"].([]interface{}); ok && len(alternatives) > 0 {
+		if first, ok := alternatives[0].(map[string]interface{}); ok {
+			add(first["required"])
+		}
+	}
+	if len(names) == 0 {
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name := range properties {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+	return names
+}
+
+// Generated components such as PartialReceipt carry no examples, so their receipt fields
+// borrow those of the same field of the published receipt schema
+func receiptFieldExample(document map[string]interface{}, name string, property map[string]interface{}) (json.RawMessage, bool) {
+	if property == nil || property["type"] != "string" {
+		return nil, false
+	}
+	for _, component := range []string{string(receiptSubmission), definitionName("item")} {
+		schema := resolveSchema(document, map[string]interface{}{"$ref": "#/components/schemas/" + component})
+		properties, _ := schema["properties"].(map[string]interface{})
+		field, _ := properties[name].(map[string]interface{})
+		if examples, ok := field["examples"].([]interface{}); ok && len(examples) > 0 {
+			return exampleJSON(examples[0]), true
+		}
+	}
+	return nil, false
+}
+
+// Build an example value for a schema of the served spec, as ordered JSON, from the
+// schema's examples where it has them and a value of its type otherwise
+func schemaExample(document map[string]interface{}, schema map[string]interface{}) json.RawMessage {
+	schema = resolveSchema(document, schema)
+	if schema == nil {
+		return json.RawMessage("null")
+	}
+	if examples, ok := schema["examples"].([]interface{}); ok && len(examples) > 0 {
+		return exampleJSON(examples[0])
+	}
+	switch schema["type"] {
+	case "object":
+		properties, _ := schema["properties"].(map[string]interface{})
+		var buffer bytes.Buffer
+		buffer.WriteByte('{')
+		for i, name := range exampleProperties(schema) {
+			if i > 0 {
+				buffer.WriteByte(',')
+			}
+			property, _ := properties[name].(map[string]interface{})
+			buffer.Write(exampleJSON(name))
+			buffer.WriteByte(':')
+			if example, ok := receiptFieldExample(document, name, property); ok {
+				buffer.Write(example)
+			} else {
+				buffer.Write(schemaExample(document, property))
+			}
+		}
+		buffer.WriteByte('}')
+		return buffer.Bytes()
+	case "array":
+		items, _ := schema["items"].(map[string]interface{})
+		return json.RawMessage("[" + string(schemaExample(document, items)) + "]")
+	case "string":
+		return exampleJSON("string")
+	case "integer", "number":
+		return json.RawMessage("1")
+	case "boolean":
+		return json.RawMessage("false")
+	}
+	return json.RawMessage("null")
+}
+
+// Encode without escaping characters such as & that are common in retailer names
+func exampleJSON(value interface{}) json.RawMessage {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n"))
+}
+
+// One rendered request
+type CodeExample struct {
+	Method  string `json:"method"`
+	Path    string `json:"path"`
+	Summary string `json:"summary"`
+	Code    string `json:"code"`
+}
+
+type exampleRequest struct {
+	method, url, body string
+}
+
+var exampleRenderers = map[string]func(exampleRequest) string{
+	"curl":   curlExample,
+	"go":     goExample,
+	"python": pythonExample,
+	"js":     jsExample,
+}
+
+// Every operation in the served spec, in path order, as requests against baseURL
+func renderExamples(document map[string]interface{}, baseURL string, render func(exampleRequest) string) []CodeExample {
+	specPaths, _ := document["paths"].(map[string]interface{})
+	paths := make([]string, 0, len(specPaths))
+	for path := range specPaths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	examples := []CodeExample{}
+	for _, path := range paths {
+		operations, _ := specPaths[path].(map[string]interface{})
+		for _, method := range []string{"get", "post", "put", "delete"} {
+			operation, ok := operations[method].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			request := exampleRequest{method: strings.ToUpper(method)}
+			segments := strings.Split(path, "/")
+			for i, segment := range segments {
+				if strings.HasPrefix(segment, "{") && i > 0 && pathExamples[segments[i-1]] != "" {
+					segments[i] = pathExamples[segments[i-1]]
+				}
+			}
+			request.url = baseURL + strings.Join(segments, "/")
+			if body, ok := operation["requestBody"].(map[string]interface{}); ok {
+				content, _ := body["content"].(map[string]interface{})
+				if media, ok := content["application/json"].(map[string]interface{}); ok {
+					schema, _ := media["schema"].(map[string]interface{})
+					var indented bytes.Buffer
+					json.Indent(&indented, schemaExample(document, schema), "", "  ")
+					request.body = indented.String()
+				}
+			}
+			summary, _ := operation["summary"].(string)
+			examples = append(examples, CodeExample{
+				Method:  request.method,
+				Path:    path,
+				Summary: summary,
+				Code:    render(request),
+			})
+		}
+	}
+	return examples
+}
+
+func curlExample(request exampleRequest) string {
+	quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'" }
+	code := "curl -X " + request.method + " " + quote(request.url)
+	if request.body != "" {
+		code += " \\\n  -H 'Content-Type: application/json' \\\n  -d " + quote(request.body)
+	}
+	return code + "\n"
+}
+
+func goExample(request exampleRequest) string {
+	body := "nil"
+	if request.body != "" {
+		if strings.Contains(request.body, "`") {
+			body = "strings.NewReader(" + strconv.Quote(request.body) + ")"
+		} else {
+			body = "strings.NewReader(`" + request.body + "`)"
+		}
+	}
+	var code strings.Builder
+	code.WriteString("package main\n\nimport (\n\t\"fmt\"\n\t\"io\"\n\t\"net/http\"\n")
+	if request.body != "" {
+		code.WriteString("\t\"strings\"\n")
+	}
+	code.WriteString(")\n\nfunc main() {\n")
+	fmt.Fprintf(&code, "\treq, err := http.NewRequest(%q, %q, %s)\n", request.method, request.url, body)
+	code.WriteString("\tif err != nil {\n\t\tpanic(err)\n\t}\n")
+	if request.body != "" {
+		code.WriteString("\treq.Header.Set(\"Content-Type\", \"application/json\")\n")
+	}
+	code.WriteString("\tresp, err := http.DefaultClient.Do(req)\n\tif err != nil {\n\t\tpanic(err)\n\t}\n")
+	code.WriteString("\tdefer resp.Body.Close()\n\tdata, _ := io.ReadAll(resp.Body)\n\tfmt.Println(resp.Status, string(data))\n}\n")
+	return code.String()
+}
+
+func pythonExample(request exampleRequest) string {
+	var code strings.Builder
+	code.WriteString("import urllib.request\n\n")
+	if request.body != "" && !strings.Contains(request.body, `"""`) {
+		fmt.Fprintf(&code, "body = r\"\"\"%s\"\"\"\n\n", request.body)
+	} else if request.body != "" {
+		fmt.Fprintf(&code, "body = %s\n\n", strconv.Quote(request.body))
+	}
+	fmt.Fprintf(&code, "request = urllib.request.Request(\n    %q,\n    method=%q,\n", request.url, request.method)
+	if request.body != "" {
+		code.WriteString("    data=body.encode(),\n    headers={\"Content-Type\": \"application/json\"},\n")
+	}
+	code.WriteString(")\nwith urllib.request.urlopen(request) as response:\n    print(response.status, response.read().decode())\n")
+	return code.String()
+}
+
+// Node.js 18+ as an ES module, or a browser console
+func jsExample(request exampleRequest) string {
+	var code strings.Builder
+	fmt.Fprintf(&code, "const response = await fetch(%s, {\n  method: %s,\n", strconv.Quote(request.url), strconv.Quote(request.method))
+	if request.body != "" {
+		body := strings.ReplaceAll(request.body, "\n", "\n  ")
+		code.WriteString("  headers: { \"Content-Type\": \"application/json\" },\n")
+		fmt.Fprintf(&code, "  body: JSON.stringify(%s),\n", body)
+	}
+	code.WriteString("});\nconsole.log(response.status, await response.text());\n")
+	return code.String()
+}
+
+// The URL clients reach this deployment at, as seen through trusted proxies
+func externalBaseURL(r *http.Request) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if isTrustedProxy(peer) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+			host = forwarded
+		}
+	}
+	return scheme + "://" + host + config.BasePath
+}
+
+// GET /docs/examples?lang=curl|go|python|js
+func getExamples(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = "curl"
+	}
+	render, ok := exampleRenderers[lang]
+	if !ok {
+		langs := make([]string, 0, len(exampleRenderers))
+		for name := range exampleRenderers {
+			langs = append(langs, name)
+		}
+		slices.Sort(langs)
+		http.Error(w, "lang must be one of "+strings.Join(langs, ", "), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid examples language", "language", lang)
+		return
+	}
+
+	baseURL := externalBaseURL(r)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"lang":     lang,
+		"baseUrl":  baseURL,
+		"examples": renderExamples(openAPIDocument, baseURL, render),
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/csv"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PointsExportRow struct {
+	Tenant   string
+	UserID   string
+	Earned   int
+	Adjusted int
+	Redeemed int
+	Expired  int
+}
+
+// Totals of each kind of ledger entry per user for the month starting at from
+func pointsExport(entries []LedgerEntry, from time.Time) []PointsExportRow {
+	to := from.AddDate(0, 1, 0)
+
+	byUser := map[string]*PointsExportRow{}
+	row := func(member string) *PointsExportRow {
+		if byUser[member] == nil {
+			tenant, userID := splitLedgerMember(member)
+			byUser[member] = &PointsExportRow{Tenant: tenant, UserID: userID}
+		}
+		return byUser[member]
+	}
+	for _, entry := range entries {
+		if entry.CreatedAt.Before(from) || !entry.CreatedAt.Before(to) {
+			continue
+		}
+		userRow := row(strings.TrimPrefix(entry.Account, "user:"))
+		switch entry.Kind {
+		case entryEarn:
+			userRow.Earned += entry.Amount
+		case entryAdjust, entryMerge:
+			// A merge moves points between users like a pair of adjustments
+			userRow.Adjusted += entry.Amount
+		case entryRedeem:
+			userRow.Redeemed -= entry.Amount
+		case entryExpire:
+			userRow.Expired -= entry.Amount
+		}
+	}
+
+	rows := make([]PointsExportRow, 0, len(byUser))
+	for _, r := range byUser {
+		rows = append(rows, *r)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Tenant != rows[j].Tenant {
+			return rows[i].Tenant < rows[j].Tenant
+		}
+		return rows[i].UserID < rows[j].UserID
+	})
+	return rows
+}
+
+// Stream the monthly points ledger as CSV, flushing as rows are written
+func exportPoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	query := r.URL.Query()
+	period := query.Get("period")
+	from, err := time.Parse("2006-01", period)
+	if err != nil {
+		http.Error(w, "period must be a month in YYYY-MM format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid export period", "period", period)
+		return
+	}
+	if format := query.Get("format"); format != "" && format != "csv" {
+		http.Error(w, "format must be csv", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid export format", "format", format)
+		return
+	}
+
+	rows := pointsExport(ledger.UserEntries(), from)
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="points-`+period+`.csv"`)
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"tenant", "user_id", "period", "earned", "adjusted", "redeemed", "expired", "net"})
+	for i, row := range rows {
+		net := row.Earned + row.Adjusted - row.Redeemed - row.Expired
+		writer.Write([]string{
+			row.Tenant, row.UserID, period,
+			strconv.Itoa(row.Earned), strconv.Itoa(row.Adjusted), strconv.Itoa(row.Redeemed), strconv.Itoa(row.Expired),
+			strconv.Itoa(net),
+		})
+		if i%500 == 499 {
+			writer.Flush()
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		slog.ErrorContext(r.Context(), "Error writing points export", "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Points export", "period", period, "users", len(rows))
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"receipt-processor/receiptpb"
+)
+
+// What happens to a submission while an external rule service can't be reached
+const (
+	externalFallbackSkip   = "skip"   // score it without the rule, with a warning
+	externalFallbackReject = "reject" // answer 503 so the client retries later
+)
+
+// Breakdown entries of external rules use the service's name prefixed with external_
+const externalRulePrefix = "external_"
+
+var externalRuleNamePattern = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+
+var errExternalRuleUnavailable = errors.New("A scoring rule service is unavailable, try again later")
+
+// What an external rule service is sent, as JSON. The receipt doesn't carry its user, and
+// its points and breakdown are those of the built-in rules.
+type ExternalRuleRequest struct {
+	Receipt      Receipt `json:"receipt"`
+	RulesVersion string  `json:"rulesVersion"`
+}
+
+// An external rule service's answer: the bonus points it awards, 0 when its rule doesn't
+// apply, and the breakdown description for them
+type ExternalRuleResult struct {
+	Points      int    `json:"points"`
+	Description string `json:"description"`
+}
+
+// Another team's rule, served over HTTP, or over gRPC when its URL is grpc:// or grpcs://:
+// an EXTERNAL_RULES entry
+type externalRule struct {
+	name    string
+	url     string
+	timeout time.Duration
+	breaker circuitBreaker
+	grpc    receiptpb.ExternalRuleServiceClient // nil for HTTP
+}
+
+// Stops calling a service after EXTERNAL_RULE_BREAKER_FAILURES consecutive failures, so a
+// service that is down doesn't add its timeout to every submission. Once
+// EXTERNAL_RULE_BREAKER_COOLDOWN has passed one call at a time is let through, and the
+// first success closes the breaker again.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < config.ExternalRuleBreakerFailures {
+		return true
+	}
+	if now.Before(b.openUntil) || b.probing {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Let the next call through after an allowed one whose outcome says nothing about the service
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Record the outcome of an allowed call; reports whether it opened the breaker
+func (b *circuitBreaker) record(err error, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		b.failures = 0
+		return false
+	}
+	b.failures++
+	if b.failures < config.ExternalRuleBreakerFailures {
+		return false
+	}
+	b.openUntil = now.Add(config.ExternalRuleBreakerCooldown)
+	return true
+}
+
+var externalRules []*externalRule
+
+var externalRuleClient = &http.Client{}
+
+// Schemes of EXTERNAL_RULES URLs; grpcs connects with TLS
+var externalRuleSchemes = []string{"http", "https", "grpc", "grpcs"}
+
+func startExternalRules() {
+	for _, endpoint := range config.ExternalRules {
+		rule := &externalRule{name: endpoint.name, url: endpoint.url, timeout: endpoint.timeout}
+		if target, err := url.Parse(endpoint.url); err == nil && (target.Scheme == "grpc" || target.Scheme == "grpcs") {
+			credentials := insecure.NewCredentials()
+			if target.Scheme == "grpcs" {
+				credentials = grpccredentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+			}
+			conn, err := grpc.NewClient(target.Host, grpc.WithTransportCredentials(credentials))
+			if err != nil {
+				fatal("Error connecting to external rule", "rule", externalRulePrefix+endpoint.name, "url", endpoint.url, "error", err)
+			}
+			rule.grpc = receiptpb.NewExternalRuleServiceClient(conn)
+		}
+		externalRules = append(externalRules, rule)
+		slog.Info("Scoring with external rule", "rule", externalRulePrefix+endpoint.name, "url", endpoint.url, "timeout", endpoint.timeout)
+	}
+}
+
+func isExternalRule(rule string) bool {
+	return strings.HasPrefix(rule, externalRulePrefix)
+}
+
+// The built-in rules, then the external rules, as they appear in breakdowns
+func scoredRules() []string {
+	rules := slices.Clone(allRules)
+	for _, rule := range externalRules {
+		rules = append(rules, externalRulePrefix+rule.name)
+	}
+	return rules
+}
+
+// Ask every external rule service, all at once, for its bonus and add it to the scored
+// receipt. A service that fails, times out or has its circuit breaker open is handled per
+// EXTERNAL_RULE_FALLBACK: skipped with a warning, or errExternalRuleUnavailable.
+func applyExternalRules(ctx context.Context, receipt *Receipt) error {
+	receipt.Warnings = slices.DeleteFunc(receipt.Warnings, func(w Warning) bool { return w.Code == warningExternalRuleSkipped })
+	if len(externalRules) == 0 {
+		return nil
+	}
+
+	request := ExternalRuleRequest{Receipt: *receipt, RulesVersion: rulesVersion}
+	request.Receipt.UserID, request.Receipt.UserIDHash = "", ""
+	results := make([]ExternalRuleResult, len(externalRules))
+	errs := make([]error, len(externalRules))
+	var wg sync.WaitGroup
+	for i, rule := range externalRules {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = rule.score(ctx, request)
+		}()
+	}
+	wg.Wait()
+
+	for i, rule := range externalRules {
+		if errs[i] != nil {
+			slog.WarnContext(ctx, "External rule unavailable", "rule", externalRulePrefix+rule.name, "fallback", config.ExternalRuleFallback, "error", errs[i])
+			if config.ExternalRuleFallback == externalFallbackReject {
+				return errExternalRuleUnavailable
+			}
+			receipt.Warnings = append(receipt.Warnings, Warning{
+				Code:    warningExternalRuleSkipped,
+				Message: fmt.Sprintf("scoring rule %s was unavailable, so the receipt was scored without it", externalRulePrefix+rule.name),
+			})
+			continue
+		}
+		points := min(results[i].Points, config.ExternalRuleMaxPoints)
+		if points == 0 {
+			continue
+		}
+		description := strings.TrimSpace(results[i].Description)
+		if description == "" {
+			description = rule.name
+		}
+		receipt.Points += points
+		receipt.Breakdown = append(receipt.Breakdown, RuleResult{externalRulePrefix + rule.name, points, fmt.Sprintf("%d points - %s", points, description)})
+	}
+	return nil
+}
+
+func (rule *externalRule) score(ctx context.Context, request ExternalRuleRequest) (ExternalRuleResult, error) {
+	var result ExternalRuleResult
+	if !rule.breaker.allow(time.Now()) {
+		return result, fmt.Errorf("circuit breaker open after %d consecutive failures", config.ExternalRuleBreakerFailures)
+	}
+	err := rule.call(ctx, request, &result)
+	if err != nil && ctx.Err() != nil {
+		// The submission was cancelled or ran out of time, which says nothing about the service
+		rule.breaker.release()
+		return result, err
+	}
+	if rule.breaker.record(err, time.Now()) {
+		slog.WarnContext(ctx, "External rule circuit breaker opened", "rule", externalRulePrefix+rule.name, "failures", config.ExternalRuleBreakerFailures, "cooldown", config.ExternalRuleBreakerCooldown)
+	}
+	return result, err
+}
+
+func (rule *externalRule) call(ctx context.Context, request ExternalRuleRequest, result *ExternalRuleResult) error {
+	ctx, cancel := context.WithTimeout(ctx, rule.timeout)
+	defer cancel()
+	var err error
+	if rule.grpc != nil {
+		err = rule.callGRPC(ctx, request, result)
+	} else {
+		err = rule.callHTTP(ctx, request, result)
+	}
+	if err != nil {
+		return err
+	}
+	if result.Points < 0 {
+		return fmt.Errorf("%s awarded %d points; external rules can only add points", rule.url, result.Points)
+	}
+	return nil
+}
+
+func (rule *externalRule) callHTTP(ctx context.Context, request ExternalRuleRequest, result *ExternalRuleResult) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rule.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if id := requestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	resp, err := externalRuleClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", rule.url, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("decoding response from %s: %w", rule.url, err)
+	}
+	return nil
+}
+
+func (rule *externalRule) callGRPC(ctx context.Context, request ExternalRuleRequest, result *ExternalRuleResult) error {
+	receipt := request.Receipt
+	scored := &receiptpb.ScoreReceiptRequest{
+		Id: receipt.ID,
+		Receipt: &receiptpb.Receipt{
+			Retailer:     receipt.Retailer,
+			PurchaseDate: receipt.PurchaseDate,
+			PurchaseTime: receipt.PurchaseTime,
+			Total:        receipt.Total,
+		},
+		Points:       int64(receipt.Points),
+		RulesVersion: request.RulesVersion,
+		Tenant:       receipt.Tenant,
+	}
+	for _, item := range receipt.Items {
+		scored.Receipt.Items = append(scored.Receipt.Items, &receiptpb.Item{ShortDescription: item.ShortDescription, Price: item.Price})
+	}
+	for _, entry := range receipt.Breakdown {
+		scored.Breakdown = append(scored.Breakdown, &receiptpb.RuleResult{Rule: entry.Rule, Points: int64(entry.Points), Description: entry.Description})
+	}
+	if id := requestID(ctx); id != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-request-id", id)
+	}
+	response, err := rule.grpc.ScoreReceipt(ctx, scored)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rule.url, err)
+	}
+	result.Points, result.Description = int(response.GetPoints()), response.GetDescription()
+	return nil
+}
+
+// Recorded external rule entries, which a re-score can't reproduce since the services
+// aren't asked again, added to a re-score's points and breakdown
+func withExternalResults(points int, breakdown []RuleResult, recorded []RuleResult) (int, []RuleResult) {
+	for _, result := range recorded {
+		if isExternalRule(result.Rule) {
+			points += result.Points
+			breakdown = append(breakdown, result)
+		}
+	}
+	return points, breakdown
+}
+
+func parseExternalFallback(value string, errs *[]error) string {
+	if value != externalFallbackSkip && value != externalFallbackReject {
+		*errs = append(*errs, fmt.Errorf("EXTERNAL_RULE_FALLBACK must be %q or %q, got %q", externalFallbackSkip, externalFallbackReject, value))
+	}
+	return value
+}
+
+func validateExternalRulesConfig(cfg Config) []error {
+	var errs []error
+	for _, rule := range cfg.ExternalRules {
+		if !externalRuleNamePattern.MatchString(rule.name) {
+			errs = append(errs, fmt.Errorf("EXTERNAL_RULES name %q must be up to 32 lowercase letters, digits and underscores", rule.name))
+		}
+	}
+	if cfg.ExternalRuleMaxPoints < 1 {
+		errs = append(errs, fmt.Errorf("EXTERNAL_RULE_MAX_POINTS must be at least 1, got %d", cfg.ExternalRuleMaxPoints))
+	}
+	if cfg.ExternalRuleBreakerFailures < 1 {
+		errs = append(errs, fmt.Errorf("EXTERNAL_RULE_BREAKER_FAILURES must be at least 1, got %d", cfg.ExternalRuleBreakerFailures))
+	}
+	if cfg.ExternalRuleBreakerCooldown <= 0 {
+		errs = append(errs, errors.New("EXTERNAL_RULE_BREAKER_COOLDOWN must be positive"))
+	}
+	return errs
+}
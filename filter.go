@@ -0,0 +1,355 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A parsed filter expression such as
+//
+//	total >= 100 AND (warning = total_mismatch OR quality < 60) AND received >= -7d
+//
+// Conditions compare a receipt field with a value using = != > >= < <= or ~ (contains),
+// and combine with AND, OR, NOT and parentheses.
+type Filter interface {
+	Match(receipt Receipt, now time.Time) bool
+}
+
+type andFilter []Filter
+type orFilter []Filter
+type notFilter struct{ Filter }
+
+func (f andFilter) Match(receipt Receipt, now time.Time) bool {
+	for _, filter := range f {
+		if !filter.Match(receipt, now) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f orFilter) Match(receipt Receipt, now time.Time) bool {
+	for _, filter := range f {
+		if filter.Match(receipt, now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f notFilter) Match(receipt Receipt, now time.Time) bool {
+	return !f.Filter.Match(receipt, now)
+}
+
+// Fields usable in conditions and how they compare
+var filterFields = map[string]string{
+	"points":   "number",
+	"total":    "amount",
+	"quality":  "number",
+	"warnings": "number",
+	"items":    "number",
+	"received": "time",
+	"retailer": "text",
+	"userId":   "text",
+	"tenant":   "text",
+	"status":   "text",
+	"warning":  "set",
+	"item":     "set",
+	"rule":     "set",
+}
+
+type condition struct {
+	field    string
+	operator string
+	value    string
+	number   float64
+	cents    int64
+	duration time.Duration
+	at       time.Time
+}
+
+func (c condition) Match(receipt Receipt, now time.Time) bool {
+	switch c.field {
+	case "points":
+		return compareNumbers(float64(receipt.Points), c.operator, c.number)
+	case "total":
+		cents, _ := parseCents(receipt.Total)
+		return compareNumbers(float64(cents), c.operator, float64(c.cents))
+	case "quality":
+		return compareNumbers(float64(receipt.Quality.Score), c.operator, c.number)
+	case "warnings":
+		return compareNumbers(float64(len(receipt.Warnings)), c.operator, c.number)
+	case "items":
+		return compareNumbers(float64(len(receipt.Items)), c.operator, c.number)
+	case "received":
+		at := c.at
+		if at.IsZero() {
+			at = now.Add(c.duration)
+		}
+		return compareNumbers(float64(receipt.ReceivedAt.Sub(at)), c.operator, 0)
+	case "retailer":
+		return compareText(receipt.Retailer, c.operator, c.value)
+	case "userId":
+		return compareText(receipt.UserID, c.operator, c.value)
+	case "tenant":
+		return compareText(receipt.Tenant, c.operator, c.value)
+	case "status":
+		return compareText(receiptStatus(receipt), c.operator, c.value)
+	}
+
+	// Set fields match if any member does; != matches if none do
+	var members []string
+	switch c.field {
+	case "warning":
+		for _, warning := range receipt.Warnings {
+			members = append(members, warning.Code)
+		}
+	case "item":
+		for _, item := range receipt.Items {
+			members = append(members, strings.TrimSpace(item.ShortDescription))
+		}
+	case "rule":
+		for _, result := range receipt.Breakdown {
+			members = append(members, result.Rule)
+		}
+	}
+	operator := c.operator
+	if operator == "!=" {
+		operator = "="
+	}
+	for _, member := range members {
+		if compareText(member, operator, c.value) {
+			return c.operator != "!="
+		}
+	}
+	return c.operator == "!="
+}
+
+func compareNumbers(a float64, operator string, b float64) bool {
+	switch operator {
+	case "=":
+		return a == b
+	case "!=":
+		return a != b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return false
+}
+
+func compareText(a, operator, b string) bool {
+	switch operator {
+	case "=":
+		return strings.EqualFold(a, b)
+	case "!=":
+		return !strings.EqualFold(a, b)
+	case "~":
+		return strings.Contains(strings.ToLower(a), strings.ToLower(b))
+	}
+	return false
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseFilter(expression string) (Filter, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("filter is empty")
+	}
+	p := &filterParser{tokens: tokens}
+	filter, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return filter, nil
+}
+
+// Split into words, operators, parentheses and "quoted strings"
+func tokenizeFilter(expression string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		switch r := runes[i]; {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == '~':
+			tokens = append(tokens, string(r))
+			i++
+		case strings.ContainsRune("=!<>", r):
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, string(runes[i:i+2]))
+				i += 2
+			} else if r == '!' {
+				return nil, errors.New("'!' must be followed by '='")
+			} else {
+				tokens = append(tokens, string(r))
+				i++
+			}
+		case r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("unterminated quoted string")
+			}
+			tokens = append(tokens, string(runes[i:end+1]))
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()~=!<>\"", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, string(runes[i:end]))
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *filterParser) or() (Filter, error) {
+	var filters orFilter
+	for {
+		filter, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+		if !strings.EqualFold(p.peek(), "OR") {
+			break
+		}
+		p.next()
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return filters, nil
+}
+
+func (p *filterParser) and() (Filter, error) {
+	var filters andFilter
+	for {
+		filter, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, filter)
+		if !strings.EqualFold(p.peek(), "AND") {
+			break
+		}
+		p.next()
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return filters, nil
+}
+
+func (p *filterParser) unary() (Filter, error) {
+	switch token := p.peek(); {
+	case strings.EqualFold(token, "NOT"):
+		p.next()
+		filter, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{filter}, nil
+	case token == "(":
+		p.next()
+		filter, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing ')'")
+		}
+		return filter, nil
+	}
+	return p.condition()
+}
+
+func (p *filterParser) condition() (Filter, error) {
+	field, operator, value := p.next(), p.next(), p.next()
+	if field == "" {
+		return nil, errors.New("expected a condition")
+	}
+	kind, ok := filterFields[field]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", field)
+	}
+	if value == "" || value == "(" || value == ")" {
+		return nil, fmt.Errorf("%s %s is missing a value", field, operator)
+	}
+	value = strings.Trim(value, `"`)
+	c := condition{field: field, operator: operator, value: value}
+
+	operators := map[string]bool{"=": true, "!=": true, "~": true}
+	if kind == "number" || kind == "amount" || kind == "time" {
+		operators = map[string]bool{"=": true, "!=": true, ">": true, ">=": true, "<": true, "<=": true}
+	}
+	if !operators[operator] {
+		return nil, fmt.Errorf("%s does not support %q", field, operator)
+	}
+
+	var err error
+	switch kind {
+	case "number":
+		if c.number, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, fmt.Errorf("%s must be compared with a number, got %q", field, value)
+		}
+	case "amount":
+		if !strings.Contains(value, ".") {
+			value += ".00"
+		}
+		var ok bool
+		if c.cents, ok = parseCents(value); !ok {
+			return nil, fmt.Errorf("%s must be compared with an amount, got %q", field, c.value)
+		}
+	case "time":
+		// Relative durations like -7d or -12h, or an RFC 3339 timestamp
+		if days, found := strings.CutSuffix(value, "d"); found {
+			n, convErr := strconv.Atoi(days)
+			if convErr != nil {
+				return nil, fmt.Errorf("%s must be compared with a duration or timestamp, got %q", field, value)
+			}
+			c.duration = time.Duration(n) * 24 * time.Hour
+		} else if c.duration, err = time.ParseDuration(value); err != nil {
+			if c.at, err = time.Parse(time.RFC3339, value); err != nil {
+				return nil, fmt.Errorf("%s must be compared with a duration or timestamp, got %q", field, value)
+			}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Behaviors that can be rolled out gradually
+const (
+	flagLenientValidation = "lenient_validation"
+)
+
+var knownFlags = map[string]string{
+	flagLenientValidation: "Normalize partner price and time formats before validation instead of rejecting them",
+}
+
+// A flag is on for everyone when enabled, otherwise for the listed tenants
+// and a stable percentage of everyone else
+type Flag struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Enabled     bool     `json:"enabled"`
+	Percentage  int      `json:"percentage"`
+	Tenants     []string `json:"tenants,omitempty"`
+}
+
+// Who a flag is evaluated for; Key buckets percentage rollouts when there is no tenant
+type FeatureSubject struct {
+	Tenant string
+	Key    string
+}
+
+var flags = map[string]Flag{}
+var flagsMutex = &sync.RWMutex{}
+
+// Seed flags from FEATURE_FLAGS; VALIDATION_MODE=lenient keeps turning lenient validation on for everyone
+func initFlags(cfg Config) {
+	flagsMutex.Lock()
+	defer flagsMutex.Unlock()
+
+	for name, description := range knownFlags {
+		flag := cfg.FeatureFlags[name]
+		flag.Name, flag.Description = name, description
+		flags[name] = flag
+	}
+	if cfg.ValidationMode == validationLenient {
+		flag := flags[flagLenientValidation]
+		flag.Enabled = true
+		flags[flagLenientValidation] = flag
+	}
+}
+
+func featureEnabled(name string, subject FeatureSubject) bool {
+	flagsMutex.RLock()
+	flag, ok := flags[name]
+	flagsMutex.RUnlock()
+	if !ok {
+		return false
+	}
+	if flag.Enabled {
+		return true
+	}
+	for _, tenant := range flag.Tenants {
+		if subject.Tenant != "" && tenant == subject.Tenant {
+			return true
+		}
+	}
+	if flag.Percentage <= 0 {
+		return false
+	}
+
+	key := subject.Tenant
+	if key == "" {
+		key = subject.Key
+	}
+	// Hash with the flag name so different flags roll out to different subjects
+	hash := fnv.New32a()
+	hash.Write([]byte(name + ":" + key))
+	return int(hash.Sum32()%100) < flag.Percentage
+}
+
+func requestSubject(r *http.Request) FeatureSubject {
+	return FeatureSubject{Tenant: r.Header.Get("X-Tenant-ID"), Key: clientIP(r)}
+}
+
+// Parse FEATURE_FLAGS entries such as "name=on", "name=25%" or "name=tenants:acme|globex"
+func getEnvFlags(key string, errs *[]error) map[string]Flag {
+	parsed := map[string]Flag{}
+	for _, entry := range strings.Split(getEnv(key, ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(entry, "=")
+		if _, ok := knownFlags[name]; !ok {
+			*errs = append(*errs, fmt.Errorf("%s contains unknown flag %q", key, name))
+			continue
+		}
+
+		flag := parsed[name]
+		switch {
+		case value == "on" || value == "off":
+			flag.Enabled = value == "on"
+		case strings.HasSuffix(value, "%"):
+			percentage, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil || percentage < 0 || percentage > 100 {
+				*errs = append(*errs, fmt.Errorf("%s flag %q must have a percentage between 0%% and 100%%, got %q", key, name, value))
+				continue
+			}
+			flag.Percentage = percentage
+		case strings.HasPrefix(value, "tenants:"):
+			flag.Tenants = append(flag.Tenants, strings.Split(strings.TrimPrefix(value, "tenants:"), "|")...)
+		default:
+			*errs = append(*errs, fmt.Errorf("%s flag %q must be on, off, a percentage or tenants:<a|b>, got %q", key, name, value))
+			continue
+		}
+		parsed[name] = flag
+	}
+	return parsed
+}
+
+func listFlags() []Flag {
+	flagsMutex.RLock()
+	defer flagsMutex.RUnlock()
+
+	list := make([]Flag, 0, len(flags))
+	for _, flag := range flags {
+		list = append(list, flag)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func handleFlags(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		writeJSON(w, http.StatusOK, listFlags())
+	case r.Method == http.MethodPut && name != "":
+		description, ok := knownFlags[name]
+		if !ok {
+			http.Error(w, "Unknown feature flag", http.StatusNotFound)
+			slog.WarnContext(r.Context(), "Unknown feature flag", "flag", name)
+			return
+		}
+
+		var flag Flag
+		if err := json.NewDecoder(r.Body).Decode(&flag); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Error decoding feature flag request", "error", err)
+			return
+		}
+		if flag.Percentage < 0 || flag.Percentage > 100 {
+			http.Error(w, "percentage must be between 0 and 100", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid feature flag percentage", "percentage", flag.Percentage)
+			return
+		}
+		flag.Name, flag.Description = name, description
+
+		flagsMutex.Lock()
+		flags[name] = flag
+		flagsMutex.Unlock()
+
+		slog.InfoContext(r.Context(), "Feature flag set", "flag", name, "enabled", flag.Enabled, "percentage", flag.Percentage, "tenants", flag.Tenants)
+		writeJSON(w, http.StatusOK, flag)
+	default:
+		http.Error(w, "Only GET /admin/flags and PUT /admin/flags/{name} are allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid feature flag request", "method", r.Method, "path", r.URL.Path)
+	}
+}
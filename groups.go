@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var errGroupNotFound = errors.New("group not found")
+var errMembershipConflict = errors.New("user is already a member of another group")
+
+// A household or other group of a tenant's users whose points are pooled for its balance
+// and the tenant's group leaderboard. Members keep their own balances and ledger accounts;
+// a user belongs to at most one group.
+type Group struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Name      string    `json:"name"`
+	Members   []string  `json:"members"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type GroupMember struct {
+	UserID  string `json:"userId"`
+	Balance int    `json:"balance"`
+}
+
+type GroupBalance struct {
+	ID      string        `json:"id"`
+	Name    string        `json:"name"`
+	Balance int           `json:"balance"`
+	Members []GroupMember `json:"members"`
+}
+
+type GroupStanding struct {
+	Rank    int    `json:"rank"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Members int    `json:"members"`
+	Balance int    `json:"balance"`
+}
+
+func (l *Ledger) CreateGroup(tenant, name string) Group {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	group := &Group{ID: uuid.NewString(), Tenant: tenant, Name: name, Members: []string{}, CreatedAt: time.Now().UTC()}
+	l.groups[group.ID] = group
+	l.dirty = true
+	return *group
+}
+
+// The tenant's group with the ID; groups of other tenants aren't found
+func (l *Ledger) groupLocked(tenant, groupID string) (*Group, bool) {
+	group, found := l.groups[groupID]
+	if !found || group.Tenant != tenant {
+		return nil, false
+	}
+	return group, true
+}
+
+// Remove a group; its members' balances are unaffected
+func (l *Ledger) DeleteGroup(tenant, groupID string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	group, found := l.groupLocked(tenant, groupID)
+	if !found {
+		return errGroupNotFound
+	}
+	for _, userID := range group.Members {
+		delete(l.memberships, ledgerMember(group.Tenant, userID))
+	}
+	delete(l.groups, groupID)
+	l.dirty = true
+	return nil
+}
+
+// Add a user to a group; a user merged into another joins as the user it was merged into.
+// Adding a member again changes nothing.
+func (l *Ledger) AddMember(tenant, groupID, userID string) (Group, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	group, found := l.groupLocked(tenant, groupID)
+	if !found {
+		return Group{}, errGroupNotFound
+	}
+	member := l.resolveLocked(ledgerMember(tenant, userID))
+	if current, found := l.memberships[member]; found && current != groupID {
+		return Group{}, fmt.Errorf("%w: %s is in group %s", errMembershipConflict, userID, current)
+	}
+	l.joinLocked(group, member)
+	return l.copyGroupLocked(group), nil
+}
+
+func (l *Ledger) RemoveMember(tenant, groupID, userID string) (Group, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	group, found := l.groupLocked(tenant, groupID)
+	if !found {
+		return Group{}, errGroupNotFound
+	}
+	l.leaveLocked(group, l.resolveLocked(ledgerMember(tenant, userID)))
+	return l.copyGroupLocked(group), nil
+}
+
+// Groups list their members by user ID, as they are all of the group's tenant
+func (l *Ledger) joinLocked(group *Group, member string) {
+	_, userID := splitLedgerMember(member)
+	if index, found := slices.BinarySearch(group.Members, userID); !found {
+		group.Members = slices.Insert(group.Members, index, userID)
+		l.memberships[member] = group.ID
+		l.dirty = true
+	}
+}
+
+func (l *Ledger) leaveLocked(group *Group, member string) {
+	_, userID := splitLedgerMember(member)
+	if index, found := slices.BinarySearch(group.Members, userID); found {
+		group.Members = slices.Delete(group.Members, index, index+1)
+		delete(l.memberships, member)
+		l.dirty = true
+	}
+}
+
+// A merged user's membership passes to the user it was merged into, unless that user is
+// in a group of its own, so the merged points are only ever pooled once
+func (l *Ledger) mergeMembershipLocked(from, into string) {
+	groupID, member := l.memberships[from]
+	if !member {
+		return
+	}
+	group := l.groups[groupID]
+	l.leaveLocked(group, from)
+	if _, intoMember := l.memberships[into]; !intoMember {
+		l.joinLocked(group, into)
+	}
+}
+
+func (l *Ledger) copyGroupLocked(group *Group) Group {
+	copied := *group
+	copied.Members = slices.Clone(group.Members)
+	return copied
+}
+
+// The ID of the group a user's points are pooled in, if any
+func (l *Ledger) GroupOf(tenant, userID string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	groupID, member := l.memberships[l.resolveLocked(ledgerMember(tenant, userID))]
+	return groupID, member
+}
+
+// A group's pooled balance: the sum of its members' balances, members richest first
+func (l *Ledger) GroupBalance(tenant, groupID string) (GroupBalance, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	group, found := l.groupLocked(tenant, groupID)
+	if !found {
+		return GroupBalance{}, errGroupNotFound
+	}
+	return l.groupBalanceLocked(group), nil
+}
+
+func (l *Ledger) groupBalanceLocked(group *Group) GroupBalance {
+	balance := GroupBalance{ID: group.ID, Name: group.Name, Members: make([]GroupMember, 0, len(group.Members))}
+	for _, userID := range group.Members {
+		points := l.balanceLocked(userAccount(ledgerMember(group.Tenant, userID)))
+		balance.Balance += points
+		balance.Members = append(balance.Members, GroupMember{UserID: userID, Balance: points})
+	}
+	slices.SortStableFunc(balance.Members, func(a, b GroupMember) int { return b.Balance - a.Balance })
+	return balance
+}
+
+// The tenant's groups ranked by pooled balance, ties broken by name, then ID
+func (l *Ledger) GroupLeaderboard(tenant string) []GroupStanding {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	standings := []GroupStanding{}
+	for _, group := range l.groups {
+		if group.Tenant != tenant {
+			continue
+		}
+		balance := l.groupBalanceLocked(group)
+		standings = append(standings, GroupStanding{ID: group.ID, Name: group.Name, Members: len(group.Members), Balance: balance.Balance})
+	}
+	slices.SortFunc(standings, func(a, b GroupStanding) int {
+		if a.Balance != b.Balance {
+			return b.Balance - a.Balance
+		}
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	for i := range standings {
+		standings[i].Rank = i + 1
+	}
+	return standings
+}
+
+// POST /admin/groups with {"name": "..."}
+func createGroup(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error decoding group", "error", err)
+		return
+	}
+	request.Name = strings.TrimSpace(request.Name)
+	if request.Name == "" || len(request.Name) > 100 {
+		http.Error(w, "name must be between 1 and 100 characters", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid group name", "name", request.Name)
+		return
+	}
+
+	group := ledger.CreateGroup(r.Header.Get("X-Tenant-ID"), request.Name)
+	slog.InfoContext(r.Context(), "Created group", "group_id", group.ID, "name", group.Name)
+	writeJSON(w, http.StatusCreated, group)
+}
+
+// DELETE /admin/groups/{id}
+func deleteGroup(w http.ResponseWriter, r *http.Request, groupID string) {
+	if err := ledger.DeleteGroup(r.Header.Get("X-Tenant-ID"), groupID); err != nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Group not found", "group_id", groupID)
+		return
+	}
+	slog.InfoContext(r.Context(), "Deleted group", "group_id", groupID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PUT and DELETE /admin/groups/{id}/members/{userId}
+func handleGroupMember(w http.ResponseWriter, r *http.Request) {
+	groupID, userID := r.PathValue("id"), r.PathValue("userId")
+	update := ledger.AddMember
+	if r.Method == http.MethodDelete {
+		update = ledger.RemoveMember
+	}
+	group, err := update(r.Header.Get("X-Tenant-ID"), groupID, userID)
+	if errors.Is(err, errGroupNotFound) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Group not found", "group_id", groupID)
+		return
+	}
+	if errors.Is(err, errMembershipConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		slog.WarnContext(r.Context(), "Rejected group membership", "group_id", groupID, "user_id", userID, "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Updated group membership", "group_id", groupID, "user_id", userID, "method", r.Method, "members", len(group.Members))
+	writeJSON(w, http.StatusOK, group)
+}
+
+// GET /v1/groups/{id}: a group of the tenant, which lists its members' user IDs and
+// balances, so only members (by JWT subject) and admins may read it
+func getGroupBalance(w http.ResponseWriter, r *http.Request, groupID string) {
+	tenant := r.Header.Get("X-Tenant-ID")
+	if !isAdmin(r) {
+		subject := authSubject(r.Context())
+		if subject == "" {
+			http.Error(w, "A JWT for a member of the group, or the admin token, is required", http.StatusUnauthorized)
+			slog.WarnContext(r.Context(), "Rejected group request without a user", "group_id", groupID)
+			return
+		}
+		if current, member := ledger.GroupOf(tenant, subject); !member || current != groupID {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			slog.WarnContext(r.Context(), "Rejected group request from a non-member", "group_id", groupID)
+			return
+		}
+	}
+	balance, err := ledger.GroupBalance(tenant, groupID)
+	if err != nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Group not found", "group_id", groupID)
+		return
+	}
+	writeJSON(w, http.StatusOK, balance)
+}
+
+// GET /v1/groups/leaderboard?limit=&offset=: the tenant's groups, without their members
+func getGroupLeaderboard(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePagination(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid pagination", "error", err)
+		return
+	}
+
+	standings := ledger.GroupLeaderboard(r.Header.Get("X-Tenant-ID"))
+	total := len(standings)
+	standings = standings[min(offset, total):]
+	if limit > 0 && limit < len(standings) {
+		standings = standings[:limit]
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total": total, "groups": standings})
+}
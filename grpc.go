@@ -0,0 +1,176 @@
+package main
+
+//go:generate protoc -I receiptpb --go_out=receiptpb --go_opt=paths=source_relative --go-grpc_out=receiptpb --go-grpc_opt=paths=source_relative receipts.proto
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"receipt-processor/receiptpb"
+)
+
+// Metadata passed on to the HTTP handlers as request headers
+var grpcForwardedMetadata = []string{
+	"authorization",
+	"x-tenant-id",
+	"idempotency-key",
+	"x-submission-channel",
+	"x-client-version",
+	"user-agent",
+	"x-request-id",
+}
+
+// Gives gRPC clients the HTTP API: each call is made as the equivalent HTTP request to the
+// router, so it goes through the same authentication, tenants, rate limits, validation,
+// scoring and storage, and counts towards the same metrics
+type receiptService struct {
+	receiptpb.UnimplementedReceiptServiceServer
+	router http.Handler
+}
+
+// Serve the gRPC API on GRPC_ADDR, if set
+func startGRPC(router http.Handler) (*grpc.Server, error) {
+	if config.GRPCAddr == "" {
+		return nil, nil
+	}
+	listener, err := net.Listen("tcp", config.GRPCAddr)
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer()
+	receiptpb.RegisterReceiptServiceServer(server, &receiptService{router: router})
+	go func() {
+		slog.Info("gRPC server running", "addr", listener.Addr().String())
+		if err := server.Serve(listener); err != nil {
+			fatal("gRPC server failed", "error", err)
+		}
+	}()
+	return server, nil
+}
+
+func (s *receiptService) ProcessReceipt(ctx context.Context, req *receiptpb.ProcessReceiptRequest) (*receiptpb.ProcessReceiptResponse, error) {
+	if req.GetReceipt() == nil {
+		return nil, status.Error(codes.InvalidArgument, "receipt is required")
+	}
+	// With every field, so missing ones fail validation as empty rather than as null
+	body, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(req.GetReceipt())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "encoding receipt: %v", err)
+	}
+	var processed processResponse
+	if err := s.call(ctx, http.MethodPost, apiVersion+"/receipts/process", body, &processed); err != nil {
+		return nil, err
+	}
+	response := &receiptpb.ProcessReceiptResponse{Id: processed.ID}
+	for _, warning := range processed.Warnings {
+		response.Warnings = append(response.Warnings, &receiptpb.Warning{Code: warning.Code, Field: warning.Field, Message: warning.Message})
+	}
+	return response, nil
+}
+
+func (s *receiptService) GetPoints(ctx context.Context, req *receiptpb.GetPointsRequest) (*receiptpb.GetPointsResponse, error) {
+	var points struct {
+		Points int `json:"points"`
+	}
+	if err := s.call(ctx, http.MethodGet, receiptPath(req.GetId(), "/points"), nil, &points); err != nil {
+		return nil, err
+	}
+	return &receiptpb.GetPointsResponse{Points: int64(points.Points)}, nil
+}
+
+// From the stored receipt, as /breakdown only describes each rule result
+func (s *receiptService) GetBreakdown(ctx context.Context, req *receiptpb.GetBreakdownRequest) (*receiptpb.GetBreakdownResponse, error) {
+	var receipt Receipt
+	if err := s.call(ctx, http.MethodGet, receiptPath(req.GetId(), ""), nil, &receipt); err != nil {
+		return nil, err
+	}
+	if receiptStatus(receipt) == statusNeedsEnrichment {
+		return nil, status.Error(codes.FailedPrecondition, "Receipt is awaiting enrichment; finalize it before requesting its breakdown")
+	}
+	response := &receiptpb.GetBreakdownResponse{Points: int64(receipt.Points)}
+	for _, result := range receipt.Breakdown {
+		response.Breakdown = append(response.Breakdown, &receiptpb.RuleResult{Rule: result.Rule, Points: int64(result.Points), Description: result.Description})
+	}
+	return response, nil
+}
+
+func receiptPath(id, suffix string) string {
+	return apiVersion + "/receipts/" + (&url.URL{Path: id}).EscapedPath() + suffix
+}
+
+// Make the HTTP request for a call and decode its JSON response into v, or return the
+// gRPC status for the HTTP error it was answered with
+func (s *receiptService) call(ctx context.Context, method, path string, body []byte, v any) error {
+	request, err := http.NewRequestWithContext(ctx, method, config.BasePath+path, bytes.NewReader(body))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, key := range grpcForwardedMetadata {
+		for _, value := range md.Get(key) {
+			request.Header.Add(key, value)
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		request.RemoteAddr = p.Addr.String()
+	}
+
+	recorder := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	s.router.ServeHTTP(recorder, request)
+	if id := recorder.header.Get("X-Request-ID"); id != "" {
+		grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	}
+	if recorder.status >= http.StatusBadRequest {
+		return status.Error(grpcCode(recorder.status), strings.TrimSpace(recorder.body.String()))
+	}
+	if err := json.Unmarshal(recorder.body.Bytes(), v); err != nil {
+		slog.ErrorContext(ctx, "Error decoding response for gRPC call", "path", path, "status", recorder.status, "error", err)
+		return status.Error(codes.Internal, fmt.Sprintf("unexpected %d response", recorder.status))
+	}
+	return nil
+}
+
+// The gRPC code closest to an HTTP error status
+func grpcCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict, http.StatusUpgradeRequired:
+		return codes.FailedPrecondition
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	}
+	if httpStatus >= http.StatusInternalServerError {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
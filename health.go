@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var startedAt = time.Now().UTC()
+
+// Looked up to check the storage backend answers; never stored
+const healthCheckID = "healthcheck-probe"
+
+type StorageHealth struct {
+	Backend   string `json:"backend"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+type HealthReport struct {
+	// ok, warming while startup warmup runs, or unavailable when the storage backend
+	// can't be reached
+	Status        string        `json:"status"`
+	Version       string        `json:"version"`
+	StartedAt     time.Time     `json:"startedAt"`
+	Uptime        string        `json:"uptime"`
+	UptimeSeconds int64         `json:"uptimeSeconds"`
+	Maintenance   bool          `json:"maintenance"`
+	Storage       StorageHealth `json:"storage"`
+	Warmup        *WarmupStatus `json:"warmup,omitempty"`
+}
+
+// Check the storage backend with a lookup through the whole store stack, bounded by
+// HEALTH_CHECK_TIMEOUT so a hung database fails the check instead of the probe timing out
+func checkStorage(ctx context.Context) StorageHealth {
+	ctx, cancel := context.WithTimeout(ctx, config.HealthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err := store.Get(ctx, healthCheckID)
+	health := StorageHealth{Backend: config.StorageBackend, OK: err == nil, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			health.Error = "no response within " + config.HealthCheckTimeout.String()
+		} else {
+			health.Error = err.Error()
+		}
+	}
+	return health
+}
+
+func healthReport(ctx context.Context) HealthReport {
+	uptime := time.Since(startedAt)
+	report := HealthReport{
+		Status:        "ok",
+		Version:       buildInfo().Version,
+		StartedAt:     startedAt,
+		Uptime:        uptime.Truncate(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+		Maintenance:   currentMaintenance().Enabled,
+		Storage:       checkStorage(ctx),
+		Warmup:        currentWarmup(),
+	}
+	switch {
+	case !report.Storage.OK:
+		report.Status = "unavailable"
+	case report.Warmup != nil && !report.Warmup.Done:
+		report.Status = "warming"
+	}
+	return report
+}
+
+// GET /healthz: 503 while the storage backend can't be reached
+func getHealth(w http.ResponseWriter, r *http.Request) {
+	serveHealth(w, r, false)
+}
+
+// GET /readyz: like /healthz, and also 503 until startup warmup has finished, so load
+// balancers and readiness probes only send traffic to instances ready for it
+func getReadiness(w http.ResponseWriter, r *http.Request) {
+	serveHealth(w, r, true)
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request, readiness bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	report := healthReport(r.Context())
+	status := http.StatusOK
+	if !report.Storage.OK {
+		status = http.StatusServiceUnavailable
+		slog.ErrorContext(r.Context(), "Health check failed", "backend", report.Storage.Backend, "error", report.Storage.Error)
+	} else if readiness && report.Status == "warming" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, report)
+}
+
+// GET /livez: the process is up and serving, whatever the state of its dependencies,
+// so a storage outage doesn't get every instance restarted
+func getLiveness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	uptime := time.Since(startedAt)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "ok",
+		"uptime":        uptime.Truncate(time.Second).String(),
+		"uptimeSeconds": int64(uptime.Seconds()),
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+)
+
+type HeatmapCell struct {
+	Weekday       string  `json:"weekday"`
+	Hour          int     `json:"hour"`
+	Receipts      int     `json:"receipts"`
+	AveragePoints float64 `json:"averagePoints"`
+}
+
+// Receipt counts and average points by weekday and hour of purchase, Monday first
+func (c *receiptCounters) Heatmap() []HeatmapCell {
+	cells := make([]HeatmapCell, 0, 7*24)
+	for i := 0; i < 7; i++ {
+		weekday := time.Weekday((i + 1) % 7)
+		for hour := 0; hour < 24; hour++ {
+			counters := &c.heatmap[weekday][hour]
+			cell := HeatmapCell{Weekday: weekday.String(), Hour: hour, Receipts: int(counters.receipts.Load())}
+			if cell.Receipts > 0 {
+				cell.AveragePoints = math.Round(float64(counters.points.Load())/float64(cell.Receipts)*100) / 100
+			}
+			cells = append(cells, cell)
+		}
+	}
+	return cells
+}
+
+func getHeatmap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"cells": counters.tenant(r.Header.Get("X-Tenant-ID")).Heatmap()})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How long an Idempotency-Key is remembered after the request that used it
+const idempotencyTTL = 24 * time.Hour
+
+// Recent replays and collisions kept for the audit endpoint
+const idempotencyAuditSize = 200
+
+// Clients kept in the audit; a new one past that replaces the one seen longest ago, and
+// clients are dropped idempotencyTTL after they were last seen
+const idempotencyAuditClients = 1000
+
+// Idempotency audit event kinds
+const (
+	idempotencyReplay     = "replay"
+	idempotencyInProgress = "in_progress"
+	idempotencyCollision  = "collision"
+)
+
+type idempotencyRecord struct {
+	key      string
+	bodyHash [32]byte
+	id       string
+	status   int
+	// The encoded response; nil while the first request is still being handled
+	response  []byte
+	createdAt time.Time
+}
+
+type IdempotencyEvent struct {
+	Kind   string    `json:"kind"`
+	Key    string    `json:"key"`
+	Client string    `json:"client"`
+	ID     string    `json:"id,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+type IdempotencyClientStats struct {
+	Client     string `json:"client"`
+	Replays    int    `json:"replays"`
+	Collisions int    `json:"collisions"`
+	lastSeen   time.Time
+}
+
+var idempotencyRecords = make(map[string]*idempotencyRecord)
+var idempotencyEvents []IdempotencyEvent
+var idempotencyClients = make(map[string]*IdempotencyClientStats)
+
+// Replays of every client, including those since dropped from idempotencyClients
+var idempotencyReplays int
+var idempotencyMutex = &sync.Mutex{}
+
+// Identify the integration behind a request for auditing
+func idempotencyClient(r *http.Request) string {
+	if userAgent := r.UserAgent(); userAgent != "" {
+		return userAgent + " (" + clientIP(r) + ")"
+	}
+	return clientIP(r)
+}
+
+// Keys are scoped to the endpoint and tenant, so the same key sent by different
+// tenants, or to different endpoints, never returns someone else's receipt
+func idempotencyScope(r *http.Request, key string) string {
+	return r.URL.Path + "\x00" + r.Header.Get("X-Tenant-ID") + "\x00" + key
+}
+
+// Reserve a key for this request, or answer for it: a retry of a request already handled
+// gets the original response, a retry while it is still being handled 409 Conflict, and a
+// different body under the same key 422. Reports whether the request should go ahead.
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request, scope, key string, body []byte) bool {
+	hash := sha256.Sum256(body)
+	idempotencyMutex.Lock()
+	defer idempotencyMutex.Unlock()
+
+	record, found := idempotencyRecords[scope]
+	if !found || time.Since(record.createdAt) > idempotencyTTL {
+		idempotencyRecords[scope] = &idempotencyRecord{key: key, bodyHash: hash, createdAt: time.Now()}
+		return true
+	}
+
+	kind := idempotencyReplay
+	switch {
+	case record.bodyHash != hash:
+		kind = idempotencyCollision
+		http.Error(w, "Idempotency-Key was already used with a different request body", http.StatusUnprocessableEntity)
+	case record.response == nil:
+		kind = idempotencyInProgress
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(record.status)
+		w.Write(record.response)
+	}
+
+	client := idempotencyClient(r)
+	idempotencyEvents = append(idempotencyEvents, IdempotencyEvent{Kind: kind, Key: key, Client: client, ID: record.id, At: time.Now().UTC()})
+	if len(idempotencyEvents) > idempotencyAuditSize {
+		idempotencyEvents = idempotencyEvents[len(idempotencyEvents)-idempotencyAuditSize:]
+	}
+	stats := idempotencyClients[client]
+	if stats == nil {
+		if len(idempotencyClients) >= idempotencyAuditClients {
+			dropIdleIdempotencyClient()
+		}
+		stats = &IdempotencyClientStats{Client: client}
+		idempotencyClients[client] = stats
+	}
+	stats.lastSeen = time.Now()
+	if kind == idempotencyCollision {
+		stats.Collisions++
+	} else {
+		stats.Replays++
+		idempotencyReplays++
+	}
+
+	slog.InfoContext(r.Context(), "Idempotency-Key", "key", key, "outcome", kind, "client", client)
+	return false
+}
+
+// Record the response to a request that claimed a key, for its retries
+func finishIdempotencyKey(scope, id string, status int, response interface{}) {
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		slog.Error("Error encoding response for Idempotency-Key", "error", err)
+		releaseIdempotencyKey(scope)
+		return
+	}
+	idempotencyMutex.Lock()
+	if record, found := idempotencyRecords[scope]; found {
+		record.id, record.status, record.response = id, status, append(encoded, '\n')
+	}
+	idempotencyMutex.Unlock()
+}
+
+// Free a key whose request failed, so it can be retried with a corrected body
+func releaseIdempotencyKey(scope string) {
+	idempotencyMutex.Lock()
+	if record, found := idempotencyRecords[scope]; found && record.response == nil {
+		delete(idempotencyRecords, scope)
+	}
+	idempotencyMutex.Unlock()
+}
+
+// Drop the client seen longest ago from the audit; the caller holds idempotencyMutex
+func dropIdleIdempotencyClient() {
+	var idle *IdempotencyClientStats
+	for _, stats := range idempotencyClients {
+		if idle == nil || stats.lastSeen.Before(idle.lastSeen) {
+			idle = stats
+		}
+	}
+	if idle != nil {
+		delete(idempotencyClients, idle.Client)
+	}
+}
+
+func purgeIdempotencyKeys() {
+	cutoff := time.Now().Add(-idempotencyTTL)
+	idempotencyMutex.Lock()
+	for key, record := range idempotencyRecords {
+		if record.createdAt.Before(cutoff) && record.response != nil {
+			delete(idempotencyRecords, key)
+		}
+	}
+	for client, stats := range idempotencyClients {
+		if stats.lastSeen.Before(cutoff) {
+			delete(idempotencyClients, client)
+		}
+	}
+	idempotencyMutex.Unlock()
+}
+
+func startIdempotencyJanitor() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			purgeIdempotencyKeys()
+		}
+	}()
+}
+
+// Replays and collisions per client, worst offenders first, plus the most recent events
+func getIdempotencyAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	idempotencyMutex.Lock()
+	clients := make([]IdempotencyClientStats, 0, len(idempotencyClients))
+	for _, stats := range idempotencyClients {
+		clients = append(clients, *stats)
+	}
+	replays := idempotencyReplays
+	recent := make([]IdempotencyEvent, len(idempotencyEvents))
+	copy(recent, idempotencyEvents)
+	activeKeys := len(idempotencyRecords)
+	idempotencyMutex.Unlock()
+
+	sort.Slice(clients, func(i, j int) bool {
+		a, b := clients[i], clients[j]
+		if a.Replays+a.Collisions != b.Replays+b.Collisions {
+			return a.Replays+a.Collisions > b.Replays+b.Collisions
+		}
+		return a.Client < b.Client
+	})
+	// Newest first
+	for i, j := 0, len(recent)-1; i < j; i, j = i+1, j-1 {
+		recent[i], recent[j] = recent[j], recent[i]
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"activeKeys":          activeKeys,
+		"duplicatesPrevented": replays,
+		"clients":             clients,
+		"recent":              recent,
+	})
+}
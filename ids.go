@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Tenant ID prefixes are short alphanumeric namespaces, joined to the UUID with an underscore
+var idPrefixPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,16}$`)
+
+// A new receipt ID, namespaced with the tenant's prefix when one is configured (e.g. acme_<uuid>)
+func newReceiptID(tenant string) string {
+	if prefix, ok := config.TenantIDPrefixes[tenant]; ok {
+		return prefix + "_" + uuid.NewString()
+	}
+	return uuid.NewString()
+}
+
+// Whether id is a UUID, optionally namespaced with one of the configured tenant prefixes
+func isValidReceiptID(id string) bool {
+	if prefix, rest, found := strings.Cut(id, "_"); found {
+		return isKnownIDPrefix(prefix) && isValidUUID(rest)
+	}
+	return isValidUUID(id)
+}
+
+func isKnownIDPrefix(prefix string) bool {
+	for _, known := range config.TenantIDPrefixes {
+		if known == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse comma-separated tenant=prefix pairs
+func getEnvIDPrefixes(key string, errs *[]error) map[string]string {
+	prefixes := map[string]string{}
+	for _, entry := range strings.Split(getEnv(key, ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tenant, prefix, _ := strings.Cut(entry, "=")
+		if tenant == "" || !idPrefixPattern.MatchString(prefix) {
+			*errs = append(*errs, fmt.Errorf("%s entries must be tenant=prefix with a prefix of up to 16 letters and digits, got %q", key, entry))
+			continue
+		}
+		prefixes[tenant] = prefix
+	}
+	return prefixes
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	topItemsDefaultLimit = 50
+	topItemsMaxLimit     = 500
+	// Distinct descriptions counted per tenant. Descriptions are free text, so once this
+	// many have been seen, new ones are only counted as untracked.
+	topItemsMaxTracked = 10000
+)
+
+type ItemStats struct {
+	Description string `json:"description"`
+	Count       int    `json:"count"`
+	Points      int    `json:"points"`
+}
+
+// Occurrences of one normalized description and the rule 5 points they earned
+type itemCounters struct {
+	count  atomic.Int64
+	points atomic.Int64
+}
+
+// Fold case and whitespace so "Gatorade " and "gatorade" count as the same item
+func normalizeDescription(description string) string {
+	return strings.Join(strings.Fields(strings.ToLower(description)), " ")
+}
+
+// The rule 5 points of each item, as the receipt's breakdown records them: the rule has an
+// entry, in item order, for each item it applied to, quoting the item's description
+func itemDescriptionPoints(receipt Receipt) []int {
+	points := make([]int, len(receipt.Items))
+	next := 0
+	for _, result := range receipt.Breakdown {
+		if result.Rule != ruleItemDescription {
+			continue
+		}
+		for i := next; i < len(receipt.Items); i++ {
+			if strings.Contains(result.Description, `"`+strings.TrimSpace(receipt.Items[i].ShortDescription)+`"`) {
+				points[i], next = result.Points, i+1
+				break
+			}
+		}
+	}
+	return points
+}
+
+func (c *receiptCounters) addItems(receipt Receipt, sign int64) {
+	points := itemDescriptionPoints(receipt)
+	for i, item := range receipt.Items {
+		description := normalizeDescription(item.ShortDescription)
+		if description == "" {
+			continue
+		}
+		// Descriptions keep the counters they got when first seen, so an item is removed
+		// from where it was added
+		value, found := c.items.Load(description)
+		if !found && c.itemsTracked.Load() >= topItemsMaxTracked {
+			c.itemsUntracked.Add(sign)
+			continue
+		}
+		if !found {
+			var loaded bool
+			if value, loaded = c.items.LoadOrStore(description, &itemCounters{}); !loaded {
+				c.itemsTracked.Add(1)
+			}
+		}
+		counters := value.(*itemCounters)
+		counters.count.Add(sign)
+		counters.points.Add(sign * int64(points[i]))
+	}
+}
+
+// The most frequent descriptions, ties broken by points then alphabetically
+func (c *receiptCounters) TopItems(limit int) []ItemStats {
+	items := []ItemStats{}
+	c.items.Range(func(key, value interface{}) bool {
+		counters := value.(*itemCounters)
+		if count := counters.count.Load(); count > 0 {
+			items = append(items, ItemStats{Description: key.(string), Count: int(count), Points: int(counters.points.Load())})
+		}
+		return true
+	})
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count != items[j].Count {
+			return items[i].Count > items[j].Count
+		}
+		if items[i].Points != items[j].Points {
+			return items[i].Points > items[j].Points
+		}
+		return items[i].Description < items[j].Description
+	})
+	return items[:min(limit, len(items))]
+}
+
+func getTopItems(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	limit, _, err := parsePagination(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid top items limit", "error", err)
+		return
+	}
+	if limit == 0 {
+		limit = topItemsDefaultLimit
+	}
+	limit = min(limit, topItemsMaxLimit)
+
+	tenant := counters.tenant(r.Header.Get("X-Tenant-ID"))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"items": tenant.TopItems(limit), "untracked": tenant.itemsUntracked.Load()})
+}
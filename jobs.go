@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Job statuses
+const (
+	jobQueued     = "queued"
+	jobProcessing = "processing"
+	jobSucceeded  = "succeeded"
+	jobFailed     = "failed"
+)
+
+// How long finished jobs can be polled
+const jobRetention = 24 * time.Hour
+
+// A receipt submitted with Prefer: respond-async, processed by a worker
+type Job struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	ReceiptID string `json:"receiptId,omitempty"`
+	// For failed jobs, the status and message the submission would have been answered with
+	StatusCode  int        `json:"statusCode,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Warnings    []Warning  `json:"warnings,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	tenant      string
+	owner       string
+	request     *http.Request
+	// The submission's partner signature was checked when it was queued; it can't be
+	// checked again, as its timestamp goes stale and the signature was used up
+	signatureVerified bool
+}
+
+var jobs = make(map[string]*Job)
+var jobsMutex = &sync.Mutex{}
+var jobQueue chan *Job
+
+func startJobWorkers() {
+	jobQueue = make(chan *Job, config.JobQueueSize)
+	for i := 0; i < config.JobWorkers; i++ {
+		go func() {
+			for job := range jobQueue {
+				runJob(job)
+			}
+		}()
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			purgeJobs()
+		}
+	}()
+}
+
+// Whether the client asked for the submission to be processed in the background (RFC 7240)
+func prefersAsync(r *http.Request) bool {
+	return hasPreference(r, "respond-async")
+}
+
+func hasPreference(r *http.Request, name string) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Accept a submission for background processing, answering 202 with the job to poll.
+// The signature is checked now, while its timestamp is fresh, rather than by the worker.
+func enqueueReceipt(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error reading request body", "error", err)
+		return
+	}
+	if !checkPartnerSignature(w, r, body) {
+		return
+	}
+
+	request := r.Clone(context.WithoutCancel(r.Context()))
+	request.Body = io.NopCloser(bytes.NewReader(body))
+	for _, header := range []string{"Prefer", "X-Partner-ID", "X-Signature", "X-Signature-Timestamp", "X-Request-Timeout", "Request-Timeout"} {
+		request.Header.Del(header)
+	}
+	job := &Job{ID: uuid.NewString(), Status: jobQueued, CreatedAt: time.Now().UTC(), tenant: r.Header.Get("X-Tenant-ID"), owner: authSubject(r.Context()), request: request, signatureVerified: true}
+
+	jobsMutex.Lock()
+	jobs[job.ID] = job
+	jobsMutex.Unlock()
+	select {
+	case jobQueue <- job:
+	default:
+		jobsMutex.Lock()
+		delete(jobs, job.ID)
+		jobsMutex.Unlock()
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many receipts waiting to be processed", http.StatusServiceUnavailable)
+		slog.WarnContext(r.Context(), "Rejected async submission: job queue is full")
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Queued receipt processing job", "job_id", job.ID)
+	w.Header().Set("Location", config.BasePath+apiVersion+"/jobs/"+job.ID)
+	w.Header().Set("Preference-Applied", "respond-async")
+	writeJSON(w, http.StatusAccepted, map[string]string{"jobId": job.ID, "status": jobQueued})
+}
+
+// Process a job's submission exactly like a synchronous one, recording the outcome
+func runJob(job *Job) {
+	jobsMutex.Lock()
+	job.Status = jobProcessing
+	request := job.request
+	if job.signatureVerified {
+		request = request.WithContext(context.WithValue(request.Context(), signatureVerifiedKey{}, true))
+	}
+	jobsMutex.Unlock()
+
+	recorder := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	processReceipt(recorder, request)
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	completedAt := time.Now().UTC()
+	job.CompletedAt, job.request = &completedAt, nil
+	var response processResponse
+	if recorder.status == http.StatusOK && json.Unmarshal(recorder.body.Bytes(), &response) == nil && response.ID != "" {
+		job.Status, job.ReceiptID, job.Warnings = jobSucceeded, response.ID, response.Warnings
+		slog.InfoContext(request.Context(), "Job processed receipt", "job_id", job.ID, "receipt_id", response.ID)
+		return
+	}
+	job.Status, job.StatusCode, job.Error = jobFailed, recorder.status, strings.TrimSpace(recorder.body.String())
+	slog.WarnContext(request.Context(), "Job failed", "job_id", job.ID, "status", job.StatusCode, "error", job.Error)
+}
+
+// Captures the response processReceipt would have sent
+type jobRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (r *jobRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *jobRecorder) Write(data []byte) (int, error) {
+	r.wrote = true
+	return r.body.Write(data)
+}
+
+func (r *jobRecorder) WriteHeader(status int) {
+	if !r.wrote {
+		r.status, r.wrote = status, true
+	}
+}
+
+func purgeJobs() {
+	cutoff := time.Now().Add(-jobRetention)
+	jobsMutex.Lock()
+	for id, job := range jobs {
+		if job.CompletedAt != nil && job.CompletedAt.Before(cutoff) {
+			delete(jobs, id)
+		}
+	}
+	jobsMutex.Unlock()
+}
+
+// GET /jobs/{id}; jobs are only visible to the tenant that submitted them
+func getJob(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	jobsMutex.Lock()
+	job, found := jobs[id]
+	var snapshot Job
+	if found {
+		snapshot = *job
+	}
+	jobsMutex.Unlock()
+	if !found || snapshot.tenant != r.Header.Get("X-Tenant-ID") || (authSubject(r.Context()) != "" && snapshot.owner != authSubject(r.Context())) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Job not found", "job_id", id)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, snapshot)
+}
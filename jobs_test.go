@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The worker can't check the signature again, so a key that must sign has its queued
+// submissions processed on the strength of the check made when they were accepted
+func TestAsyncSubmissionWithPartnerBoundKey(t *testing.T) {
+	const apiKey, secret = "acme-key-0123456789", "partner-secret-0123456789"
+	t.Setenv("API_KEYS", "acme="+apiKey)
+	t.Setenv("PARTNER_SECRETS", "acme-partner="+secret)
+	t.Setenv("API_KEY_PARTNERS", "acme=acme-partner")
+	var err error
+	if config, err = loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	store = newMemoryStore()
+	startJobWorkers()
+	router := newRouter()
+
+	body, err := os.ReadFile("payload.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	request := httptest.NewRequest(http.MethodPost, "/v1/receipts/process", bytes.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+apiKey)
+	request.Header.Set("Prefer", "respond-async")
+	request.Header.Set("X-Signature-Timestamp", timestamp)
+	request.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, request)
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("submission answered %d: %s", response.Code, response.Body)
+	}
+	var accepted struct {
+		JobID string `json:"jobId"`
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+
+	var job Job
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		request := httptest.NewRequest(http.MethodGet, "/v1/jobs/"+accepted.JobID, nil)
+		request.Header.Set("Authorization", "Bearer "+apiKey)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		if err := json.Unmarshal(response.Body.Bytes(), &job); err != nil {
+			t.Fatalf("job answered %d: %s", response.Code, response.Body)
+		}
+		if job.Status != jobQueued && job.Status != jobProcessing {
+			break
+		}
+	}
+	if job.Status != jobSucceeded || job.ReceiptID == "" {
+		t.Fatalf("job %s finished %s with %d: %s", job.ID, job.Status, job.StatusCode, job.Error)
+	}
+}
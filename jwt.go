@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Allowed difference between our clock and the issuer's for exp and nbf
+const jwtLeeway = time.Minute
+
+type authSubjectKey struct{}
+
+// The subject of the JWT the request ctx belongs to authenticated with, empty when it
+// didn't use one. Requests with a subject only see that user's receipts.
+func authSubject(ctx context.Context) string {
+	subject, _ := ctx.Value(authSubjectKey{}).(string)
+	return subject
+}
+
+func jwtEnabled() bool {
+	return config.JWTSecret != "" || config.JWTPublicKey != nil
+}
+
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+// Verify a compact JWT signed with HS256 by JWT_SECRET, or with RS256 or ES256 by the key in
+// JWT_PUBLIC_KEY_FILE, and return its subject. Tokens must expire, and must match
+// JWT_ISSUER and JWT_AUDIENCE when those are set.
+func verifyJWT(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", errors.New("malformed header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+	if err := verifyJWTSignature(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return "", err
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", errors.New("malformed claims")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("no sub claim")
+	}
+	if claims.ExpiresAt == nil {
+		return "", errors.New("no exp claim")
+	}
+	if now.After(time.Unix(*claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return "", errors.New("expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return "", errors.New("not valid yet")
+	}
+	if config.JWTIssuer != "" && claims.Issuer != config.JWTIssuer {
+		return "", fmt.Errorf("issuer %q is not %s", claims.Issuer, config.JWTIssuer)
+	}
+	if config.JWTAudience != "" && !jwtAudienceIncludes(claims.Audience, config.JWTAudience) {
+		return "", fmt.Errorf("audience doesn't include %s", config.JWTAudience)
+	}
+	return claims.Subject, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Only the algorithm configured for the key is accepted, so a token can't pick a weaker
+// one, or none
+func verifyJWTSignature(alg, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch key := config.JWTPublicKey.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && len(signature) == 64 {
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return nil
+			}
+		}
+	}
+	if config.JWTSecret != "" && alg == "HS256" {
+		mac := hmac.New(sha256.New, []byte(config.JWTSecret))
+		mac.Write([]byte(signed))
+		if hmac.Equal(signature, mac.Sum(nil)) {
+			return nil
+		}
+	}
+	return errors.New("signature does not verify")
+}
+
+// aud is either a single audience or a list of them
+func jwtAudienceIncludes(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	return json.Unmarshal(raw, &list) == nil && slices.Contains(list, audience)
+}
+
+// Whether the request may see a receipt: any receipt without a JWT subject, otherwise only
+// the subject's own
+func ownsReceipt(r *http.Request, receipt Receipt) bool {
+	subject := authSubject(r.Context())
+	return subject == "" || receipt.UserID == subject
+}
+
+// Make the JWT subject the user of a submitted receipt. Reports false, having answered 403,
+// when the submission names another user.
+func assignOwner(w http.ResponseWriter, r *http.Request, receipt *Receipt) bool {
+	subject := authSubject(r.Context())
+	if subject == "" {
+		return true
+	}
+	if receipt.UserID != "" && receipt.UserID != subject {
+		http.Error(w, "userId must be the authenticated user", http.StatusForbidden)
+		slog.WarnContext(r.Context(), "Rejected submission for another user", "user_id", receipt.UserID)
+		return false
+	}
+	receipt.UserID = subject
+	return true
+}
+
+// withPathValue for the /v1/users/{id} endpoints, which a JWT subject may only call for itself
+func withOwnUser(handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("id")
+		if subject := authSubject(r.Context()); subject != "" && subject != userID {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			slog.WarnContext(r.Context(), "Rejected request for another user", "user_id", userID)
+			return
+		}
+		handler(w, r, userID)
+	}
+}
+
+// withPathValue for the /v1/users/{id} points endpoints, which move or reveal a member's
+// points: only the user's own JWT subject, or the admin token, may call them. API keys
+// act for a whole tenant rather than a member, so they can't.
+func withUserPoints(handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.PathValue("id")
+		subject := authSubject(r.Context())
+		switch {
+		case isAdmin(r):
+		case subject == "":
+			http.Error(w, "A JWT for the user, or the admin token, is required", http.StatusUnauthorized)
+			slog.WarnContext(r.Context(), "Rejected points request without a user", "user_id", userID)
+			return
+		case subject != userID:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			slog.WarnContext(r.Context(), "Rejected request for another user", "user_id", userID)
+			return
+		}
+		handler(w, r, userID)
+	}
+}
+
+// Load the PEM public key JWTs are verified with, RSA or P-256 ECDSA
+func loadJWTPublicKey(path string, errs *[]error) crypto.PublicKey {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("JWT_PUBLIC_KEY_FILE could not be read: %v", err))
+		return nil
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		*errs = append(*errs, errors.New("JWT_PUBLIC_KEY_FILE is not a PEM file"))
+		return nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("JWT_PUBLIC_KEY_FILE is not a PEM public key: %v", err))
+		return nil
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return key
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return key
+		}
+	}
+	*errs = append(*errs, errors.New("JWT_PUBLIC_KEY_FILE must hold an RSA or P-256 ECDSA public key"))
+	return nil
+}
+
+func validateJWTConfig(cfg Config) []error {
+	var errs []error
+	if cfg.JWTSecret != "" && len(cfg.JWTSecret) < 32 {
+		errs = append(errs, errors.New("JWT_SECRET must be at least 32 characters"))
+	}
+	return errs
+}
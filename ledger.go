@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Kinds of ledger transactions
+const (
+	entryEarn   = "earn"
+	entryAdjust = "adjust"
+	entryRedeem = "redeem"
+	entryExpire = "expire"
+	entryMerge  = "merge"
+)
+
+// System accounts balancing the user side of each transaction; points flow out of
+// issued when earned and into redeemed or expired when spent
+const (
+	accountIssued      = "system:issued"
+	accountAdjustments = "system:adjustments"
+	accountRedeemed    = "system:redeemed"
+	accountExpired     = "system:expired"
+)
+
+var errInsufficientPoints = errors.New("insufficient points")
+var errOperationConflict = errors.New("operation ID was already used for a different request")
+var errMergeConflict = errors.New("users can't be merged")
+
+// One side of a transaction; the entries of a transaction always sum to zero
+type LedgerEntry struct {
+	ID            string    `json:"id"`
+	TransactionID string    `json:"transactionId"`
+	Account       string    `json:"account"`
+	Kind          string    `json:"kind"`
+	Amount        int       `json:"amount"`
+	BalanceAfter  int       `json:"balanceAfter"`
+	ReceiptID     string    `json:"receiptId,omitempty"`
+	OperationID   string    `json:"operationId,omitempty"`
+	Memo          string    `json:"memo,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Append-only points ledger; balances are always derived from the entries
+type Ledger struct {
+	mu       sync.Mutex
+	entries  []LedgerEntry
+	accounts map[string][]int
+	// Running sum of the entries of each account, kept as they are appended
+	balances map[string]int
+	expired  map[string]bool
+	// Operation ID to the index of the user-side entry it posted
+	operations map[string]int
+	// Merged user ID to the user it was merged into
+	merges map[string]string
+	// Groups by ID, and the ID of the group each member is in
+	groups      map[string]*Group
+	memberships map[string]string
+	// Changed since the last snapshot
+	dirty bool
+}
+
+var ledger = &Ledger{
+	accounts:    make(map[string][]int),
+	balances:    make(map[string]int),
+	expired:     make(map[string]bool),
+	operations:  make(map[string]int),
+	merges:      make(map[string]string),
+	groups:      make(map[string]*Group),
+	memberships: make(map[string]string),
+}
+
+// The ledger's name for a member. User IDs are only unique within a tenant, and can't
+// contain a slash, so a tenant's members are named tenant/userId; members without a
+// tenant keep their plain user ID.
+func ledgerMember(tenant, userID string) string {
+	if tenant == "" {
+		return userID
+	}
+	return tenant + "/" + userID
+}
+
+// The tenant and user ID of a member named by ledgerMember
+func splitLedgerMember(member string) (string, string) {
+	if i := strings.LastIndex(member, "/"); i >= 0 {
+		return member[:i], member[i+1:]
+	}
+	return "", member
+}
+
+func userAccount(member string) string {
+	return "user:" + member
+}
+
+// Operation IDs are chosen by clients, so each tenant has its own
+func operationKey(account, operationID string) string {
+	if tenant, _ := splitLedgerMember(strings.TrimPrefix(account, "user:")); tenant != "" {
+		return tenant + "/" + operationID
+	}
+	return operationID
+}
+
+func (l *Ledger) balanceLocked(account string) int {
+	return l.balances[account]
+}
+
+// Return the entry previously posted for an operation ID, or an error if it was posted with different parameters
+func (l *Ledger) replayLocked(operationID, kind, account string, amount int) (LedgerEntry, bool, error) {
+	index, found := l.operations[operationKey(account, operationID)]
+	if !found {
+		return LedgerEntry{}, false, nil
+	}
+	entry := l.entries[index]
+	if entry.Kind != kind || entry.Account != account || entry.Amount != amount {
+		return LedgerEntry{}, true, errOperationConflict
+	}
+	slog.Info("Replayed ledger operation", "kind", kind, "operation_id", operationID, "account", account)
+	return entry, true, nil
+}
+
+// Post a balanced transfer of amount points from one account to another
+func (l *Ledger) postLocked(kind, from, to string, amount int, receiptID, memo, operationID string, now time.Time) []LedgerEntry {
+	transactionID := uuid.NewString()
+	posted := make([]LedgerEntry, 0, 2)
+	for _, side := range []struct {
+		account string
+		amount  int
+	}{{from, -amount}, {to, amount}} {
+		entry := LedgerEntry{
+			ID:            uuid.NewString(),
+			TransactionID: transactionID,
+			Account:       side.account,
+			Kind:          kind,
+			Amount:        side.amount,
+			BalanceAfter:  l.balanceLocked(side.account) + side.amount,
+			ReceiptID:     receiptID,
+			OperationID:   operationID,
+			Memo:          memo,
+			CreatedAt:     now,
+		}
+		l.appendLocked(entry)
+		posted = append(posted, entry)
+	}
+	return posted
+}
+
+// Append an entry and index it by account and operation ID
+func (l *Ledger) appendLocked(entry LedgerEntry) {
+	if entry.OperationID != "" && strings.HasPrefix(entry.Account, "user:") {
+		l.operations[operationKey(entry.Account, entry.OperationID)] = len(l.entries)
+	}
+	// A merge posts from the merged user to the one it was merged into
+	if entry.Kind == entryMerge && len(l.entries) > 0 {
+		if from := l.entries[len(l.entries)-1]; from.TransactionID == entry.TransactionID {
+			l.merges[strings.TrimPrefix(from.Account, "user:")] = strings.TrimPrefix(entry.Account, "user:")
+		}
+	}
+	l.accounts[entry.Account] = append(l.accounts[entry.Account], len(l.entries))
+	l.balances[entry.Account] += entry.Amount
+	l.entries = append(l.entries, entry)
+	l.dirty = true
+}
+
+// The member whose account member's points go to: itself, or the member it was merged into
+func (l *Ledger) resolveLocked(member string) string {
+	for {
+		target, merged := l.merges[member]
+		if !merged {
+			return member
+		}
+		member = target
+	}
+}
+
+// The user of the tenant whose account userID's points go to
+func (l *Ledger) ResolveUser(tenant, userID string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, resolved := splitLedgerMember(l.resolveLocked(ledgerMember(tenant, userID)))
+	return resolved
+}
+
+// The balance of the user userID's points go to
+func (l *Ledger) Balance(tenant, userID string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.balanceLocked(userAccount(l.resolveLocked(ledgerMember(tenant, userID))))
+}
+
+// Entries posted to a user's account, oldest first. A merged user's history ends with the merge.
+func (l *Ledger) History(tenant, userID string) []LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	history := []LedgerEntry{}
+	for _, index := range l.accounts[userAccount(ledgerMember(tenant, userID))] {
+		history = append(history, l.entries[index])
+	}
+	return history
+}
+
+// Entries of every kind posted to user accounts, for reporting
+func (l *Ledger) UserEntries() []LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var entries []LedgerEntry
+	for _, entry := range l.entries {
+		if entry.Account != accountIssued && entry.Account != accountAdjustments && entry.Account != accountRedeemed && entry.Account != accountExpired {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Credit a receipt's points once; the receipt ID doubles as the operation ID
+func (l *Ledger) Earn(tenant, userID, receiptID string, points int) (LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	account := userAccount(l.resolveLocked(ledgerMember(tenant, userID)))
+	if entry, found, err := l.replayLocked("earn:"+receiptID, entryEarn, account, points); found {
+		return entry, err
+	}
+	return l.postLocked(entryEarn, accountIssued, account, points, receiptID, "", "earn:"+receiptID, time.Now().UTC())[1], nil
+}
+
+// Add (or with a negative amount, remove) points from a user's balance
+func (l *Ledger) Adjust(tenant, userID string, points int, memo, operationID string) (LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	account := userAccount(l.resolveLocked(ledgerMember(tenant, userID)))
+	if entry, found, err := l.replayLocked(operationID, entryAdjust, account, points); found {
+		return entry, err
+	}
+	return l.postLocked(entryAdjust, accountAdjustments, account, points, "", memo, operationID, time.Now().UTC())[1], nil
+}
+
+// Check the balance and post the redemption under one lock so concurrent redemptions can't overdraw.
+// Retrying with the same operation ID returns the original entry instead of deducting again.
+func (l *Ledger) Redeem(tenant, userID string, points int, memo, operationID string) (LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	account := userAccount(l.resolveLocked(ledgerMember(tenant, userID)))
+	if entry, found, err := l.replayLocked(operationID, entryRedeem, account, -points); found {
+		return entry, err
+	}
+	if balance := l.balanceLocked(account); balance < points {
+		slog.Warn("Rejected redemption above balance", "points", points, "user_id", userID, "balance", balance)
+		return LedgerEntry{}, fmt.Errorf("%w: balance is %d", errInsufficientPoints, balance)
+	}
+	return l.postLocked(entryRedeem, account, accountRedeemed, points, "", memo, operationID, time.Now().UTC())[0], nil
+}
+
+// Merge the user from into the user into: from's balance is transferred to into, and
+// points earned, adjusted or redeemed for from afterwards go to into. from's entries are
+// kept as they were. Merging into the same user again returns the original entry. Both
+// users are the tenant's.
+func (l *Ledger) Merge(tenant, fromUser, intoUser, memo string) (LedgerEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	from, into := ledgerMember(tenant, fromUser), ledgerMember(tenant, intoUser)
+	if target, merged := l.merges[from]; merged {
+		if target != into {
+			_, targetUser := splitLedgerMember(target)
+			return LedgerEntry{}, fmt.Errorf("%w: %s was already merged into %s", errMergeConflict, fromUser, targetUser)
+		}
+		return l.entries[l.operations[operationKey(userAccount(into), "merge:"+from)]], nil
+	}
+	if resolved := l.resolveLocked(into); resolved == from {
+		return LedgerEntry{}, fmt.Errorf("%w: %s was merged into %s", errMergeConflict, intoUser, fromUser)
+	} else if resolved != into {
+		_, resolvedUser := splitLedgerMember(resolved)
+		return LedgerEntry{}, fmt.Errorf("%w: %s was merged into %s, merge into that user instead", errMergeConflict, intoUser, resolvedUser)
+	}
+	l.mergeMembershipLocked(from, into)
+	amount := l.balanceLocked(userAccount(from))
+	return l.postLocked(entryMerge, userAccount(from), userAccount(into), amount, "", memo, "merge:"+from, time.Now().UTC())[1], nil
+}
+
+// Expire the points of earn transactions older than POINTS_EXPIRY, capped at what is left of the balance.
+// Returns the user side of each expiry posted.
+func (l *Ledger) ExpirePoints(now time.Time) []LedgerEntry {
+	if config.PointsExpiry == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var expired []LedgerEntry
+	count := len(l.entries)
+	for i := 0; i < count; i++ {
+		entry := l.entries[i]
+		if entry.Kind != entryEarn || entry.Account == accountIssued || l.expired[entry.TransactionID] {
+			continue
+		}
+		if now.Before(entry.CreatedAt.Add(config.PointsExpiry)) {
+			continue
+		}
+		l.expired[entry.TransactionID] = true
+		l.dirty = true
+
+		// Points earned by a merged user expire from the user they were merged into
+		account := userAccount(l.resolveLocked(strings.TrimPrefix(entry.Account, "user:")))
+		amount := min(entry.Amount, l.balanceLocked(account))
+		if amount <= 0 {
+			continue
+		}
+		expired = append(expired, l.postLocked(entryExpire, account, accountExpired, amount, entry.ReceiptID, "", "", now)[0])
+	}
+	return expired
+}
+
+func startLedgerJanitor() {
+	if config.PointsExpiry == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			expired := ledger.ExpirePoints(time.Now().UTC())
+			points := 0
+			for _, entry := range expired {
+				points -= entry.Amount
+				publishExpiry(entry)
+			}
+			if points > 0 {
+				slog.Info("Expired points past POINTS_EXPIRY", "points", points)
+			}
+		}
+	}()
+}
+
+type pointsRequest struct {
+	Points      int    `json:"points"`
+	Memo        string `json:"memo"`
+	OperationID string `json:"operationId"`
+}
+
+func decodePointsRequest(w http.ResponseWriter, r *http.Request, allowNegative bool) (pointsRequest, bool) {
+	var request pointsRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error decoding points request", "error", err)
+		return request, false
+	}
+	if request.Points == 0 || (request.Points < 0 && !allowNegative) {
+		http.Error(w, "points must be a positive integer", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid points amount", "points", request.Points)
+		return request, false
+	}
+	if request.OperationID == "" {
+		http.Error(w, "operationId is required", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Points request without an operationId")
+		return request, false
+	}
+	return request, true
+}
+
+func getBalance(w http.ResponseWriter, r *http.Request, userID string) {
+	tenant := r.Header.Get("X-Tenant-ID")
+	response := map[string]interface{}{"userId": userID, "balance": ledger.Balance(tenant, userID)}
+	if resolved := ledger.ResolveUser(tenant, userID); resolved != userID {
+		response["mergedInto"] = resolved
+	}
+	if groupID, member := ledger.GroupOf(tenant, userID); member {
+		response["groupId"] = groupID
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func getLedger(w http.ResponseWriter, r *http.Request, userID string) {
+	writeJSON(w, http.StatusOK, ledger.History(r.Header.Get("X-Tenant-ID"), userID))
+}
+
+func redeemPoints(w http.ResponseWriter, r *http.Request, userID string) {
+	request, ok := decodePointsRequest(w, r, false)
+	if !ok || !commitBeforeDeadline(r) {
+		return
+	}
+
+	entry, err := ledger.Redeem(r.Header.Get("X-Tenant-ID"), userID, request.Points, request.Memo, request.OperationID)
+	if errors.Is(err, errInsufficientPoints) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, errOperationConflict) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		slog.WarnContext(r.Context(), "Operation reused for a different redemption", "operation_id", request.OperationID)
+		return
+	}
+	slog.InfoContext(r.Context(), "Redeemed points", "points", request.Points, "user_id", userID, "transaction_id", entry.TransactionID)
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func adjustPoints(w http.ResponseWriter, r *http.Request, userID string) {
+	request, ok := decodePointsRequest(w, r, true)
+	if !ok || !commitBeforeDeadline(r) {
+		return
+	}
+
+	entry, err := ledger.Adjust(r.Header.Get("X-Tenant-ID"), userID, request.Points, request.Memo, request.OperationID)
+	if errors.Is(err, errOperationConflict) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		slog.WarnContext(r.Context(), "Operation reused for a different adjustment", "operation_id", request.OperationID)
+		return
+	}
+	slog.InfoContext(r.Context(), "Adjusted points", "user_id", userID, "points", request.Points, "transaction_id", entry.TransactionID)
+	writeJSON(w, http.StatusOK, entry)
+}
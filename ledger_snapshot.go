@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// On-disk form of the ledger; balances and indexes are rebuilt from the entries on load
+type ledgerSnapshot struct {
+	Entries []LedgerEntry `json:"entries"`
+	// Earn transactions already processed by expiry, including those that had nothing left to expire
+	Expired []string `json:"expired"`
+	Groups  []Group  `json:"groups,omitempty"`
+}
+
+// A memory-snapshot store keeps the ledger next to its receipts, e.g. receipts.ledger.json
+// for receipts.json, so a restart loses neither the receipts nor the points they earned
+func defaultLedgerSnapshotFile(cfg Config) string {
+	if cfg.StorageBackend != backendMemorySnapshot || cfg.StorageDSN == "" {
+		return ""
+	}
+	return strings.TrimSuffix(cfg.StorageDSN, filepath.Ext(cfg.StorageDSN)) + ".ledger.json"
+}
+
+// Restore the ledger from LEDGER_SNAPSHOT_FILE, then save it every SNAPSHOT_INTERVAL while it changes
+func startLedgerSnapshots() error {
+	if config.LedgerSnapshotFile == "" {
+		return nil
+	}
+	if err := ledger.Load(config.LedgerSnapshotFile); err != nil {
+		return err
+	}
+	if config.SnapshotInterval > 0 {
+		go func() {
+			for range time.Tick(config.SnapshotInterval) {
+				if err := ledger.Save(config.LedgerSnapshotFile); err != nil {
+					slog.Error("Error saving ledger snapshot", "path", config.LedgerSnapshotFile, "error", err)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+func (l *Ledger) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("Ledger snapshot does not exist yet, starting empty", "path", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading ledger snapshot: %w", err)
+	}
+	var snapshot ledgerSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("decoding ledger snapshot %s: %w", path, err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, entry := range snapshot.Entries {
+		l.appendLocked(entry)
+	}
+	for _, transactionID := range snapshot.Expired {
+		l.expired[transactionID] = true
+	}
+	for _, group := range snapshot.Groups {
+		l.groups[group.ID] = &group
+		for _, userID := range group.Members {
+			l.memberships[ledgerMember(group.Tenant, userID)] = group.ID
+		}
+	}
+	l.dirty = false
+	slog.Info("Loaded ledger entries from snapshot", "entries", len(snapshot.Entries), "path", path)
+	return nil
+}
+
+// Write the ledger to a temporary file and rename it into place, skipping the write when nothing changed
+func (l *Ledger) Save(path string) error {
+	l.mu.Lock()
+	if !l.dirty {
+		l.mu.Unlock()
+		return nil
+	}
+	// Entries are never modified once appended, so they can be encoded after the lock is released
+	count := len(l.entries)
+	snapshot := ledgerSnapshot{Entries: l.entries[:count:count], Expired: make([]string, 0, len(l.expired))}
+	for transactionID := range l.expired {
+		snapshot.Expired = append(snapshot.Expired, transactionID)
+	}
+	// Groups change in place, so they're copied under the lock
+	for _, group := range l.groups {
+		snapshot.Groups = append(snapshot.Groups, l.copyGroupLocked(group))
+	}
+	l.dirty = false
+	l.mu.Unlock()
+	sort.Strings(snapshot.Expired)
+	sort.Slice(snapshot.Groups, func(i, j int) bool { return snapshot.Groups[i].ID < snapshot.Groups[j].ID })
+
+	data, err := json.Marshal(snapshot)
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+	if err != nil {
+		l.mu.Lock()
+		l.dirty = true
+		l.mu.Unlock()
+		return err
+	}
+	slog.Info("Saved ledger entries to snapshot", "entries", len(snapshot.Entries), "path", path)
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating snapshot: %w", err)
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("replacing snapshot: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// Receipt statuses; receipts stored before statuses were tracked have none and count as active
+const (
+	statusActive   = "active"
+	statusFlagged  = "flagged"
+	statusApproved = "approved"
+	statusVoided   = "voided"
+
+	// Captured from partial data and not yet scored; see capture.go
+	statusNeedsEnrichment = "needs_enrichment"
+)
+
+func receiptStatus(receipt Receipt) string {
+	if receipt.Status == "" {
+		return statusActive
+	}
+	return receipt.Status
+}
+
+type receiptTransition struct {
+	to    string
+	from  []string
+	event string
+}
+
+// Admin actions moving a receipt between statuses; voided is final
+var receiptTransitions = map[string]receiptTransition{
+	"flag":    {statusFlagged, []string{statusActive, statusApproved}, eventReceiptFlagged},
+	"approve": {statusApproved, []string{statusFlagged}, eventReceiptApproved},
+	"void":    {statusVoided, []string{statusActive, statusFlagged, statusApproved}, eventReceiptVoided},
+}
+
+// Serializes read-modify-write of a receipt by lifecycle actions
+var lifecycleMutex = &sync.Mutex{}
+
+// POST /admin/receipts/{id}/{action} for one of the receiptTransitions or recalculate
+func receiptAction(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleAdminReceipts(w, r, r.PathValue("id"), action)
+	}
+}
+
+// POST /admin/receipts/{id}/{flag|approve|void|recalculate} with an optional {"reason": "..."}
+func handleAdminReceipts(w http.ResponseWriter, r *http.Request, id, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "POST")
+		return
+	}
+
+	transition, isTransition := receiptTransitions[action]
+
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error decoding receipt action request", "action", action, "error", err)
+		return
+	}
+
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	receipt, ok := findReceipt(w, r, id)
+	if !ok {
+		return
+	}
+	status := receiptStatus(receipt)
+	event := WebhookEvent{Reason: request.Reason}
+
+	if isTransition {
+		if !slices.Contains(transition.from, status) {
+			http.Error(w, fmt.Sprintf("Cannot %s a receipt that is %s", action, status), http.StatusConflict)
+			slog.WarnContext(r.Context(), "Rejected action on receipt", "action", action, "receipt_id", id, "status", status)
+			return
+		}
+		receipt.Status = transition.to
+		event.Type = transition.event
+	} else {
+		if status == statusVoided {
+			http.Error(w, "Cannot recalculate a voided receipt", http.StatusConflict)
+			slog.WarnContext(r.Context(), "Rejected recalculation of receipt: receipt is voided", "receipt_id", id)
+			return
+		}
+		if rejectUnscored(w, r, receipt, "recalculation") {
+			return
+		}
+		previousPoints := receipt.Points
+		if err := scoreReceipt(r.Context(), &receipt); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			slog.WarnContext(r.Context(), "Rejected recalculation of receipt", "receipt_id", id, "error", err)
+			return
+		}
+		event.Type, event.PreviousPoints = eventReceiptRecalculated, &previousPoints
+	}
+
+	if !commitBeforeDeadline(r) {
+		return
+	}
+	if err := store.Put(r.Context(), receipt); err != nil {
+		http.Error(w, "Error storing receipt", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error storing receipt", "receipt_id", id, "error", err)
+		return
+	}
+	settleLedger(receipt, event)
+	if !isTransition {
+		traceScoring(r.Context(), receipt, event.Type)
+	}
+
+	slog.InfoContext(r.Context(), "Receipt action applied", "receipt_id", id, "event", event.Type, "status", receiptStatus(receipt), "points", receipt.Points)
+	event.Receipt = receipt
+	publishWebhook(event)
+	writeJSON(w, http.StatusOK, receipt)
+}
+
+// Keep the member's balance in line with the receipt: voiding takes its points
+// back and recalculation or an update credits or debits the difference
+func settleLedger(receipt Receipt, event WebhookEvent) {
+	if receipt.UserID == "" {
+		return
+	}
+	var points int
+	var memo, operationID string
+	switch event.Type {
+	case eventReceiptVoided:
+		points, memo, operationID = -receipt.Points, "Receipt "+receipt.ID+" voided", "void:"+receipt.ID
+	case eventReceiptRecalculated:
+		points = receipt.Points - *event.PreviousPoints
+		memo = fmt.Sprintf("Receipt %s recalculated under rules version %s", receipt.ID, receipt.RulesVersion)
+		operationID = fmt.Sprintf("recalculate:%s:%d", receipt.ID, receipt.ScoredAt.UnixNano())
+	case eventReceiptUpdated:
+		points = receipt.Points - *event.PreviousPoints
+		memo = "Receipt " + receipt.ID + " updated"
+		operationID = fmt.Sprintf("update:%s:%d", receipt.ID, receipt.ScoredAt.UnixNano())
+	}
+	if points == 0 {
+		return
+	}
+	if _, err := ledger.Adjust(receipt.Tenant, receipt.UserID, points, memo, operationID); err != nil {
+		slog.Error("Error adjusting points for receipt", "receipt_id", receipt.ID, "error", err)
+	}
+}
+
+// PUT /receipts/{id}: replace a receipt's body, validating and scoring it like a new
+// submission. Its ID, status, tenant and when it was received are kept, and the
+// member is credited or debited the change in points.
+func updateReceipt(w http.ResponseWriter, r *http.Request, id string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error reading request body", "error", err)
+		return
+	}
+	if !checkPartnerSignature(w, r, body) {
+		return
+	}
+
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	existing, ok := findReceipt(w, r, id)
+	if !ok {
+		return
+	}
+	if receiptStatus(existing) == statusVoided {
+		http.Error(w, "Cannot update a voided receipt", http.StatusConflict)
+		slog.WarnContext(r.Context(), "Rejected update of receipt: receipt is voided", "receipt_id", id)
+		return
+	}
+	if receiptStatus(existing) == statusNeedsEnrichment {
+		http.Error(w, "Cannot update a receipt awaiting enrichment; enrich and finalize it instead", http.StatusConflict)
+		slog.WarnContext(r.Context(), "Rejected update of receipt: receipt needs enrichment", "receipt_id", id)
+		return
+	}
+
+	receipt, err := prepareReceipt(r.Context(), body, requestSubject(r), existing.Source)
+	if err != nil {
+		http.Error(w, err.Error(), receiptErrorStatus(err))
+		return
+	}
+	if !assignOwner(w, r, &receipt) {
+		return
+	}
+	// Points already credited stay with the member they were credited to
+	receipt.UserID = ledger.ResolveUser(existing.Tenant, receipt.UserID)
+	if receipt.UserID == "" {
+		receipt.UserID = existing.UserID
+	}
+	if receipt.UserID != existing.UserID {
+		http.Error(w, "Cannot change the userId of a receipt", http.StatusConflict)
+		slog.WarnContext(r.Context(), "Rejected update of receipt: userId changed", "receipt_id", id)
+		return
+	}
+	receipt.ID = existing.ID
+	receipt.ReceivedAt = existing.ReceivedAt
+	receipt.Tenant = existing.Tenant
+	receipt.Status = existing.Status
+
+	// A correction can't turn the receipt into a copy of another one
+	releaseDuplicates := lockDuplicates()
+	defer releaseDuplicates()
+	if err := checkDuplicate(receipt); err != nil {
+		duplicate := err.(*duplicateError).existing
+		http.Error(w, duplicateMessage(r, duplicate), http.StatusConflict)
+		slog.WarnContext(r.Context(), "Rejected update of receipt: duplicate of a stored receipt", "receipt_id", id, "duplicate_of", duplicate)
+		return
+	}
+	if !commitBeforeDeadline(r) {
+		return
+	}
+	if err := store.Put(r.Context(), receipt); err != nil {
+		http.Error(w, "Error storing receipt", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error storing receipt", "receipt_id", id, "error", err)
+		return
+	}
+	releaseDuplicates()
+	event := WebhookEvent{Type: eventReceiptUpdated, PreviousPoints: &existing.Points}
+	settleLedger(receipt, event)
+	captureRawPayload(r.Context(), id, body)
+	archiveRawPayload(id, body)
+	traceScoring(r.Context(), receipt, eventReceiptUpdated)
+
+	slog.InfoContext(r.Context(), "Receipt updated", "receipt_id", id, "points", receipt.Points, "previous_points", existing.Points)
+	event.Receipt = receipt
+	publishWebhook(event)
+	writeJSON(w, http.StatusOK, receipt)
+}
+
+// DELETE /receipts/{id}: remove a receipt along with its captured payload, taking back
+// the points it earned unless it was already voided
+func deleteReceipt(w http.ResponseWriter, r *http.Request, id string) {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	receipt, ok := findReceipt(w, r, id)
+	if !ok || !commitBeforeDeadline(r) {
+		return
+	}
+	deleted, err := store.Delete(r.Context(), id)
+	if err != nil {
+		http.Error(w, "Error deleting receipt", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error deleting receipt", "receipt_id", id, "error", err)
+		return
+	}
+	if !deleted {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Receipt not found", "receipt_id", id)
+		return
+	}
+
+	rawMutex.Lock()
+	delete(rawPayloads, id)
+	rawMutex.Unlock()
+	if receipt.UserID != "" && receipt.Points != 0 && receiptStatus(receipt) != statusVoided {
+		if _, err := ledger.Adjust(receipt.Tenant, receipt.UserID, -receipt.Points, "Receipt "+id+" deleted", "delete:"+id); err != nil {
+			slog.ErrorContext(r.Context(), "Error adjusting points for deleted receipt", "receipt_id", id, "error", err)
+		}
+	}
+
+	slog.InfoContext(r.Context(), "Deleted receipt", "receipt_id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Tell subscribers a receipt's points ran out past POINTS_EXPIRY
+func publishExpiry(entry LedgerEntry) {
+	receipt, found, err := store.Get(context.Background(), entry.ReceiptID)
+	if err != nil || !found {
+		slog.Warn("Skipping expiry webhook for receipt", "receipt_id", entry.ReceiptID, "found", found, "error", err)
+		return
+	}
+	publishWebhook(WebhookEvent{Type: eventReceiptExpired, Receipt: receipt, ExpiredPoints: -entry.Amount})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	listDefaultLimit = 50
+	listMaxLimit     = 500
+)
+
+// A processed receipt as listed by GET /receipts
+type ReceiptListing struct {
+	ID           string `json:"id"`
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	Points       int    `json:"points"`
+}
+
+// Narrows a listing to one retailer and a range of purchase dates
+type listFilter struct {
+	retailer string
+	from, to string // YYYY-MM-DD; from is inclusive, to exclusive
+}
+
+func parseListFilter(query url.Values) (listFilter, error) {
+	filter := listFilter{retailer: strings.TrimSpace(query.Get("retailer")), from: query.Get("from"), to: query.Get("to")}
+	for _, name := range []string{"from", "to"} {
+		value := query.Get(name)
+		if _, err := time.Parse("2006-01-02", value); value != "" && err != nil {
+			return filter, fmt.Errorf("%s must be a date in YYYY-MM-DD format", name)
+		}
+	}
+	if filter.from != "" && filter.to != "" && filter.from >= filter.to {
+		return filter, errors.New("from must be before to")
+	}
+	return filter, nil
+}
+
+// Dates in YYYY-MM-DD format compare correctly as strings
+func (f listFilter) match(receipt Receipt) bool {
+	if f.retailer != "" && !strings.EqualFold(receipt.Retailer, f.retailer) {
+		return false
+	}
+	if f.from != "" && receipt.PurchaseDate < f.from {
+		return false
+	}
+	return f.to == "" || receipt.PurchaseDate < f.to
+}
+
+// Position in the listing order: when a receipt was received, then its ID
+type listPosition struct {
+	receivedAt time.Time
+	id         string
+}
+
+func positionOf(receipt Receipt) listPosition {
+	return listPosition{receipt.ReceivedAt, receipt.ID}
+}
+
+func (p listPosition) before(other listPosition) bool {
+	if !p.receivedAt.Equal(other.receivedAt) {
+		return p.receivedAt.Before(other.receivedAt)
+	}
+	return p.id < other.id
+}
+
+// Cursors are opaque to clients; they encode the position of the last receipt on a page.
+// Receipts stored before receivedAt was recorded have an empty timestamp and sort first.
+func encodeListCursor(p listPosition) string {
+	nanos := ""
+	if !p.receivedAt.IsZero() {
+		nanos = strconv.FormatInt(p.receivedAt.UnixNano(), 10)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(nanos + ":" + p.id))
+}
+
+func decodeListCursor(cursor string) (listPosition, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return listPosition{}, errors.New("cursor is invalid")
+	}
+	nanos, id, found := strings.Cut(string(decoded), ":")
+	if !found || id == "" {
+		return listPosition{}, errors.New("cursor is invalid")
+	}
+	if nanos == "" {
+		return listPosition{id: id}, nil
+	}
+	unixNanos, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return listPosition{}, errors.New("cursor is invalid")
+	}
+	return listPosition{time.Unix(0, unixNanos).UTC(), id}, nil
+}
+
+// GET /receipts?limit=&offset=: the requesting tenant's receipts in the order they were
+// received, oldest first and then by ID. retailer, from and to narrow the listing to a
+// store or a period. Pages carry a nextCursor; passing it back as cursor continues right
+// after the last receipt seen, which unlike an offset isn't thrown off by receipts
+// added or deleted in between.
+func listReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	limit, offset, err := parsePagination(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid receipt list pagination", "error", err)
+		return
+	}
+	filter, err := parseListFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid receipt list filter", "error", err)
+		return
+	}
+	if limit == 0 {
+		limit = listDefaultLimit
+	}
+	limit = min(limit, listMaxLimit)
+	var after *listPosition
+	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
+		if r.URL.Query().Has("offset") {
+			http.Error(w, "cursor and offset can't be combined", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid receipt list pagination: both cursor and offset given")
+			return
+		}
+		position, err := decodeListCursor(cursor)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid receipt list cursor", "cursor", cursor)
+			return
+		}
+		after = &position
+	}
+
+	receipts, err := store.ListPurchased(r.Context(), filter.from, filter.to)
+	if err != nil {
+		http.Error(w, "Error reading receipts", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing receipts", "error", err)
+		return
+	}
+
+	tenant := r.Header.Get("X-Tenant-ID")
+	matches := []Receipt{}
+	for _, receipt := range receipts {
+		if receipt.Tenant == tenant && ownsReceipt(r, receipt) && filter.match(receipt) {
+			matches = append(matches, receipt)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return positionOf(matches[i]).before(positionOf(matches[j])) })
+
+	total := len(matches)
+	start := min(offset, total)
+	if after != nil {
+		start = sort.Search(total, func(i int) bool { return after.before(positionOf(matches[i])) })
+	}
+	end := min(start+limit, total)
+	page := []ReceiptListing{}
+	for _, receipt := range matches[start:end] {
+		page = append(page, ReceiptListing{
+			ID:           receipt.ID,
+			Retailer:     receipt.Retailer,
+			PurchaseDate: receipt.PurchaseDate,
+			Points:       receipt.Points,
+		})
+	}
+	response := map[string]interface{}{"total": total, "receipts": page}
+	if end < total {
+		response["nextCursor"] = encodeListCursor(positionOf(matches[end-1]))
+	}
+	slog.InfoContext(r.Context(), "Listed receipts", "returned", len(page), "total", total)
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// Request IDs taken from trusted proxies: printable, without spaces, and short enough to log
+var requestIDPattern = regexp.MustCompile(`^[!-~]{1,128}$`)
+
+type requestIDKey struct{}
+
+// The ID of the request ctx belongs to, empty outside of requests
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Middleware giving every request an ID, logged with everything logged for it and sent
+// back in X-Request-ID so client reports can be matched to the logs. An X-Request-ID set
+// by a trusted proxy is kept, so one ID follows the request across services; other
+// callers always get a new one rather than choosing what ends up in the logs.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			peer = r.RemoteAddr
+		}
+		id := r.Header.Get("X-Request-ID")
+		if !isTrustedProxy(peer) || !requestIDPattern.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Adds the request ID, and the API key name or JWT subject it authenticated with, to every
+// record logged with a request's context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if name := apiKeyName(ctx); name != "" {
+		record.AddAttrs(slog.String("api_key", name))
+	}
+	if subject := authSubject(ctx); subject != "" {
+		record.AddAttrs(slog.String("subject", subject))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Log to stderr in LOG_FORMAT from LOG_LEVEL up. Anything still written with the log
+// package, such as net/http's own errors, goes through the same handler.
+func initLogging(cfg Config) {
+	options := &slog.HandlerOptions{Level: cfg.LogLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// Log an error the server can't run past and exit, like log.Fatal
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+func parseLogLevel(value string, errs *[]error) slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		*errs = append(*errs, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", value))
+		return slog.LevelInfo
+	}
+	return level
+}
+
+func validateLoggingConfig(cfg Config) []error {
+	var errs []error
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be text or json, got %q", cfg.LogFormat))
+	}
+	return errs
+}
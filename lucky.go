@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+)
+
+// A receipt's draw for the lucky receipt bonus
+type luckyDraw struct {
+	// Uniform in [0, 1); the receipt is lucky when it is below LUCKY_RECEIPT_RATE
+	Roll  float64
+	Bonus int
+	// Identifies the draw, so an auditor holding LUCKY_RECEIPT_SEED can reproduce it
+	ID string
+}
+
+// Draw the receipt's bonus from a ChaCha8 stream seeded with the HMAC-SHA256 of its
+// content, keyed by LUCKY_RECEIPT_SEED. Nothing is shared between draws, so concurrent
+// scoring needs no locking, and a receipt draws the same whenever it is scored again,
+// recalculated or submitted again: it can't be re-rolled. The tenant is left out
+// because receipts are scored before it is attached.
+func drawLuckyReceipt(receipt Receipt) luckyDraw {
+	receipt.Tenant = ""
+	mac := hmac.New(sha256.New, []byte(config.LuckySeed))
+	mac.Write([]byte(contentHash(receipt)))
+	var seed [32]byte
+	copy(seed[:], mac.Sum(nil))
+
+	source := rand.New(rand.NewChaCha8(seed))
+	return luckyDraw{
+		Roll:  source.Float64(),
+		Bonus: config.LuckyMinPoints + source.IntN(config.LuckyMaxPoints-config.LuckyMinPoints+1),
+		ID:    hex.EncodeToString(seed[:8]),
+	}
+}
+
+func validateLuckyConfig(cfg Config) []error {
+	var errs []error
+	if cfg.LuckyRate < 0 || cfg.LuckyRate > 1 {
+		errs = append(errs, fmt.Errorf("LUCKY_RECEIPT_RATE must be between 0 and 1, e.g. 0.01, got %g", cfg.LuckyRate))
+	}
+	if cfg.LuckyRate > 0 && len(cfg.LuckySeed) < 16 {
+		errs = append(errs, errors.New("LUCKY_RECEIPT_SEED must be at least 16 characters when LUCKY_RECEIPT_RATE is set"))
+	}
+	if cfg.LuckyMinPoints < 1 || cfg.LuckyMaxPoints < cfg.LuckyMinPoints {
+		errs = append(errs, fmt.Errorf("LUCKY_RECEIPT_MIN_POINTS must be at least 1 and at most LUCKY_RECEIPT_MAX_POINTS, got %d and %d", cfg.LuckyMinPoints, cfg.LuckyMaxPoints))
+	}
+	return errs
+}
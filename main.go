@@ -1,29 +1,48 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"log"
-	"math"
+	"io"
+	"log/slog"
+	"math/big"
 	"net/http"
+	"os"
+	"os/signal"
 	"regexp"
-	"strconv"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
 type Receipt struct {
-	ID           string `json:"id,omitempty"`
-	Retailer     string `json:"retailer"`
-	PurchaseDate string `json:"purchaseDate"`
-	PurchaseTime string `json:"purchaseTime"`
-	Items        []Item `json:"items"`
-	Total        string `json:"total"`
-	Points       int    `json:"-"`
-	Breakdown    []string
+	ID           string       `json:"id,omitempty"`
+	Retailer     string       `json:"retailer"`
+	PurchaseDate string       `json:"purchaseDate,omitempty"`
+	PurchaseTime string       `json:"purchaseTime,omitempty"`
+	PurchasedAt  string       `json:"purchasedAt,omitempty"`
+	Items        []Item       `json:"items"`
+	Total        string       `json:"total"`
+	UserID       string       `json:"userId,omitempty"`
+	UserIDHash   string       `json:"userIdHash,omitempty"`
+	Tenant       string       `json:"tenant,omitempty"`
+	Status       string       `json:"status,omitempty"`
+	Points       int          `json:"points"`
+	Breakdown    []RuleResult `json:"breakdown,omitempty"`
+	ScoredAt     time.Time    `json:"scoredAt"`
+	RulesVersion string       `json:"rulesVersion,omitempty"`
+	Warnings     []Warning    `json:"warnings,omitempty"`
+	Quality      QualityScore `json:"quality"`
+	Source       Source       `json:"source"`
+	ReceivedAt   time.Time    `json:"receivedAt"`
+	Shadow       *ShadowScore `json:"shadow,omitempty"`
+	// How every rule was evaluated when the receipt was scored, recorded while tracing is
+	// on for traceScoring; not stored
+	traceSteps []TraceStep
 }
 
 type Item struct {
@@ -31,250 +50,725 @@ type Item struct {
 	Price            string `json:"price"`
 }
 
-var receipts = make(map[string]Receipt)
-var mutex = &sync.Mutex{}
+// A single breakdown entry: the rule that applied and the points it awarded
+type RuleResult struct {
+	Rule        string `json:"rule"`
+	Points      int    `json:"points"`
+	Description string `json:"description"`
+}
+
+// Version of the scoring rules; bump whenever calculatePoints changes the points it awards
+const rulesVersion = "1"
+
+// Rule identifiers used in breakdown entries and filters
+const (
+	ruleRetailerName    = "retailer_name"
+	ruleRoundDollar     = "round_dollar"
+	ruleQuarterMultiple = "quarter_multiple"
+	ruleItemPairs       = "item_pairs"
+	ruleItemDescription = "item_description"
+	ruleOddDay          = "odd_day"
+	rulePurchaseTime    = "purchase_time"
+	ruleChannelBonus    = "channel_bonus"
+	ruleLuckyReceipt    = "lucky_receipt"
+)
+
+// Every rule, in the order calculatePoints applies them
+var allRules = []string{ruleRetailerName, ruleRoundDollar, ruleQuarterMultiple, ruleItemPairs, ruleItemDescription, ruleOddDay, rulePurchaseTime, ruleChannelBonus, ruleLuckyReceipt}
 
 func main() {
-	log.Println("Starting Receipt Processor server...")
-	http.HandleFunc("/receipts/process", logRequest(processReceipt))
-	http.HandleFunc("/receipts/", logRequest(handleRequests))
+	var err error
+	report := &StartupReport{OK: true}
+	config, err = loadConfig()
+	report.add("config", err)
+	initLogging(config)
+	initFlags(config)
+	initTracing(config)
+	shadowRules = config.ShadowRules
+
+	// Subcommands: server migrate ...
+	if len(os.Args) > 1 {
+		report.exitIfFailed()
+		switch os.Args[1] {
+		case "migrate":
+			err = runMigrate(os.Args[2:])
+		case "verify":
+			err = runVerify(os.Args[2:])
+		case "export":
+			err = runExport(os.Args[2:])
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+		if err != nil {
+			fatal("Command failed", "command", os.Args[1], "error", err)
+		}
+		return
+	}
+
+	slog.Info("Starting Receipt Processor server")
+
+	// Check everything that can be checked before serving, reporting every problem at once
+	report.add("rules", checkRules())
+	report.add("keys", checkKeyMaterial(config))
+	if store, err = openStore(config.StorageBackend, config.StorageDSN); err != nil {
+		report.add("storage", fmt.Errorf("opening %s storage: %w", config.StorageBackend, err))
+	}
+	var previous Store
+	if config.StorageOldBackend != "" {
+		if previous, err = openStore(config.StorageOldBackend, config.StorageOldDSN); err != nil {
+			report.add("storage", fmt.Errorf("opening old %s storage: %w", config.StorageOldBackend, err))
+		}
+	}
+	report.exitIfFailed()
+	slog.Info("Using storage backend", "backend", config.StorageBackend)
+	startRawPayloadJanitor()
+	if err := startRawArchive(); err != nil {
+		fatal("Error setting up raw payload archive", "error", err)
+	}
+	if err := startLedgerSnapshots(); err != nil {
+		fatal("Error loading ledger", "error", err)
+	}
+	startLedgerJanitor()
+	startIdempotencyJanitor()
+	startRateLimitJanitor()
+	startSubmissionTokenJanitor()
+	startEnrichment()
+	startExternalRules()
+	startWebhooks()
+	startJobWorkers()
+	startSLOTracking()
+	startAlerting()
+	startReports()
+
+	// Double-write to the previous backend while migrating away from it
+	if previous != nil {
+		store = &dualWriteStore{current: store, previous: previous}
+		slog.Info("Double-writing to old storage backend", "backend", config.StorageOldBackend)
+	}
+
+	// Encrypt user IDs at rest with USER_ID_KEY
+	store = &userIDStore{Store: store}
+
+	// Keep running totals for stats
+	if store, err = newCountingStore(context.Background(), store, counters); err != nil {
+		fatal("Error counting stored receipts", "error", err)
+	}
+	if store, err = newIndexedStore(context.Background(), store, receiptIndex); err != nil {
+		fatal("Error indexing stored receipts", "error", err)
+	}
+	if config.DuplicateReceipts != duplicatesAllow {
+		if store, err = newContentIndexedStore(context.Background(), store, duplicateIndex); err != nil {
+			fatal("Error indexing stored receipts by content", "error", err)
+		}
+	}
+	store = &cdcStore{Store: store, log: changes}
+	startAnomalyDetection()
+	startRetentionJanitor()
+	startConsistencyChecks()
+	if err := startRecalculations(); err != nil {
+		fatal("Error resuming recalculations", "error", err)
+	}
 
-	log.Println("Server running at http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	router := newRouter()
+	server := &http.Server{Addr: ":8080", Handler: router, ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelError)}
+	grpcServer, err := startGRPC(router)
+	if err != nil {
+		fatal("Error starting gRPC server", "error", err)
+	}
+	startWarmup()
+	go func() {
+		slog.Info("Server running", "url", "http://localhost:8080"+config.BasePath+"/")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server failed", "error", err)
+		}
+	}()
+
+	// Shut down gracefully so stores can flush to disk
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	slog.Info("Shutting down server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Error shutting down server", "error", err)
+	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+	if err := store.Close(); err != nil {
+		slog.Error("Error closing storage", "error", err)
+	}
+	if config.LedgerSnapshotFile != "" {
+		if err := ledger.Save(config.LedgerSnapshotFile); err != nil {
+			slog.Error("Error saving ledger snapshot", "error", err)
+		}
+	}
+	slog.Info("Server stopped")
+}
+
+func newRouter() http.Handler {
+	openAPIDocument = buildOpenAPIDocument(routes)
+	mux := http.NewServeMux()
+	for _, route := range routes {
+		mux.HandleFunc(route.path, logRequest(route.handler))
+	}
+
+	handler := legacyPaths(instrument(ipFilter(cors(rateLimit(authenticate(routeGuard(requestDeadline(clientVersionGuard(maintenanceGuard(mux))))))))))
+
+	// Mount under a base path (e.g. /api) when running behind an ingress
+	if config.BasePath != "" {
+		handler = http.StripPrefix(config.BasePath, handler)
+	}
+	return withRequestID(handler)
 }
 
 // Middleware to log incoming requests
 func logRequest(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("Received %s request for %s", r.Method, r.URL.Path)
+		slog.InfoContext(r.Context(), "Received request", "method", r.Method, "path", r.URL.Path, "client_ip", clientIP(r))
 		handler(w, r)
 	}
 }
 
+// Response to a processed receipt
+type processResponse struct {
+	ID       string    `json:"id"`
+	Warnings []Warning `json:"warnings,omitempty"`
+	// Only with SCORE_COMPARISON and a Prefer: score-comparison header
+	Scores *ScoreComparison `json:"scores,omitempty"`
+}
+
 func processReceipt(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		log.Printf("Invalid method: %s. Only POST allowed.", r.Method)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "POST")
+		return
+	}
+	if !checkChannel(w, r) {
+		return
+	}
+	if prefersAsync(r) {
+		enqueueReceipt(w, r)
 		return
 	}
 
-	var receipt Receipt
-	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
-		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
-		log.Printf("Error decoding JSON: %v", err)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error reading request body", "error", err)
+		return
+	}
+	if !checkPartnerSignature(w, r, body) {
 		return
 	}
 
-	// Validate receipt
-	if err := validateReceipt(receipt); err != nil {
-		http.Error(w, fmt.Sprintf("Invalid receipt: %v", err), http.StatusBadRequest)
-		log.Printf("Validation failed: %v", err)
+	// Retries carrying the same Idempotency-Key get the original response instead of a duplicate receipt
+	stored := false
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	scope := idempotencyScope(r, idempotencyKey)
+	if idempotencyKey != "" {
+		if !claimIdempotencyKey(w, r, scope, idempotencyKey, body) {
+			return
+		}
+		defer func() {
+			if !stored {
+				releaseIdempotencyKey(scope)
+			}
+		}()
+	}
+
+	// Pre-signed submission URLs decide the tenant and user themselves
+	var submission *submissionToken
+	if token := r.URL.Query().Get("token"); token != "" {
+		claimed, ok := claimSubmissionToken(w, r, token)
+		if !ok {
+			return
+		}
+		submission = &claimed
+		defer func() { finishSubmissionToken(token, stored) }()
+		r.Header.Set("X-Tenant-ID", submission.tenant)
+	}
+
+	receipt, err := prepareReceipt(r.Context(), body, requestSubject(r), requestSource(r))
+	if err != nil {
+		http.Error(w, err.Error(), receiptErrorStatus(err))
 		return
 	}
 
-	// Generate a unique ID and calculate points with breakdown
-	receipt.ID = uuid.NewString()
-	receipt.Points, receipt.Breakdown = calculatePoints(receipt)
+	// Generate a unique ID and record when it was submitted
+	receipt.ID = newReceiptID(r.Header.Get("X-Tenant-ID"))
+	receipt.ReceivedAt = time.Now().UTC()
+	receipt.Tenant = r.Header.Get("X-Tenant-ID")
+	receipt.Status = statusActive
+	if submission != nil {
+		receipt.UserID = submission.userID
+	}
+	if !assignOwner(w, r, &receipt) {
+		return
+	}
+	// Points for users merged into another go to that user, once the submission is known
+	// to be the caller's own
+	receipt.UserID = ledger.ResolveUser(receipt.Tenant, receipt.UserID)
+
+	// Identical resubmissions are rejected or answered with the original, per DUPLICATE_RECEIPTS.
+	// The check and store are serialized until the receipt is stored, and only that long.
+	releaseDuplicates := lockDuplicates()
+	defer releaseDuplicates()
+	if err := checkDuplicate(receipt); err != nil {
+		existing := err.(*duplicateError).existing
+		if config.DuplicateReceipts == duplicatesReject {
+			http.Error(w, duplicateMessage(r, existing), http.StatusConflict)
+			slog.WarnContext(r.Context(), "Rejected duplicate of receipt", "receipt_id", existing)
+			return
+		}
+		// Another user's receipt is neither theirs to be given nor to be credited for again
+		original, found, err := store.Get(r.Context(), existing)
+		if err != nil {
+			http.Error(w, "Error reading receipt", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Error reading duplicated receipt", "receipt_id", existing, "error", err)
+			return
+		}
+		if !found || original.UserID != receipt.UserID {
+			http.Error(w, "Receipt is a duplicate of a receipt submitted by another user", http.StatusConflict)
+			slog.WarnContext(r.Context(), "Rejected duplicate of another user's receipt", "receipt_id", existing)
+			return
+		}
+		stored = true
+		response := processResponse{ID: existing, Warnings: []Warning{{
+			Code:    warningDuplicateReceipt,
+			Message: "receipt is identical to " + existing + ", which was returned instead of storing it again",
+		}}}
+		if idempotencyKey != "" {
+			finishIdempotencyKey(scope, existing, http.StatusOK, response)
+		}
+		slog.InfoContext(r.Context(), "Returned existing receipt for a duplicate submission", "receipt_id", existing)
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	// Don't store a receipt the caller has already given up on
+	if !commitBeforeDeadline(r) {
+		return
+	}
+
+	// Store the receipt
+	if err := store.Put(r.Context(), receipt); err != nil {
+		http.Error(w, "Error storing receipt", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error storing receipt", "receipt_id", receipt.ID, "error", err)
+		return
+	}
+	stored = true
+	// Identical submissions from now on find this receipt
+	releaseDuplicates()
+
+	// Credit the member's points balance
+	if receipt.UserID != "" && receipt.Points > 0 {
+		if _, err := ledger.Earn(receipt.Tenant, receipt.UserID, receipt.ID, receipt.Points); err != nil {
+			slog.ErrorContext(r.Context(), "Error crediting points for receipt", "receipt_id", receipt.ID, "error", err)
+		}
+	}
 
-	// Store in memory
-	mutex.Lock()
-	receipts[receipt.ID] = receipt
-	mutex.Unlock()
+	captureRawPayload(r.Context(), receipt.ID, body)
+	archiveRawPayload(receipt.ID, body)
+	traceScoring(r.Context(), receipt, eventReceiptProcessed)
+	publishWebhook(WebhookEvent{Type: eventReceiptProcessed, Receipt: receipt})
 
-	log.Printf("Receipt processed successfully. ID: %s, Points: %d", receipt.ID, receipt.Points)
+	slog.InfoContext(r.Context(), "Receipt processed successfully", "receipt_id", receipt.ID, "points", receipt.Points)
 
-	// Respond with ID
+	// Respond with ID and any warnings
+	response := processResponse{ID: receipt.ID, Warnings: receipt.Warnings}
+	if prefersScoreComparison(r) {
+		response.Scores = compareScores(receipt)
+		w.Header().Add("Preference-Applied", preferScoreComparison)
+	}
+	if idempotencyKey != "" {
+		finishIdempotencyKey(scope, receipt.ID, http.StatusOK, response)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"id": receipt.ID})
+	json.NewEncoder(w).Encode(response)
 }
 
-func handleRequests(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
-		log.Printf("Invalid method: %s. Only GET allowed.", r.Method)
-		return
+// Decode, normalize, validate and score a submitted receipt body.
+// Returned errors are client errors suitable for a 400 response, except
+// errExternalRuleUnavailable; see receiptErrorStatus.
+func prepareReceipt(ctx context.Context, body []byte, subject FeatureSubject, source Source) (Receipt, error) {
+	var receipt Receipt
+	var warnings []Warning
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&receipt); err != nil {
+		slog.WarnContext(ctx, "Error decoding JSON", "error", err)
+		return receipt, errors.New("Invalid JSON format")
 	}
+	// Scored with the receipt, since channel bonuses depend on it
+	receipt.Source = source
 
-	id := strings.TrimPrefix(r.URL.Path, "/receipts/")
-	if strings.HasSuffix(id, "/points") {
-		id = strings.TrimSuffix(id, "/points")
-		getPoints(w, id)
-	} else if strings.HasSuffix(id, "/breakdown") {
-		id = strings.TrimSuffix(id, "/breakdown")
-		getBreakdown(w, id)
-	} else {
-		http.Error(w, "Invalid endpoint", http.StatusNotFound)
-		log.Printf("Invalid endpoint: %s", r.URL.Path)
+	// Normalize partner formats before validation where lenient validation is rolled out
+	if featureEnabled(flagLenientValidation, subject) {
+		warnings = append(warnings, normalizeReceipt(ctx, &receipt)...)
 	}
+
+	// Validate against the published JSON Schema
+	if err := validateReceiptSchema(receipt); err != nil {
+		slog.WarnContext(ctx, "Schema validation failed", "error", err)
+		return receipt, fmt.Errorf("Invalid receipt: %v", err)
+	}
+
+	// A full purchasedAt timestamp supersedes the separate date and time fields
+	purchasedAtWarnings, err := applyPurchasedAt(ctx, &receipt)
+	if err != nil {
+		slog.WarnContext(ctx, "Validation failed", "error", err)
+		return receipt, fmt.Errorf("Invalid receipt: %v", err)
+	}
+	warnings = append(warnings, purchasedAtWarnings...)
+
+	// Validate receipt
+	if err := validateReceipt(ctx, receipt); err != nil {
+		slog.WarnContext(ctx, "Validation failed", "error", err)
+		return receipt, fmt.Errorf("Invalid receipt: %v", err)
+	}
+
+	// Non-fatal data-quality issues are stored and returned with the ID
+	receipt.Warnings = append(warnings, receiptWarnings(receipt)...)
+	for _, warning := range receipt.Warnings {
+		slog.InfoContext(ctx, "Receipt warning", "code", warning.Code, "message", warning.Message)
+	}
+
+	// Calculate points with breakdown
+	if err := scoreReceipt(ctx, &receipt); err != nil {
+		return receipt, err
+	}
+	receipt.Quality = scoreQuality(receipt)
+	return receipt, nil
 }
 
-func getPoints(w http.ResponseWriter, id string) {
-	if !isValidUUID(id) {
-		http.Error(w, "Invalid ID format", http.StatusBadRequest)
-		log.Printf("Invalid UUID format: %s", id)
+// The status for an error from prepareReceipt
+func receiptErrorStatus(err error) int {
+	if errors.Is(err, errExternalRuleUnavailable) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+// GET, PUT and DELETE /receipts/{id}
+func handleReceipt(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		getReceipt(w, r, id)
+	case http.MethodPut:
+		updateReceipt(w, r, id)
+	case http.MethodDelete:
+		deleteReceipt(w, r, id)
+	default:
+		http.Error(w, "Only GET, PUT and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET, PUT and DELETE")
+	}
+}
+
+// The full stored receipt: submitted fields, points, breakdown, status and warnings
+func getReceipt(w http.ResponseWriter, r *http.Request, id string) {
+	receipt, ok := findReceipt(w, r, id)
+	if !ok {
 		return
 	}
 
-	mutex.Lock()
-	receipt, found := receipts[id]
-	mutex.Unlock()
+	slog.InfoContext(r.Context(), "Receipt retrieved", "receipt_id", id)
+	writeJSON(w, http.StatusOK, receipt)
+}
 
-	if !found {
-		http.Error(w, "Receipt not found", http.StatusNotFound)
-		log.Printf("Receipt not found for ID: %s", id)
+func getPoints(w http.ResponseWriter, r *http.Request, id string) {
+	receipt, ok := findReceipt(w, r, id)
+	if !ok {
 		return
 	}
 
-	log.Printf("Points retrieved for Receipt ID: %s, Points: %d", id, receipt.Points)
+	if rejectUnscored(w, r, receipt, "points") {
+		return
+	}
+
+	if checkNotModified(w, r, receipt.ScoredAt) {
+		slog.InfoContext(r.Context(), "Points not modified", "receipt_id", id)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Points retrieved", "receipt_id", id, "points", receipt.Points)
 
 	// Respond with points
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]int{"points": receipt.Points})
 }
 
-func getBreakdown(w http.ResponseWriter, id string) {
-	if !isValidUUID(id) {
-		http.Error(w, "Invalid ID format", http.StatusBadRequest)
-		log.Printf("Invalid UUID format: %s", id)
+func getBreakdown(w http.ResponseWriter, r *http.Request, id string) {
+	query, err := parseBreakdownQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid query: %v", err), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid breakdown query", "query", r.URL.RawQuery, "error", err)
+		return
+	}
+
+	receipt, ok := findReceipt(w, r, id)
+	if !ok {
 		return
 	}
 
-	mutex.Lock()
-	receipt, found := receipts[id]
-	mutex.Unlock()
+	if rejectUnscored(w, r, receipt, "breakdown") {
+		return
+	}
 
-	if !found {
-		http.Error(w, "Receipt not found", http.StatusNotFound)
-		log.Printf("Receipt not found for ID: %s", id)
+	if checkNotModified(w, r, receipt.ScoredAt) {
+		slog.InfoContext(r.Context(), "Breakdown not modified", "receipt_id", id)
 		return
 	}
 
-	log.Printf("Breakdown retrieved for Receipt ID: %s", id)
+	slog.InfoContext(r.Context(), "Breakdown retrieved", "receipt_id", id)
 
-	// Respond with breakdown
 	w.Header().Set("Content-Type", "application/json")
+
+	// Summary view reports per-rule subtotals without per-item detail
+	if query.View == breakdownViewSummary {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"points": receipt.Points,
+			"rules":  summarizeBreakdown(filterBreakdown(receipt.Breakdown, query.Rules)),
+		})
+		return
+	}
+
+	// Respond with the filtered and paginated breakdown
+	breakdown, total := selectBreakdown(receipt.Breakdown, query)
 	response := map[string]interface{}{
 		"points":    receipt.Points,
-		"breakdown": receipt.Breakdown,
+		"breakdown": breakdownDescriptions(breakdown),
+		"total":     total,
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
-func calculatePoints(receipt Receipt) (int, []string) {
+// Calculate points, external rule bonuses included, and record when and under which rules
+// version they were awarded
+func scoreReceipt(ctx context.Context, receipt *Receipt) error {
+	var trace *ScoringTrace
+	if tracingEnabled() {
+		trace = &ScoringTrace{}
+	}
+	receipt.Points, receipt.Breakdown = calculatePointsTraced(*receipt, trace)
+	if err := applyExternalRules(ctx, receipt); err != nil {
+		return err
+	}
+	receipt.traceSteps = nil
+	if trace != nil {
+		for _, result := range receipt.Breakdown {
+			if isExternalRule(result.Rule) {
+				trace.applied(result)
+			}
+		}
+		receipt.traceSteps = trace.Steps
+	}
+	receipt.ScoredAt = time.Now()
+	receipt.RulesVersion = rulesVersion
+	receipt.Shadow = shadowScore(ctx, *receipt)
+	slog.InfoContext(ctx, "Points calculated for receipt", "points", receipt.Points)
+	return nil
+}
+
+// Look up a receipt by ID, writing the error response and returning false if it can't be
+// served. Receipts of other tenants than X-Tenant-ID's, and of other users than a JWT
+// subject, aren't found.
+func findReceipt(w http.ResponseWriter, r *http.Request, id string) (Receipt, bool) {
+	if !isValidReceiptID(id) {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid receipt ID format", "receipt_id", id)
+		return Receipt{}, false
+	}
+
+	receipt, found, err := store.Get(r.Context(), id)
+	if err != nil {
+		http.Error(w, "Error reading receipt", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error reading receipt", "receipt_id", id, "error", err)
+		return Receipt{}, false
+	}
+	if !found || receipt.Tenant != r.Header.Get("X-Tenant-ID") || !ownsReceipt(r, receipt) {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Receipt not found", "receipt_id", id)
+		return Receipt{}, false
+	}
+	return receipt, true
+}
+
+// Points awarded by the fixed rules, leaving out the channel bonus, the lucky receipt draw
+// and external rule bonuses, for checks against fixed expectations
+func pointsWithoutBonuses(breakdown []RuleResult) int {
 	points := 0
-	breakdown := []string{}
+	for _, result := range breakdown {
+		if result.Rule != ruleChannelBonus && result.Rule != ruleLuckyReceipt && !isExternalRule(result.Rule) {
+			points += result.Points
+		}
+	}
+	return points
+}
+
+func calculatePoints(receipt Receipt) (int, []RuleResult) {
+	return calculatePointsTraced(receipt, nil)
+}
+
+// calculatePoints, recording how every rule was evaluated, whether it applied or not, in
+// trace unless it is nil
+func calculatePointsTraced(receipt Receipt, trace *ScoringTrace) (int, []RuleResult) {
+	points := 0
+	breakdown := []RuleResult{}
+	award := func(result RuleResult) {
+		points += result.Points
+		breakdown = append(breakdown, result)
+		trace.applied(result)
+	}
 
 	// Rule 1: Alphanumeric characters in retailer name
 	retailerPoints := countAlphanumeric(receipt.Retailer)
-	points += retailerPoints
-	breakdown = append(breakdown, fmt.Sprintf("%d points - retailer name (%s) has %d alphanumeric characters", retailerPoints, receipt.Retailer, retailerPoints))
+	award(RuleResult{ruleRetailerName, retailerPoints, fmt.Sprintf("%d points - retailer name (%s) has %d alphanumeric characters", retailerPoints, receipt.Retailer, retailerPoints)})
 
 	// Rule 2: Total is a round dollar amount
-	total, _ := strconv.ParseFloat(receipt.Total, 64)
-	if total == float64(int(total)) {
-		points += 50
-		breakdown = append(breakdown, "50 points - total is a round dollar amount with no cents")
+	// Amounts are scored as exact integer cents; validation guarantees they parse and fit
+	total, _ := parseCents(receipt.Total)
+	if total%100 == 0 {
+		award(RuleResult{ruleRoundDollar, 50, "50 points - total is a round dollar amount with no cents"})
+	} else {
+		trace.skipped(ruleRoundDollar, fmt.Sprintf("total %s has %d cents", receipt.Total, total%100))
 	}
 
 	// Rule 3: Total is a multiple of 0.25
-	if math.Mod(total, 0.25) == 0 {
-		points += 25
-		breakdown = append(breakdown, "25 points - total is a multiple of 0.25")
+	if total%25 == 0 {
+		award(RuleResult{ruleQuarterMultiple, 25, "25 points - total is a multiple of 0.25"})
+	} else {
+		trace.skipped(ruleQuarterMultiple, fmt.Sprintf("total %s leaves %d cents over a multiple of 0.25", receipt.Total, total%25))
 	}
 
 	// Rule 4: 5 points for every two items
 	itemPoints := (len(receipt.Items) / 2) * 5
-	points += itemPoints
-	breakdown = append(breakdown, fmt.Sprintf("%d points - %d items (%d pairs @ 5 points each)", itemPoints, len(receipt.Items), len(receipt.Items)/2))
+	award(RuleResult{ruleItemPairs, itemPoints, fmt.Sprintf("%d points - %d items (%d pairs @ 5 points each)", itemPoints, len(receipt.Items), len(receipt.Items)/2)})
 
 	// Rule 5: Description length and price points
 	for _, item := range receipt.Items {
-		price, _ := strconv.ParseFloat(item.Price, 64)
+		price, _ := parseCents(item.Price)
 		descLength := len(strings.TrimSpace(item.ShortDescription))
 		if descLength%3 == 0 {
-			totalPrice := price * 0.2
-			itemPoints := int(math.Ceil(totalPrice))
-			points += itemPoints
-			breakdown = append(breakdown, fmt.Sprintf("%d points - \"%s\" is %d characters (a multiple of 3), item price %.2f * 0.2 = %.2f which is rounded to: %d points", itemPoints, strings.TrimSpace(item.ShortDescription), descLength, price, totalPrice, itemPoints))
+			// price * 0.2 in dollars is price/500 in cents, rounded up without going through floats
+			totalPrice := big.NewRat(price, 500)
+			itemPoints := int((price + 499) / 500)
+			award(RuleResult{ruleItemDescription, itemPoints, fmt.Sprintf("%d points - \"%s\" is %d characters (a multiple of 3), item price %s * 0.2 = %s which is rounded to: %d points", itemPoints, strings.TrimSpace(item.ShortDescription), descLength, formatCents(price), totalPrice.FloatString(2), itemPoints)})
+		} else {
+			trace.skipped(ruleItemDescription, fmt.Sprintf("\"%s\" is %d characters, not a multiple of 3", strings.TrimSpace(item.ShortDescription), descLength))
 		}
 	}
 
 	// Rule 6: Day of purchase is odd
 	date, _ := time.Parse("2006-01-02", receipt.PurchaseDate)
 	if date.Day()%2 != 0 {
-		points += 6
-		breakdown = append(breakdown, "6 points - purchase day is odd")
+		award(RuleResult{ruleOddDay, 6, "6 points - purchase day is odd"})
+	} else {
+		trace.skipped(ruleOddDay, fmt.Sprintf("purchase day %d of %s is even", date.Day(), receipt.PurchaseDate))
 	}
 
 	// Rule 7: Purchase time between 2:00pm and 4:00pm
 	time, _ := time.Parse("15:04", receipt.PurchaseTime)
 	if time.Hour() == 14 || time.Hour() == 15 {
-		points += 10
-		breakdown = append(breakdown, "10 points - purchase time is between 2:00pm and 4:00pm")
+		award(RuleResult{rulePurchaseTime, 10, "10 points - purchase time is between 2:00pm and 4:00pm"})
+	} else {
+		trace.skipped(rulePurchaseTime, fmt.Sprintf("purchase time %s is not between 2:00pm and 4:00pm", receipt.PurchaseTime))
+	}
+
+	// Rule 8: Bonus for the channel the receipt was submitted through, per CHANNEL_BONUSES
+	if len(config.ChannelBonuses) > 0 {
+		channel := receiptChannel(receipt)
+		if bonus := config.ChannelBonuses[channel]; bonus > 0 {
+			award(RuleResult{ruleChannelBonus, bonus, fmt.Sprintf("%d points - submitted through the %s channel", bonus, channel)})
+		} else {
+			trace.skipped(ruleChannelBonus, fmt.Sprintf("no bonus for the %s channel", channel))
+		}
 	}
 
-	log.Printf("Points calculated for receipt: %d", points)
+	// Rule 9: Random bonus for a share of receipts, when LUCKY_RECEIPT_RATE is set
+	if config.LuckyRate > 0 {
+		draw := drawLuckyReceipt(receipt)
+		if draw.Roll < config.LuckyRate {
+			award(RuleResult{ruleLuckyReceipt, draw.Bonus, fmt.Sprintf("%d points - lucky receipt: draw %s rolled %.6f, under the rate of %g", draw.Bonus, draw.ID, draw.Roll, config.LuckyRate)})
+		} else {
+			trace.skipped(ruleLuckyReceipt, fmt.Sprintf("draw %s rolled %.6f, not under the rate of %g", draw.ID, draw.Roll, config.LuckyRate))
+		}
+	}
 
 	return points, breakdown
 }
 
-func validateReceipt(receipt Receipt) error {
+func validateReceipt(ctx context.Context, receipt Receipt) error {
 	// Validate Retailer
 	if receipt.Retailer == "" {
-		log.Println("Validation failed: Retailer name is empty")
+		slog.WarnContext(ctx, "Validation failed: Retailer name is empty")
 		return errors.New("retailer name is invalid")
 	}
 	if !regexp.MustCompile(`^[\w\s\-\&]+$`).MatchString(receipt.Retailer) {
-		log.Printf("Validation failed: Retailer name '%s' contains invalid characters", receipt.Retailer)
+		slog.WarnContext(ctx, "Validation failed: Retailer name contains invalid characters", "retailer", receipt.Retailer)
 		return errors.New("retailer name is invalid")
 	}
 
 	// Validate PurchaseDate
 	if _, err := time.Parse("2006-01-02", receipt.PurchaseDate); err != nil {
-		log.Printf("Validation failed: PurchaseDate '%s' is not in YYYY-MM-DD format", receipt.PurchaseDate)
+		slog.WarnContext(ctx, "Validation failed: PurchaseDate is not in YYYY-MM-DD format", "purchase_date", receipt.PurchaseDate)
 		return errors.New("purchaseDate must be in YYYY-MM-DD format")
 	}
 
 	// Validate PurchaseTime
 	if _, err := time.Parse("15:04", receipt.PurchaseTime); err != nil {
-		log.Printf("Validation failed: PurchaseTime '%s' is not in HH:mm 24-hour format", receipt.PurchaseTime)
+		slog.WarnContext(ctx, "Validation failed: PurchaseTime is not in HH:mm 24-hour format", "purchase_time", receipt.PurchaseTime)
 		return errors.New("purchaseTime must be in HH:mm 24-hour format")
 	}
 
 	// Validate Items
 	if len(receipt.Items) < 1 {
-		log.Println("Validation failed: Items array is empty")
+		slog.WarnContext(ctx, "Validation failed: Items array is empty")
 		return errors.New("items array must have at least one item")
 	}
 	for index, item := range receipt.Items {
 		// Validate ShortDescription
 		if item.ShortDescription == "" {
-			log.Printf("Validation failed: Item at index %d has an empty shortDescription", index)
+			slog.WarnContext(ctx, "Validation failed: Item has an empty shortDescription", "index", index)
 			return errors.New("item shortDescription is invalid")
 		}
 		if !regexp.MustCompile(`^[\w\s\-]+$`).MatchString(item.ShortDescription) {
-			log.Printf("Validation failed: Item at index %d has invalid characters in shortDescription '%s'", index, item.ShortDescription)
+			slog.WarnContext(ctx, "Validation failed: Item has invalid characters in shortDescription", "index", index, "short_description", item.ShortDescription)
 			return errors.New("item shortDescription is invalid")
 		}
 
 		// Validate Price
 		if !regexp.MustCompile(`^\d+\.\d{2}$`).MatchString(item.Price) {
-			log.Printf("Validation failed: Item at index %d has an invalid price '%s'", index, item.Price)
+			slog.WarnContext(ctx, "Validation failed: Item has an invalid price", "index", index, "price", item.Price)
 			return errors.New("item price must be a valid decimal number")
 		}
+		if !withinLimit(item.Price, config.MaxItemPriceCents) {
+			slog.WarnContext(ctx, "Validation failed: Item has a price above the maximum", "index", index, "price", item.Price)
+			return fmt.Errorf("item price must not exceed %s", formatCents(config.MaxItemPriceCents))
+		}
 	}
 
 	// Validate Total
 	if !regexp.MustCompile(`^\d+\.\d{2}$`).MatchString(receipt.Total) {
-		log.Printf("Validation failed: Total '%s' is not a valid decimal number", receipt.Total)
+		slog.WarnContext(ctx, "Validation failed: Total is not a valid decimal number", "total", receipt.Total)
 		return errors.New("total must be a valid decimal number")
 	}
+	if !withinLimit(receipt.Total, config.MaxTotalCents) {
+		slog.WarnContext(ctx, "Validation failed: Total is above the maximum", "total", receipt.Total)
+		return fmt.Errorf("total must not exceed %s", formatCents(config.MaxTotalCents))
+	}
 
 	// Log success if all validations pass
-	log.Println("Validation successful for receipt")
+	slog.InfoContext(ctx, "Validation successful for receipt")
 	return nil
 }
 
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
 func countAlphanumeric(s string) int {
 	count := 0
 	for _, char := range s {
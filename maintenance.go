@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MaintenanceStatus struct {
+	Enabled bool       `json:"enabled"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+var maintenance MaintenanceStatus
+var maintenanceMutex = &sync.RWMutex{}
+
+func currentMaintenance() MaintenanceStatus {
+	maintenanceMutex.RLock()
+	defer maintenanceMutex.RUnlock()
+	return maintenance
+}
+
+// Middleware rejecting writes with 503 while in maintenance mode; reads and the admin API keep working
+func maintenanceGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := currentMaintenance()
+		if status.Enabled && !isReadMethod(r.Method) && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			slog.WarnContext(r.Context(), "Rejected request: server is in maintenance mode", "method", r.Method, "path", r.URL.Path)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+				"error":   "maintenance",
+				"message": status.Message,
+				"since":   status.Since,
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isReadMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, currentMaintenance())
+	case http.MethodPut:
+		var request struct {
+			Enabled bool   `json:"enabled"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Error decoding maintenance request", "error", err)
+			return
+		}
+
+		maintenanceMutex.Lock()
+		if request.Enabled {
+			if !maintenance.Enabled {
+				now := time.Now().UTC()
+				maintenance.Since = &now
+			}
+			if request.Message == "" {
+				request.Message = "The service is undergoing maintenance; writes are temporarily disabled"
+			}
+			maintenance.Enabled, maintenance.Message = true, request.Message
+		} else {
+			maintenance = MaintenanceStatus{}
+		}
+		status := maintenance
+		maintenanceMutex.Unlock()
+
+		slog.InfoContext(r.Context(), "Maintenance mode set", "enabled", status.Enabled)
+		writeJSON(w, http.StatusOK, status)
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET and PUT")
+	}
+}
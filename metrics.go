@@ -0,0 +1,173 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the latency histogram buckets; the last bucket is unbounded
+var latencyBounds = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// Width of each metrics bucket and how much history is kept
+const (
+	metricsResolution = 10 * time.Second
+	metricsHistory    = time.Hour
+)
+
+type LatencyHistogram [12]int
+
+type metricsBucket struct {
+	start    int64
+	requests int
+	errors   int
+	// 4xx responses
+	clientErrors int
+	slow         int
+	latency      LatencyHistogram
+}
+
+// Request counts, server errors and latencies over a recent window
+type WindowStats struct {
+	Requests     int
+	Errors       int
+	ClientErrors int
+	// Requests slower than the series' slow threshold, if it has one
+	Slow    int
+	Latency LatencyHistogram
+}
+
+// Rolling per-interval request metrics used for alerting and SLOs
+type requestMetrics struct {
+	mutex      sync.Mutex
+	resolution time.Duration
+	slowAbove  time.Duration
+	buckets    []metricsBucket
+}
+
+var metrics = newRequestMetrics(metricsResolution, metricsHistory, 0)
+
+// Keep history in buckets of resolution, counting requests slower than slowAbove if set
+func newRequestMetrics(resolution, history, slowAbove time.Duration) *requestMetrics {
+	return &requestMetrics{resolution: resolution, slowAbove: slowAbove, buckets: make([]metricsBucket, history/resolution)}
+}
+
+func (m *requestMetrics) observe(status int, duration time.Duration) {
+	slot := time.Now().UnixNano() / int64(m.resolution)
+
+	m.mutex.Lock()
+	bucket := &m.buckets[slot%int64(len(m.buckets))]
+	if bucket.start != slot {
+		*bucket = metricsBucket{start: slot}
+	}
+	bucket.requests++
+	if status >= 500 {
+		bucket.errors++
+	} else if status >= 400 {
+		bucket.clientErrors++
+	}
+	if m.slowAbove > 0 && duration > m.slowAbove {
+		bucket.slow++
+	}
+	bucket.latency[latencyBucket(duration)]++
+	m.mutex.Unlock()
+}
+
+func (m *requestMetrics) window(window time.Duration) WindowStats {
+	now := time.Now().UnixNano() / int64(m.resolution)
+	oldest := now - int64(window/m.resolution)
+
+	var stats WindowStats
+	m.mutex.Lock()
+	for _, bucket := range m.buckets {
+		if bucket.start > oldest && bucket.start <= now {
+			stats.Requests += bucket.requests
+			stats.Errors += bucket.errors
+			stats.ClientErrors += bucket.clientErrors
+			stats.Slow += bucket.slow
+			for i, count := range bucket.latency {
+				stats.Latency[i] += count
+			}
+		}
+	}
+	m.mutex.Unlock()
+	return stats
+}
+
+func latencyBucket(duration time.Duration) int {
+	for i, bound := range latencyBounds {
+		if duration <= bound {
+			return i
+		}
+	}
+	return len(latencyBounds)
+}
+
+// Estimate a latency quantile as the upper bound of the bucket containing it
+func (h LatencyHistogram) Quantile(q float64) time.Duration {
+	total := 0
+	for _, count := range h {
+		total += count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := int(q * float64(total))
+	seen := 0
+	for i, count := range h {
+		seen += count
+		if seen > rank {
+			if i < len(latencyBounds) {
+				return latencyBounds[i]
+			}
+			break
+		}
+	}
+	return latencyBounds[len(latencyBounds)-1] * 2
+}
+
+func (s WindowStats) ErrorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Requests)
+}
+
+// Middleware recording the status and latency of every request. Streams stay open for as
+// long as the client watches, so their latency would only skew the percentiles.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		if isStreamingPath(r.URL.Path) {
+			return
+		}
+		elapsed := time.Since(start)
+		metrics.observe(recorder.status, elapsed)
+		reportMetrics.observe(recorder.status, elapsed)
+		if scoringMetrics != nil && r.Method == http.MethodPost && r.URL.Path == apiVersion+"/receipts/process" {
+			scoringMetrics.observe(recorder.status, elapsed)
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Let http.ResponseController reach the underlying writer (e.g. for Flush)
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
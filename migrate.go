@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+)
+
+type MigrationProgress struct {
+	Total   int
+	Copied  int
+	Skipped int
+}
+
+// Copy every receipt from one store to another. Receipts already present in the destination
+// are skipped unless overwrite is set, so an interrupted migration can simply be re-run.
+func migrateReceipts(ctx context.Context, from, to Store, overwrite bool, progress func(MigrationProgress)) (MigrationProgress, error) {
+	receipts, err := from.List(ctx)
+	if err != nil {
+		return MigrationProgress{}, fmt.Errorf("listing source receipts: %w", err)
+	}
+
+	status := MigrationProgress{Total: len(receipts)}
+	for _, receipt := range receipts {
+		if err := ctx.Err(); err != nil {
+			return status, err
+		}
+
+		if !overwrite {
+			_, found, err := to.Get(ctx, receipt.ID)
+			if err != nil {
+				return status, fmt.Errorf("checking receipt %s in destination: %w", receipt.ID, err)
+			}
+			if found {
+				status.Skipped++
+				if progress != nil {
+					progress(status)
+				}
+				continue
+			}
+		}
+
+		if err := to.Put(ctx, receipt); err != nil {
+			return status, fmt.Errorf("copying receipt %s: %w", receipt.ID, err)
+		}
+		status.Copied++
+		if progress != nil {
+			progress(status)
+		}
+	}
+	return status, nil
+}
+
+// server migrate --from=<backend> --from-dsn=<dsn> --to=<backend> --to-dsn=<dsn>
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fromBackend := flags.String("from", "", "source storage backend")
+	fromDSN := flags.String("from-dsn", "", "source storage DSN")
+	toBackend := flags.String("to", "", "destination storage backend")
+	toDSN := flags.String("to-dsn", "", "destination storage DSN")
+	overwrite := flags.Bool("overwrite", false, "overwrite receipts that already exist in the destination")
+	every := flags.Int("progress-every", 1000, "log progress every N receipts")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *fromBackend == "" || *toBackend == "" {
+		return errors.New("both --from and --to are required")
+	}
+
+	from, err := openStore(*fromBackend, *fromDSN)
+	if err != nil {
+		return fmt.Errorf("opening source: %w", err)
+	}
+	defer from.Close()
+
+	to, err := openStore(*toBackend, *toDSN)
+	if err != nil {
+		return fmt.Errorf("opening destination: %w", err)
+	}
+
+	slog.Info("Migrating receipts", "from", *fromBackend, "to", *toBackend)
+	status, err := migrateReceipts(context.Background(), from, to, *overwrite, func(p MigrationProgress) {
+		if done := p.Copied + p.Skipped; done%*every == 0 || done == p.Total {
+			slog.Info("Migration progress", "done", done, "total", p.Total, "copied", p.Copied, "skipped", p.Skipped)
+		}
+	})
+	if closeErr := to.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("migration stopped after %d copied and %d skipped: %w", status.Copied, status.Skipped, err)
+	}
+
+	slog.Info("Migration complete", "copied", status.Copied, "already_present", status.Skipped)
+	return nil
+}
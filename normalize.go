@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Characters stripped from prices in lenient mode: currency symbols, thousands separators and spaces
+var priceNoise = strings.NewReplacer("$", "", "€", "", "£", "", ",", "", " ", "")
+
+// 12-hour clock layouts used by partner exports, e.g. "2:05 PM" or "02:05PM"
+var twelveHourLayouts = []string{"3:04 PM", "3:04PM"}
+
+// Normalize partner-formatted values so they pass strict validation and scoring,
+// returning a warning for every value that had to be rewritten
+func normalizeReceipt(ctx context.Context, receipt *Receipt) []Warning {
+	var warnings []Warning
+
+	if normalized := normalizeTime(ctx, receipt.PurchaseTime); normalized != receipt.PurchaseTime {
+		warnings = append(warnings, Warning{warningTimeNormalized, "purchaseTime", fmt.Sprintf("purchaseTime %q was normalized to %q", receipt.PurchaseTime, normalized)})
+		receipt.PurchaseTime = normalized
+	}
+	if normalized := normalizePrice(ctx, receipt.Total); normalized != receipt.Total {
+		warnings = append(warnings, Warning{warningPriceNormalized, "total", fmt.Sprintf("total %q was normalized to %q", receipt.Total, normalized)})
+		receipt.Total = normalized
+	}
+	for index, item := range receipt.Items {
+		if normalized := normalizePrice(ctx, item.Price); normalized != item.Price {
+			field := fmt.Sprintf("items[%d].price", index)
+			warnings = append(warnings, Warning{warningPriceNormalized, field, fmt.Sprintf("%s %q was normalized to %q", field, item.Price, normalized)})
+			receipt.Items[index].Price = normalized
+		}
+	}
+	return warnings
+}
+
+func normalizePrice(ctx context.Context, price string) string {
+	normalized := priceNoise.Replace(strings.TrimSpace(price))
+	if normalized != price {
+		slog.InfoContext(ctx, "Normalized price", "price", price, "normalized", normalized)
+	}
+	return normalized
+}
+
+func normalizeTime(ctx context.Context, value string) string {
+	upper := strings.ToUpper(strings.TrimSpace(value))
+	for _, layout := range twelveHourLayouts {
+		if parsed, err := time.Parse(layout, upper); err == nil {
+			normalized := parsed.Format("15:04")
+			slog.InfoContext(ctx, "Normalized purchaseTime", "purchase_time", value, "normalized", normalized)
+			return normalized
+		}
+	}
+	return value
+}
+
+// Store purchasedAt canonically and derive the purchase date and time from it.
+// Returns a warning when it overrides separate fields that disagree with it.
+func applyPurchasedAt(ctx context.Context, receipt *Receipt) ([]Warning, error) {
+	if receipt.PurchasedAt == "" {
+		return nil, nil
+	}
+
+	purchasedAt, err := time.Parse(time.RFC3339, receipt.PurchasedAt)
+	if err != nil {
+		slog.WarnContext(ctx, "Validation failed: PurchasedAt is not an RFC 3339 timestamp", "purchased_at", receipt.PurchasedAt)
+		return nil, errors.New("purchasedAt must be an RFC 3339 timestamp")
+	}
+
+	var warnings []Warning
+	date, clock := purchasedAt.Format("2006-01-02"), purchasedAt.Format("15:04")
+	if (receipt.PurchaseDate != "" && receipt.PurchaseDate != date) || (receipt.PurchaseTime != "" && receipt.PurchaseTime != clock) {
+		warnings = append(warnings, Warning{warningPurchasedAtOverride, "purchasedAt", fmt.Sprintf("purchasedAt overrides purchaseDate %q and purchaseTime %q", receipt.PurchaseDate, receipt.PurchaseTime)})
+	}
+
+	receipt.PurchasedAt = purchasedAt.Format(time.RFC3339)
+	receipt.PurchaseDate = date
+	receipt.PurchaseTime = clock
+	slog.InfoContext(ctx, "Derived purchaseDate and purchaseTime from purchasedAt", "purchase_date", receipt.PurchaseDate, "purchase_time", receipt.PurchaseTime, "purchased_at", receipt.PurchasedAt)
+	return warnings, nil
+}
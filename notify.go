@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// Severity levels understood by the notifiers
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// A message for operators, e.g. an alert or a report
+type Notification struct {
+	Key      string
+	Title    string
+	Message  string
+	Severity string
+	Details  map[string]string
+	// Optional HTML rendering of Message, for notifiers that can show it
+	HTML string
+}
+
+// Delivers notifications to an external channel
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, n Notification) error
+}
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+func postJSON(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return nil
+}
+
+// Posts to a Slack incoming webhook
+type slackNotifier struct {
+	webhookURL string
+}
+
+func (s *slackNotifier) Name() string {
+	return "slack"
+}
+
+func (s *slackNotifier) Notify(ctx context.Context, n Notification) error {
+	text := fmt.Sprintf("*%s*\n%s", n.Title, n.Message)
+	for key, value := range n.Details {
+		text += fmt.Sprintf("\n• %s: %s", key, value)
+	}
+	return postJSON(ctx, s.webhookURL, map[string]string{"text": text})
+}
+
+// Triggers PagerDuty incidents through the Events API v2
+type pagerDutyNotifier struct {
+	routingKey string
+}
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+func (p *pagerDutyNotifier) Name() string {
+	return "pagerduty"
+}
+
+// Only warnings and worse page anyone; reports are left to the other notifiers
+func (p *pagerDutyNotifier) Notify(ctx context.Context, n Notification) error {
+	if n.Severity == severityInfo {
+		return nil
+	}
+	source, _ := os.Hostname()
+	return postJSON(ctx, pagerDutyEventsURL, map[string]interface{}{
+		"routing_key":  p.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    n.Key,
+		"payload": map[string]interface{}{
+			"summary":        n.Title + ": " + n.Message,
+			"source":         "receipt-processor@" + source,
+			"severity":       n.Severity,
+			"custom_details": n.Details,
+		},
+	})
+}
+
+// Sends email through an SMTP server, authenticating with PLAIN when a username is set
+type emailNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func (e *emailNotifier) Name() string {
+	return "email"
+}
+
+func (e *emailNotifier) Notify(ctx context.Context, n Notification) error {
+	var body bytes.Buffer
+	parts := multipart.NewWriter(&body)
+	fmt.Fprintf(&body, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nMIME-Version: 1.0\r\n",
+		e.from, strings.Join(e.to, ", "), mime.QEncoding.Encode("utf-8", n.Title), time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+
+	text := n.Message
+	for key, value := range n.Details {
+		text += fmt.Sprintf("\n%s: %s", key, value)
+	}
+	alternatives := []struct{ contentType, content string }{{"text/plain", text}, {"text/html", n.HTML}}
+	for _, alternative := range alternatives {
+		if alternative.content == "" {
+			continue
+		}
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {alternative.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return err
+		}
+		encoder := quotedprintable.NewWriter(part)
+		encoder.Write([]byte(alternative.content))
+		encoder.Close()
+	}
+	parts.Close()
+
+	var auth smtp.Auth
+	if e.username != "" {
+		host, _, _ := net.SplitHostPort(e.addr)
+		auth = smtp.PlainAuth("", e.username, e.password, host)
+	}
+	// net/smtp takes no context, so the send runs until the server answers or drops it
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(e.addr, auth, e.from, e.to, body.Bytes()) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Notifiers enabled by configuration
+func configuredNotifiers() []Notifier {
+	var notifiers []Notifier
+	if config.SlackWebhookURL != "" {
+		notifiers = append(notifiers, &slackNotifier{webhookURL: config.SlackWebhookURL})
+	}
+	if config.PagerDutyRoutingKey != "" {
+		notifiers = append(notifiers, &pagerDutyNotifier{routingKey: config.PagerDutyRoutingKey})
+	}
+	if len(config.AlertEmailTo) > 0 {
+		notifiers = append(notifiers, &emailNotifier{addr: config.SMTPAddr, from: config.SMTPFrom, to: config.AlertEmailTo, username: config.SMTPUsername, password: config.SMTPPassword})
+	}
+	return notifiers
+}
+
+func notifyAll(ctx context.Context, notifiers []Notifier, n Notification) error {
+	var errs []error
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(ctx, n); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", notifier.Name(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A query parameter of an operation; path parameters come from the route
+type apiParameter struct {
+	name, typ, description string
+}
+
+// What the spec says about an operation beyond its route. request and responses are
+// values of the types the handler decodes and encodes, or a schemaRef; several
+// responses are alternatives, and none means the success response has no body.
+type apiOperation struct {
+	summary   string
+	query     []apiParameter
+	request   interface{}
+	status    int
+	responses []interface{}
+}
+
+// A named schema that isn't generated from a Go type
+type schemaRef string
+
+// Submissions are described by the published JSON Schema, which is stricter than Receipt
+const receiptSubmission schemaRef = "ReceiptSubmission"
+
+var paginationParameters = []apiParameter{
+	{"limit", "integer", "Maximum number of entries to return"},
+	{"offset", "integer", "Number of entries to skip"},
+}
+
+// Documented operations by method and path below apiVersion. Routes without an entry,
+// such as the admin-only raw payloads, are left out of the spec.
+var apiOperations = map[string]apiOperation{
+	"GET /receipts": {
+		summary: "Lists the tenant's receipts in the order they were received",
+		query: append([]apiParameter{
+			{"retailer", "string", "Only receipts from this retailer, ignoring case"},
+			{"from", "string", "Only receipts purchased on or after this date (YYYY-MM-DD)"},
+			{"to", "string", "Only receipts purchased before this date (YYYY-MM-DD)"},
+			{"cursor", "string", "nextCursor of the previous page"},
+		}, paginationParameters...),
+		responses: []interface{}{struct {
+			Total      int              `json:"total"`
+			Receipts   []ReceiptListing `json:"receipts"`
+			NextCursor string           `json:"nextCursor,omitempty"`
+		}{}},
+	},
+	"POST /receipts/process": {
+		summary:   "Submits a receipt for processing",
+		request:   receiptSubmission,
+		responses: []interface{}{processResponse{}},
+	},
+	"GET /receipts/search": {
+		summary: "Searches the tenant's receipts by retailer and item descriptions",
+		query:   []apiParameter{{"q", "string", "Search terms"}},
+		responses: []interface{}{struct {
+			Total   int            `json:"total"`
+			Results []SearchResult `json:"results"`
+		}{}},
+	},
+	"GET /receipts/summary": {
+		summary:   "Returns the points issued over all receipts and each rule's contribution",
+		responses: []interface{}{PointsSummary{}},
+	},
+	"POST /receipts/score": {
+		summary:   "Scores a receipt without storing it",
+		query:     []apiParameter{{"disableRules", "string", "Comma-separated rule IDs to leave out"}},
+		request:   receiptSubmission,
+		responses: []interface{}{ScorePreview{}},
+	},
+	"POST /receipts/capture": {
+		summary:   "Captures a partial receipt to be enriched and finalized later",
+		request:   partialReceipt{},
+		status:    http.StatusCreated,
+		responses: []interface{}{captureResponse{}},
+	},
+	"GET /receipts/{id}": {
+		summary:   "Returns a stored receipt",
+		responses: []interface{}{Receipt{}},
+	},
+	"PUT /receipts/{id}": {
+		summary:   "Replaces a stored receipt with a corrected submission and rescores it",
+		request:   receiptSubmission,
+		responses: []interface{}{Receipt{}},
+	},
+	"DELETE /receipts/{id}": {
+		summary: "Deletes a receipt, taking back the points it earned",
+		status:  http.StatusNoContent,
+	},
+	"POST /receipts/{id}/enrich": {
+		summary:   "Adds fields to a captured receipt",
+		request:   partialReceipt{},
+		responses: []interface{}{captureResponse{}},
+	},
+	"POST /receipts/{id}/finalize": {
+		summary:   "Validates and scores a captured receipt",
+		responses: []interface{}{Receipt{}},
+	},
+	"GET /receipts/{id}/points": {
+		summary: "Returns the points awarded for the receipt",
+		responses: []interface{}{struct {
+			Points int `json:"points"`
+		}{}},
+	},
+	"GET /receipts/{id}/breakdown": {
+		summary: "Returns how the receipt's points were awarded, rule by rule",
+		query: append([]apiParameter{
+			{"view", "string", "full (the default) for each awarded rule, summary for per-rule subtotals"},
+			{"rules", "string", "Comma-separated rule IDs to keep"},
+		}, paginationParameters...),
+		responses: []interface{}{
+			struct {
+				Points    int      `json:"points"`
+				Breakdown []string `json:"breakdown"`
+				Total     int      `json:"total"`
+			}{},
+			struct {
+				Points int           `json:"points"`
+				Rules  []RuleSummary `json:"rules"`
+			}{},
+		},
+	},
+	"GET /receipts/{id}/quality": {
+		summary: "Returns the receipt's data quality score and the warnings behind it",
+		responses: []interface{}{struct {
+			Quality  QualityScore `json:"quality"`
+			Warnings []Warning    `json:"warnings"`
+		}{}},
+	},
+	"GET /receipts/{id}/source": {
+		summary:   "Returns where the receipt was submitted from",
+		responses: []interface{}{Source{}},
+	},
+	"POST /enrichment/callbacks": {
+		summary: "Receives an enrichment provider's asynchronous result",
+		query:   []apiParameter{{"token", "string", "Token from the callbackUrl the provider was sent"}},
+		request: struct {
+			partialReceipt
+			Error string `json:"error,omitempty"`
+		}{},
+		status: http.StatusNoContent,
+	},
+	"GET /jobs/{id}": {
+		summary:   "Returns the status of a receipt submitted with Prefer: respond-async",
+		responses: []interface{}{Job{}},
+	},
+	"GET /schema/receipt.json": {
+		summary:   "Returns the JSON Schema receipts are validated against",
+		responses: []interface{}{receiptSubmission},
+	},
+	"GET /openapi.json": {
+		summary:   "Returns this OpenAPI document",
+		responses: []interface{}{map[string]interface{}{}},
+	},
+	"GET /docs/examples": {
+		summary: "Returns example requests for every operation",
+		query:   []apiParameter{{"lang", "string", "curl, go, python or js"}},
+		responses: []interface{}{struct {
+			Lang     string        `json:"lang"`
+			BaseURL  string        `json:"baseUrl"`
+			Examples []CodeExample `json:"examples"`
+		}{}},
+	},
+	"GET /stats": {
+		summary:   "Returns receipt, points, quality and source totals",
+		responses: []interface{}{Stats{}},
+	},
+	"GET /stats/heatmap": {
+		summary: "Returns receipt counts and average points by weekday and hour of purchase",
+		responses: []interface{}{struct {
+			Cells []HeatmapCell `json:"cells"`
+		}{}},
+	},
+	"GET /stats/items/top": {
+		summary: "Returns the most purchased items",
+		query:   []apiParameter{{"limit", "integer", "Maximum number of items to return"}},
+		responses: []interface{}{struct {
+			Items     []ItemStats `json:"items"`
+			Untracked int         `json:"untracked"`
+		}{}},
+	},
+	"GET /version": {
+		summary:   "Returns the server's version",
+		responses: []interface{}{VersionInfo{}},
+	},
+	"GET /users/{id}/digest": {
+		summary:   "Returns a member's activity over the last week or month",
+		query:     []apiParameter{{"period", "string", "week (the default) or month"}},
+		responses: []interface{}{Digest{}},
+	},
+	"GET /users/{id}/balance": {
+		summary: "Returns a member's points balance",
+		responses: []interface{}{struct {
+			UserID     string `json:"userId"`
+			Balance    int    `json:"balance"`
+			MergedInto string `json:"mergedInto,omitempty"`
+			GroupID    string `json:"groupId,omitempty"`
+		}{}},
+	},
+	"GET /users/{id}/ledger": {
+		summary:   "Returns a member's ledger entries, oldest first",
+		responses: []interface{}{[]LedgerEntry{}},
+	},
+	"POST /users/{id}/redeem": {
+		summary:   "Redeems points from a member's balance",
+		request:   pointsRequest{},
+		responses: []interface{}{LedgerEntry{}},
+	},
+	"GET /groups/leaderboard": {
+		summary: "Ranks the tenant's groups by the points their members have pooled",
+		query:   paginationParameters,
+		responses: []interface{}{struct {
+			Total  int             `json:"total"`
+			Groups []GroupStanding `json:"groups"`
+		}{}},
+	},
+	"GET /groups/{id}": {
+		summary:   "Returns a group's pooled balance and each member's balance, to its members and admins",
+		responses: []interface{}{GroupBalance{}},
+	},
+}
+
+// The spec served at GET /openapi.json, without servers; built by newRouter
+var openAPIDocument map[string]interface{}
+
+// Build the spec from the route table and the operations' Go types, so it can't drift
+// from what the handlers accept and return
+func buildOpenAPIDocument(routes []route) map[string]interface{} {
+	generator := &schemaGenerator{schemas: receiptSubmissionSchemas()}
+	paths := make(map[string]interface{})
+	for _, route := range routes {
+		relative, versioned := strings.CutPrefix(route.path, apiVersion)
+		if !versioned {
+			continue
+		}
+		operations := make(map[string]interface{})
+		for _, method := range route.methods {
+			operation, documented := apiOperations[method+" "+relative]
+			if documented {
+				operations[strings.ToLower(method)] = generator.operation(route.path, operation)
+			}
+		}
+		if len(operations) > 0 {
+			paths[route.path] = operations
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":       "Receipt Processor",
+			"description": "A simple receipt processor",
+			"version":     buildInfo().Version,
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": generator.schemas},
+	}
+}
+
+type schemaGenerator struct {
+	schemas map[string]interface{}
+}
+
+func (g *schemaGenerator) operation(path string, operation apiOperation) map[string]interface{} {
+	parameters := []interface{}{}
+	for _, segment := range strings.Split(path, "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			parameters = append(parameters, map[string]interface{}{
+				"name": strings.TrimSuffix(name, "}"), "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	for _, parameter := range operation.query {
+		parameters = append(parameters, map[string]interface{}{
+			"name": parameter.name, "in": "query", "description": parameter.description, "schema": map[string]interface{}{"type": parameter.typ},
+		})
+	}
+
+	status := operation.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if len(operation.responses) == 1 {
+		success["content"] = jsonContent(g.schemaOf(operation.responses[0]))
+	} else if len(operation.responses) > 1 {
+		alternatives := []interface{}{}
+		for _, response := range operation.responses {
+			alternatives = append(alternatives, g.schemaOf(response))
+		}
+		success["content"] = jsonContent(map[string]interface{}{"oneOf": alternatives})
+	}
+
+	result := map[string]interface{}{
+		"summary":    operation.summary,
+		"parameters": parameters,
+		"responses": map[string]interface{}{
+			strconv.Itoa(status): success,
+			"default": map[string]interface{}{
+				"description": "The request failed; the body explains why",
+				"content":     map[string]interface{}{"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}},
+			},
+		},
+	}
+	if operation.request != nil {
+		result["requestBody"] = map[string]interface{}{"required": true, "content": jsonContent(g.schemaOf(operation.request))}
+	}
+	return result
+}
+
+func jsonContent(schema interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+func (g *schemaGenerator) schemaOf(value interface{}) map[string]interface{} {
+	if ref, ok := value.(schemaRef); ok {
+		return map[string]interface{}{"$ref": "#/components/schemas/" + string(ref)}
+	}
+	return g.schema(reflect.TypeOf(value))
+}
+
+// The schema of values of t as encoding/json writes them. Named structs become
+// components, referenced wherever they're used.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return g.schema(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name := schemaName(t)
+		if _, generated := g.schemas[name]; !generated {
+			// Claim the name first so self-referencing types terminate
+			g.schemas[name] = nil
+			g.schemas[name] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func (g *schemaGenerator) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	required := []string{}
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				collect(field.Type)
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = g.schema(field.Type)
+			if !strings.Contains(","+options+",", ",omitempty,") {
+				required = append(required, name)
+			}
+		}
+	}
+	collect(t)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Component names are type names with an initial capital, e.g. PartialReceipt
+func schemaName(t reflect.Type) string {
+	first, size := utf8.DecodeRuneInString(t.Name())
+	return string(unicode.ToUpper(first)) + t.Name()[size:]
+}
+
+// ReceiptSubmission and its definitions, from the published receipt schema
+func receiptSubmissionSchemas() map[string]interface{} {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(receiptSchemaJSON, &schema); err != nil {
+		fatal("Error loading receipt schema", "error", err)
+	}
+	schemas := map[string]interface{}{string(receiptSubmission): schema}
+	definitions, _ := schema["$defs"].(map[string]interface{})
+	for name, definition := range definitions {
+		schemas[definitionName(name)] = definition
+	}
+	delete(schema, "$defs")
+	delete(schema, "$schema")
+	rewriteDefinitionRefs(schema)
+	for _, definition := range definitions {
+		rewriteDefinitionRefs(definition)
+	}
+	return schemas
+}
+
+// The component a definition of the receipt schema becomes, e.g. item is ReceiptSubmissionItem
+func definitionName(name string) string {
+	return string(receiptSubmission) + strings.ToUpper(name[:1]) + name[1:]
+}
+
+// Point "#/$defs/item" references at the ReceiptSubmissionItem component
+func rewriteDefinitionRefs(node interface{}) {
+	switch node := node.(type) {
+	case map[string]interface{}:
+		if ref, ok := node["$ref"].(string); ok {
+			if name, ok := strings.CutPrefix(ref, "#/$defs/"); ok {
+				node["$ref"] = "#/components/schemas/" + definitionName(name)
+			}
+		}
+		for _, child := range node {
+			rewriteDefinitionRefs(child)
+		}
+	case []interface{}:
+		for _, child := range node {
+			rewriteDefinitionRefs(child)
+		}
+	}
+}
+
+// GET /openapi.json
+func getOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	document := make(map[string]interface{}, len(openAPIDocument)+1)
+	for key, value := range openAPIDocument {
+		document[key] = value
+	}
+	document["servers"] = []interface{}{map[string]string{"url": externalBaseURL(r)}}
+	writeJSON(w, http.StatusOK, document)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// One row per receipt
+type ReceiptFact struct {
+	ID            string    `parquet:"id"`
+	Retailer      string    `parquet:"retailer"`
+	PurchaseDate  string    `parquet:"purchase_date"`
+	PurchaseTime  string    `parquet:"purchase_time"`
+	PurchasedAt   string    `parquet:"purchased_at,optional"`
+	TotalCents    int64     `parquet:"total_cents"`
+	Items         int32     `parquet:"items"`
+	Points        int64     `parquet:"points"`
+	RulesVersion  string    `parquet:"rules_version"`
+	QualityScore  int32     `parquet:"quality_score"`
+	Warnings      int32     `parquet:"warnings"`
+	UserID        string    `parquet:"user_id,optional"`
+	Tenant        string    `parquet:"tenant,optional"`
+	UserAgent     string    `parquet:"user_agent,optional"`
+	ClientVersion string    `parquet:"client_version,optional"`
+	Channel       string    `parquet:"channel"`
+	ScoredAt      time.Time `parquet:"scored_at,timestamp(millisecond)"`
+	ReceivedAt    time.Time `parquet:"received_at,timestamp(millisecond)"`
+}
+
+// One row per rule a receipt was awarded points for
+type RuleResultFact struct {
+	ReceiptID string `parquet:"receipt_id"`
+	Position  int32  `parquet:"position"`
+	Rule      string `parquet:"rule"`
+	Points    int64  `parquet:"points"`
+}
+
+type ParquetExport struct {
+	Files       []string `json:"files"`
+	Receipts    int      `json:"receipts"`
+	RuleResults int      `json:"ruleResults"`
+}
+
+func receiptFacts(receipts []Receipt) ([]ReceiptFact, []RuleResultFact) {
+	facts := make([]ReceiptFact, 0, len(receipts))
+	var results []RuleResultFact
+	for _, receipt := range receipts {
+		total, _ := parseCents(receipt.Total)
+		facts = append(facts, ReceiptFact{
+			ID:            receipt.ID,
+			Retailer:      receipt.Retailer,
+			PurchaseDate:  receipt.PurchaseDate,
+			PurchaseTime:  receipt.PurchaseTime,
+			PurchasedAt:   receipt.PurchasedAt,
+			TotalCents:    total,
+			Items:         int32(len(receipt.Items)),
+			Points:        int64(receipt.Points),
+			RulesVersion:  receipt.RulesVersion,
+			QualityScore:  int32(receipt.Quality.Score),
+			Warnings:      int32(len(receipt.Warnings)),
+			UserID:        exportedUserID(receipt),
+			Tenant:        receipt.Tenant,
+			UserAgent:     receipt.Source.UserAgent,
+			ClientVersion: receipt.Source.ClientVersion,
+			Channel:       receiptChannel(receipt),
+			ScoredAt:      receipt.ScoredAt.UTC(),
+			ReceivedAt:    receipt.ReceivedAt.UTC(),
+		})
+		for i, result := range receipt.Breakdown {
+			results = append(results, RuleResultFact{ReceiptID: receipt.ID, Position: int32(i), Rule: result.Rule, Points: int64(result.Points)})
+		}
+	}
+	return facts, results
+}
+
+func encodeParquet[T any](rows []T) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := parquet.NewGenericWriter[T](&buf)
+	if _, err := writer.Write(rows); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Write receipts and rule-result facts as Parquet files to a local directory or s3://bucket/prefix
+func exportParquet(ctx context.Context, receipts []Receipt, destination string) (ParquetExport, error) {
+	facts, results := receiptFacts(receipts)
+	receiptData, err := encodeParquet(facts)
+	if err != nil {
+		return ParquetExport{}, fmt.Errorf("encoding receipts: %w", err)
+	}
+	resultData, err := encodeParquet(results)
+	if err != nil {
+		return ParquetExport{}, fmt.Errorf("encoding rule results: %w", err)
+	}
+
+	// Timestamped names so repeated exports land side by side as new partitions
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	files := map[string][]byte{
+		"receipts/receipts-" + stamp + ".parquet":         receiptData,
+		"rule_results/rule_results-" + stamp + ".parquet": resultData,
+	}
+
+	export := ParquetExport{Receipts: len(facts), RuleResults: len(results)}
+	if strings.HasPrefix(destination, "s3://") {
+		bucket, prefix, err := parseS3URL(destination)
+		if err != nil {
+			return export, err
+		}
+		client, err := newS3Client(config)
+		if err != nil {
+			return export, err
+		}
+		for name, data := range files {
+			key := strings.TrimPrefix(prefix+"/"+name, "/")
+			if err := client.PutObject(ctx, bucket, key, "application/vnd.apache.parquet", data); err != nil {
+				return export, err
+			}
+			export.Files = append(export.Files, "s3://"+bucket+"/"+key)
+		}
+	} else {
+		for name, data := range files {
+			path := filepath.Join(destination, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				return export, err
+			}
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				return export, err
+			}
+			export.Files = append(export.Files, path)
+		}
+	}
+	slog.InfoContext(ctx, "Exported receipts to parquet", "receipts", export.Receipts, "rule_results", export.RuleResults, "destination", destination)
+	return export, nil
+}
+
+func handleParquetExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "POST")
+		return
+	}
+
+	var request struct {
+		Destination string `json:"destination"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Destination == "" {
+		http.Error(w, "destination is required", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid parquet export request", "error", err)
+		return
+	}
+
+	receipts, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Error reading receipts", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing receipts for export", "error", err)
+		return
+	}
+	export, err := exportParquet(r.Context(), receipts, request.Destination)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Export failed: %v", err), http.StatusBadGateway)
+		slog.ErrorContext(r.Context(), "Parquet export failed", "error", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, export)
+}
+
+// server export --to=<dir|s3://bucket/prefix> [--backend=<backend> --dsn=<dsn>]
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	to := flags.String("to", "", "local directory or s3://bucket/prefix to write Parquet files to")
+	backend := flags.String("backend", config.StorageBackend, "storage backend to export")
+	dsn := flags.String("dsn", config.StorageDSN, "storage DSN")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *to == "" {
+		return fmt.Errorf("--to is required")
+	}
+
+	s, err := openStore(*backend, *dsn)
+	if err != nil {
+		return fmt.Errorf("opening storage: %w", err)
+	}
+	defer s.Close()
+
+	receipts, err := s.List(context.Background())
+	if err != nil {
+		return err
+	}
+	export, err := exportParquet(context.Background(), receipts, *to)
+	if err != nil {
+		return err
+	}
+	for _, file := range export.Files {
+		fmt.Println(file)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+)
+
+// Stores partition receipts by purchase month (YYYY-MM), so reads of a range of purchase
+// dates and retention only touch the months involved. Receipts without a valid purchase
+// date, such as captured receipts still awaiting enrichment, share their own partition.
+const undatedPartition = "undated"
+
+func purchaseMonth(date string) string {
+	purchased, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return undatedPartition
+	}
+	return purchased.Format("2006-01")
+}
+
+// Whether a month's partition can hold receipts purchased from from up to but not
+// including to (YYYY-MM-DD, either may be empty); the undated partition is only part
+// of unbounded ranges
+func partitionInRange(month, from, to string) bool {
+	if month == undatedPartition {
+		return from == "" && to == ""
+	}
+	return (from == "" || month >= from[:min(len(from), len("2006-01"))]) && (to == "" || month+"-01" < to)
+}
+
+// Dates in YYYY-MM-DD format compare correctly as strings
+func purchasedInRange(receipt Receipt, from, to string) bool {
+	if !partitionInRange(purchaseMonth(receipt.PurchaseDate), from, to) {
+		return false
+	}
+	return (from == "" || receipt.PurchaseDate >= from) && (to == "" || receipt.PurchaseDate < to)
+}
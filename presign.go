@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	submissionURLDefaultTTL = 15 * time.Minute
+	submissionURLMaxTTL     = 24 * time.Hour
+)
+
+// Lifecycle of a pre-signed submission token
+const (
+	submissionUnused  = "unused"
+	submissionPending = "pending" // a submission with it is being processed
+	submissionUsed    = "used"
+)
+
+// A single-use token allowing one POST /receipts/process without other credentials
+type submissionToken struct {
+	tenant    string
+	userID    string
+	expiresAt time.Time
+	state     string
+}
+
+var submissionTokens = make(map[string]*submissionToken)
+var submissionMutex = &sync.Mutex{}
+
+// POST /admin/submission-urls with {"ttl": "15m", "tenant": "...", "userId": "..."}: mint a
+// pre-signed URL for kiosks and mobile web capture. The receipt submitted with it is
+// recorded under the given tenant and user, whatever the submitter sends.
+func createSubmissionURL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "POST")
+		return
+	}
+
+	var request struct {
+		TTL    string `json:"ttl"`
+		Tenant string `json:"tenant"`
+		UserID string `json:"userId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error decoding submission URL request", "error", err)
+		return
+	}
+	ttl := submissionURLDefaultTTL
+	if request.TTL != "" {
+		parsed, err := time.ParseDuration(request.TTL)
+		if err != nil || parsed <= 0 || parsed > submissionURLMaxTTL {
+			http.Error(w, "ttl must be a positive duration of at most "+submissionURLMaxTTL.String(), http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid submission URL ttl", "ttl", request.TTL)
+			return
+		}
+		ttl = parsed
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, "Error creating submission URL", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error creating submission token", "error", err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(secret)
+	expiresAt := time.Now().UTC().Add(ttl).Truncate(time.Second)
+
+	submissionMutex.Lock()
+	submissionTokens[token] = &submissionToken{tenant: request.Tenant, userID: request.UserID, expiresAt: expiresAt, state: submissionUnused}
+	submissionMutex.Unlock()
+
+	slog.InfoContext(r.Context(), "Created submission URL", "tenant", request.Tenant, "expires_at", expiresAt)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"url":       externalBaseURL(r) + apiVersion + "/receipts/process?token=" + token,
+		"expiresAt": expiresAt,
+		"tenant":    request.Tenant,
+		"userId":    request.UserID,
+	})
+}
+
+// Whether token can still be used, for letting its holder past PUBLIC_ALLOW_CIDRS
+func isUsableSubmissionToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	submissionMutex.Lock()
+	defer submissionMutex.Unlock()
+	submission, found := submissionTokens[token]
+	return found && submission.state == submissionUnused && time.Now().Before(submission.expiresAt)
+}
+
+// Reserve a token for the submission in progress, so concurrent requests can't both use it
+func claimSubmissionToken(w http.ResponseWriter, r *http.Request, token string) (submissionToken, bool) {
+	submissionMutex.Lock()
+	defer submissionMutex.Unlock()
+	submission, found := submissionTokens[token]
+	switch {
+	case !found:
+		http.Error(w, "Invalid submission token", http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "Rejected submission with an unknown token")
+	case !time.Now().Before(submission.expiresAt):
+		http.Error(w, "Submission URL has expired", http.StatusGone)
+		slog.WarnContext(r.Context(), "Rejected submission with an expired token", "expired_at", submission.expiresAt)
+	case submission.state != submissionUnused:
+		http.Error(w, "Submission URL was already used", http.StatusGone)
+		slog.WarnContext(r.Context(), "Rejected submission with a used token", "state", submission.state)
+	default:
+		submission.state = submissionPending
+		return *submission, true
+	}
+	return submissionToken{}, false
+}
+
+// Mark a claimed token used once its receipt is stored, or free it again so a rejected
+// submission can be corrected and retried
+func finishSubmissionToken(token string, stored bool) {
+	submissionMutex.Lock()
+	defer submissionMutex.Unlock()
+	if submission, found := submissionTokens[token]; found {
+		if stored {
+			submission.state = submissionUsed
+		} else {
+			submission.state = submissionUnused
+		}
+	}
+}
+
+func purgeSubmissionTokens() {
+	now := time.Now()
+	submissionMutex.Lock()
+	for token, submission := range submissionTokens {
+		if now.After(submission.expiresAt) && submission.state != submissionPending {
+			delete(submissionTokens, token)
+		}
+	}
+	submissionMutex.Unlock()
+}
+
+func startSubmissionTokenJanitor() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			purgeSubmissionTokens()
+		}
+	}()
+}
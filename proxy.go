@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Resolve the originating client IP. Forwarding headers are only honored when the
+// direct peer is a trusted proxy, otherwise any caller could spoof its address.
+func clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		return realIP
+	}
+
+	// Walk X-Forwarded-For from the right, skipping our own proxies, to find the first untrusted hop
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop != "" && !isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	return peer
+}
+
+func isTrustedProxy(address string) bool {
+	return containsIP(config.TrustedProxies, net.ParseIP(address))
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejecting callers by client IP before anything else, admin authentication
+// included. Admin endpoints (and raw payloads, which need the admin token) use the
+// ADMIN_* lists, everything else the PUBLIC_* lists. A denied address is always rejected;
+// when an allow list is set, only addresses on it get through.
+func ipFilter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allow, deny, surface := config.PublicAllowCIDRs, config.PublicDenyCIDRs, "public"
+		if isAdminPath(r.URL.Path) {
+			allow, deny, surface = config.AdminAllowCIDRs, config.AdminDenyCIDRs, "admin"
+		}
+		address := clientIP(r)
+		ip := net.ParseIP(address)
+		// A pre-signed submission URL is its own credential, usable from anywhere not denied
+		presigned := strings.EqualFold(r.URL.Path, apiVersion+"/receipts/process") && isUsableSubmissionToken(r.URL.Query().Get("token"))
+		if containsIP(deny, ip) || (len(allow) > 0 && !containsIP(allow, ip) && !presigned) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			slog.WarnContext(r.Context(), "Rejected request by client IP", "surface", surface, "path", r.URL.Path, "client_ip", address)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Compared case-insensitively, since routeGuard only canonicalizes the path afterwards
+func isAdminPath(path string) bool {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	if strings.EqualFold(segments[0], "admin") {
+		return true
+	}
+	return len(segments) == 4 && strings.EqualFold("/"+segments[0], apiVersion) && strings.EqualFold(segments[1], "receipts") && strings.EqualFold(segments[3], "raw")
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+)
+
+// Data-quality score for a receipt. Each component is 0-100 and Score is their average.
+type QualityScore struct {
+	Score         int `json:"score"`
+	Completeness  int `json:"completeness"`
+	Consistency   int `json:"consistency"`
+	Normalization int `json:"normalization"`
+}
+
+// Receipts scoring below this are counted as low quality in stats
+const lowQualityThreshold = 60
+
+func scoreQuality(receipt Receipt) QualityScore {
+	quality := QualityScore{Completeness: 100, Consistency: 100, Normalization: 100}
+
+	// A full timestamp carries the timezone the separate date and time fields lack
+	if receipt.PurchasedAt == "" {
+		quality.Completeness -= 20
+	}
+
+	for _, warning := range receipt.Warnings {
+		switch warning.Code {
+		case warningTotalMismatch:
+			quality.Consistency -= 60
+		case warningPurchasedAtOverride:
+			quality.Consistency -= 40
+		case warningPriceNormalized, warningTimeNormalized, warningDescriptionTrimmed:
+			quality.Normalization -= 10
+		}
+	}
+
+	quality.Consistency = max(quality.Consistency, 0)
+	quality.Normalization = max(quality.Normalization, 0)
+	quality.Score = int(math.Round(float64(quality.Completeness+quality.Consistency+quality.Normalization) / 3))
+	return quality
+}
+
+func getQuality(w http.ResponseWriter, r *http.Request, id string) {
+	receipt, ok := findReceipt(w, r, id)
+	if !ok {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Quality retrieved", "receipt_id", id, "score", receipt.Quality.Score)
+
+	// Respond with the quality score and the warnings behind it
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"quality":  receipt.Quality,
+		"warnings": receipt.Warnings,
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A client IP's token bucket: it holds up to RATE_LIMIT_BURST tokens, refilled at
+// RATE_LIMIT per second, and each request takes one
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+var rateBuckets = make(map[string]*rateBucket)
+var rateMutex = &sync.Mutex{}
+
+// Take a token from the client's bucket. Without one, reports how long until the next
+// token is available.
+func takeRateToken(client string, now time.Time) (bool, time.Duration) {
+	rateMutex.Lock()
+	defer rateMutex.Unlock()
+	bucket, found := rateBuckets[client]
+	if !found {
+		bucket = &rateBucket{tokens: float64(config.RateLimitBurst), updated: now}
+		rateBuckets[client] = bucket
+	}
+	bucket.tokens = min(float64(config.RateLimitBurst), bucket.tokens+now.Sub(bucket.updated).Seconds()*config.RateLimit)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / config.RateLimit * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Middleware limiting each client IP to RATE_LIMIT requests per second, with bursts of up
+// to RATE_LIMIT_BURST, so a client stuck in a loop can't take the service down for
+// everyone else. The admin endpoints and health probes aren't limited.
+func rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.RateLimit == 0 || isAdminPath(r.URL.Path) || isProbePath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		address := clientIP(r)
+		if ok, wait := takeRateToken(address, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests, retry later", http.StatusTooManyRequests)
+			slog.WarnContext(r.Context(), "Rate limited request", "path", r.URL.Path, "client_ip", address, "retry_after", wait.Round(time.Millisecond))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isProbePath(path string) bool {
+	return path == "/healthz" || path == "/readyz" || path == "/livez"
+}
+
+// Forget clients whose buckets have refilled, since they'd start out full anyway
+func purgeRateBuckets() {
+	refill := time.Duration(float64(config.RateLimitBurst) / config.RateLimit * float64(time.Second))
+	cutoff := time.Now().Add(-refill)
+	rateMutex.Lock()
+	for client, bucket := range rateBuckets {
+		if bucket.updated.Before(cutoff) {
+			delete(rateBuckets, client)
+		}
+	}
+	rateMutex.Unlock()
+}
+
+func startRateLimitJanitor() {
+	if config.RateLimit == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			purgeRateBuckets()
+		}
+	}()
+}
+
+func validateRateLimitConfig(cfg Config) []error {
+	var errs []error
+	if cfg.RateLimit > 0 && cfg.RateLimitBurst < 1 {
+		errs = append(errs, fmt.Errorf("RATE_LIMIT_BURST must be at least 1 when RATE_LIMIT is set, got %d", cfg.RateLimitBurst))
+	}
+	return errs
+}
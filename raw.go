@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Original request body kept for debugging, encrypted at rest with AES-GCM
+type rawPayload struct {
+	Nonce      []byte
+	Ciphertext []byte
+	Size       int
+	Truncated  bool
+	CapturedAt time.Time
+}
+
+var rawPayloads = make(map[string]rawPayload)
+var rawMutex = &sync.Mutex{}
+
+// Encrypt and keep the first RAW_CAPTURE_MAX_BYTES of a processed receipt's body
+func captureRawPayload(ctx context.Context, id string, body []byte) {
+	if !config.RawCapture {
+		return
+	}
+
+	payload := rawPayload{Size: len(body), CapturedAt: time.Now()}
+	if len(body) > config.RawCaptureMaxBytes {
+		body = body[:config.RawCaptureMaxBytes]
+		payload.Truncated = true
+	}
+
+	gcm, err := rawCipher()
+	if err != nil {
+		slog.ErrorContext(ctx, "Error capturing raw payload", "receipt_id", id, "error", err)
+		return
+	}
+	payload.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(payload.Nonce); err != nil {
+		slog.ErrorContext(ctx, "Error capturing raw payload", "receipt_id", id, "error", err)
+		return
+	}
+	// Bind the ciphertext to its receipt ID so payloads can't be swapped between receipts
+	payload.Ciphertext = gcm.Seal(nil, payload.Nonce, body, []byte(id))
+
+	rawMutex.Lock()
+	rawPayloads[id] = payload
+	rawMutex.Unlock()
+	slog.InfoContext(ctx, "Captured raw payload", "receipt_id", id, "bytes", len(body), "truncated", payload.Truncated)
+}
+
+func rawCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(config.RawCaptureKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Drop captured payloads older than the retention period
+func purgeRawPayloads() {
+	cutoff := time.Now().Add(-config.RawCaptureRetention)
+	purged := 0
+	rawMutex.Lock()
+	for id, payload := range rawPayloads {
+		if payload.CapturedAt.Before(cutoff) {
+			delete(rawPayloads, id)
+			purged++
+		}
+	}
+	rawMutex.Unlock()
+	if purged > 0 {
+		slog.Info("Purged raw payloads past retention", "purged", purged)
+	}
+}
+
+func startRawPayloadJanitor() {
+	if !config.RawCapture {
+		return
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			purgeRawPayloads()
+		}
+	}()
+}
+
+func getRawPayload(w http.ResponseWriter, r *http.Request, id string) {
+	if !isValidReceiptID(id) {
+		http.Error(w, "Invalid ID format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid receipt ID format", "receipt_id", id)
+		return
+	}
+
+	rawMutex.Lock()
+	payload, found := rawPayloads[id]
+	rawMutex.Unlock()
+
+	if !found || time.Since(payload.CapturedAt) > config.RawCaptureRetention {
+		http.Error(w, "Raw payload not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Raw payload not found", "receipt_id", id)
+		return
+	}
+
+	gcm, err := rawCipher()
+	if err != nil {
+		http.Error(w, "Error decrypting raw payload", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error decrypting raw payload", "receipt_id", id, "error", err)
+		return
+	}
+	body, err := gcm.Open(nil, payload.Nonce, payload.Ciphertext, []byte(id))
+	if err != nil {
+		http.Error(w, "Error decrypting raw payload", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error decrypting raw payload", "receipt_id", id, "error", err)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Raw payload retrieved", "receipt_id", id)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Raw-Captured-At", payload.CapturedAt.UTC().Format(time.RFC3339))
+	w.Header().Set("X-Raw-Original-Size", strconv.Itoa(payload.Size))
+	w.Header().Set("X-Raw-Truncated", strconv.FormatBool(payload.Truncated))
+	w.Write(body)
+}
+
+// Accept a 32-byte AES-256 key encoded as hex or base64
+func parseRawCaptureKey(value string, required bool, errs *[]error) []byte {
+	if value == "" {
+		if required {
+			*errs = append(*errs, fmt.Errorf("RAW_CAPTURE_KEY is required when RAW_CAPTURE is enabled"))
+		}
+		return nil
+	}
+	return decodeKey("RAW_CAPTURE_KEY", value, errs)
+}
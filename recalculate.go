@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Receipts a recalculation job lists under failedReceipts; failures beyond these are only counted
+const maxRecalculationFailures = 100
+
+type RecalculationFailure struct {
+	ReceiptID string `json:"receiptId"`
+	Error     string `json:"error"`
+}
+
+// A bulk re-scoring of every stored receipt under the current rules, started with
+// POST /admin/recalculate
+type RecalculationJob struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	RulesVersion string `json:"rulesVersion"`
+	Total        int    `json:"total"`
+	Processed    int    `json:"processed"`
+	// Receipts whose points changed, and by how many points in all
+	Changed     int `json:"changed"`
+	PointsDelta int `json:"pointsDelta"`
+	// Voided receipts and receipts awaiting enrichment, which aren't re-scored
+	Skipped        int                    `json:"skipped"`
+	Failures       int                    `json:"failures"`
+	FailedReceipts []RecalculationFailure `json:"failedReceipts"`
+	// Times the job was picked up again after a restart
+	Resumed     int        `json:"resumed"`
+	Error       string     `json:"error,omitempty"`
+	StartedAt   time.Time  `json:"startedAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+	ETA         *time.Time `json:"eta,omitempty"`
+}
+
+// What RECALCULATION_STATE_FILE holds for a job: its progress up to the last completed chunk,
+// the last receipt ID of that chunk, and the points the receipts of the chunk in flight had
+// before it started. A job resumed in the middle of a chunk redoes it against those points
+// with the same ledger operation IDs, so members are never credited twice.
+type recalculationCheckpoint struct {
+	Job     RecalculationJob `json:"job"`
+	Cursor  string           `json:"cursor,omitempty"`
+	Pending map[string]int   `json:"pending,omitempty"`
+}
+
+type recalculation struct {
+	recalculationCheckpoint
+	// Progress since the job was started or resumed by this instance, for the ETA
+	runStartedAt time.Time
+	runProcessed int
+}
+
+var recalculations = make(map[string]*recalculation)
+var recalculationsMutex = &sync.Mutex{}
+
+// Resume the jobs RECALCULATION_STATE_FILE has as still processing. Called once the store
+// stack is complete, so re-scored receipts reach stats, search and the change feed.
+func startRecalculations() error {
+	if config.RecalculationStateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(config.RecalculationStateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading recalculation state: %w", err)
+	}
+	var checkpoints []recalculationCheckpoint
+	if err := json.Unmarshal(data, &checkpoints); err != nil {
+		return fmt.Errorf("decoding recalculation state %s: %w", config.RecalculationStateFile, err)
+	}
+
+	recalculationsMutex.Lock()
+	defer recalculationsMutex.Unlock()
+	for _, checkpoint := range checkpoints {
+		job := &recalculation{recalculationCheckpoint: checkpoint}
+		recalculations[checkpoint.Job.ID] = job
+		if checkpoint.Job.Status == jobProcessing {
+			job.Job.Resumed++
+			slog.Info("Resuming recalculation", "job_id", checkpoint.Job.ID, "processed", checkpoint.Job.Processed, "total", checkpoint.Job.Total)
+			go job.run()
+		}
+	}
+	return nil
+}
+
+// Write every job's checkpoint to RECALCULATION_STATE_FILE; the caller holds recalculationsMutex
+func saveRecalculationsLocked() error {
+	if config.RecalculationStateFile == "" {
+		return nil
+	}
+	checkpoints := make([]recalculationCheckpoint, 0, len(recalculations))
+	for _, job := range recalculations {
+		checkpoints = append(checkpoints, job.recalculationCheckpoint)
+	}
+	sort.Slice(checkpoints, func(i, j int) bool { return checkpoints[i].Job.StartedAt.Before(checkpoints[j].Job.StartedAt) })
+	data, err := json.Marshal(checkpoints)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(config.RecalculationStateFile, data)
+}
+
+// Re-score the receipts after the cursor a chunk at a time, in receipt ID order
+func (job *recalculation) run() {
+	ctx := context.Background()
+	receipts, err := store.List(ctx)
+	if err != nil {
+		job.fail(fmt.Errorf("listing receipts: %w", err))
+		return
+	}
+	var ids []string
+	for _, receipt := range receipts {
+		if receipt.ID > job.Cursor {
+			ids = append(ids, receipt.ID)
+		}
+	}
+	sort.Strings(ids)
+
+	recalculationsMutex.Lock()
+	job.Job.Total = job.Job.Processed + len(ids)
+	job.runStartedAt, job.runProcessed = time.Now(), 0
+	recalculationsMutex.Unlock()
+
+	for len(ids) > 0 {
+		chunk := ids[:min(config.RecalculationChunkSize, len(ids))]
+		ids = ids[len(chunk):]
+		if err := job.runChunk(ctx, chunk); err != nil {
+			job.fail(err)
+			return
+		}
+	}
+
+	recalculationsMutex.Lock()
+	completedAt := time.Now().UTC()
+	job.Job.Status, job.Job.CompletedAt, job.Job.UpdatedAt = jobSucceeded, &completedAt, completedAt
+	job.Cursor = ""
+	err = saveRecalculationsLocked()
+	summary := job.Job
+	recalculationsMutex.Unlock()
+	if err != nil {
+		slog.Error("Error saving recalculation state", "job_id", summary.ID, "error", err)
+	}
+	slog.Info("Recalculation completed", "job_id", summary.ID, "processed", summary.Processed, "changed", summary.Changed, "points_delta", summary.PointsDelta, "failures", summary.Failures)
+}
+
+// Re-score one chunk. Lifecycle actions and updates wait until it is done, so the points
+// recorded as pending are the ones the ledger was last settled for.
+func (job *recalculation) runChunk(ctx context.Context, ids []string) error {
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+
+	receipts := make([]Receipt, 0, len(ids))
+	for _, id := range ids {
+		receipt, found, err := store.Get(ctx, id)
+		if err != nil {
+			return fmt.Errorf("reading receipt %s: %w", id, err)
+		}
+		if found {
+			receipts = append(receipts, receipt)
+		}
+	}
+
+	recalculationsMutex.Lock()
+	// A chunk redone after a restart keeps the points from before its first attempt
+	if job.Pending == nil {
+		job.Pending = make(map[string]int, len(receipts))
+		for _, receipt := range receipts {
+			job.Pending[receipt.ID] = receipt.Points
+		}
+	}
+	pending := job.Pending
+	err := saveRecalculationsLocked()
+	recalculationsMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("saving recalculation checkpoint: %w", err)
+	}
+
+	var result RecalculationJob
+	for _, receipt := range receipts {
+		status := receiptStatus(receipt)
+		if status == statusVoided || status == statusNeedsEnrichment {
+			result.Skipped++
+			continue
+		}
+		previousPoints, found := pending[receipt.ID]
+		if !found {
+			previousPoints = receipt.Points
+		}
+		if err := job.recalculate(ctx, &receipt, previousPoints); err != nil {
+			result.Failures++
+			result.FailedReceipts = append(result.FailedReceipts, RecalculationFailure{ReceiptID: receipt.ID, Error: err.Error()})
+			slog.Warn("Error recalculating receipt", "job_id", job.Job.ID, "receipt_id", receipt.ID, "error", err)
+			continue
+		}
+		if receipt.Points != previousPoints {
+			result.Changed++
+			result.PointsDelta += receipt.Points - previousPoints
+		}
+	}
+	// The ledger is saved with the chunk's adjustments before the checkpoint moves past it
+	if config.LedgerSnapshotFile != "" {
+		if err := ledger.Save(config.LedgerSnapshotFile); err != nil {
+			return fmt.Errorf("saving ledger snapshot: %w", err)
+		}
+	}
+
+	recalculationsMutex.Lock()
+	defer recalculationsMutex.Unlock()
+	job.Job.Processed += len(ids)
+	job.Job.Changed += result.Changed
+	job.Job.PointsDelta += result.PointsDelta
+	job.Job.Skipped += result.Skipped
+	job.Job.Failures += result.Failures
+	for _, failure := range result.FailedReceipts {
+		if len(job.Job.FailedReceipts) < maxRecalculationFailures {
+			job.Job.FailedReceipts = append(job.Job.FailedReceipts, failure)
+		}
+	}
+	job.Job.UpdatedAt = time.Now().UTC()
+	job.runProcessed += len(ids)
+	job.Cursor, job.Pending = ids[len(ids)-1], nil
+	if err := saveRecalculationsLocked(); err != nil {
+		return fmt.Errorf("saving recalculation checkpoint: %w", err)
+	}
+	return nil
+}
+
+// Re-score and store a receipt, settling the difference from previousPoints with the member.
+// The ledger operation is named after the job and receipt, so a redone chunk replays it.
+func (job *recalculation) recalculate(ctx context.Context, receipt *Receipt, previousPoints int) error {
+	if err := scoreReceipt(ctx, receipt); err != nil {
+		return err
+	}
+	if err := store.Put(ctx, *receipt); err != nil {
+		return fmt.Errorf("storing receipt: %w", err)
+	}
+	if points := receipt.Points - previousPoints; points != 0 && receipt.UserID != "" {
+		memo := fmt.Sprintf("Receipt %s recalculated under rules version %s", receipt.ID, receipt.RulesVersion)
+		if _, err := ledger.Adjust(receipt.Tenant, receipt.UserID, points, memo, "recalculate:"+job.Job.ID+":"+receipt.ID); err != nil {
+			return fmt.Errorf("adjusting points: %w", err)
+		}
+	}
+	traceScoring(ctx, *receipt, eventReceiptRecalculated)
+	// Only receipts whose points changed are announced, so a job doesn't flood subscribers
+	if receipt.Points != previousPoints {
+		publishWebhook(WebhookEvent{Type: eventReceiptRecalculated, PreviousPoints: &previousPoints, Reason: "recalculation " + job.Job.ID, Receipt: *receipt})
+	}
+	return nil
+}
+
+func (job *recalculation) fail(err error) {
+	recalculationsMutex.Lock()
+	completedAt := time.Now().UTC()
+	job.Job.Status, job.Job.Error, job.Job.CompletedAt, job.Job.UpdatedAt = jobFailed, err.Error(), &completedAt, completedAt
+	saveErr := saveRecalculationsLocked()
+	recalculationsMutex.Unlock()
+	slog.Error("Recalculation failed", "job_id", job.Job.ID, "error", err)
+	if saveErr != nil {
+		slog.Error("Error saving recalculation state", "job_id", job.Job.ID, "error", saveErr)
+	}
+}
+
+// The job as served, with an ETA extrapolated from this instance's progress on it
+func (job *recalculation) snapshotLocked() RecalculationJob {
+	snapshot := job.Job
+	snapshot.FailedReceipts = append([]RecalculationFailure{}, job.Job.FailedReceipts...)
+	if snapshot.Status == jobProcessing && job.runProcessed > 0 {
+		elapsed := time.Since(job.runStartedAt)
+		remaining := time.Duration(float64(elapsed) / float64(job.runProcessed) * float64(snapshot.Total-snapshot.Processed))
+		eta := time.Now().UTC().Add(remaining).Truncate(time.Second)
+		snapshot.ETA = &eta
+	}
+	return snapshot
+}
+
+// POST /admin/recalculate: start re-scoring every stored receipt in the background
+func startRecalculation(w http.ResponseWriter, r *http.Request) {
+	recalculationsMutex.Lock()
+	defer recalculationsMutex.Unlock()
+	for _, job := range recalculations {
+		if job.Job.Status == jobProcessing {
+			http.Error(w, "Recalculation "+job.Job.ID+" is still processing", http.StatusConflict)
+			slog.WarnContext(r.Context(), "Rejected recalculation: another is processing", "job_id", job.Job.ID)
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	job := &recalculation{recalculationCheckpoint: recalculationCheckpoint{Job: RecalculationJob{
+		ID:             uuid.NewString(),
+		Status:         jobProcessing,
+		RulesVersion:   rulesVersion,
+		FailedReceipts: []RecalculationFailure{},
+		StartedAt:      now,
+		UpdatedAt:      now,
+	}}}
+	recalculations[job.Job.ID] = job
+	if err := saveRecalculationsLocked(); err != nil {
+		delete(recalculations, job.Job.ID)
+		http.Error(w, "Error saving recalculation state", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error saving recalculation state", "error", err)
+		return
+	}
+	go job.run()
+
+	slog.InfoContext(r.Context(), "Started recalculation", "job_id", job.Job.ID, "rules_version", rulesVersion)
+	w.Header().Set("Location", config.BasePath+"/admin/recalculate/"+job.Job.ID)
+	writeJSON(w, http.StatusAccepted, job.snapshotLocked())
+}
+
+// GET /admin/recalculate/{jobId}
+func getRecalculation(w http.ResponseWriter, r *http.Request, id string) {
+	recalculationsMutex.Lock()
+	job, found := recalculations[id]
+	var snapshot RecalculationJob
+	if found {
+		snapshot = job.snapshotLocked()
+	}
+	recalculationsMutex.Unlock()
+	if !found {
+		http.Error(w, "Recalculation not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Recalculation not found", "job_id", id)
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+func validateRecalculationConfig(cfg Config) []error {
+	var errs []error
+	if cfg.RecalculationChunkSize < 1 {
+		errs = append(errs, fmt.Errorf("RECALCULATION_CHUNK_SIZE must be at least 1, got %d", cfg.RecalculationChunkSize))
+	}
+	return errs
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Report periods and how far back each one looks
+var reportPeriods = map[string]time.Duration{
+	"daily":  24 * time.Hour,
+	"weekly": 7 * 24 * time.Hour,
+}
+
+// Requests by the hour for a week, for report error rates
+var reportMetrics = newRequestMetrics(time.Hour, 7*24*time.Hour+time.Hour, 0)
+var reportMetricsSince = time.Now().UTC()
+
+// An operational summary of the receipts received and requests served over a period
+type OperationalReport struct {
+	Period        string            `json:"period"`
+	From          time.Time         `json:"from"`
+	To            time.Time         `json:"to"`
+	Receipts      int               `json:"receipts"`
+	Points        int               `json:"points"`
+	AveragePoints float64           `json:"averagePoints"`
+	Users         int               `json:"users"`
+	WithWarnings  int               `json:"withWarnings"`
+	TopRetailers  []RetailerSummary `json:"topRetailers"`
+	Requests      int               `json:"requests"`
+	// 5xx responses, and 4xx responses such as rejected submissions
+	ServerErrors    int     `json:"serverErrors"`
+	ClientErrors    int     `json:"clientErrors"`
+	ServerErrorRate float64 `json:"serverErrorRate"`
+	ClientErrorRate float64 `json:"clientErrorRate"`
+	P95LatencyMs    int64   `json:"p95LatencyMs"`
+	// Set when this instance started during the period, so request counts only cover it
+	// since then. Requests served by other instances are never counted.
+	RequestsSince *time.Time `json:"requestsSince,omitempty"`
+}
+
+// Summarize the receipts received in the period ending now and this instance's requests
+func buildReport(ctx context.Context, period string, now time.Time) (OperationalReport, error) {
+	length := reportPeriods[period]
+	report := OperationalReport{Period: period, From: now.Add(-length), To: now, TopRetailers: []RetailerSummary{}}
+	receipts, err := store.List(ctx)
+	if err != nil {
+		return report, err
+	}
+
+	users := map[string]bool{}
+	retailers := map[string]*RetailerSummary{}
+	for _, receipt := range receipts {
+		// Receipts stored before receivedAt was recorded fall back to when they were scored
+		received := receipt.ReceivedAt
+		if received.IsZero() {
+			received = receipt.ScoredAt
+		}
+		if received.Before(report.From) || received.After(now) {
+			continue
+		}
+		report.Receipts++
+		report.Points += receipt.Points
+		if receipt.UserID != "" {
+			users[receipt.UserID] = true
+		}
+		if len(receipt.Warnings) > 0 {
+			report.WithWarnings++
+		}
+		if retailers[receipt.Retailer] == nil {
+			retailers[receipt.Retailer] = &RetailerSummary{Retailer: receipt.Retailer}
+		}
+		retailers[receipt.Retailer].Receipts++
+		retailers[receipt.Retailer].Points += receipt.Points
+	}
+	report.Users = len(users)
+	if report.Receipts > 0 {
+		report.AveragePoints = round2(float64(report.Points) / float64(report.Receipts))
+	}
+	for _, summary := range retailers {
+		report.TopRetailers = append(report.TopRetailers, *summary)
+	}
+	sort.Slice(report.TopRetailers, func(i, j int) bool {
+		a, b := report.TopRetailers[i], report.TopRetailers[j]
+		if a.Receipts != b.Receipts {
+			return a.Receipts > b.Receipts
+		}
+		return a.Retailer < b.Retailer
+	})
+	if len(report.TopRetailers) > config.ReportTopRetailers {
+		report.TopRetailers = report.TopRetailers[:config.ReportTopRetailers]
+	}
+
+	stats := reportMetrics.window(length)
+	report.Requests, report.ServerErrors, report.ClientErrors = stats.Requests, stats.Errors, stats.ClientErrors
+	if stats.Requests > 0 {
+		report.ServerErrorRate = round4(stats.ErrorRate())
+		report.ClientErrorRate = round4(float64(stats.ClientErrors) / float64(stats.Requests))
+	}
+	report.P95LatencyMs = stats.Latency.Quantile(0.95).Milliseconds()
+	if reportMetricsSince.After(report.From) {
+		since := reportMetricsSince
+		report.RequestsSince = &since
+	}
+	return report, nil
+}
+
+func (report OperationalReport) title() string {
+	return fmt.Sprintf("Receipt Processor %s report, %s to %s", report.Period, report.From.Format("2006-01-02 15:04"), report.To.Format("2006-01-02 15:04 MST"))
+}
+
+func renderReportMarkdown(report OperationalReport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", report.title())
+	fmt.Fprintf(&b, "## Volume\n\n")
+	fmt.Fprintf(&b, "- Receipts: %d, from %d users\n", report.Receipts, report.Users)
+	fmt.Fprintf(&b, "- Points: %d, %.2f per receipt\n", report.Points, report.AveragePoints)
+	fmt.Fprintf(&b, "- Receipts with warnings: %d\n\n", report.WithWarnings)
+	fmt.Fprintf(&b, "## Top retailers\n\n")
+	if len(report.TopRetailers) == 0 {
+		fmt.Fprintf(&b, "No receipts.\n\n")
+	} else {
+		fmt.Fprintf(&b, "| Retailer | Receipts | Points |\n|---|---:|---:|\n")
+		for _, retailer := range report.TopRetailers {
+			// Pipes would end the table cell
+			fmt.Fprintf(&b, "| %s | %d | %d |\n", strings.ReplaceAll(retailer.Retailer, "|", `\|`), retailer.Receipts, retailer.Points)
+		}
+		fmt.Fprintf(&b, "\n")
+	}
+	fmt.Fprintf(&b, "## Requests\n\n")
+	fmt.Fprintf(&b, "- Requests: %d, p95 latency %dms\n", report.Requests, report.P95LatencyMs)
+	fmt.Fprintf(&b, "- Server errors (5xx): %d (%.2f%%)\n", report.ServerErrors, report.ServerErrorRate*100)
+	fmt.Fprintf(&b, "- Client errors (4xx): %d (%.2f%%)\n", report.ClientErrors, report.ClientErrorRate*100)
+	if report.RequestsSince != nil {
+		fmt.Fprintf(&b, "\nRequest counts only cover this instance since it started at %s.\n", report.RequestsSince.Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(rate float64) string { return fmt.Sprintf("%.2f%%", rate*100) },
+	"time":    func(t time.Time) string { return t.Format(time.RFC3339) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body style="font-family: sans-serif">
+<h1>{{.Title}}</h1>
+<h2>Volume</h2>
+<ul>
+<li>Receipts: {{.Receipts}}, from {{.Users}} users</li>
+<li>Points: {{.Points}}, {{printf "%.2f" .AveragePoints}} per receipt</li>
+<li>Receipts with warnings: {{.WithWarnings}}</li>
+</ul>
+<h2>Top retailers</h2>
+{{if .TopRetailers}}<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Retailer</th><th>Receipts</th><th>Points</th></tr>
+{{range .TopRetailers}}<tr><td>{{.Retailer}}</td><td align="right">{{.Receipts}}</td><td align="right">{{.Points}}</td></tr>
+{{end}}</table>{{else}}<p>No receipts.</p>{{end}}
+<h2>Requests</h2>
+<ul>
+<li>Requests: {{.Requests}}, p95 latency {{.P95LatencyMs}}ms</li>
+<li>Server errors (5xx): {{.ServerErrors}} ({{percent .ServerErrorRate}})</li>
+<li>Client errors (4xx): {{.ClientErrors}} ({{percent .ClientErrorRate}})</li>
+</ul>
+{{with .RequestsSince}}<p>Request counts only cover this instance since it started at {{time .}}.</p>{{end}}
+</body>
+</html>
+`))
+
+func renderReportHTML(report OperationalReport) (string, error) {
+	var b strings.Builder
+	err := reportTemplate.Execute(&b, struct {
+		OperationalReport
+		Title string
+	}{report, report.title()})
+	return b.String(), err
+}
+
+// Send a report to the configured notifiers every day, or every Monday, at REPORT_TIME UTC
+func startReports() {
+	if config.ReportSchedule == "" {
+		return
+	}
+	notifiers := configuredNotifiers()
+	if len(notifiers) == 0 {
+		slog.Warn("REPORT_SCHEDULE is set but no notifier is configured, not sending reports")
+		return
+	}
+	slog.Info("Scheduled reports", "schedule", config.ReportSchedule, "next", nextReportTime(time.Now().UTC()))
+	go func() {
+		for {
+			next := nextReportTime(time.Now().UTC())
+			time.Sleep(time.Until(next))
+			if err := sendReport(notifiers, next); err != nil {
+				slog.Error("Error sending report", "schedule", config.ReportSchedule, "error", err)
+			}
+		}
+	}()
+}
+
+func nextReportTime(now time.Time) time.Time {
+	at, _ := time.Parse("15:04", config.ReportTime)
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, time.UTC)
+	for !next.After(now) || (config.ReportSchedule == "weekly" && next.Weekday() != time.Monday) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+func sendReport(notifiers []Notifier, now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	report, err := buildReport(ctx, config.ReportSchedule, now)
+	if err != nil {
+		return err
+	}
+	html, err := renderReportHTML(report)
+	if err != nil {
+		return err
+	}
+	slog.Info("Sending report", "period", report.Period, "receipts", report.Receipts, "requests", report.Requests)
+	return notifyAll(ctx, notifiers, Notification{
+		Key:      "receipt-processor-report-" + report.Period,
+		Title:    report.title(),
+		Message:  renderReportMarkdown(report),
+		HTML:     html,
+		Severity: severityInfo,
+	})
+}
+
+// GET /admin/reports/{period}?format=json|markdown|html: the report for the period ending now
+func getReport(w http.ResponseWriter, r *http.Request, period string) {
+	if _, ok := reportPeriods[period]; !ok {
+		http.Error(w, "period must be daily or weekly", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Invalid report period", "period", period)
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "markdown" && format != "html" {
+		http.Error(w, "format must be json, markdown or html", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid report format", "format", format)
+		return
+	}
+
+	report, err := buildReport(r.Context(), period, time.Now().UTC())
+	if err != nil {
+		http.Error(w, "Error reading receipts", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing receipts for report", "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Report generated", "period", period, "format", format, "receipts", report.Receipts)
+	switch format {
+	case "markdown":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		fmt.Fprint(w, renderReportMarkdown(report))
+	case "html":
+		html, err := renderReportHTML(report)
+		if err != nil {
+			http.Error(w, "Error rendering report", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Error rendering report", "error", err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, html)
+	default:
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+func validateReportConfig(cfg Config) []error {
+	var errs []error
+	if _, ok := reportPeriods[cfg.ReportSchedule]; cfg.ReportSchedule != "" && !ok {
+		errs = append(errs, fmt.Errorf("REPORT_SCHEDULE must be daily or weekly, got %q", cfg.ReportSchedule))
+	}
+	if _, err := time.Parse("15:04", cfg.ReportTime); err != nil {
+		errs = append(errs, fmt.Errorf("REPORT_TIME must be a UTC time such as 06:00, got %q", cfg.ReportTime))
+	}
+	if cfg.ReportTopRetailers < 1 {
+		errs = append(errs, fmt.Errorf("REPORT_TOP_RETAILERS must be at least 1, got %d", cfg.ReportTopRetailers))
+	}
+	return errs
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const retentionCheckInterval = 10 * time.Minute
+
+// What RECEIPT_RETENTION counts from, selected with RECEIPT_RETENTION_BASIS
+const (
+	retentionReceived  = "received"
+	retentionPurchased = "purchased"
+)
+
+// Delete receipts received, or with RECEIPT_RETENTION_BASIS=purchased purchased, more than
+// RECEIPT_RETENTION ago, then drop the purchase month partitions left empty. Deletes go
+// through the full store stack so stats, search and the change feed see them.
+func evictExpiredReceipts(ctx context.Context, now time.Time) (int, int, error) {
+	cutoff := now.Add(-config.ReceiptRetention)
+	var receipts []Receipt
+	var err error
+	if config.ReceiptRetentionBasis == retentionPurchased {
+		// Only the partitions of months up to the cutoff are read
+		receipts, err = store.ListPurchased(ctx, "", cutoff.Format("2006-01-02"))
+	} else {
+		receipts, err = store.List(ctx)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	evicted := 0
+	for _, receipt := range receipts {
+		if config.ReceiptRetentionBasis == retentionReceived {
+			// Receipts stored before receivedAt was recorded fall back to when they were scored
+			received := receipt.ReceivedAt
+			if received.IsZero() {
+				received = receipt.ScoredAt
+			}
+			if !received.Before(cutoff) {
+				continue
+			}
+		}
+		deleted, err := store.Delete(ctx, receipt.ID)
+		if err != nil {
+			return evicted, 0, err
+		}
+		if deleted {
+			evicted++
+		}
+	}
+
+	dropped, err := store.DropEmptyPartitions(ctx, cutoff.Format("2006-01"))
+	return evicted, dropped, err
+}
+
+func startRetentionJanitor() {
+	if config.ReceiptRetention == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(retentionCheckInterval) {
+			evicted, dropped, err := evictExpiredReceipts(context.Background(), time.Now().UTC())
+			if err != nil {
+				slog.Error("Error evicting receipts past RECEIPT_RETENTION", "error", err)
+			}
+			if evicted > 0 || dropped > 0 {
+				slog.Info("Evicted receipts past RECEIPT_RETENTION", "evicted", evicted, "dropped_partitions", dropped)
+			}
+		}
+	}()
+}
+
+func parseRetentionBasis(value string, errs *[]error) string {
+	switch value {
+	case retentionReceived, retentionPurchased:
+		return value
+	}
+	*errs = append(*errs, fmt.Errorf("RECEIPT_RETENTION_BASIS must be %q or %q, got %q", retentionReceived, retentionPurchased, value))
+	return retentionReceived
+}
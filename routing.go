@@ -0,0 +1,205 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// The version prefix of the public API, so later versions can be served alongside it.
+// Admin endpoints are versioned with the server and stay under /admin.
+const apiVersion = "/v1"
+
+// Every route the API serves; {braced} segments match any single non-empty segment and
+// reach the handler as path values
+type route struct {
+	path    string
+	methods []string
+	handler http.HandlerFunc
+}
+
+var routes = []route{
+	{apiVersion + "/receipts", []string{http.MethodGet}, listReceipts},
+	{apiVersion + "/receipts/process", []string{http.MethodPost}, processReceipt},
+	{apiVersion + "/receipts/search", []string{http.MethodGet}, searchReceipts},
+	{apiVersion + "/receipts/summary", []string{http.MethodGet}, getSummary},
+	{apiVersion + "/receipts/score", []string{http.MethodPost}, previewScore},
+	{apiVersion + "/receipts/capture", []string{http.MethodPost}, captureReceipt},
+	{apiVersion + "/receipts/stream", []string{http.MethodGet}, streamReceipts},
+	{apiVersion + "/receipts/live", []string{http.MethodGet}, liveReceipts},
+	{apiVersion + "/receipts/{id}", []string{http.MethodGet, http.MethodPut, http.MethodDelete}, withPathValue("id", handleReceipt)},
+	{apiVersion + "/receipts/{id}/enrich", []string{http.MethodPost}, withPathValue("id", enrichReceipt)},
+	{apiVersion + "/receipts/{id}/finalize", []string{http.MethodPost}, withPathValue("id", finalizeReceipt)},
+	{apiVersion + "/receipts/{id}/points", []string{http.MethodGet}, withPathValue("id", getPoints)},
+	{apiVersion + "/receipts/{id}/breakdown", []string{http.MethodGet}, withPathValue("id", getBreakdown)},
+	{apiVersion + "/receipts/{id}/quality", []string{http.MethodGet}, withPathValue("id", getQuality)},
+	{apiVersion + "/receipts/{id}/source", []string{http.MethodGet}, withPathValue("id", getSource)},
+	{apiVersion + "/receipts/{id}/raw", []string{http.MethodGet}, requireAdmin(withPathValue("id", getRawPayload))},
+	{apiVersion + "/enrichment/callbacks", []string{http.MethodPost}, handleEnrichmentCallback},
+	{apiVersion + "/jobs/{id}", []string{http.MethodGet}, withPathValue("id", getJob)},
+	{apiVersion + "/schema/receipt.json", []string{http.MethodGet}, getReceiptSchema},
+	{apiVersion + "/openapi.json", []string{http.MethodGet}, getOpenAPISpec},
+	{apiVersion + "/docs/examples", []string{http.MethodGet}, getExamples},
+	{apiVersion + "/stats", []string{http.MethodGet}, getStats},
+	{apiVersion + "/stats/heatmap", []string{http.MethodGet}, getHeatmap},
+	{apiVersion + "/stats/items/top", []string{http.MethodGet}, getTopItems},
+	{apiVersion + "/version", []string{http.MethodGet}, getVersion},
+	{apiVersion + "/users/{id}/digest", []string{http.MethodGet}, withOwnUser(getDigest)},
+	{apiVersion + "/users/{id}/balance", []string{http.MethodGet}, withUserPoints(getBalance)},
+	{apiVersion + "/users/{id}/ledger", []string{http.MethodGet}, withUserPoints(getLedger)},
+	{apiVersion + "/users/{id}/redeem", []string{http.MethodPost}, withUserPoints(redeemPoints)},
+	{apiVersion + "/groups/leaderboard", []string{http.MethodGet}, getGroupLeaderboard},
+	{apiVersion + "/groups/{id}", []string{http.MethodGet}, withPathValue("id", getGroupBalance)},
+	{"/healthz", []string{http.MethodGet}, getHealth},
+	{"/readyz", []string{http.MethodGet}, getReadiness},
+	{"/livez", []string{http.MethodGet}, getLiveness},
+	{"/admin/maintenance", []string{http.MethodGet, http.MethodPut}, requireAdmin(handleMaintenance)},
+	{"/admin/selftest", []string{http.MethodPost}, requireAdmin(handleSelfTest)},
+	{"/admin/flags", []string{http.MethodGet}, requireAdmin(handleFlags)},
+	{"/admin/flags/{name}", []string{http.MethodPut}, requireAdmin(handleFlags)},
+	{"/admin/shadow", []string{http.MethodGet, http.MethodPut, http.MethodDelete}, requireAdmin(handleShadow)},
+	{"/admin/exports/points", []string{http.MethodGet}, requireAdmin(exportPoints)},
+	{"/admin/exports/parquet", []string{http.MethodPost}, requireAdmin(handleParquetExport)},
+	{"/admin/cdc", []string{http.MethodGet}, requireAdmin(streamChanges)},
+	{"/admin/idempotency", []string{http.MethodGet}, requireAdmin(getIdempotencyAudit)},
+	{"/admin/anomalies", []string{http.MethodGet}, requireAdmin(getAnomalies)},
+	{"/admin/rules/coverage", []string{http.MethodGet}, requireAdmin(getRuleCoverage)},
+	{"/admin/rules/validate", []string{http.MethodPost}, requireAdmin(validateRules)},
+	{"/admin/storage/consistency", []string{http.MethodGet, http.MethodPost}, requireAdmin(handleConsistency)},
+	{"/admin/storage/compression", []string{http.MethodGet}, requireAdmin(getCompressionStats)},
+	{"/admin/enrichment", []string{http.MethodGet}, requireAdmin(getEnrichmentStats)},
+	{"/admin/slo", []string{http.MethodGet}, requireAdmin(getSLOStatus)},
+	{"/admin/tracing", []string{http.MethodGet, http.MethodPut}, requireAdmin(handleTraceSettings)},
+	{"/admin/traces", []string{http.MethodGet}, requireAdmin(listTraces)},
+	{"/admin/receipts/{id}/flag", []string{http.MethodPost}, requireAdmin(receiptAction("flag"))},
+	{"/admin/receipts/{id}/approve", []string{http.MethodPost}, requireAdmin(receiptAction("approve"))},
+	{"/admin/receipts/{id}/void", []string{http.MethodPost}, requireAdmin(receiptAction("void"))},
+	{"/admin/receipts/{id}/recalculate", []string{http.MethodPost}, requireAdmin(receiptAction("recalculate"))},
+	{"/admin/recalculate", []string{http.MethodPost}, requireAdmin(startRecalculation)},
+	{"/admin/recalculate/{jobId}", []string{http.MethodGet}, requireAdmin(withPathValue("jobId", getRecalculation))},
+	{"/admin/reports/{period}", []string{http.MethodGet}, requireAdmin(withPathValue("period", getReport))},
+	{"/admin/users/{id}/adjust", []string{http.MethodPost}, requireAdmin(withPathValue("id", adjustPoints))},
+	{"/admin/users/{id}/hash", []string{http.MethodGet}, requireAdmin(withPathValue("id", getUserIDHash))},
+	{"/admin/users/{id}/merge", []string{http.MethodPost}, requireAdmin(withPathValue("id", mergeUsers))},
+	{"/admin/groups", []string{http.MethodPost}, requireAdmin(createGroup)},
+	{"/admin/groups/{id}", []string{http.MethodDelete}, requireAdmin(withPathValue("id", deleteGroup))},
+	{"/admin/groups/{id}/members/{userId}", []string{http.MethodPut, http.MethodDelete}, requireAdmin(handleGroupMember)},
+	{"/admin/views", []string{http.MethodGet}, requireAdmin(handleViews)},
+	{"/admin/views/{name}", []string{http.MethodPut, http.MethodDelete}, requireAdmin(handleViews)},
+	{"/admin/views/{name}/receipts", []string{http.MethodGet}, requireAdmin(withPathValue("name", listViewReceipts))},
+	{"/admin/submission-urls", []string{http.MethodPost}, requireAdmin(createSubmissionURL)},
+	{"/admin/webhooks", []string{http.MethodGet, http.MethodPost}, requireAdmin(handleWebhooks)},
+	{"/admin/webhooks/{id}", []string{http.MethodDelete}, requireAdmin(handleWebhooks)},
+}
+
+// Return the route matching path and the path with its fixed segments in canonical case.
+// Fixed segments match case-insensitively; parameters such as IDs keep their case.
+func matchRoute(path string) (route, string, bool) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, candidate := range routes {
+		pattern := strings.Split(strings.Trim(candidate.path, "/"), "/")
+		if len(pattern) != len(segments) {
+			continue
+		}
+		canonical := make([]string, len(segments))
+		matched := true
+		for i, part := range pattern {
+			switch {
+			case strings.HasPrefix(part, "{"):
+				canonical[i] = segments[i]
+				matched = segments[i] != ""
+			case strings.EqualFold(part, segments[i]):
+				canonical[i] = part
+			default:
+				matched = false
+			}
+			if !matched {
+				break
+			}
+		}
+		if matched {
+			return candidate, "/" + strings.Join(canonical, "/"), true
+		}
+	}
+	return route{}, "", false
+}
+
+// Middleware resolving requests against the route table before they reach the handlers:
+// non-canonical paths (a trailing slash, different case) get a 308 redirect that keeps
+// the method and body, unknown paths a 404 and known paths with the wrong method a 405.
+// OPTIONS is answered here for every route with the methods it allows.
+func routeGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matched, canonical, found := matchRoute(r.URL.Path)
+		if !found {
+			http.Error(w, "Invalid endpoint", http.StatusNotFound)
+			slog.WarnContext(r.Context(), "Invalid endpoint", "path", r.URL.Path)
+			return
+		}
+		if canonical != r.URL.Path {
+			target := config.BasePath + canonical
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			slog.InfoContext(r.Context(), "Redirecting to canonical path", "path", r.URL.Path, "canonical", canonical)
+			http.Redirect(w, r, target, http.StatusPermanentRedirect)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(append(slices.Clone(matched.methods), http.MethodOptions), ", "))
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !slices.Contains(matched.methods, r.Method) {
+			allowed := joinMethods(matched.methods)
+			if len(matched.methods) == 1 {
+				http.Error(w, "Only "+allowed+" method is allowed", http.StatusMethodNotAllowed)
+			} else {
+				http.Error(w, "Only "+allowed+" methods are allowed", http.StatusMethodNotAllowed)
+			}
+			slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", allowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Adapt a handler taking a path parameter, such as a receipt or user ID
+func withPathValue(name string, handler func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, r.PathValue(name))
+	}
+}
+
+// Middleware serving the public API's unversioned paths, which predate /v1, as their /v1
+// equivalents. Responses link to the versioned path so clients can move over.
+func legacyPaths(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		if strings.EqualFold("/"+segments[0], apiVersion) || strings.EqualFold(segments[0], "admin") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, _, found := matchRoute(apiVersion + r.URL.Path); !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		versioned := r.Clone(r.Context())
+		versioned.URL.Path = apiVersion + r.URL.Path
+		if r.URL.RawPath != "" {
+			versioned.URL.RawPath = apiVersion + r.URL.RawPath
+		}
+		w.Header().Add("Link", "<"+config.BasePath+versioned.URL.Path+">; rel=\"successor-version\"")
+		next.ServeHTTP(w, versioned)
+	})
+}
+
+// "GET", "GET and PUT", "GET, PUT and DELETE"
+func joinMethods(methods []string) string {
+	if len(methods) == 1 {
+		return methods[0]
+	}
+	return strings.Join(methods[:len(methods)-1], ", ") + " and " + methods[len(methods)-1]
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	findingError   = "error"
+	findingWarning = "warning"
+)
+
+// A problem in a proposed rule set. Errors make PUT /admin/shadow reject it;
+// warnings point at settings that are ignored or have no effect.
+type RuleFinding struct {
+	Severity string `json:"severity"`
+	// JSON path of the offending value, e.g. rules.odd_day.multiplier
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type RuleLintReport struct {
+	Valid    bool          `json:"valid"`
+	Findings []RuleFinding `json:"findings"`
+}
+
+// Lint a rule set in the SHADOW_RULES_FILE format, reporting every finding instead of stopping at the first
+func lintRuleSet(data []byte) RuleLintReport {
+	findings := []RuleFinding{}
+	add := func(severity, path, format string, args ...interface{}) {
+		findings = append(findings, RuleFinding{severity, path, fmt.Sprintf(format, args...)})
+	}
+
+	var document map[string]json.RawMessage
+	if err := json.Unmarshal(data, &document); err != nil {
+		add(findingError, "", "rule set must be a JSON object")
+		return RuleLintReport{Valid: false, Findings: findings}
+	}
+	for _, field := range sortedKeys(document) {
+		if field != "version" && field != "rules" {
+			add(findingWarning, field, "unknown field %q is ignored", field)
+		}
+	}
+
+	var version string
+	if raw, ok := document["version"]; !ok {
+		add(findingError, "version", "version is required")
+	} else if err := json.Unmarshal(raw, &version); err != nil || version == "" {
+		add(findingError, "version", "version must be a non-empty string")
+	} else if version == rulesVersion {
+		add(findingError, "version", "version %q is already the active rules version", version)
+	}
+
+	var rules map[string]json.RawMessage
+	if raw, ok := document["rules"]; ok {
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			add(findingError, "rules", "rules must be an object keyed by rule ID")
+		}
+	}
+	disabled := 0
+	for _, rule := range sortedKeys(rules) {
+		path := "rules." + rule
+		if !isKnownRule(rule) {
+			add(findingError, path, "unknown rule %q; known rules are %s", rule, strings.Join(allRules, ", "))
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(rules[rule], &fields); err != nil {
+			add(findingError, path, "rule change must be an object with enabled and multiplier")
+			continue
+		}
+		for _, field := range sortedKeys(fields) {
+			if field != "enabled" && field != "multiplier" {
+				add(findingWarning, path+"."+field, "unknown field %q is ignored", field)
+			}
+		}
+
+		var change RuleChange
+		if raw, ok := fields["enabled"]; ok {
+			if err := json.Unmarshal(raw, &change.Enabled); err != nil || change.Enabled == nil {
+				add(findingError, path+".enabled", "enabled must be true or false")
+			}
+		}
+		if raw, ok := fields["multiplier"]; ok {
+			if err := json.Unmarshal(raw, &change.Multiplier); err != nil || change.Multiplier == nil {
+				add(findingError, path+".multiplier", "multiplier must be a number")
+				change.Multiplier = nil
+			}
+		}
+
+		switch {
+		case change.Multiplier != nil && *change.Multiplier < 0:
+			add(findingError, path+".multiplier", "multiplier must be non-negative, %g would award negative points", *change.Multiplier)
+		case change.Enabled != nil && !*change.Enabled:
+			disabled++
+			if change.Multiplier != nil {
+				add(findingWarning, path+".multiplier", "multiplier has no effect on a disabled rule")
+			}
+		case change.Multiplier != nil && *change.Multiplier == 0:
+			add(findingWarning, path+".multiplier", "a multiplier of 0 awards no points; set enabled to false instead")
+		case change.Multiplier == nil || *change.Multiplier == 1:
+			add(findingWarning, path, "change has no effect; the rule scores as it does today")
+		}
+	}
+	if disabled == len(allRules) {
+		add(findingWarning, "rules", "every rule is disabled, so every receipt would score 0 points")
+	}
+
+	valid := true
+	for _, finding := range findings {
+		if finding.Severity == findingError {
+			valid = false
+		}
+	}
+	return RuleLintReport{Valid: valid, Findings: findings}
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// POST /admin/rules/validate: lint a proposed rule set before it is applied with PUT /admin/shadow
+func validateRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "POST")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error reading request body", "error", err)
+		return
+	}
+	report := lintRuleSet(bytes.TrimSpace(body))
+	slog.InfoContext(r.Context(), "Linted rule set", "valid", report.Valid, "findings", len(report.Findings))
+	writeJSON(w, http.StatusOK, report)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+//go:embed schema/receipt.json
+var receiptSchemaJSON []byte
+
+var receiptSchema = compileReceiptSchema()
+
+func compileReceiptSchema() *jsonschema.Schema {
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat = true
+	if err := compiler.AddResource("receipt.json", bytes.NewReader(receiptSchemaJSON)); err != nil {
+		fatal("Error loading receipt schema", "error", err)
+	}
+	return compiler.MustCompile("receipt.json")
+}
+
+// Validate a receipt against the published schema; errors name the failing field and schema keyword
+func validateReceiptSchema(receipt Receipt) error {
+	payload, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	var document interface{}
+	if err := json.Unmarshal(payload, &document); err != nil {
+		return err
+	}
+
+	if err := receiptSchema.Validate(document); err != nil {
+		if validationErr, ok := err.(*jsonschema.ValidationError); ok {
+			leaf := validationErr
+			for len(leaf.Causes) > 0 {
+				leaf = leaf.Causes[0]
+			}
+			return fmt.Errorf("'%s' does not validate with receipt.json#%s: %s", leaf.InstanceLocation, leaf.KeywordLocation, leaf.Message)
+		}
+		return err
+	}
+	return nil
+}
+
+func getReceiptSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(receiptSchemaJSON)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type ScorePreview struct {
+	Points        int          `json:"points"`
+	Breakdown     []RuleResult `json:"breakdown"`
+	DisabledRules []string     `json:"disabledRules,omitempty"`
+	Warnings      []Warning    `json:"warnings,omitempty"`
+}
+
+// Parse ?disableRules=purchase_time,odd_day
+func parseDisabledRules(value string) (map[string]bool, []string, error) {
+	disabled := make(map[string]bool)
+	var names []string
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" || disabled[rule] {
+			continue
+		}
+		if !slices.Contains(scoredRules(), rule) {
+			return nil, nil, fmt.Errorf("unknown rule %q", rule)
+		}
+		disabled[rule] = true
+		names = append(names, rule)
+	}
+	return disabled, names, nil
+}
+
+// Dry-run scoring: validate and score a receipt without storing it
+func previewScore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "POST")
+		return
+	}
+	if !checkChannel(w, r) {
+		return
+	}
+
+	disabled, disabledNames, err := parseDisabledRules(r.URL.Query().Get("disableRules"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid disableRules", "error", err)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading request body", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error reading request body", "error", err)
+		return
+	}
+	receipt, err := prepareReceipt(r.Context(), body, requestSubject(r), requestSource(r))
+	if err != nil {
+		http.Error(w, err.Error(), receiptErrorStatus(err))
+		return
+	}
+
+	preview := ScorePreview{Breakdown: []RuleResult{}, DisabledRules: disabledNames, Warnings: receipt.Warnings}
+	for _, result := range receipt.Breakdown {
+		// The lucky receipt draw is only revealed once a receipt is submitted, so it
+		// can't be probed for receipts that would win
+		if disabled[result.Rule] || result.Rule == ruleLuckyReceipt {
+			continue
+		}
+		preview.Points += result.Points
+		preview.Breakdown = append(preview.Breakdown, result)
+	}
+
+	slog.InfoContext(r.Context(), "Previewed score", "points", preview.Points, "disabled_rules", len(disabledNames))
+	writeJSON(w, http.StatusOK, preview)
+}
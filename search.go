@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+)
+
+type searchDocument struct {
+	tenant   string
+	userID   string
+	retailer string
+	items    []string
+	terms    map[string]int
+}
+
+// Inverted index from item description terms to the receipts containing them
+type searchIndex struct {
+	mu       sync.RWMutex
+	postings map[string]map[string]int // term -> receipt ID -> occurrences
+	docs     map[string]searchDocument
+}
+
+var receiptIndex = &searchIndex{postings: make(map[string]map[string]int), docs: make(map[string]searchDocument)}
+
+// Lowercased alphanumeric words
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func newSearchDocument(receipt Receipt) searchDocument {
+	doc := searchDocument{tenant: receipt.Tenant, userID: receipt.UserID, retailer: receipt.Retailer, terms: make(map[string]int)}
+	for _, item := range receipt.Items {
+		description := strings.TrimSpace(item.ShortDescription)
+		doc.items = append(doc.items, description)
+		for _, term := range searchTerms(description) {
+			doc.terms[term]++
+		}
+	}
+	return doc
+}
+
+// Everything a document is built from, for comparing it with the receipt it should hold
+func (doc searchDocument) fingerprint() string {
+	return strings.Join(append([]string{doc.tenant, doc.userID, doc.retailer}, doc.items...), "\x00")
+}
+
+func (idx *searchIndex) add(receipt Receipt) {
+	doc := newSearchDocument(receipt)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(receipt.ID)
+	idx.docs[receipt.ID] = doc
+	for term, count := range doc.terms {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[string]int)
+		}
+		idx.postings[term][receipt.ID] = count
+	}
+}
+
+func (idx *searchIndex) remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(id)
+}
+
+func (idx *searchIndex) removeLocked(id string) {
+	doc, found := idx.docs[id]
+	if !found {
+		return
+	}
+	for term := range doc.terms {
+		delete(idx.postings[term], id)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docs, id)
+}
+
+// Map iteration starts at a random position, so the first n IDs are a sample
+func (idx *searchIndex) sampleIDs(n int) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	ids := make([]string, 0, min(n, len(idx.docs)))
+	for id := range idx.docs {
+		if len(ids) == n {
+			break
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (idx *searchIndex) entry(id string) (string, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	doc, found := idx.docs[id]
+	return doc.fingerprint(), found
+}
+
+func (idx *searchIndex) expectedEntry(receipt Receipt) (string, bool) {
+	return newSearchDocument(receipt).fingerprint(), true
+}
+
+type SearchResult struct {
+	ID       string   `json:"id"`
+	Retailer string   `json:"retailer"`
+	Score    float64  `json:"score"`
+	Matches  []string `json:"matches"`
+}
+
+// Rank the tenant's receipts, or only userID's when set, by TF-IDF over the query terms;
+// receipts matching more of the terms always rank above those matching fewer
+func (idx *searchIndex) Search(tenant, userID, query string) []SearchResult {
+	terms := searchTerms(query)
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	scores := make(map[string]float64)
+	matched := make(map[string]int)
+	for _, term := range uniqueTerms(terms) {
+		postings := idx.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+		idf := math.Log(1 + float64(len(idx.docs))/float64(len(postings)))
+		for id, count := range postings {
+			if doc := idx.docs[id]; doc.tenant != tenant || (userID != "" && doc.userID != userID) {
+				continue
+			}
+			scores[id] += float64(count) * idf
+			matched[id]++
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for id, score := range scores {
+		doc := idx.docs[id]
+		result := SearchResult{ID: id, Retailer: doc.retailer, Score: math.Round((float64(matched[id])+score)*1000) / 1000}
+		for _, item := range doc.items {
+			if containsAnyTerm(searchTerms(item), terms) {
+				result.Matches = append(result.Matches, item)
+			}
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if matched[results[i].ID] != matched[results[j].ID] {
+			return matched[results[i].ID] > matched[results[j].ID]
+		}
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].ID < results[j].ID
+	})
+	return results
+}
+
+func uniqueTerms(terms []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
+
+func containsAnyTerm(terms, wanted []string) bool {
+	for _, term := range terms {
+		for _, w := range wanted {
+			if term == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Store decorator keeping the search index in step with writes
+type indexedStore struct {
+	Store
+	index *searchIndex
+}
+
+func newIndexedStore(ctx context.Context, backing Store, index *searchIndex) (*indexedStore, error) {
+	receipts, err := backing.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, receipt := range receipts {
+		index.add(receipt)
+	}
+	return &indexedStore{Store: backing, index: index}, nil
+}
+
+func (s *indexedStore) Put(ctx context.Context, receipt Receipt) error {
+	if err := s.Store.Put(ctx, receipt); err != nil {
+		return err
+	}
+	s.index.add(receipt)
+	return nil
+}
+
+func (s *indexedStore) Delete(ctx context.Context, id string) (bool, error) {
+	found, err := s.Store.Delete(ctx, id)
+	if found {
+		s.index.remove(id)
+	}
+	return found, err
+}
+
+func searchReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	query := r.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if len(searchTerms(q)) == 0 {
+		http.Error(w, "q must contain at least one word", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid search query", "query", q)
+		return
+	}
+	limit, offset, err := parsePagination(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid search pagination", "error", err)
+		return
+	}
+	if limit == 0 {
+		limit = searchDefaultLimit
+	}
+	limit = min(limit, searchMaxLimit)
+
+	// Only the requesting tenant's receipts are searched, and only the JWT subject's own
+	tenant := r.Header.Get("X-Tenant-ID")
+	results := receiptIndex.Search(tenant, authSubject(r.Context()), q)
+	total := len(results)
+	start := min(offset, total)
+	results = results[start:min(start+limit, total)]
+
+	slog.InfoContext(r.Context(), "Search matched receipts", "query", q, "total", total)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"total": total, "results": results})
+}
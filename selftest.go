@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Fixture from the challenge examples and the points it must score
+const selfTestFixture = `{
+  "retailer": "M&M Corner Market",
+  "purchaseDate": "2022-03-20",
+  "purchaseTime": "14:33",
+  "items": [
+    { "shortDescription": "Gatorade", "price": "2.25" },
+    { "shortDescription": "Gatorade", "price": "2.25" },
+    { "shortDescription": "Gatorade", "price": "2.25" },
+    { "shortDescription": "Gatorade", "price": "2.25" }
+  ],
+  "total": "9.00"
+}`
+
+const selfTestPoints = 109
+
+// Self-test receipts live under their own ID prefix so they never collide with real receipt IDs
+const selfTestNamespace = "selftest-"
+
+type SelfTestStep struct {
+	Component  string `json:"component"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+type SelfTestReport struct {
+	OK    bool           `json:"ok"`
+	Steps []SelfTestStep `json:"steps"`
+}
+
+// Run a fixture receipt through the pipeline and storage backend, stopping at the first failure
+func runSelfTest(ctx context.Context) SelfTestReport {
+	report := SelfTestReport{OK: true}
+	var receipt Receipt
+
+	steps := []struct {
+		component string
+		run       func() error
+	}{
+		{"pipeline", func() error {
+			var err error
+			receipt, err = prepareReceipt(ctx, []byte(selfTestFixture), FeatureSubject{}, Source{})
+			return err
+		}},
+		{"scoring", func() error {
+			if points := pointsWithoutBonuses(receipt.Breakdown); points != selfTestPoints {
+				return fmt.Errorf("fixture scored %d points, expected %d", points, selfTestPoints)
+			}
+			return nil
+		}},
+		{"storage.put", func() error {
+			receipt.ID = selfTestNamespace + uuid.NewString()
+			return store.Put(ctx, receipt)
+		}},
+		{"storage.get", func() error {
+			stored, found, err := store.Get(ctx, receipt.ID)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return errors.New("stored fixture was not found")
+			}
+			if stored.Points != receipt.Points {
+				return fmt.Errorf("stored fixture has %d points, expected %d", stored.Points, receipt.Points)
+			}
+			return nil
+		}},
+		{"storage.delete", func() error {
+			found, err := store.Delete(ctx, receipt.ID)
+			if err != nil {
+				return err
+			}
+			if !found {
+				return errors.New("stored fixture was not found for deletion")
+			}
+			if _, found, err := store.Get(ctx, receipt.ID); err != nil || found {
+				return errors.New("fixture still present after deletion")
+			}
+			return nil
+		}},
+	}
+
+	for _, step := range steps {
+		start := time.Now()
+		err := step.run()
+		result := SelfTestStep{Component: step.component, OK: err == nil, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Error = err.Error()
+			report.OK = false
+		}
+		report.Steps = append(report.Steps, result)
+		if err != nil {
+			break
+		}
+	}
+
+	// Don't leave the fixture behind if a later step failed
+	if receipt.ID != "" && !report.OK {
+		store.Delete(ctx, receipt.ID)
+	}
+	return report
+}
+
+func handleSelfTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "POST")
+		return
+	}
+
+	report := runSelfTest(r.Context())
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	slog.InfoContext(r.Context(), "Self-test completed", "ok", report.OK)
+	writeJSON(w, status, report)
+}
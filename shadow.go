@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Candidate changes to the active rules; rules not listed score as they do today
+type RuleSet struct {
+	Version string                `json:"version"`
+	Rules   map[string]RuleChange `json:"rules"`
+}
+
+type RuleChange struct {
+	Enabled    *bool    `json:"enabled,omitempty"`
+	Multiplier *float64 `json:"multiplier,omitempty"`
+}
+
+// Result of scoring a receipt with the candidate rule set; stored, and only returned to
+// clients asking for a ScoreComparison
+type ShadowScore struct {
+	RulesVersion string       `json:"rulesVersion"`
+	Points       int          `json:"points"`
+	Breakdown    []RuleResult `json:"breakdown"`
+}
+
+var shadowRules *RuleSet
+var shadowMutex = &sync.RWMutex{}
+
+func currentShadowRules() *RuleSet {
+	shadowMutex.RLock()
+	defer shadowMutex.RUnlock()
+	return shadowRules
+}
+
+// Re-weight the active breakdown according to the candidate rule set
+func applyRuleSet(breakdown []RuleResult, rules RuleSet) (int, []RuleResult) {
+	points := 0
+	shadow := []RuleResult{}
+	for _, result := range breakdown {
+		change := rules.Rules[result.Rule]
+		if change.Enabled != nil && !*change.Enabled {
+			continue
+		}
+		if change.Multiplier != nil {
+			result.Points = int(math.Round(float64(result.Points) * *change.Multiplier))
+			result.Description = fmt.Sprintf("%d points - %s (x%g in rules version %s)", result.Points, result.Rule, *change.Multiplier, rules.Version)
+		}
+		points += result.Points
+		shadow = append(shadow, result)
+	}
+	return points, shadow
+}
+
+func shadowScore(ctx context.Context, receipt Receipt) *ShadowScore {
+	rules := currentShadowRules()
+	if rules == nil {
+		return nil
+	}
+	points, breakdown := applyRuleSet(receipt.Breakdown, *rules)
+	if points != receipt.Points {
+		slog.InfoContext(ctx, "Shadow rules scored receipt", "version", rules.Version, "points", points, "active_points", receipt.Points)
+	}
+	return &ShadowScore{RulesVersion: rules.Version, Points: points, Breakdown: breakdown}
+}
+
+// Prefer token asking for a submission's response to include its ScoreComparison
+const preferScoreComparison = "score-comparison"
+
+type RuleSetScore struct {
+	RulesVersion string       `json:"rulesVersion"`
+	Points       int          `json:"points"`
+	Breakdown    []RuleResult `json:"breakdown"`
+}
+
+// A receipt's active score next to its score under the candidate rule set, for partner
+// test environments to see what an upcoming rules change does to their receipts
+type ScoreComparison struct {
+	Active RuleSetScore `json:"active"`
+	// Absent while no candidate rule set is configured
+	Canary *RuleSetScore `json:"canary,omitempty"`
+	// Canary points less active points
+	Difference int `json:"difference"`
+}
+
+// Whether the response may include a ScoreComparison: SCORE_COMPARISON has to be enabled,
+// since it reveals the candidate rules, and the client has to ask for it
+func prefersScoreComparison(r *http.Request) bool {
+	return config.ScoreComparison && hasPreference(r, preferScoreComparison)
+}
+
+func compareScores(receipt Receipt) *ScoreComparison {
+	comparison := &ScoreComparison{Active: RuleSetScore{RulesVersion: receipt.RulesVersion, Points: receipt.Points, Breakdown: receipt.Breakdown}}
+	if receipt.Shadow != nil {
+		comparison.Canary = &RuleSetScore{RulesVersion: receipt.Shadow.RulesVersion, Points: receipt.Shadow.Points, Breakdown: receipt.Shadow.Breakdown}
+		comparison.Difference = receipt.Shadow.Points - receipt.Points
+	}
+	return comparison
+}
+
+func parseRuleSet(data []byte) (*RuleSet, error) {
+	var rules RuleSet
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	if rules.Version == "" {
+		return nil, fmt.Errorf("version is required")
+	}
+	if rules.Version == rulesVersion {
+		return nil, fmt.Errorf("version %q is already the active rules version", rules.Version)
+	}
+	for rule, change := range rules.Rules {
+		if !isKnownRule(rule) {
+			return nil, fmt.Errorf("unknown rule %q", rule)
+		}
+		if change.Multiplier != nil && *change.Multiplier < 0 {
+			return nil, fmt.Errorf("rule %q multiplier must be non-negative", rule)
+		}
+	}
+	return &rules, nil
+}
+
+func isKnownRule(rule string) bool {
+	return slices.Contains(allRules, rule)
+}
+
+// Load the candidate rule set named by SHADOW_RULES_FILE, if any
+func loadShadowRules(path string, errs *[]error) *RuleSet {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("SHADOW_RULES_FILE could not be read: %v", err))
+		return nil
+	}
+	rules, err := parseRuleSet(data)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("SHADOW_RULES_FILE is invalid: %v", err))
+		return nil
+	}
+	return rules
+}
+
+type ShadowRuleDelta struct {
+	Rule         string `json:"rule"`
+	ActivePoints int    `json:"activePoints"`
+	ShadowPoints int    `json:"shadowPoints"`
+}
+
+type ShadowChange struct {
+	ID           string `json:"id"`
+	ActivePoints int    `json:"activePoints"`
+	ShadowPoints int    `json:"shadowPoints"`
+}
+
+type ShadowComparison struct {
+	ActiveVersion    string            `json:"activeVersion"`
+	CandidateVersion string            `json:"candidateVersion"`
+	Compared         int               `json:"compared"`
+	Changed          int               `json:"changed"`
+	ActivePoints     int               `json:"activePoints"`
+	ShadowPoints     int               `json:"shadowPoints"`
+	Rules            []ShadowRuleDelta `json:"rules"`
+	LargestChanges   []ShadowChange    `json:"largestChanges"`
+}
+
+const shadowLargestChanges = 10
+
+// Compare receipts shadow-scored with the candidate version against their active scores
+func compareShadow(receipts []Receipt, candidate string) ShadowComparison {
+	comparison := ShadowComparison{ActiveVersion: rulesVersion, CandidateVersion: candidate, Rules: []ShadowRuleDelta{}, LargestChanges: []ShadowChange{}}
+	byRule := map[string]*ShadowRuleDelta{}
+	ruleDelta := func(rule string) *ShadowRuleDelta {
+		if byRule[rule] == nil {
+			byRule[rule] = &ShadowRuleDelta{Rule: rule}
+		}
+		return byRule[rule]
+	}
+
+	for _, receipt := range receipts {
+		if receipt.Shadow == nil || receipt.Shadow.RulesVersion != candidate {
+			continue
+		}
+		comparison.Compared++
+		comparison.ActivePoints += receipt.Points
+		comparison.ShadowPoints += receipt.Shadow.Points
+		for _, result := range receipt.Breakdown {
+			ruleDelta(result.Rule).ActivePoints += result.Points
+		}
+		for _, result := range receipt.Shadow.Breakdown {
+			ruleDelta(result.Rule).ShadowPoints += result.Points
+		}
+		if receipt.Shadow.Points != receipt.Points {
+			comparison.Changed++
+			comparison.LargestChanges = append(comparison.LargestChanges, ShadowChange{receipt.ID, receipt.Points, receipt.Shadow.Points})
+		}
+	}
+
+	for _, delta := range byRule {
+		comparison.Rules = append(comparison.Rules, *delta)
+	}
+	sort.Slice(comparison.Rules, func(i, j int) bool { return comparison.Rules[i].Rule < comparison.Rules[j].Rule })
+
+	changes := comparison.LargestChanges
+	sort.SliceStable(changes, func(i, j int) bool {
+		return abs(changes[i].ShadowPoints-changes[i].ActivePoints) > abs(changes[j].ShadowPoints-changes[j].ActivePoints)
+	})
+	if len(changes) > shadowLargestChanges {
+		comparison.LargestChanges = changes[:shadowLargestChanges]
+	}
+	return comparison
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func handleShadow(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		rules := currentShadowRules()
+		if rules == nil {
+			http.Error(w, "No shadow rule set is configured", http.StatusNotFound)
+			slog.WarnContext(r.Context(), "Shadow comparison requested without a shadow rule set")
+			return
+		}
+		receipts, err := store.List(r.Context())
+		if err != nil {
+			http.Error(w, "Error reading receipts", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Error listing receipts", "error", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, compareShadow(receipts, rules.Version))
+	case http.MethodPut:
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Error decoding shadow rule set", "error", err)
+			return
+		}
+		rules, err := parseRuleSet(body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid rule set: %v", err), http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid shadow rule set", "error", err)
+			return
+		}
+
+		shadowMutex.Lock()
+		shadowRules = rules
+		shadowMutex.Unlock()
+
+		slog.InfoContext(r.Context(), "Shadow scoring enabled", "version", rules.Version)
+		writeJSON(w, http.StatusOK, rules)
+	case http.MethodDelete:
+		shadowMutex.Lock()
+		shadowRules = nil
+		shadowMutex.Unlock()
+
+		slog.InfoContext(r.Context(), "Shadow scoring disabled")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Only GET, PUT and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET, PUT and DELETE")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Context key marking a request whose signature was checked before it was queued as a job
+type signatureVerifiedKey struct{}
+
+// Signatures already accepted, kept until their timestamp falls outside SIGNATURE_MAX_SKEW
+var seenSignatures = make(map[string]time.Time)
+var signaturesMutex = &sync.Mutex{}
+
+// Verify a server-to-server submission from a partner in PARTNER_SECRETS. Partners send
+// X-Partner-ID, X-Signature-Timestamp (Unix seconds) and X-Signature: sha256= followed by
+// the hex HMAC-SHA256 of "{timestamp}.{body}" keyed by their secret. Requests made with an
+// API key in API_KEY_PARTNERS are the key's partner's and must be signed, with or without
+// X-Partner-ID; other requests without X-Partner-ID aren't partner submissions and pass
+// unchecked.
+func verifyPartnerSignature(r *http.Request, body []byte, now time.Time) error {
+	partner := r.Header.Get("X-Partner-ID")
+	if bound, found := config.APIKeyPartners[apiKeyName(r.Context())]; found {
+		if partner != "" && partner != bound {
+			return fmt.Errorf("X-Partner-ID %q doesn't match the partner of the API key", partner)
+		}
+		partner = bound
+	}
+	if partner == "" {
+		return nil
+	}
+	secret, known := config.PartnerSecrets[partner]
+	if !known {
+		return fmt.Errorf("unknown partner %q", partner)
+	}
+
+	timestamp := r.Header.Get("X-Signature-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("X-Signature-Timestamp must be a Unix timestamp in seconds")
+	}
+	signedAt := time.Unix(seconds, 0)
+	if skew := now.Sub(signedAt).Abs(); skew > config.SignatureMaxSkew {
+		return fmt.Errorf("signature timestamp is %s away from server time", skew.Truncate(time.Second))
+	}
+
+	signature, found := strings.CutPrefix(r.Header.Get("X-Signature"), "sha256=")
+	provided, err := hex.DecodeString(signature)
+	if !found || err != nil {
+		return errors.New("X-Signature must be sha256= followed by a hex HMAC-SHA256")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	if !hmac.Equal(provided, mac.Sum(nil)) {
+		return errors.New("signature does not match the request body")
+	}
+
+	// A valid signature can only be used once within the window it would be accepted in,
+	// however its hex is written
+	key := partner + ":" + hex.EncodeToString(provided)
+	signaturesMutex.Lock()
+	defer signaturesMutex.Unlock()
+	for seen, at := range seenSignatures {
+		if now.Sub(at) > config.SignatureMaxSkew {
+			delete(seenSignatures, seen)
+		}
+	}
+	if _, replayed := seenSignatures[key]; replayed {
+		return errors.New("signature was already used")
+	}
+	seenSignatures[key] = signedAt
+	return nil
+}
+
+// Reject a partner submission whose signature doesn't verify; reports whether the request may proceed
+func checkPartnerSignature(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	if verified, _ := r.Context().Value(signatureVerifiedKey{}).(bool); verified {
+		return true
+	}
+	if err := verifyPartnerSignature(r, body, time.Now()); err != nil {
+		http.Error(w, "Invalid request signature: "+err.Error(), http.StatusUnauthorized)
+		slog.WarnContext(r.Context(), "Rejected signed request", "path", r.URL.Path, "client_ip", clientIP(r), "error", err)
+		return false
+	}
+	return true
+}
+
+func getEnvPartnerSecrets(key string, errs *[]error) map[string]string {
+	secrets := map[string]string{}
+	for _, entry := range strings.Split(getEnv(key, ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		partner, secret, _ := strings.Cut(entry, "=")
+		if partner == "" || len(secret) < 16 {
+			*errs = append(*errs, fmt.Errorf("%s entries must be partner=secret with a secret of at least 16 characters, got an entry for %q", key, partner))
+			continue
+		}
+		secrets[partner] = secret
+	}
+	return secrets
+}
+
+// Parse API_KEY_PARTNERS entries such as "acme_sync=acme", binding an API key, by name, to
+// the partner in PARTNER_SECRETS whose signature every submission made with it must carry
+func getEnvAPIKeyPartners(key string, keys, secrets map[string]string, errs *[]error) map[string]string {
+	partners := map[string]string{}
+	for _, entry := range getEnvList(key) {
+		name, partner, _ := strings.Cut(entry, "=")
+		name, partner = strings.TrimSpace(name), strings.TrimSpace(partner)
+		if name == "" || partner == "" {
+			*errs = append(*errs, fmt.Errorf("%s entries must be name=partner, got %q", key, entry))
+			continue
+		}
+		if _, exists := keys[name]; !exists {
+			*errs = append(*errs, fmt.Errorf("%s names API key %q, which isn't in API_KEYS or API_KEYS_FILE", key, name))
+			continue
+		}
+		if _, exists := secrets[partner]; !exists {
+			*errs = append(*errs, fmt.Errorf("%s names partner %q, which isn't in PARTNER_SECRETS", key, partner))
+			continue
+		}
+		partners[name] = partner
+	}
+	return partners
+}
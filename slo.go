@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Width of the buckets receipt scoring is tracked in for SLOs
+const sloResolution = 5 * time.Minute
+
+// Windows error budget burn rates are reported over, for multiwindow burn-rate reviews
+var sloBurnWindows = []time.Duration{time.Hour, 6 * time.Hour, 24 * time.Hour, 72 * time.Hour}
+
+// Submissions to POST /receipts/process over SLO_WINDOW, counting those slower than SLO_LATENCY
+var scoringMetrics *requestMetrics
+var sloTrackingSince time.Time
+
+func startSLOTracking() {
+	scoringMetrics = newRequestMetrics(sloResolution, config.SLOWindow, config.SLOLatency)
+	sloTrackingSince = time.Now().UTC()
+}
+
+// One objective: the share of requests that must be good, and how it is doing
+type SLOObjective struct {
+	Name      string  `json:"name"`
+	Objective float64 `json:"objective"`
+	// For the latency objective, how fast a request must be to count as good
+	Threshold string `json:"threshold,omitempty"`
+	Requests  int    `json:"requests"`
+	Bad       int    `json:"bad"`
+	// Share of requests that were good over the window; 1 without requests
+	SLI float64 `json:"sli"`
+	Met bool    `json:"met"`
+	// Share of the window's error budget left; negative once it is overspent
+	ErrorBudgetRemaining float64 `json:"errorBudgetRemaining"`
+	// How fast the budget is being spent in each recent window, 1 meaning exactly on budget
+	BurnRates map[string]float64 `json:"burnRates"`
+}
+
+type SLOStatus struct {
+	Window       string         `json:"window"`
+	Since        time.Time      `json:"since"`
+	Requests     int            `json:"requests"`
+	P99LatencyMs int64          `json:"p99LatencyMs"`
+	Objectives   []SLOObjective `json:"objectives"`
+}
+
+func sloObjective(name string, objective float64, bad func(WindowStats) int) SLOObjective {
+	stats := scoringMetrics.window(config.SLOWindow)
+	result := SLOObjective{Name: name, Objective: objective, Requests: stats.Requests, Bad: bad(stats), SLI: 1, ErrorBudgetRemaining: 1, BurnRates: map[string]float64{}}
+	budget := 1 - objective
+	if stats.Requests > 0 {
+		result.SLI = 1 - float64(result.Bad)/float64(stats.Requests)
+		result.ErrorBudgetRemaining = round4(1 - float64(result.Bad)/(float64(stats.Requests)*budget))
+	}
+	result.Met = result.SLI >= objective
+	result.SLI = round4(result.SLI)
+
+	for _, window := range sloBurnWindows {
+		if window > config.SLOWindow {
+			continue
+		}
+		recent := scoringMetrics.window(window)
+		rate := 0.0
+		if recent.Requests > 0 {
+			rate = round4(float64(bad(recent)) / float64(recent.Requests) / budget)
+		}
+		result.BurnRates[strings.TrimSuffix(window.String(), "0m0s")] = rate
+	}
+	return result
+}
+
+func round4(value float64) float64 {
+	return math.Round(value*10000) / 10000
+}
+
+func currentSLOStatus() SLOStatus {
+	stats := scoringMetrics.window(config.SLOWindow)
+	availability := sloObjective("availability", config.SLOAvailability, func(s WindowStats) int { return s.Errors })
+	latency := sloObjective("latency", config.SLOLatencyTarget, func(s WindowStats) int { return s.Slow })
+	latency.Threshold = config.SLOLatency.String()
+	return SLOStatus{
+		Window:       config.SLOWindow.String(),
+		Since:        sloTrackingSince,
+		Requests:     stats.Requests,
+		P99LatencyMs: stats.Latency.Quantile(0.99).Milliseconds(),
+		Objectives:   []SLOObjective{availability, latency},
+	}
+}
+
+// GET /admin/slo
+func getSLOStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, currentSLOStatus())
+}
+
+func validateSLOConfig(cfg Config) []error {
+	var errs []error
+	for _, objective := range []struct {
+		key   string
+		value float64
+	}{{"SLO_AVAILABILITY", cfg.SLOAvailability}, {"SLO_LATENCY_TARGET", cfg.SLOLatencyTarget}} {
+		if objective.value <= 0 || objective.value >= 1 {
+			errs = append(errs, fmt.Errorf("%s must be between 0 and 1, e.g. 0.999, got %g", objective.key, objective.value))
+		}
+	}
+	if cfg.SLOLatency <= 0 {
+		errs = append(errs, errors.New("SLO_LATENCY must be positive"))
+	}
+	if cfg.SLOWindow < time.Hour || cfg.SLOWindow > 90*24*time.Hour {
+		errs = append(errs, fmt.Errorf("SLO_WINDOW must be between 1h and 2160h, got %s", cfg.SLOWindow))
+	}
+	return errs
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Channels a receipt can be submitted through, from the X-Submission-Channel header
+const (
+	channelAPI    = "api"
+	channelMobile = "mobile"
+	channelEmail  = "email"
+	channelKiosk  = "kiosk"
+)
+
+var channels = []string{channelAPI, channelMobile, channelEmail, channelKiosk}
+
+// Who submitted a receipt, taken from the request that processed it
+type Source struct {
+	// Name of the API key the request carried, from API_KEYS
+	APIKey        string `json:"apiKey,omitempty"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	ClientVersion string `json:"clientVersion,omitempty"`
+	Channel       string `json:"channel,omitempty"`
+}
+
+// Sources counted separately per tenant; receipts from sources first seen after that
+// many are counted under otherSource
+const sourcesMaxTracked = 1000
+
+var otherSource = Source{UserAgent: "other"}
+
+// Receipts and points per submission channel
+type ChannelStats struct {
+	Channel       string  `json:"channel"`
+	Receipts      int     `json:"receipts"`
+	Points        int     `json:"points"`
+	AveragePoints float64 `json:"averagePoints"`
+	// Points awarded by CHANNEL_BONUSES, included in points
+	BonusPoints int `json:"bonusPoints"`
+}
+
+type SourceStats struct {
+	Source
+	Receipts       int     `json:"receipts"`
+	Points         int     `json:"points"`
+	AverageQuality float64 `json:"averageQuality"`
+	Warnings       int     `json:"warnings"`
+}
+
+func requestSource(r *http.Request) Source {
+	return Source{
+		APIKey:        apiKeyName(r.Context()),
+		UserAgent:     strings.TrimSpace(r.UserAgent()),
+		ClientVersion: strings.TrimSpace(r.Header.Get("X-Client-Version")),
+		Channel:       requestChannel(r),
+	}
+}
+
+// The source a receipt is counted under in the stats. Clients can send anything in the
+// headers, so only the User-Agent's product, e.g. "acme-pos/2.3" of "acme-pos/2.3 (Linux)",
+// is kept, and it and the client version are cut short.
+func statsSource(source Source) Source {
+	product, _, _ := strings.Cut(source.UserAgent, " ")
+	source.UserAgent = truncateRunes(product, 64)
+	source.ClientVersion = truncateRunes(source.ClientVersion, 32)
+	return source
+}
+
+func truncateRunes(value string, n int) string {
+	if runes := []rune(value); len(runes) > n {
+		return string(runes[:n])
+	}
+	return value
+}
+
+// Submissions without X-Submission-Channel came in through the API
+func requestChannel(r *http.Request) string {
+	if channel := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Submission-Channel"))); channel != "" {
+		return channel
+	}
+	return channelAPI
+}
+
+// Receipts stored before channels were recorded were all submitted through the API
+func receiptChannel(receipt Receipt) string {
+	if receipt.Source.Channel == "" {
+		return channelAPI
+	}
+	return receipt.Source.Channel
+}
+
+// Reports false, having answered 400, when X-Submission-Channel isn't a known channel
+func checkChannel(w http.ResponseWriter, r *http.Request) bool {
+	if channel := requestChannel(r); !slices.Contains(channels, channel) {
+		http.Error(w, fmt.Sprintf("X-Submission-Channel must be one of %s, got %q", strings.Join(channels, ", "), channel), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Rejected submission from an unknown channel", "channel", channel)
+		return false
+	}
+	return true
+}
+
+// Order sources busiest first
+func sortSourceStats(sources []SourceStats) {
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Receipts != sources[j].Receipts {
+			return sources[i].Receipts > sources[j].Receipts
+		}
+		return sources[i].APIKey+sources[i].UserAgent+sources[i].ClientVersion+sources[i].Channel < sources[j].APIKey+sources[j].UserAgent+sources[j].ClientVersion+sources[j].Channel
+	})
+}
+
+// Order channels as they are listed in channels
+func sortChannelStats(stats []ChannelStats) {
+	sort.Slice(stats, func(i, j int) bool {
+		return slices.Index(channels, stats[i].Channel) < slices.Index(channels, stats[j].Channel)
+	})
+}
+
+// Parse CHANNEL_BONUSES entries such as "mobile=10", points awarded to every receipt
+// submitted through the channel
+func getEnvChannelBonuses(key string, errs *[]error) map[string]int {
+	bonuses := map[string]int{}
+	for _, entry := range getEnvList(key) {
+		channel, value, _ := strings.Cut(entry, "=")
+		channel = strings.ToLower(strings.TrimSpace(channel))
+		points, err := strconv.Atoi(strings.TrimSpace(value))
+		if !slices.Contains(channels, channel) || err != nil || points <= 0 {
+			*errs = append(*errs, fmt.Errorf("%s entries must be channel=points with one of %s and a positive number of points, got %q", key, strings.Join(channels, ", "), entry))
+			continue
+		}
+		bonuses[channel] = points
+	}
+	return bonuses
+}
+
+func getSource(w http.ResponseWriter, r *http.Request, id string) {
+	receipt, ok := findReceipt(w, r, id)
+	if !ok {
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Source retrieved", "receipt_id", id)
+	writeJSON(w, http.StatusOK, receipt.Source)
+}
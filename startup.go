@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// A problem found while validating the configuration on startup
+type StartupProblem struct {
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// Every problem found on startup, printed as JSON to stderr before exiting when there are any
+type StartupReport struct {
+	OK       bool             `json:"ok"`
+	Problems []StartupProblem `json:"problems"`
+}
+
+// Record err under check, one problem per error when several were joined
+func (r *StartupReport) add(check string, err error) {
+	if err == nil {
+		return
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			r.add(check, err)
+		}
+		return
+	}
+	r.OK = false
+	r.Problems = append(r.Problems, StartupProblem{Check: check, Message: err.Error()})
+}
+
+func (r *StartupReport) exitIfFailed() {
+	if r.OK {
+		return
+	}
+	encoder := json.NewEncoder(os.Stderr)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(r)
+	fatal("Startup validation failed", "problems", len(r.Problems))
+}
+
+// Score the self-test fixture and check the rules agree with each other and with the shadow rule set
+func checkRules() error {
+	var errs []error
+	var receipt Receipt
+	if err := json.Unmarshal([]byte(selfTestFixture), &receipt); err != nil {
+		return fmt.Errorf("decoding the self-test fixture: %w", err)
+	}
+	points, breakdown := calculatePoints(receipt)
+	if pointsWithoutBonuses(breakdown) != selfTestPoints {
+		errs = append(errs, fmt.Errorf("the self-test fixture scores %d points, expected %d", pointsWithoutBonuses(breakdown), selfTestPoints))
+	}
+	sum := 0
+	for _, result := range breakdown {
+		sum += result.Points
+		if !slices.Contains(allRules, result.Rule) {
+			errs = append(errs, fmt.Errorf("rule %q in the breakdown is not a known rule", result.Rule))
+		}
+	}
+	if sum != points {
+		errs = append(errs, fmt.Errorf("breakdown totals %d points but the receipt scores %d", sum, points))
+	}
+	if config.ShadowRules != nil && config.ShadowRules.Version == rulesVersion {
+		errs = append(errs, fmt.Errorf("SHADOW_RULES_FILE has version %q, the same as the active rules", rulesVersion))
+	}
+	return errors.Join(errs...)
+}
+
+// Check secrets are strong enough and that a key isn't reused for different purposes
+func checkKeyMaterial(cfg Config) error {
+	var errs []error
+	if cfg.AdminToken != "" && len(cfg.AdminToken) < 16 {
+		errs = append(errs, errors.New("ADMIN_TOKEN must be at least 16 characters"))
+	}
+	if cfg.RawCaptureKey != nil && cfg.UserIDKey != nil && string(cfg.RawCaptureKey) == string(cfg.UserIDKey) {
+		errs = append(errs, errors.New("RAW_CAPTURE_KEY and USER_ID_KEY must be different keys"))
+	}
+	if cfg.LuckySeed != "" && cfg.LuckySeed == cfg.AdminToken {
+		errs = append(errs, errors.New("LUCKY_RECEIPT_SEED must not be the ADMIN_TOKEN"))
+	}
+	for partner, secret := range cfg.PartnerSecrets {
+		if secret == cfg.AdminToken {
+			errs = append(errs, fmt.Errorf("PARTNER_SECRETS secret for %q must not be the ADMIN_TOKEN", partner))
+		}
+	}
+	if cfg.WebhookSecret != "" && cfg.WebhookSecret == cfg.AdminToken {
+		errs = append(errs, errors.New("WEBHOOK_SECRET must not be the ADMIN_TOKEN"))
+	}
+	if cfg.JWTSecret != "" && cfg.JWTSecret == cfg.AdminToken {
+		errs = append(errs, errors.New("JWT_SECRET must not be the ADMIN_TOKEN"))
+	}
+	for name, key := range cfg.APIKeys {
+		if key == cfg.AdminToken {
+			errs = append(errs, fmt.Errorf("API key %q must not be the ADMIN_TOKEN", name))
+		}
+	}
+	if cfg.RawArchive != "" {
+		if _, err := newS3Client(cfg); err != nil {
+			errs = append(errs, fmt.Errorf("RAW_ARCHIVE: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
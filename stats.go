@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+)
+
+// Points a rule contributed across all receipts
+type RuleContribution struct {
+	Rule string `json:"rule"`
+	// Receipts the rule awarded points to
+	Receipts int `json:"receipts"`
+	Points   int `json:"points"`
+	// Share of all points issued, as a percentage
+	ShareOfPoints float64 `json:"shareOfPoints"`
+}
+
+type PointsSummary struct {
+	Receipts      int                `json:"receipts"`
+	Points        int                `json:"points"`
+	AveragePoints float64            `json:"averagePoints"`
+	Rules         []RuleContribution `json:"rules"`
+}
+
+type QualityStats struct {
+	Average    float64 `json:"average"`
+	LowQuality int     `json:"lowQuality"`
+}
+
+type Stats struct {
+	Receipts int            `json:"receipts"`
+	Points   int            `json:"points"`
+	Quality  QualityStats   `json:"quality"`
+	Sources  []SourceStats  `json:"sources"`
+	Channels []ChannelStats `json:"channels"`
+}
+
+func getStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	// Served from running counters rather than scanning the store
+	stats := counters.tenant(r.Header.Get("X-Tenant-ID")).Stats()
+
+	slog.InfoContext(r.Context(), "Stats retrieved", "receipts", stats.Receipts)
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (c *receiptCounters) Summary() PointsSummary {
+	rules := scoredRules()
+	summary := PointsSummary{
+		Receipts: int(c.receipts.Load()),
+		Points:   int(c.points.Load()),
+		Rules:    make([]RuleContribution, 0, len(rules)),
+	}
+	if summary.Receipts > 0 {
+		summary.AveragePoints = round2(float64(summary.Points) / float64(summary.Receipts))
+	}
+	for _, rule := range rules {
+		contribution := RuleContribution{Rule: rule}
+		if value, ok := c.rules.Load(rule); ok {
+			counter := value.(*ruleCounters)
+			contribution.Receipts, contribution.Points = int(counter.receipts.Load()), int(counter.points.Load())
+		}
+		if summary.Points > 0 {
+			contribution.ShareOfPoints = round2(100 * float64(contribution.Points) / float64(summary.Points))
+		}
+		summary.Rules = append(summary.Rules, contribution)
+	}
+	return summary
+}
+
+// GET /receipts/summary: points issued to the tenant's receipts overall and per rule, from the running counters
+func getSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	summary := counters.tenant(r.Header.Get("X-Tenant-ID")).Summary()
+	slog.InfoContext(r.Context(), "Summary retrieved", "receipts", summary.Receipts)
+	writeJSON(w, http.StatusOK, summary)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// Store persists processed receipts keyed by ID
+type Store interface {
+	Get(ctx context.Context, id string) (Receipt, bool, error)
+	Put(ctx context.Context, receipt Receipt) error
+	Delete(ctx context.Context, id string) (bool, error)
+	// List returns every stored receipt ordered by ID
+	List(ctx context.Context) ([]Receipt, error)
+	// ListPurchased returns the receipts purchased from from up to but not including to
+	// (YYYY-MM-DD, either may be empty) ordered by ID, reading only the purchase months
+	// in range. Receipts without a purchase date are only listed when both are empty.
+	ListPurchased(ctx context.Context, from, to string) ([]Receipt, error)
+	// DropEmptyPartitions releases the partitions of purchase months before before
+	// (YYYY-MM) that no longer hold any receipts, returning how many were dropped
+	DropEmptyPartitions(ctx context.Context, before string) (int, error)
+	Close() error
+}
+
+// Storage backends selectable via STORAGE_BACKEND
+const (
+	backendMemory         = "memory"
+	backendMemorySnapshot = "memory-snapshot"
+	backendPostgres       = "postgres"
+	backendRedis          = "redis"
+	backendBolt           = "bolt"
+)
+
+var store Store
+
+func openStore(backend, dsn string) (Store, error) {
+	switch backend {
+	case backendMemory:
+		return newMemoryStore(), nil
+	case backendMemorySnapshot:
+		if dsn == "" {
+			return nil, fmt.Errorf("%s backend requires a snapshot file path as its DSN", backend)
+		}
+		return openSnapshotStore(dsn)
+	case backendPostgres:
+		if dsn == "" {
+			return nil, fmt.Errorf("%s backend requires a postgres:// connection URL as its DSN", backend)
+		}
+		return openPostgresStore(context.Background(), dsn)
+	case backendRedis:
+		if dsn == "" {
+			return nil, fmt.Errorf("%s backend requires a redis:// connection URL as its DSN", backend)
+		}
+		return openRedisStore(context.Background(), dsn, config.RedisTTL)
+	case backendBolt:
+		if dsn == "" {
+			return nil, fmt.Errorf("%s backend requires a database file path as its DSN", backend)
+		}
+		return openBoltStore(dsn)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// Receipts are spread over independently locked shards so writers only contend
+// within a shard and snapshots can copy one shard at a time. Shards are read-locked
+// for lookups, so concurrent reads never wait on each other.
+const memoryShards = 64
+
+type memoryShard struct {
+	mutex    sync.RWMutex
+	receipts map[string]compactReceipt
+	// Receipt IDs by purchase month; a receipt's month is read from its compact receipt
+	months map[string]map[string]struct{}
+}
+
+type memoryStore struct {
+	shards [memoryShards]memoryShard
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{}
+	for i := range s.shards {
+		s.shards[i].receipts = make(map[string]compactReceipt)
+		s.shards[i].months = make(map[string]map[string]struct{})
+	}
+	return s
+}
+
+func (s *memoryStore) shard(id string) *memoryShard {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return &s.shards[hash.Sum32()%memoryShards]
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (Receipt, bool, error) {
+	shard := s.shard(id)
+	shard.mutex.RLock()
+	compact, found := shard.receipts[id]
+	shard.mutex.RUnlock()
+	if !found {
+		return Receipt{}, false, nil
+	}
+	return compact.receipt(id), true, nil
+}
+
+func (s *memoryStore) Put(ctx context.Context, receipt Receipt) error {
+	compact := compactReceiptOf(receipt)
+	month := purchaseMonth(receipt.PurchaseDate)
+	shard := s.shard(receipt.ID)
+	shard.mutex.Lock()
+	previous, replaced := shard.receipts[receipt.ID]
+	shard.receipts[receipt.ID] = compact
+	if !replaced || previous.purchaseMonth() != month {
+		if replaced {
+			shard.removeFromPartition(receipt.ID, previous.purchaseMonth())
+		}
+		if shard.months[month] == nil {
+			shard.months[month] = make(map[string]struct{})
+		}
+		shard.months[month][receipt.ID] = struct{}{}
+	}
+	shard.mutex.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, id string) (bool, error) {
+	shard := s.shard(id)
+	shard.mutex.Lock()
+	previous, found := shard.receipts[id]
+	delete(shard.receipts, id)
+	if found {
+		shard.removeFromPartition(id, previous.purchaseMonth())
+	}
+	shard.mutex.Unlock()
+	return found, nil
+}
+
+// Months are dropped as soon as their last receipt is removed
+func (shard *memoryShard) removeFromPartition(id, month string) {
+	delete(shard.months[month], id)
+	if len(shard.months[month]) == 0 {
+		delete(shard.months, month)
+	}
+}
+
+// Copy out one shard's receipts, holding only that shard's lock
+func (s *memoryStore) shardReceipts(index int) []Receipt {
+	shard := &s.shards[index]
+	shard.mutex.RLock()
+	ids := make([]string, 0, len(shard.receipts))
+	compacts := make([]compactReceipt, 0, len(shard.receipts))
+	for id, compact := range shard.receipts {
+		ids = append(ids, id)
+		compacts = append(compacts, compact)
+	}
+	shard.mutex.RUnlock()
+
+	// Expand outside the lock so copying doesn't block writers
+	receipts := make([]Receipt, len(compacts))
+	for i, compact := range compacts {
+		receipts[i] = compact.receipt(ids[i])
+	}
+	return receipts
+}
+
+func (s *memoryStore) List(ctx context.Context) ([]Receipt, error) {
+	var receipts []Receipt
+	for i := range s.shards {
+		receipts = append(receipts, s.shardReceipts(i)...)
+	}
+
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].ID < receipts[j].ID })
+	return receipts, nil
+}
+
+func (s *memoryStore) ListPurchased(ctx context.Context, from, to string) ([]Receipt, error) {
+	if from == "" && to == "" {
+		return s.List(ctx)
+	}
+	receipts := []Receipt{}
+	for i := range s.shards {
+		shard := &s.shards[i]
+		var ids []string
+		var compacts []compactReceipt
+		shard.mutex.RLock()
+		for month, members := range shard.months {
+			if !partitionInRange(month, from, to) {
+				continue
+			}
+			for id := range members {
+				ids = append(ids, id)
+				compacts = append(compacts, shard.receipts[id])
+			}
+		}
+		shard.mutex.RUnlock()
+
+		for j, compact := range compacts {
+			if receipt := compact.receipt(ids[j]); purchasedInRange(receipt, from, to) {
+				receipts = append(receipts, receipt)
+			}
+		}
+	}
+
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].ID < receipts[j].ID })
+	return receipts, nil
+}
+
+func (s *memoryStore) DropEmptyPartitions(ctx context.Context, before string) (int, error) {
+	return 0, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Receipt documents live in one nested bucket per purchase month under
+// boltPurchaseMonthsBucket, keyed by ID; boltReceiptsBucket maps each ID to its month
+var (
+	boltReceiptsBucket       = []byte("receipts")
+	boltPurchaseMonthsBucket = []byte("purchase_months")
+)
+
+// Embedded bbolt store: a single file, no external database, durable on every write
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	// A second process opening the file would block forever on its lock
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt database %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		receipts, err := tx.CreateBucketIfNotExists(boltReceiptsBucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(boltPurchaseMonthsBucket) != nil {
+			return nil
+		}
+		months, err := tx.CreateBucket(boltPurchaseMonthsBucket)
+		if err != nil {
+			return err
+		}
+		return partitionBoltReceipts(receipts, months)
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating bolt buckets: %w", err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+// Move the documents of a database written before receipts were partitioned, which
+// kept them in boltReceiptsBucket itself, into their purchase months
+func partitionBoltReceipts(receipts, months *bolt.Bucket) error {
+	type entry struct{ id, document []byte }
+	var entries []entry
+	err := receipts.ForEach(func(id, document []byte) error {
+		entries = append(entries, entry{bytes.Clone(id), bytes.Clone(document)})
+		return nil
+	})
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	slog.Info("Partitioning bolt receipts by purchase month", "receipts", len(entries))
+	for _, entry := range entries {
+		decoded, err := decompressDocument(entry.document)
+		if err != nil {
+			return fmt.Errorf("decompressing receipt %s: %w", entry.id, err)
+		}
+		var receipt struct {
+			PurchaseDate string `json:"purchaseDate"`
+		}
+		if err := json.Unmarshal(decoded, &receipt); err != nil {
+			return fmt.Errorf("decoding receipt %s: %w", entry.id, err)
+		}
+		month := []byte(purchaseMonth(receipt.PurchaseDate))
+		partition, err := months.CreateBucketIfNotExists(month)
+		if err != nil {
+			return err
+		}
+		if err := partition.Put(entry.id, entry.document); err != nil {
+			return err
+		}
+		if err := receipts.Put(entry.id, month); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The document stored for id, if any; only valid for the life of the transaction
+func boltDocument(tx *bolt.Tx, id []byte) []byte {
+	month := tx.Bucket(boltReceiptsBucket).Get(id)
+	if month == nil {
+		return nil
+	}
+	partition := tx.Bucket(boltPurchaseMonthsBucket).Bucket(month)
+	if partition == nil {
+		return nil
+	}
+	return partition.Get(id)
+}
+
+func decodeBoltReceipt(id, document []byte) (Receipt, error) {
+	var receipt Receipt
+	decoded, err := decompressDocument(document)
+	if err != nil {
+		return receipt, fmt.Errorf("decompressing receipt %s: %w", id, err)
+	}
+	if err := json.Unmarshal(decoded, &receipt); err != nil {
+		return receipt, fmt.Errorf("decoding receipt %s: %w", id, err)
+	}
+	return receipt, nil
+}
+
+func (s *boltStore) Get(ctx context.Context, id string) (Receipt, bool, error) {
+	var receipt Receipt
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		document := boltDocument(tx, []byte(id))
+		if document == nil {
+			return nil
+		}
+		found = true
+		var err error
+		receipt, err = decodeBoltReceipt([]byte(id), document)
+		return err
+	})
+	if err != nil {
+		return Receipt{}, false, fmt.Errorf("reading receipt %s: %w", id, err)
+	}
+	return receipt, found, nil
+}
+
+func (s *boltStore) Put(ctx context.Context, receipt Receipt) error {
+	document, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	id, month := []byte(receipt.ID), []byte(purchaseMonth(receipt.PurchaseDate))
+	return s.db.Update(func(tx *bolt.Tx) error {
+		receipts, months := tx.Bucket(boltReceiptsBucket), tx.Bucket(boltPurchaseMonthsBucket)
+		// A changed purchase date moves the receipt to another month
+		if previous := receipts.Get(id); previous != nil && !bytes.Equal(previous, month) {
+			if partition := months.Bucket(previous); partition != nil {
+				if err := partition.Delete(id); err != nil {
+					return err
+				}
+			}
+		}
+		partition, err := months.CreateBucketIfNotExists(month)
+		if err != nil {
+			return err
+		}
+		if err := partition.Put(id, compressDocument(document)); err != nil {
+			return err
+		}
+		return receipts.Put(id, month)
+	})
+}
+
+func (s *boltStore) Delete(ctx context.Context, id string) (bool, error) {
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		receipts := tx.Bucket(boltReceiptsBucket)
+		month := receipts.Get([]byte(id))
+		if month == nil {
+			return nil
+		}
+		found = true
+		if partition := tx.Bucket(boltPurchaseMonthsBucket).Bucket(month); partition != nil {
+			if err := partition.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return receipts.Delete([]byte(id))
+	})
+	return found, err
+}
+
+// Bolt keeps keys in byte order, so receipts come out ordered by ID
+func (s *boltStore) List(ctx context.Context) ([]Receipt, error) {
+	receipts := []Receipt{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltReceiptsBucket).ForEach(func(id, _ []byte) error {
+			document := boltDocument(tx, id)
+			if document == nil {
+				return fmt.Errorf("receipt %s is missing from its purchase month", id)
+			}
+			receipt, err := decodeBoltReceipt(id, document)
+			if err != nil {
+				return err
+			}
+			receipts = append(receipts, receipt)
+			return nil
+		})
+	})
+	return receipts, err
+}
+
+func (s *boltStore) ListPurchased(ctx context.Context, from, to string) ([]Receipt, error) {
+	if from == "" && to == "" {
+		return s.List(ctx)
+	}
+	receipts := []Receipt{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		months := tx.Bucket(boltPurchaseMonthsBucket)
+		return months.ForEachBucket(func(month []byte) error {
+			if !partitionInRange(string(month), from, to) {
+				return nil
+			}
+			return months.Bucket(month).ForEach(func(id, document []byte) error {
+				receipt, err := decodeBoltReceipt(id, document)
+				if err != nil {
+					return err
+				}
+				if purchasedInRange(receipt, from, to) {
+					receipts = append(receipts, receipt)
+				}
+				return nil
+			})
+		})
+	})
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].ID < receipts[j].ID })
+	return receipts, err
+}
+
+func (s *boltStore) DropEmptyPartitions(ctx context.Context, before string) (int, error) {
+	dropped := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		months := tx.Bucket(boltPurchaseMonthsBucket)
+		var empty [][]byte
+		err := months.ForEachBucket(func(month []byte) error {
+			if string(month) != undatedPartition && string(month) < before {
+				if key, _ := months.Bucket(month).Cursor().First(); key == nil {
+					empty = append(empty, bytes.Clone(month))
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, month := range empty {
+			if err := months.DeleteBucket(month); err != nil {
+				return err
+			}
+			dropped++
+		}
+		return nil
+	})
+	return dropped, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
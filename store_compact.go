@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+	"unique"
+)
+
+// Rule IDs in the order their compact index refers to them. lucky_receipt and external
+// rules aren't among them, so receipts awarded those are kept whole, as they were recorded.
+var compactRuleIDs = []string{ruleRetailerName, ruleRoundDollar, ruleQuarterMultiple, ruleItemPairs, ruleItemDescription, ruleOddDay, rulePurchaseTime}
+
+// How the memory store keeps receipts: strings that repeat across receipts, breakdown
+// descriptions among them, are interned and amounts are integer cents. Values that
+// wouldn't survive the round trip exactly are kept verbatim in original. Receipts are
+// read back as they were scored, never re-scored, so verify still sees any drift.
+type compactReceipt struct {
+	retailer     unique.Handle[string]
+	purchaseDate int32 // days since the Unix epoch
+	purchaseTime int16 // minutes past midnight
+	items        []compactItem
+	totalCents   int64
+	points       int32
+	rules        []compactRule
+	scoredAt     int64 // Unix nanoseconds
+	receivedAt   int64 // Unix nanoseconds
+	rulesVersion unique.Handle[string]
+	quality      [4]uint8
+	source       unique.Handle[Source]
+	userID       unique.Handle[string]
+	tenant       unique.Handle[string]
+	status       unique.Handle[string]
+	optional     *compactOptional
+	original     *Receipt
+}
+
+// Fields most receipts leave empty, nil when they all are
+type compactOptional struct {
+	purchasedAt string
+	userIDHash  string
+	warnings    []Warning
+	shadow      *ShadowScore
+}
+
+type compactItem struct {
+	description unique.Handle[string]
+	priceCents  int64
+}
+
+type compactRule struct {
+	rule        uint8
+	points      int32
+	description unique.Handle[string]
+}
+
+func compactRuleIndex(rule string) (uint8, bool) {
+	for i, id := range compactRuleIDs {
+		if id == rule {
+			return uint8(i), true
+		}
+	}
+	return 0, false
+}
+
+func unixNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNanos(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos).UTC()
+}
+
+func compactQuality(quality QualityScore) ([4]uint8, bool) {
+	values := [4]int{quality.Score, quality.Completeness, quality.Consistency, quality.Normalization}
+	var packed [4]uint8
+	for i, value := range values {
+		if value < 0 || value > 255 {
+			return packed, false
+		}
+		packed[i] = uint8(value)
+	}
+	return packed, true
+}
+
+func compactReceiptOf(receipt Receipt) compactReceipt {
+	c := compactReceipt{
+		retailer:     unique.Make(receipt.Retailer),
+		points:       int32(receipt.Points),
+		scoredAt:     unixNanos(receipt.ScoredAt),
+		receivedAt:   unixNanos(receipt.ReceivedAt),
+		rulesVersion: unique.Make(receipt.RulesVersion),
+		source:       unique.Make(receipt.Source),
+		userID:       unique.Make(receipt.UserID),
+		tenant:       unique.Make(receipt.Tenant),
+		status:       unique.Make(receipt.Status),
+		items:        make([]compactItem, len(receipt.Items)),
+	}
+	if receipt.PurchasedAt != "" || receipt.UserIDHash != "" || receipt.Warnings != nil || receipt.Shadow != nil {
+		c.optional = &compactOptional{receipt.PurchasedAt, receipt.UserIDHash, receipt.Warnings, receipt.Shadow}
+	}
+
+	exact := true
+	if date, err := time.Parse("2006-01-02", receipt.PurchaseDate); err == nil {
+		c.purchaseDate = int32(date.Unix() / 86400)
+	} else {
+		exact = false
+	}
+	if purchaseTime, err := time.Parse("15:04", receipt.PurchaseTime); err == nil {
+		c.purchaseTime = int16(purchaseTime.Hour()*60 + purchaseTime.Minute())
+	} else {
+		exact = false
+	}
+
+	var ok bool
+	if c.totalCents, ok = parseCents(receipt.Total); !ok {
+		exact = false
+	}
+	for i, item := range receipt.Items {
+		c.items[i].description = unique.Make(item.ShortDescription)
+		if c.items[i].priceCents, ok = parseCents(item.Price); !ok {
+			exact = false
+		}
+	}
+	if c.quality, ok = compactQuality(receipt.Quality); !ok {
+		exact = false
+	}
+
+	if receipt.Points < math.MinInt32 || receipt.Points > math.MaxInt32 {
+		exact = false
+	}
+	c.rules = make([]compactRule, len(receipt.Breakdown))
+	for i, result := range receipt.Breakdown {
+		if c.rules[i].rule, ok = compactRuleIndex(result.Rule); !ok {
+			exact = false
+		}
+		c.rules[i].points = int32(result.Points)
+		c.rules[i].description = unique.Make(result.Description)
+	}
+
+	// Anything the compact fields can't reproduce exactly is kept whole
+	if !exact {
+		c.original = &receipt
+		return c
+	}
+	if expanded := c.receipt(receipt.ID); expanded.Points != receipt.Points || !sameBreakdown(expanded.Breakdown, receipt.Breakdown) ||
+		expanded.PurchaseDate != receipt.PurchaseDate || expanded.PurchaseTime != receipt.PurchaseTime ||
+		expanded.Total != receipt.Total || !sameItems(expanded.Items, receipt.Items) {
+		c.original = &receipt
+	}
+	return c
+}
+
+func (c compactReceipt) receipt(id string) Receipt {
+	if c.original != nil {
+		receipt := *c.original
+		receipt.ID = id
+		return receipt
+	}
+
+	receipt := Receipt{
+		ID:           id,
+		Retailer:     c.retailer.Value(),
+		PurchaseDate: time.Unix(int64(c.purchaseDate)*86400, 0).UTC().Format("2006-01-02"),
+		PurchaseTime: fmt.Sprintf("%02d:%02d", c.purchaseTime/60, c.purchaseTime%60),
+		Items:        make([]Item, len(c.items)),
+		Total:        formatCents(c.totalCents),
+		UserID:       c.userID.Value(),
+		Tenant:       c.tenant.Value(),
+		Status:       c.status.Value(),
+		Points:       int(c.points),
+		ScoredAt:     fromUnixNanos(c.scoredAt),
+		RulesVersion: c.rulesVersion.Value(),
+		Quality:      QualityScore{int(c.quality[0]), int(c.quality[1]), int(c.quality[2]), int(c.quality[3])},
+		Source:       c.source.Value(),
+		ReceivedAt:   fromUnixNanos(c.receivedAt),
+	}
+	if c.optional != nil {
+		receipt.PurchasedAt, receipt.UserIDHash = c.optional.purchasedAt, c.optional.userIDHash
+		receipt.Warnings, receipt.Shadow = c.optional.warnings, c.optional.shadow
+	}
+	for i, item := range c.items {
+		receipt.Items[i] = Item{ShortDescription: item.description.Value(), Price: formatCents(item.priceCents)}
+	}
+	receipt.Breakdown = make([]RuleResult, len(c.rules))
+	for i, rule := range c.rules {
+		receipt.Breakdown[i] = RuleResult{Rule: compactRuleIDs[rule.rule], Points: int(rule.points), Description: rule.description.Value()}
+	}
+	return receipt
+}
+
+// The month partition the receipt is stored in, as purchaseMonth gives it
+func (c compactReceipt) purchaseMonth() string {
+	if c.original != nil {
+		return purchaseMonth(c.original.PurchaseDate)
+	}
+	return time.Unix(int64(c.purchaseDate)*86400, 0).UTC().Format("2006-01")
+}
+
+func sameItems(a, b []Item) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 10M receipts take several GB of memory; lower it with -compact.receipts on smaller machines
+var compactBenchmarkReceipts = flag.Int("compact.receipts", 10_000_000, "receipts loaded by the compact memory store benchmarks")
+
+// Receipts loaded once for every benchmark in the run
+type loadedBenchmark struct {
+	once    sync.Once
+	loaded  bool
+	heap    uint64 // bytes the receipts added to the live heap
+	loading time.Duration
+}
+
+var compactBenchmark struct {
+	loadedBenchmark
+	store *memoryStore
+}
+
+// The receipts as they were kept before compaction, to measure the compact store against
+var uncompactedBenchmark struct {
+	loadedBenchmark
+	receipts map[string]Receipt
+}
+
+func compactBenchmarkID(i int) string {
+	return fmt.Sprintf("%016x-0000-4000-8000-000000000000", i)
+}
+
+// Receipts with the retailers, items and totals of a busy deployment: a few hundred
+// retailers and products shared by every receipt, and scores that vary with them
+func compactBenchmarkReceipt(i int) Receipt {
+	items := make([]Item, 1+i%5)
+	for j := range items {
+		product := (i*7 + j*13) % 500
+		items[j] = Item{ShortDescription: fmt.Sprintf("Product %03d", product), Price: formatCents(int64(100 + product*37))}
+	}
+	var total int64
+	for _, item := range items {
+		cents, _ := parseCents(item.Price)
+		total += cents
+	}
+	receipt := Receipt{
+		ID:           compactBenchmarkID(i),
+		Retailer:     fmt.Sprintf("Retailer %d", i%300),
+		PurchaseDate: time.Date(2024, 1, 1+i%366, 0, 0, 0, 0, time.UTC).Format("2006-01-02"),
+		PurchaseTime: fmt.Sprintf("%02d:%02d", i%24, i%60),
+		Items:        items,
+		Total:        formatCents(total),
+		UserID:       fmt.Sprintf("user-%d", i%100000),
+		RulesVersion: rulesVersion,
+		Source:       Source{Channel: "api"},
+		ReceivedAt:   time.Unix(1717000000+int64(i), 0).UTC(),
+	}
+	receipt.Points, receipt.Breakdown = calculatePoints(receipt)
+	receipt.ScoredAt = receipt.ReceivedAt
+	return receipt
+}
+
+// Put every benchmark receipt, measuring the heap they take once stored
+func (l *loadedBenchmark) load(b *testing.B, put func(Receipt) error) {
+	l.once.Do(func() {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		started := time.Now()
+		for i := range *compactBenchmarkReceipts {
+			if err := put(compactBenchmarkReceipt(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		l.loading = time.Since(started)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		l.heap, l.loaded = after.HeapAlloc-before.HeapAlloc, true
+	})
+	if !l.loaded {
+		b.Fatal("loading the receipts failed")
+	}
+}
+
+func (l *loadedBenchmark) report(b *testing.B) {
+	receipts := float64(*compactBenchmarkReceipts)
+	b.ReportMetric(float64(l.heap)/receipts, "heap-B/receipt")
+	b.ReportMetric(float64(l.heap)/(1<<20), "heap-MiB")
+	b.ReportMetric(float64(l.loading.Nanoseconds())/receipts, "load-ns/receipt")
+}
+
+func loadCompactBenchmark(b *testing.B) *memoryStore {
+	if compactBenchmark.store == nil {
+		compactBenchmark.store = newMemoryStore()
+	}
+	compactBenchmark.load(b, func(receipt Receipt) error {
+		return compactBenchmark.store.Put(context.Background(), receipt)
+	})
+	return compactBenchmark.store
+}
+
+func loadUncompactedBenchmark(b *testing.B) map[string]Receipt {
+	if uncompactedBenchmark.receipts == nil {
+		uncompactedBenchmark.receipts = map[string]Receipt{}
+	}
+	uncompactedBenchmark.load(b, func(receipt Receipt) error {
+		uncompactedBenchmark.receipts[receipt.ID] = receipt
+		return nil
+	})
+	return uncompactedBenchmark.receipts
+}
+
+// go test -run - -bench CompactStore -benchtime 1000000x
+//
+// BenchmarkCompactStoreUncompacted keeps the same receipts as Receipt values in a map, as
+// the memory store did before compaction, so heap-B/receipt of the two compares them. Run
+// it on its own (-bench CompactStoreUncompacted) to not hold both sets of receipts at once.
+func BenchmarkCompactStoreGet(b *testing.B) {
+	s := loadCompactBenchmark(b)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := range b.N {
+		i := n * 7919 % *compactBenchmarkReceipts
+		if _, found, err := s.Get(ctx, compactBenchmarkID(i)); err != nil || !found {
+			b.Fatalf("receipt %d: found %t, %v", i, found, err)
+		}
+	}
+	b.StopTimer()
+	compactBenchmark.report(b)
+}
+
+func BenchmarkCompactStorePut(b *testing.B) {
+	s := loadCompactBenchmark(b)
+	ctx := context.Background()
+	receipts := make([]Receipt, 1000)
+	for i := range receipts {
+		receipts[i] = compactBenchmarkReceipt(i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := range b.N {
+		if err := s.Put(ctx, receipts[n%len(receipts)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	compactBenchmark.report(b)
+}
+
+func BenchmarkCompactStoreUncompacted(b *testing.B) {
+	receipts := loadUncompactedBenchmark(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := range b.N {
+		i := n * 7919 % *compactBenchmarkReceipts
+		if _, found := receipts[compactBenchmarkID(i)]; !found {
+			b.Fatalf("receipt %d not found", i)
+		}
+	}
+	b.StopTimer()
+	uncompactedBenchmark.report(b)
+}
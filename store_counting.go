@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Running totals kept up to date on every write so stats never scan the store
+type receiptCounters struct {
+	receipts     atomic.Int64
+	points       atomic.Int64
+	qualityTotal atomic.Int64
+	lowQuality   atomic.Int64
+	sources      sync.Map // statsSource -> *sourceCounters
+	channels     sync.Map // channel -> *channelCounters
+	heatmap      [7][24]heatmapCounters
+	items        sync.Map // normalized description -> *itemCounters
+	// Descriptions in items, and items left out once there were topItemsMaxTracked
+	itemsTracked   atomic.Int64
+	itemsUntracked atomic.Int64
+	// Sources in sources, up to sourcesMaxTracked
+	sourcesTracked atomic.Int64
+	rules          sync.Map // rule ID -> *ruleCounters
+}
+
+// Receipts a rule awarded points to and the points it awarded them
+type ruleCounters struct {
+	receipts atomic.Int64
+	points   atomic.Int64
+}
+
+// Receipts purchased in one weekday and hour slot
+type heatmapCounters struct {
+	receipts atomic.Int64
+	points   atomic.Int64
+}
+
+type sourceCounters struct {
+	receipts     atomic.Int64
+	points       atomic.Int64
+	qualityTotal atomic.Int64
+	warnings     atomic.Int64
+}
+
+type channelCounters struct {
+	receipts atomic.Int64
+	points   atomic.Int64
+	bonus    atomic.Int64
+}
+
+// Running totals per tenant, so each tenant's stats only count its own receipts
+type tenantCounters struct {
+	tenants sync.Map // tenant -> *receiptCounters
+	// Writes through countingStore started and finished, so a recount from a listing can
+	// tell whether any write overlapped it
+	started  atomic.Int64
+	finished atomic.Int64
+	// Held for reading while a write is counted, and for writing to replace a tenant's
+	// counters with a recount
+	replacing sync.RWMutex
+}
+
+var counters = &tenantCounters{}
+
+// The totals of a tenant's receipts; "" for receipts stored without a tenant
+func (t *tenantCounters) tenant(tenant string) *receiptCounters {
+	if value, ok := t.tenants.Load(tenant); ok {
+		return value.(*receiptCounters)
+	}
+	// Reads of a tenant without receipts don't create counters for it
+	return &receiptCounters{}
+}
+
+func (t *tenantCounters) add(receipt Receipt, sign int64) {
+	t.replacing.RLock()
+	defer t.replacing.RUnlock()
+	value, _ := t.tenants.LoadOrStore(receipt.Tenant, &receiptCounters{})
+	value.(*receiptCounters).add(receipt, sign)
+}
+
+// Add (sign 1) or remove (sign -1) a receipt from the totals
+func (c *receiptCounters) add(receipt Receipt, sign int64) {
+	// Partial receipts have no points yet and join the totals once finalized
+	if receipt.Status == statusNeedsEnrichment {
+		return
+	}
+	c.receipts.Add(sign)
+	c.points.Add(sign * int64(receipt.Points))
+	c.qualityTotal.Add(sign * int64(receipt.Quality.Score))
+	if receipt.Quality.Score < lowQualityThreshold {
+		c.lowQuality.Add(sign)
+	}
+
+	source := c.source(receipt.Source)
+	source.receipts.Add(sign)
+	source.points.Add(sign * int64(receipt.Points))
+	source.qualityTotal.Add(sign * int64(receipt.Quality.Score))
+	source.warnings.Add(sign * int64(len(receipt.Warnings)))
+	c.addItems(receipt, sign)
+
+	// Per-item rules have one breakdown entry per item
+	rulePoints := map[string]int{}
+	for _, result := range receipt.Breakdown {
+		rulePoints[result.Rule] += result.Points
+	}
+	value, _ := c.channels.LoadOrStore(receiptChannel(receipt), &channelCounters{})
+	channel := value.(*channelCounters)
+	channel.receipts.Add(sign)
+	channel.points.Add(sign * int64(receipt.Points))
+	channel.bonus.Add(sign * int64(rulePoints[ruleChannelBonus]))
+	for rule, points := range rulePoints {
+		if points == 0 {
+			continue
+		}
+		value, _ := c.rules.LoadOrStore(rule, &ruleCounters{})
+		counter := value.(*ruleCounters)
+		counter.receipts.Add(sign)
+		counter.points.Add(sign * int64(points))
+	}
+
+	if date, err := time.Parse("2006-01-02", receipt.PurchaseDate); err == nil {
+		if purchaseTime, err := time.Parse("15:04", receipt.PurchaseTime); err == nil {
+			cell := &c.heatmap[date.Weekday()][purchaseTime.Hour()]
+			cell.receipts.Add(sign)
+			cell.points.Add(sign * int64(receipt.Points))
+		}
+	}
+}
+
+// The counters a receipt from source is counted in. Sources keep the counters they got when
+// first seen, so a receipt is removed from where it was added.
+func (c *receiptCounters) source(source Source) *sourceCounters {
+	key := statsSource(source)
+	value, found := c.sources.Load(key)
+	if !found && c.sourcesTracked.Load() >= sourcesMaxTracked {
+		key = otherSource
+	}
+	if !found {
+		var loaded bool
+		if value, loaded = c.sources.LoadOrStore(key, &sourceCounters{}); !loaded {
+			c.sourcesTracked.Add(1)
+		}
+	}
+	return value.(*sourceCounters)
+}
+
+func (c *receiptCounters) Stats() Stats {
+	stats := Stats{
+		Receipts: int(c.receipts.Load()),
+		Points:   int(c.points.Load()),
+		Quality:  QualityStats{LowQuality: int(c.lowQuality.Load())},
+		Sources:  []SourceStats{},
+		Channels: []ChannelStats{},
+	}
+	if stats.Receipts > 0 {
+		stats.Quality.Average = float64(c.qualityTotal.Load()) / float64(stats.Receipts)
+	}
+
+	c.sources.Range(func(key, value interface{}) bool {
+		source := value.(*sourceCounters)
+		receipts := source.receipts.Load()
+		if receipts <= 0 {
+			return true
+		}
+		stats.Sources = append(stats.Sources, SourceStats{
+			Source:         key.(Source),
+			Receipts:       int(receipts),
+			Points:         int(source.points.Load()),
+			AverageQuality: float64(source.qualityTotal.Load()) / float64(receipts),
+			Warnings:       int(source.warnings.Load()),
+		})
+		return true
+	})
+	sortSourceStats(stats.Sources)
+
+	c.channels.Range(func(key, value interface{}) bool {
+		channel := value.(*channelCounters)
+		receipts := channel.receipts.Load()
+		if receipts <= 0 {
+			return true
+		}
+		points := channel.points.Load()
+		stats.Channels = append(stats.Channels, ChannelStats{
+			Channel:       key.(string),
+			Receipts:      int(receipts),
+			Points:        int(points),
+			AveragePoints: round2(float64(points) / float64(receipts)),
+			BonusPoints:   int(channel.bonus.Load()),
+		})
+		return true
+	})
+	sortChannelStats(stats.Channels)
+	return stats
+}
+
+// Store decorator maintaining counters for the receipts written through it
+type countingStore struct {
+	Store
+	counters *tenantCounters
+}
+
+// Seed the counters with what is already stored, then keep them current
+func newCountingStore(ctx context.Context, backing Store, counters *tenantCounters) (*countingStore, error) {
+	receipts, err := backing.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, receipt := range receipts {
+		counters.add(receipt, 1)
+	}
+	return &countingStore{Store: backing, counters: counters}, nil
+}
+
+func (s *countingStore) Put(ctx context.Context, receipt Receipt) error {
+	s.counters.started.Add(1)
+	defer s.counters.finished.Add(1)
+	previous, replaced, err := s.Store.Get(ctx, receipt.ID)
+	if err != nil {
+		return err
+	}
+	if err := s.Store.Put(ctx, receipt); err != nil {
+		return err
+	}
+	if replaced {
+		s.counters.add(previous, -1)
+	}
+	s.counters.add(receipt, 1)
+	return nil
+}
+
+func (s *countingStore) Delete(ctx context.Context, id string) (bool, error) {
+	s.counters.started.Add(1)
+	defer s.counters.finished.Add(1)
+	previous, found, err := s.Store.Get(ctx, id)
+	if err != nil || !found {
+		return false, err
+	}
+	deleted, err := s.Store.Delete(ctx, id)
+	if deleted {
+		s.counters.add(previous, -1)
+	}
+	return deleted, err
+}
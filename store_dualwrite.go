@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+)
+
+// Transitional store for zero-downtime migrations: writes go to both backends,
+// reads prefer the new backend and fall back to the old one for receipts not yet backfilled.
+type dualWriteStore struct {
+	current  Store
+	previous Store
+}
+
+func (s *dualWriteStore) Get(ctx context.Context, id string) (Receipt, bool, error) {
+	receipt, found, err := s.current.Get(ctx, id)
+	if err != nil || found {
+		return receipt, found, err
+	}
+	receipt, found, err = s.previous.Get(ctx, id)
+	if found {
+		slog.InfoContext(ctx, "Receipt served from the old storage backend", "receipt_id", id)
+	}
+	return receipt, found, err
+}
+
+func (s *dualWriteStore) Put(ctx context.Context, receipt Receipt) error {
+	if err := s.previous.Put(ctx, receipt); err != nil {
+		return fmt.Errorf("writing to old backend: %w", err)
+	}
+	if err := s.current.Put(ctx, receipt); err != nil {
+		return fmt.Errorf("writing to new backend: %w", err)
+	}
+	return nil
+}
+
+func (s *dualWriteStore) Delete(ctx context.Context, id string) (bool, error) {
+	foundPrevious, err := s.previous.Delete(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("deleting from old backend: %w", err)
+	}
+	foundCurrent, err := s.current.Delete(ctx, id)
+	if err != nil {
+		return false, fmt.Errorf("deleting from new backend: %w", err)
+	}
+	return foundPrevious || foundCurrent, nil
+}
+
+func (s *dualWriteStore) List(ctx context.Context) ([]Receipt, error) {
+	return s.merge(ctx, func(backend Store) ([]Receipt, error) { return backend.List(ctx) })
+}
+
+func (s *dualWriteStore) ListPurchased(ctx context.Context, from, to string) ([]Receipt, error) {
+	return s.merge(ctx, func(backend Store) ([]Receipt, error) { return backend.ListPurchased(ctx, from, to) })
+}
+
+// Receipts listed from both backends, preferring the new backend's copy
+func (s *dualWriteStore) merge(ctx context.Context, list func(Store) ([]Receipt, error)) ([]Receipt, error) {
+	receipts, err := list(s.current)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(receipts))
+	for _, receipt := range receipts {
+		seen[receipt.ID] = true
+	}
+
+	previous, err := list(s.previous)
+	if err != nil {
+		return nil, err
+	}
+	for _, receipt := range previous {
+		if !seen[receipt.ID] {
+			receipts = append(receipts, receipt)
+		}
+	}
+
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].ID < receipts[j].ID })
+	return receipts, nil
+}
+
+func (s *dualWriteStore) DropEmptyPartitions(ctx context.Context, before string) (int, error) {
+	droppedPrevious, err := s.previous.DropEmptyPartitions(ctx, before)
+	if err != nil {
+		return droppedPrevious, fmt.Errorf("dropping partitions from old backend: %w", err)
+	}
+	droppedCurrent, err := s.current.DropEmptyPartitions(ctx, before)
+	if err != nil {
+		return droppedPrevious + droppedCurrent, fmt.Errorf("dropping partitions from new backend: %w", err)
+	}
+	return droppedPrevious + droppedCurrent, nil
+}
+
+func (s *dualWriteStore) Close() error {
+	return errors.Join(s.current.Close(), s.previous.Close())
+}
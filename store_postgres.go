@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Created on open; the full receipt is kept as a JSON document so nothing is lost,
+// with items broken out for reporting straight from SQL. With STORAGE_COMPRESSION
+// the document is stored compressed in compressed instead of document. purchase_date is
+// null for receipts without a valid one yet.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS receipts (
+	id            TEXT PRIMARY KEY,
+	retailer      TEXT NOT NULL,
+	purchase_date DATE,
+	total_cents   BIGINT NOT NULL,
+	points        INTEGER NOT NULL,
+	user_id       TEXT,
+	tenant        TEXT,
+	received_at   TIMESTAMPTZ NOT NULL,
+	document      JSONB,
+	compressed    BYTEA
+);
+ALTER TABLE receipts ALTER COLUMN document DROP NOT NULL;
+ALTER TABLE receipts ADD COLUMN IF NOT EXISTS compressed BYTEA;
+ALTER TABLE receipts ALTER COLUMN purchase_date DROP NOT NULL;
+CREATE INDEX IF NOT EXISTS receipts_user_id ON receipts (user_id) WHERE user_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS receipt_items (
+	receipt_id        TEXT NOT NULL REFERENCES receipts (id) ON DELETE CASCADE,
+	position          INTEGER NOT NULL,
+	short_description TEXT NOT NULL,
+	price_cents       BIGINT NOT NULL,
+	PRIMARY KEY (receipt_id, position)
+);
+`
+
+// The schema of databases created since receipts are partitioned by purchase month:
+// receipts is range partitioned on purchase_date, with each month's partition created
+// as its first receipt arrives, and undated receipts kept in the default partition, which
+// only takes them so a dated receipt never lands there when its month's partition is missing.
+// Unique indexes of partitioned tables must include the partition key, and primary keys
+// can't include a nullable column, so receipts are unique by ID and purchase date and
+// found by ID through receipts_id, and items can't reference their receipt and are
+// deleted along with it instead. Databases partitioned before undated receipts were kept
+// have their primary key replaced.
+const postgresPartitionedSchema = `
+CREATE TABLE IF NOT EXISTS receipts (
+	id            TEXT NOT NULL,
+	retailer      TEXT NOT NULL,
+	purchase_date DATE,
+	total_cents   BIGINT NOT NULL,
+	points        INTEGER NOT NULL,
+	user_id       TEXT,
+	tenant        TEXT,
+	received_at   TIMESTAMPTZ NOT NULL,
+	document      JSONB,
+	compressed    BYTEA
+) PARTITION BY RANGE (purchase_date);
+ALTER TABLE receipts DROP CONSTRAINT IF EXISTS receipts_pkey;
+ALTER TABLE receipts ALTER COLUMN purchase_date DROP NOT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS receipts_id_purchase_date ON receipts (id, purchase_date);
+CREATE TABLE IF NOT EXISTS receipts_undated PARTITION OF receipts (
+	CONSTRAINT receipts_undated_purchase_date CHECK (purchase_date IS NULL)
+) DEFAULT;
+CREATE INDEX IF NOT EXISTS receipts_id ON receipts (id);
+CREATE INDEX IF NOT EXISTS receipts_user_id ON receipts (user_id) WHERE user_id IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS receipt_items (
+	receipt_id        TEXT NOT NULL,
+	position          INTEGER NOT NULL,
+	short_description TEXT NOT NULL,
+	price_cents       BIGINT NOT NULL,
+	PRIMARY KEY (receipt_id, position)
+);
+`
+
+// PostgreSQL store; the DSN is a postgres:// URL, and pool settings such as
+// pool_max_conns can be given as its query parameters
+type postgresStore struct {
+	pool *pgxpool.Pool
+	// Whether receipts is partitioned, which databases created before partitioning aren't
+	partitioned bool
+	partitions  sync.Map // months whose partition is known to exist
+}
+
+func openPostgresStore(ctx context.Context, dsn string) (*postgresStore, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+	var partitioned bool
+	err = pool.QueryRow(ctx, `SELECT relkind = 'p' FROM pg_class WHERE oid = to_regclass('receipts')`).Scan(&partitioned)
+	schema := postgresSchema
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		partitioned, schema = true, postgresPartitionedSchema
+	case err != nil:
+		pool.Close()
+		return nil, fmt.Errorf("inspecting postgres schema: %w", err)
+	case partitioned:
+		schema = postgresPartitionedSchema
+	default:
+		slog.WarnContext(ctx, "The postgres receipts table isn't partitioned by purchase month; migrate to a new database to partition it")
+	}
+	if _, err := pool.Exec(ctx, schema); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("creating postgres schema: %w", err)
+	}
+	return &postgresStore{pool: pool, partitioned: partitioned}, nil
+}
+
+// The purchase_date column of a receipt; null for undated receipts, which the default
+// partition holds
+func postgresPurchaseDate(receipt Receipt) interface{} {
+	if purchaseMonth(receipt.PurchaseDate) == undatedPartition {
+		return nil
+	}
+	return receipt.PurchaseDate
+}
+
+func postgresPartitionName(month string) string {
+	return "receipts_" + strings.ReplaceAll(month, "-", "_")
+}
+
+// Create the partition for a purchase date's month unless it is known to exist
+func (s *postgresStore) ensurePartition(ctx context.Context, date string) error {
+	purchased, err := time.Parse("2006-01-02", date)
+	// Undated receipts go to the default partition
+	if !s.partitioned || err != nil {
+		return nil
+	}
+	month := purchased.Format("2006-01")
+	if _, exists := s.partitions.Load(month); exists {
+		return nil
+	}
+	first := time.Date(purchased.Year(), purchased.Month(), 1, 0, 0, 0, 0, time.UTC)
+	_, err = s.pool.Exec(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s PARTITION OF receipts FOR VALUES FROM ('%s') TO ('%s')`,
+		pgx.Identifier{postgresPartitionName(month)}.Sanitize(), first.Format(time.DateOnly), first.AddDate(0, 1, 0).Format(time.DateOnly)))
+	// Another instance created it at the same time
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && (pgErr.Code == "42P07" || pgErr.Code == "23505") {
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("creating partition for %s: %w", month, err)
+	}
+	s.partitions.Store(month, true)
+	return nil
+}
+
+func (s *postgresStore) Get(ctx context.Context, id string) (Receipt, bool, error) {
+	var document, compressed []byte
+	err := s.pool.QueryRow(ctx, `SELECT document, compressed FROM receipts WHERE id = $1`, id).Scan(&document, &compressed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Receipt{}, false, nil
+	}
+	if err != nil {
+		return Receipt{}, false, err
+	}
+	receipt, err := decodePostgresReceipt(document, compressed)
+	if err != nil {
+		return Receipt{}, false, fmt.Errorf("decoding receipt %s: %w", id, err)
+	}
+	return receipt, true, nil
+}
+
+// Write the receipt and its items in one transaction so readers never see a partial receipt.
+// The ledger credit, idempotency record and raw payload are kept in memory by the caller
+// and aren't part of it.
+func (s *postgresStore) Put(ctx context.Context, receipt Receipt) error {
+	document, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	total, _ := parseCents(receipt.Total)
+	var compressed []byte
+	if stored := compressDocument(document); config.StorageCompression != compressionNone {
+		document, compressed = nil, stored
+	}
+
+	// With USER_ID_KEY set the column holds the keyed hash, so it can still be queried by user
+	userID := receipt.UserID
+	if receipt.UserIDHash != "" {
+		userID = receipt.UserIDHash
+	}
+
+	if err := s.ensurePartition(ctx, receipt.PurchaseDate); err != nil {
+		return err
+	}
+	err = s.write(ctx, receipt, total, userID, document, compressed)
+	// The month's partition was dropped by another instance since this one created it
+	var pgErr *pgconn.PgError
+	if s.partitioned && errors.As(err, &pgErr) && pgErr.Code == "23514" {
+		s.partitions.Delete(purchaseMonth(receipt.PurchaseDate))
+		if err := s.ensurePartition(ctx, receipt.PurchaseDate); err != nil {
+			return err
+		}
+		err = s.write(ctx, receipt, total, userID, document, compressed)
+	}
+	return err
+}
+
+func (s *postgresStore) write(ctx context.Context, receipt Receipt, total int64, userID string, document, compressed []byte) error {
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		conflict := "id"
+		if s.partitioned {
+			// A changed purchase date moves the receipt to another partition. Nulls never
+			// conflict, so an undated receipt is always replaced.
+			if _, err := tx.Exec(ctx, `DELETE FROM receipts WHERE id = $1 AND (purchase_date IS NULL OR purchase_date IS DISTINCT FROM $2::date)`, receipt.ID, postgresPurchaseDate(receipt)); err != nil {
+				return fmt.Errorf("moving receipt %s: %w", receipt.ID, err)
+			}
+			conflict = "id, purchase_date"
+		}
+		_, err := tx.Exec(ctx, `
+			INSERT INTO receipts (id, retailer, purchase_date, total_cents, points, user_id, tenant, received_at, document, compressed)
+			VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8, $9, $10)
+			ON CONFLICT (`+conflict+`) DO UPDATE SET
+				retailer = EXCLUDED.retailer, purchase_date = EXCLUDED.purchase_date,
+				total_cents = EXCLUDED.total_cents, points = EXCLUDED.points,
+				user_id = EXCLUDED.user_id, tenant = EXCLUDED.tenant,
+				received_at = EXCLUDED.received_at, document = EXCLUDED.document, compressed = EXCLUDED.compressed`,
+			receipt.ID, receipt.Retailer, postgresPurchaseDate(receipt), total, receipt.Points,
+			userID, receipt.Tenant, receipt.ReceivedAt, document, compressed)
+		if err != nil {
+			return fmt.Errorf("writing receipt %s: %w", receipt.ID, err)
+		}
+
+		if _, err := tx.Exec(ctx, `DELETE FROM receipt_items WHERE receipt_id = $1`, receipt.ID); err != nil {
+			return fmt.Errorf("replacing items of receipt %s: %w", receipt.ID, err)
+		}
+		rows := make([][]interface{}, len(receipt.Items))
+		for i, item := range receipt.Items {
+			price, _ := parseCents(item.Price)
+			rows[i] = []interface{}{receipt.ID, i, item.ShortDescription, price}
+		}
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"receipt_items"},
+			[]string{"receipt_id", "position", "short_description", "price_cents"}, pgx.CopyFromRows(rows))
+		if err != nil {
+			return fmt.Errorf("writing items of receipt %s: %w", receipt.ID, err)
+		}
+		return nil
+	})
+}
+
+// Items are deleted explicitly since partitioned databases can't cascade to them
+func (s *postgresStore) Delete(ctx context.Context, id string) (bool, error) {
+	found := false
+	err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM receipt_items WHERE receipt_id = $1`, id); err != nil {
+			return err
+		}
+		tag, err := tx.Exec(ctx, `DELETE FROM receipts WHERE id = $1`, id)
+		found = tag.RowsAffected() > 0
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+func (s *postgresStore) List(ctx context.Context) ([]Receipt, error) {
+	return s.query(ctx, `SELECT document, compressed FROM receipts ORDER BY id COLLATE "C"`)
+}
+
+// Bounds on purchase_date let postgres skip the partitions of other months. Undated
+// receipts, with a null purchase_date, only match when neither bound is given.
+func (s *postgresStore) ListPurchased(ctx context.Context, from, to string) ([]Receipt, error) {
+	if from == "" && to == "" {
+		return s.List(ctx)
+	}
+	var conditions []string
+	var args []interface{}
+	if from != "" {
+		args = append(args, from)
+		conditions = append(conditions, fmt.Sprintf("purchase_date >= $%d", len(args)))
+	}
+	if to != "" {
+		args = append(args, to)
+		conditions = append(conditions, fmt.Sprintf("purchase_date < $%d", len(args)))
+	}
+	return s.query(ctx, `SELECT document, compressed FROM receipts WHERE `+strings.Join(conditions, " AND ")+` ORDER BY id COLLATE "C"`, args...)
+}
+
+func (s *postgresStore) query(ctx context.Context, sql string, args ...interface{}) ([]Receipt, error) {
+	rows, err := s.pool.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	receipts := []Receipt{}
+	for rows.Next() {
+		var document, compressed []byte
+		if err := rows.Scan(&document, &compressed); err != nil {
+			return nil, err
+		}
+		receipt, err := decodePostgresReceipt(document, compressed)
+		if err != nil {
+			return nil, fmt.Errorf("decoding receipt: %w", err)
+		}
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
+
+// Receipts written with compression have their document in compressed instead
+func decodePostgresReceipt(document, compressed []byte) (Receipt, error) {
+	var receipt Receipt
+	if compressed != nil {
+		var err error
+		if document, err = decompressDocument(compressed); err != nil {
+			return receipt, err
+		}
+	}
+	err := json.Unmarshal(document, &receipt)
+	return receipt, err
+}
+
+// Each partition is checked and dropped under its lock, so a receipt can't be written
+// to it in between. The default partition of undated receipts is never dropped.
+func (s *postgresStore) DropEmptyPartitions(ctx context.Context, before string) (int, error) {
+	if !s.partitioned {
+		return 0, nil
+	}
+	rows, err := s.pool.Query(ctx, `SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid WHERE i.inhparent = 'receipts'::regclass`)
+	if err != nil {
+		return 0, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+
+	dropped := 0
+	for _, name := range names {
+		month, ok := strings.CutPrefix(name, "receipts_")
+		month = strings.ReplaceAll(month, "_", "-")
+		if !ok || month == undatedPartition || month >= before {
+			continue
+		}
+		empty := false
+		err := pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+			table := pgx.Identifier{name}.Sanitize()
+			if _, err := tx.Exec(ctx, `LOCK TABLE `+table+` IN ACCESS EXCLUSIVE MODE`); err != nil {
+				return err
+			}
+			if err := tx.QueryRow(ctx, `SELECT NOT EXISTS (SELECT 1 FROM `+table+`)`).Scan(&empty); err != nil || !empty {
+				return err
+			}
+			_, err := tx.Exec(ctx, `DROP TABLE `+table)
+			return err
+		})
+		if err != nil {
+			return dropped, fmt.Errorf("dropping partition %s: %w", name, err)
+		}
+		if empty {
+			s.partitions.Delete(month)
+			dropped++
+		}
+	}
+	return dropped, nil
+}
+
+func (s *postgresStore) Close() error {
+	s.pool.Close()
+	return nil
+}
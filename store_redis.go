@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisReceiptPrefix = "receipt:"
+	// Sorted set of receipt IDs scored by expiry time, so List can skip expired receipts
+	redisIndexKey  = "receipts"
+	redisListBatch = 500
+	// A set of receipt IDs per purchase month, the set of months that have one, and a
+	// hash of each receipt's month
+	redisPartitionPrefix = "receipts:month:"
+	redisPartitionsKey   = "receipts:months"
+	redisPartitionOfKey  = "receipts:partition"
+)
+
+// Redis store; receipts are JSON strings that expire after REDIS_TTL, and the DSN is a
+// redis:// URL. Only receipts are kept here: the ledger, idempotency keys, webhooks,
+// counters and indexes stay in each instance's memory, and expiry by REDIS_TTL doesn't
+// reach them, so it suits a single instance.
+type redisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func openRedisStore(ctx context.Context, dsn string, ttl time.Duration) (*redisStore, error) {
+	options, err := redis.ParseURL(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis URL: %w", err)
+	}
+	client := redis.NewClient(options)
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+	return &redisStore{client: client, ttl: ttl}, nil
+}
+
+func (s *redisStore) Get(ctx context.Context, id string) (Receipt, bool, error) {
+	document, err := s.client.Get(ctx, redisReceiptPrefix+id).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Receipt{}, false, nil
+	}
+	if err != nil {
+		return Receipt{}, false, err
+	}
+	var receipt Receipt
+	if err := json.Unmarshal(document, &receipt); err != nil {
+		return Receipt{}, false, fmt.Errorf("decoding receipt %s: %w", id, err)
+	}
+	return receipt, true, nil
+}
+
+func (s *redisStore) Put(ctx context.Context, receipt Receipt) error {
+	document, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	expiresAt := math.Inf(1)
+	if s.ttl > 0 {
+		expiresAt = float64(time.Now().Add(s.ttl).Unix())
+	}
+	month := purchaseMonth(receipt.PurchaseDate)
+	previous, err := s.partitionOf(ctx, receipt.ID)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisReceiptPrefix+receipt.ID, document, s.ttl)
+		pipe.ZAdd(ctx, redisIndexKey, redis.Z{Score: expiresAt, Member: receipt.ID})
+		if previous != "" && previous != month {
+			pipe.SRem(ctx, redisPartitionPrefix+previous, receipt.ID)
+		}
+		pipe.SAdd(ctx, redisPartitionPrefix+month, receipt.ID)
+		pipe.SAdd(ctx, redisPartitionsKey, month)
+		pipe.HSet(ctx, redisPartitionOfKey, receipt.ID, month)
+		return nil
+	})
+	return err
+}
+
+// The purchase month a receipt was stored under, or "" if it wasn't
+func (s *redisStore) partitionOf(ctx context.Context, id string) (string, error) {
+	month, err := s.client.HGet(ctx, redisPartitionOfKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return month, err
+}
+
+func (s *redisStore) Delete(ctx context.Context, id string) (bool, error) {
+	month, err := s.partitionOf(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	var deleted *redis.IntCmd
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		deleted = pipe.Del(ctx, redisReceiptPrefix+id)
+		pipe.ZRem(ctx, redisIndexKey, id)
+		if month != "" {
+			pipe.SRem(ctx, redisPartitionPrefix+month, id)
+			pipe.HDel(ctx, redisPartitionOfKey, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted.Val() > 0, nil
+}
+
+func (s *redisStore) List(ctx context.Context) ([]Receipt, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := s.client.ZRemRangeByScore(ctx, redisIndexKey, "-inf", "("+now).Err(); err != nil {
+		return nil, err
+	}
+	ids, err := s.client.ZRangeByScore(ctx, redisIndexKey, &redis.ZRangeBy{Min: now, Max: "+inf"}).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	return s.fetch(ctx, ids)
+}
+
+// Fetch receipts by ID in batches, skipping those that have expired
+func (s *redisStore) fetch(ctx context.Context, ids []string) ([]Receipt, error) {
+	receipts := make([]Receipt, 0, len(ids))
+	for start := 0; start < len(ids); start += redisListBatch {
+		batch := ids[start:min(start+redisListBatch, len(ids))]
+		keys := make([]string, len(batch))
+		for i, id := range batch {
+			keys[i] = redisReceiptPrefix + id
+		}
+		documents, err := s.client.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, document := range documents {
+			// Expired between the range and the fetch
+			value, ok := document.(string)
+			if !ok {
+				continue
+			}
+			var receipt Receipt
+			if err := json.Unmarshal([]byte(value), &receipt); err != nil {
+				return nil, fmt.Errorf("decoding receipt %s: %w", batch[i], err)
+			}
+			receipts = append(receipts, receipt)
+		}
+	}
+	return receipts, nil
+}
+
+func (s *redisStore) ListPurchased(ctx context.Context, from, to string) ([]Receipt, error) {
+	if from == "" && to == "" {
+		return s.List(ctx)
+	}
+	months, err := s.client.SMembers(ctx, redisPartitionsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, month := range months {
+		if !partitionInRange(month, from, to) {
+			continue
+		}
+		members, err := s.client.SMembers(ctx, redisPartitionPrefix+month).Result()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, members...)
+	}
+	sort.Strings(ids)
+
+	fetched, err := s.fetch(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	receipts := []Receipt{}
+	for _, receipt := range fetched {
+		if purchasedInRange(receipt, from, to) {
+			receipts = append(receipts, receipt)
+		}
+	}
+	return receipts, nil
+}
+
+// Receipts that expired after REDIS_TTL stay in their month's set until it is checked
+// here, so their IDs are cleared out first
+func (s *redisStore) DropEmptyPartitions(ctx context.Context, before string) (int, error) {
+	months, err := s.client.SMembers(ctx, redisPartitionsKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	dropped := 0
+	for _, month := range months {
+		if month == undatedPartition || month >= before {
+			continue
+		}
+		members, err := s.client.SMembers(ctx, redisPartitionPrefix+month).Result()
+		if err != nil {
+			return dropped, err
+		}
+		remaining := len(members)
+		for start := 0; start < len(members); start += redisListBatch {
+			batch := members[start:min(start+redisListBatch, len(members))]
+			keys := make([]string, len(batch))
+			for i, id := range batch {
+				keys[i] = redisReceiptPrefix + id
+			}
+			documents, err := s.client.MGet(ctx, keys...).Result()
+			if err != nil {
+				return dropped, err
+			}
+			for i, document := range documents {
+				if document != nil {
+					continue
+				}
+				_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+					pipe.SRem(ctx, redisPartitionPrefix+month, batch[i])
+					pipe.HDel(ctx, redisPartitionOfKey, batch[i])
+					return nil
+				})
+				if err != nil {
+					return dropped, err
+				}
+				remaining--
+			}
+		}
+		if remaining > 0 {
+			continue
+		}
+		if err := s.client.SRem(ctx, redisPartitionsKey, month).Err(); err != nil {
+			return dropped, err
+		}
+		// A receipt stored in the month in the meantime brings it back
+		count, err := s.client.SCard(ctx, redisPartitionPrefix+month).Result()
+		if err != nil {
+			return dropped, err
+		}
+		if count > 0 {
+			if err := s.client.SAdd(ctx, redisPartitionsKey, month).Err(); err != nil {
+				return dropped, err
+			}
+			continue
+		}
+		dropped++
+	}
+	return dropped, nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// In-memory store backed by a JSON snapshot file, loaded on open and written
+// every SNAPSHOT_INTERVAL and on Close
+type snapshotStore struct {
+	*memoryStore
+	path   string
+	dirty  atomic.Bool
+	saving sync.Mutex
+	stop   chan struct{}
+}
+
+func openSnapshotStore(path string) (*snapshotStore, error) {
+	s := &snapshotStore{memoryStore: newMemoryStore(), path: path, stop: make(chan struct{})}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if config.SnapshotInterval > 0 {
+		go s.saveEvery(config.SnapshotInterval)
+	}
+	return s, nil
+}
+
+func (s *snapshotStore) load() error {
+	path := s.path
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		slog.Info("Snapshot does not exist yet, starting empty", "path", path)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("opening snapshot: %w", err)
+	}
+	defer file.Close()
+
+	var receipts []Receipt
+	if err := json.NewDecoder(file).Decode(&receipts); err != nil {
+		return fmt.Errorf("decoding snapshot %s: %w", path, err)
+	}
+	ctx := context.Background()
+	for _, receipt := range receipts {
+		s.memoryStore.Put(ctx, receipt)
+	}
+	slog.Info("Loaded receipts from snapshot", "receipts", len(receipts), "path", path)
+	return nil
+}
+
+func (s *snapshotStore) saveEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !s.dirty.Load() {
+				continue
+			}
+			if err := s.Save(); err != nil {
+				slog.Error("Error saving snapshot", "path", s.path, "error", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Stream the snapshot shard by shard to a temporary file and rename it into place
+// so readers never see a partial file. Only one shard is locked at a time, so
+// requests keep being served while a snapshot is written.
+func (s *snapshotStore) Save() (err error) {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+	// Cleared before writing, so writes made meanwhile are saved by the next snapshot, and
+	// set again if this one isn't saved
+	s.dirty.Store(false)
+	defer func() {
+		if err != nil {
+			s.dirty.Store(true)
+		}
+	}()
+
+	temp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating snapshot: %w", err)
+	}
+	defer os.Remove(temp.Name())
+
+	count, err := s.writeSnapshot(temp)
+	if err != nil {
+		temp.Close()
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := os.Rename(temp.Name(), s.path); err != nil {
+		return fmt.Errorf("replacing snapshot: %w", err)
+	}
+	slog.Info("Saved receipts to snapshot", "receipts", count, "path", s.path)
+	return nil
+}
+
+// Write every receipt as one JSON array without holding more than one shard in memory
+func (s *snapshotStore) writeSnapshot(file *os.File) (int, error) {
+	writer := bufio.NewWriter(file)
+	writer.WriteString("[")
+	count := 0
+	for i := range s.shards {
+		for _, receipt := range s.shardReceipts(i) {
+			encoded, err := json.Marshal(receipt)
+			if err != nil {
+				return count, err
+			}
+			if count > 0 {
+				writer.WriteString(",")
+			}
+			writer.WriteString("\n")
+			writer.Write(encoded)
+			count++
+		}
+	}
+	writer.WriteString("\n]\n")
+	return count, writer.Flush()
+}
+
+func (s *snapshotStore) Put(ctx context.Context, receipt Receipt) error {
+	s.dirty.Store(true)
+	return s.memoryStore.Put(ctx, receipt)
+}
+
+func (s *snapshotStore) Delete(ctx context.Context, id string) (bool, error) {
+	s.dirty.Store(true)
+	return s.memoryStore.Delete(ctx, id)
+}
+
+// Only rewrite the snapshot if something changed since it was last saved
+func (s *snapshotStore) Close() error {
+	close(s.stop)
+	if !s.dirty.Load() {
+		return nil
+	}
+	return s.Save()
+}
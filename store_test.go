@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+// Lookups as they were made before shards were read-locked, each taking the shard's
+// exclusive lock
+type exclusiveReadStore struct {
+	*memoryStore
+}
+
+func (s exclusiveReadStore) Get(ctx context.Context, id string) (Receipt, bool, error) {
+	shard := s.shard(id)
+	shard.mutex.Lock()
+	compact, found := shard.receipts[id]
+	shard.mutex.Unlock()
+	if !found {
+		return Receipt{}, false, nil
+	}
+	return compact.receipt(id), true, nil
+}
+
+func benchmarkStoreReceipt(i int) Receipt {
+	receipt := Receipt{
+		ID:           fmt.Sprintf("receipt-%05d", i),
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items: []Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+		},
+		Total: "18.74",
+	}
+	receipt.Points, receipt.Breakdown = calculatePoints(receipt)
+	return receipt
+}
+
+// Parallel lookups of count stored receipts with one write in every writeEvery operations
+func benchmarkParallelGetPut(b *testing.B, store Store, count, writeEvery int) {
+	ctx := context.Background()
+	receipts := make([]Receipt, count)
+	for i := range receipts {
+		receipts[i] = benchmarkStoreReceipt(i)
+		if err := store.Put(ctx, receipts[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for n := 0; pb.Next(); n++ {
+			receipt := receipts[rand.IntN(len(receipts))]
+			if n%writeEvery == 0 {
+				if err := store.Put(ctx, receipt); err != nil {
+					b.Error(err)
+				}
+			} else if _, found, err := store.Get(ctx, receipt.ID); err != nil || !found {
+				b.Errorf("Get(%s) = %t, %v", receipt.ID, found, err)
+			}
+		}
+	})
+}
+
+// Compare with go test -run - -bench GetPut -cpu 1,4,16 on a machine with that many cores.
+// With a single receipt every operation contends for the same shard.
+func BenchmarkMemoryStoreGetPut(b *testing.B) {
+	for _, count := range []int{1, 10000} {
+		for _, writeEvery := range []int{10, 100} {
+			name := fmt.Sprintf("receipts=%d/writes=1in%d", count, writeEvery)
+			b.Run("rwmutex/"+name, func(b *testing.B) {
+				benchmarkParallelGetPut(b, newMemoryStore(), count, writeEvery)
+			})
+			b.Run("mutex/"+name, func(b *testing.B) {
+				benchmarkParallelGetPut(b, exclusiveReadStore{newMemoryStore()}, count, writeEvery)
+			})
+		}
+	}
+}
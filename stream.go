@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How often an idle stream sends a comment, so proxies don't close it
+const streamHeartbeat = 15 * time.Second
+
+// Server-sent event types, by change operation
+var streamEvents = map[string]string{
+	changeCreate: "receipt.processed",
+	changeUpdate: "receipt.updated",
+	changeDelete: "receipt.deleted",
+}
+
+// What dashboards are told about a receipt as it is processed, changed or deleted.
+// PointsDelta is the change to the points awarded for it: all of them for a new receipt,
+// the difference for a rescored one and minus them for a voided or deleted one.
+type StreamedReceipt struct {
+	ID          string    `json:"id"`
+	Retailer    string    `json:"retailer"`
+	Total       string    `json:"total"`
+	UserID      string    `json:"userId,omitempty"`
+	Status      string    `json:"status"`
+	Channel     string    `json:"channel"`
+	Points      int       `json:"points"`
+	PointsDelta int       `json:"pointsDelta"`
+	At          time.Time `json:"at"`
+}
+
+func streamedReceipt(event ChangeEvent) StreamedReceipt {
+	receipt := event.After
+	if receipt == nil {
+		receipt = event.Before
+	}
+	streamed := StreamedReceipt{
+		ID:       receipt.ID,
+		Retailer: receipt.Retailer,
+		Total:    receipt.Total,
+		UserID:   receipt.UserID,
+		Status:   receiptStatus(*receipt),
+		Channel:  receiptChannel(*receipt),
+		At:       event.At,
+	}
+	if event.After != nil {
+		streamed.Points = event.After.Points
+	}
+	streamed.PointsDelta = awardedPoints(event.After) - awardedPoints(event.Before)
+	return streamed
+}
+
+// Voided receipts keep their points, but members no longer have them
+func awardedPoints(receipt *Receipt) int {
+	if receipt == nil || receiptStatus(*receipt) == statusVoided {
+		return 0
+	}
+	return receipt.Points
+}
+
+// GET /v1/receipts/stream: the tenant's receipts as server-sent events, from when the
+// stream is opened, or after the Last-Event-ID a reconnecting client sends, until the
+// client disconnects. Event IDs are change log sequence numbers.
+func streamReceipts(w http.ResponseWriter, r *http.Request) {
+	seq := changes.latest()
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			http.Error(w, "Last-Event-ID must be the id of a streamed event", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid Last-Event-ID", "last_event_id", value)
+			return
+		}
+		seq = min(parsed, seq)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Stop nginx and similar proxies from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(w)
+	controller.Flush()
+	slog.InfoContext(r.Context(), "Receipt stream opened", "sequence", seq)
+
+	tenant := r.Header.Get("X-Tenant-ID")
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		events, ok, appended := changes.since(seq)
+		if !ok {
+			// The client was away for longer than the change log covers; carry on from now,
+			// and it can catch up from /v1/receipts
+			latest := changes.latest()
+			slog.WarnContext(r.Context(), "Receipt stream resumed after expired sequence", "sequence", seq, "resumed_at", latest)
+			seq = latest
+			continue
+		}
+		for _, event := range events {
+			seq = event.Seq
+			receipt := event.After
+			if receipt == nil {
+				receipt = event.Before
+			}
+			if receipt.Tenant != tenant || !ownsReceipt(r, *receipt) {
+				continue
+			}
+			data, _ := json.Marshal(streamedReceipt(event))
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, streamEvents[event.Op], data); err != nil {
+				slog.InfoContext(r.Context(), "Receipt stream closed", "error", err)
+				return
+			}
+		}
+		controller.Flush()
+
+		select {
+		case <-appended:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				slog.InfoContext(r.Context(), "Receipt stream closed", "error", err)
+				return
+			}
+			controller.Flush()
+		case <-r.Context().Done():
+			slog.InfoContext(r.Context(), "Receipt stream closed", "sequence", seq)
+			return
+		}
+	}
+}
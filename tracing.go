@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Which scored receipts get a verbose scoring trace: a random share of all of them, every
+// receipt of the listed tenants, and the listed receipts whenever they are scored again
+type TraceSettings struct {
+	SampleRate float64  `json:"sampleRate"`
+	Tenants    []string `json:"tenants,omitempty"`
+	ReceiptIDs []string `json:"receiptIds,omitempty"`
+}
+
+// How one rule was evaluated; rules that didn't apply say why
+type TraceStep struct {
+	Rule    string `json:"rule"`
+	Applied bool   `json:"applied"`
+	Points  int    `json:"points"`
+	Detail  string `json:"detail"`
+}
+
+type ScoringTrace struct {
+	ReceiptID string `json:"receiptId"`
+	Tenant    string `json:"tenant,omitempty"`
+	// The webhook event the scoring belonged to, e.g. receipt.processed or receipt.recalculated
+	Event string `json:"event"`
+	// Why the receipt was traced: sampled, tenant or receipt
+	Reason       string       `json:"reason"`
+	TracedAt     time.Time    `json:"tracedAt"`
+	RulesVersion string       `json:"rulesVersion"`
+	Points       int          `json:"points"`
+	Steps        []TraceStep  `json:"steps"`
+	Warnings     []Warning    `json:"warnings,omitempty"`
+	Quality      QualityScore `json:"quality"`
+	Shadow       *ShadowScore `json:"shadow,omitempty"`
+}
+
+var traceSettings TraceSettings
+var traces []ScoringTrace // oldest first, at most TRACE_BUFFER
+var tracesMutex = &sync.RWMutex{}
+
+func initTracing(cfg Config) {
+	tracesMutex.Lock()
+	traceSettings = TraceSettings{SampleRate: cfg.TraceSampleRate, Tenants: cfg.TraceTenants, ReceiptIDs: cfg.TraceReceiptIDs}
+	tracesMutex.Unlock()
+}
+
+func (t *ScoringTrace) applied(result RuleResult) {
+	if t != nil {
+		t.Steps = append(t.Steps, TraceStep{Rule: result.Rule, Applied: true, Points: result.Points, Detail: result.Description})
+	}
+}
+
+func (t *ScoringTrace) skipped(rule, reason string) {
+	if t != nil {
+		t.Steps = append(t.Steps, TraceStep{Rule: rule, Detail: reason})
+	}
+}
+
+// Whether any receipt can be selected for a trace, so scoring records how it went
+func tracingEnabled() bool {
+	tracesMutex.RLock()
+	defer tracesMutex.RUnlock()
+	return traceSettings.SampleRate > 0 || len(traceSettings.Tenants) > 0 || len(traceSettings.ReceiptIDs) > 0
+}
+
+// Why a receipt should be traced, if it should
+func traceReason(receipt Receipt) (string, bool) {
+	tracesMutex.RLock()
+	settings := traceSettings
+	tracesMutex.RUnlock()
+	switch {
+	case slices.Contains(settings.ReceiptIDs, receipt.ID):
+		return "receipt", true
+	case receipt.Tenant != "" && slices.Contains(settings.Tenants, receipt.Tenant):
+		return "tenant", true
+	case settings.SampleRate > 0 && rand.Float64() < settings.SampleRate:
+		return "sampled", true
+	}
+	return "", false
+}
+
+// Log and keep a verbose trace of how a just-stored receipt was scored, if it is selected,
+// from the steps scoreReceipt recorded. Receipts scored before tracing was turned on have
+// none and aren't traced.
+func traceScoring(ctx context.Context, receipt Receipt, event string) {
+	if receipt.traceSteps == nil {
+		return
+	}
+	reason, traced := traceReason(receipt)
+	if !traced {
+		return
+	}
+
+	trace := &ScoringTrace{
+		ReceiptID:    receipt.ID,
+		Tenant:       receipt.Tenant,
+		Event:        event,
+		Reason:       reason,
+		TracedAt:     time.Now().UTC(),
+		RulesVersion: receipt.RulesVersion,
+		Warnings:     receipt.Warnings,
+		Quality:      receipt.Quality,
+		Shadow:       receipt.Shadow,
+		Points:       receipt.Points,
+		Steps:        receipt.traceSteps,
+	}
+
+	slog.InfoContext(ctx, "Scoring trace", "receipt_id", trace.ReceiptID, "event", event, "reason", reason, "points", trace.Points, "rules_version", trace.RulesVersion)
+	for _, step := range trace.Steps {
+		slog.InfoContext(ctx, "Scoring trace step", "receipt_id", trace.ReceiptID, "rule", step.Rule, "applied", step.Applied, "points", step.Points, "detail", step.Detail)
+	}
+	for _, warning := range trace.Warnings {
+		slog.InfoContext(ctx, "Scoring trace warning", "receipt_id", trace.ReceiptID, "code", warning.Code, "message", warning.Message)
+	}
+	if trace.Shadow != nil {
+		slog.InfoContext(ctx, "Scoring trace shadow score", "receipt_id", trace.ReceiptID, "rules_version", trace.Shadow.RulesVersion, "points", trace.Shadow.Points)
+	}
+
+	tracesMutex.Lock()
+	traces = append(traces, *trace)
+	if len(traces) > config.TraceBuffer {
+		traces = slices.Delete(traces, 0, len(traces)-config.TraceBuffer)
+	}
+	tracesMutex.Unlock()
+}
+
+// GET and PUT /admin/tracing: who gets scoring traces, changeable without a restart
+func handleTraceSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tracesMutex.RLock()
+		settings := traceSettings
+		tracesMutex.RUnlock()
+		writeJSON(w, http.StatusOK, settings)
+	case http.MethodPut:
+		var settings TraceSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Error decoding trace settings", "error", err)
+			return
+		}
+		if settings.SampleRate < 0 || settings.SampleRate > 1 {
+			http.Error(w, "sampleRate must be between 0 and 1", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid trace sample rate", "sample_rate", settings.SampleRate)
+			return
+		}
+
+		tracesMutex.Lock()
+		traceSettings = settings
+		tracesMutex.Unlock()
+
+		slog.InfoContext(r.Context(), "Scoring traces set", "sample_rate", settings.SampleRate, "tenants", settings.Tenants, "receipt_ids", settings.ReceiptIDs)
+		writeJSON(w, http.StatusOK, settings)
+	default:
+		http.Error(w, "Only GET and PUT methods are allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET and PUT")
+	}
+}
+
+// GET /admin/traces?receiptId=...&tenant=...&limit=50, newest first
+func listTraces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET")
+		return
+	}
+
+	query := r.URL.Query()
+	limit := 50
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid traces limit", "limit", value)
+			return
+		}
+		limit = n
+	}
+	receiptID, tenant := query.Get("receiptId"), query.Get("tenant")
+
+	matches := []ScoringTrace{}
+	tracesMutex.RLock()
+	for i := len(traces) - 1; i >= 0 && len(matches) < limit; i-- {
+		trace := traces[i]
+		if (receiptID == "" || trace.ReceiptID == receiptID) && (tenant == "" || trace.Tenant == tenant) {
+			matches = append(matches, trace)
+		}
+	}
+	tracesMutex.RUnlock()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"traces": matches})
+}
+
+func validateTraceConfig(cfg Config) []error {
+	var errs []error
+	if cfg.TraceSampleRate < 0 || cfg.TraceSampleRate > 1 {
+		errs = append(errs, fmt.Errorf("TRACE_SAMPLE_RATE must be between 0 and 1, e.g. 0.01, got %g", cfg.TraceSampleRate))
+	}
+	if cfg.TraceBuffer < 1 {
+		errs = append(errs, fmt.Errorf("TRACE_BUFFER must be at least 1, got %d", cfg.TraceBuffer))
+	}
+	return errs
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Prefix of user IDs encrypted at rest, so IDs stored before USER_ID_KEY was set stay readable
+const encryptedUserIDPrefix = "enc1:"
+
+func parseUserIDKey(value string, errs *[]error) []byte {
+	if value == "" {
+		return nil
+	}
+	return decodeKey("USER_ID_KEY", value, errs)
+}
+
+// Derive a per-tenant key for one purpose, so a key recovered for one tenant or use reveals nothing else
+func tenantKey(purpose, tenant string) []byte {
+	mac := hmac.New(sha256.New, config.UserIDKey)
+	mac.Write([]byte(purpose + ":" + tenant))
+	return mac.Sum(nil)
+}
+
+// Keyed hash of a user ID; stable per tenant so stored receipts can be looked up by it
+func userIDHash(tenant, userID string) string {
+	mac := hmac.New(sha256.New, tenantKey("hash", tenant))
+	mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func userIDCipher(tenant string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(tenantKey("encrypt", tenant))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Store decorator encrypting user IDs on the way into the backend and decrypting them on the
+// way out, so everything above it works with plain IDs while a copy of the database only holds
+// ciphertext and the lookup hash in userIdHash. Without USER_ID_KEY new receipts are stored as
+// they are, and receipts encrypted earlier fail to load rather than surfacing ciphertext.
+type userIDStore struct {
+	Store
+}
+
+func (s *userIDStore) Put(ctx context.Context, receipt Receipt) error {
+	if receipt.UserID == "" || config.UserIDKey == nil {
+		return s.Store.Put(ctx, receipt)
+	}
+	gcm, err := userIDCipher(receipt.Tenant)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	// Bind the ciphertext to its receipt so it can't be moved to another one
+	sealed := gcm.Seal(nonce, nonce, []byte(receipt.UserID), []byte(receipt.ID))
+	receipt.UserIDHash = userIDHash(receipt.Tenant, receipt.UserID)
+	receipt.UserID = encryptedUserIDPrefix + base64.RawURLEncoding.EncodeToString(sealed)
+	return s.Store.Put(ctx, receipt)
+}
+
+func (s *userIDStore) Get(ctx context.Context, id string) (Receipt, bool, error) {
+	receipt, found, err := s.Store.Get(ctx, id)
+	if err != nil || !found {
+		return receipt, found, err
+	}
+	receipt, err = revealUserID(receipt)
+	return receipt, err == nil, err
+}
+
+func (s *userIDStore) List(ctx context.Context) ([]Receipt, error) {
+	return revealUserIDs(s.Store.List(ctx))
+}
+
+func (s *userIDStore) ListPurchased(ctx context.Context, from, to string) ([]Receipt, error) {
+	return revealUserIDs(s.Store.ListPurchased(ctx, from, to))
+}
+
+func revealUserIDs(receipts []Receipt, err error) ([]Receipt, error) {
+	if err != nil {
+		return nil, err
+	}
+	for i := range receipts {
+		if receipts[i], err = revealUserID(receipts[i]); err != nil {
+			return nil, err
+		}
+	}
+	return receipts, nil
+}
+
+func revealUserID(receipt Receipt) (Receipt, error) {
+	encoded, encrypted := strings.CutPrefix(receipt.UserID, encryptedUserIDPrefix)
+	if !encrypted {
+		return receipt, nil
+	}
+	if config.UserIDKey == nil {
+		return receipt, errors.New("receipt " + receipt.ID + " has an encrypted user ID but USER_ID_KEY is not set")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return receipt, err
+	}
+	gcm, err := userIDCipher(receipt.Tenant)
+	if err != nil {
+		return receipt, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return receipt, errors.New("receipt " + receipt.ID + " has a malformed encrypted user ID")
+	}
+	userID, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(receipt.ID))
+	if err != nil {
+		return receipt, err
+	}
+	receipt.UserID, receipt.UserIDHash = string(userID), ""
+	return receipt, nil
+}
+
+// The user ID written to exports: with USER_ID_KEY set, the keyed hash the database holds,
+// so exported rows can still be grouped by member without naming them
+func exportedUserID(receipt Receipt) string {
+	if receipt.UserID == "" || config.UserIDKey == nil {
+		return receipt.UserID
+	}
+	return userIDHash(receipt.Tenant, receipt.UserID)
+}
+
+// GET /admin/users/{id}/hash: the hash stored for a user under the X-Tenant-ID tenant, for finding their receipts in the database
+func getUserIDHash(w http.ResponseWriter, r *http.Request, userID string) {
+	if config.UserIDKey == nil {
+		http.Error(w, "User IDs are not encrypted; set USER_ID_KEY", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"userId": userID, "userIdHash": userIDHash(r.Header.Get("X-Tenant-ID"), userID)})
+}
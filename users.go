@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// POST /admin/users/{id}/merge with {"into": "...", "reason": "..."}: fold a duplicate user
+// into the user it duplicates. The balance moves over in a merge transaction, receipts are
+// reassigned, and the duplicate's ledger history stays as it was. Later points for the
+// duplicate's ID go to the user it was merged into. Retrying a merge completes it.
+func mergeUsers(w http.ResponseWriter, r *http.Request, userID string) {
+	var request struct {
+		Into   string `json:"into"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error decoding merge request", "error", err)
+		return
+	}
+	if request.Into == "" || request.Into == userID {
+		http.Error(w, "into must be a different user ID", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid user merge", "user_id", userID, "into", request.Into)
+		return
+	}
+
+	memo := "Merged user " + userID + " into " + request.Into
+	if request.Reason != "" {
+		memo += ": " + request.Reason
+	}
+	lifecycleMutex.Lock()
+	defer lifecycleMutex.Unlock()
+	if !commitBeforeDeadline(r) {
+		return
+	}
+
+	tenant := r.Header.Get("X-Tenant-ID")
+	entry, err := ledger.Merge(tenant, userID, request.Into, memo)
+	if errors.Is(err, errMergeConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		slog.WarnContext(r.Context(), "Rejected user merge", "user_id", userID, "into", request.Into, "error", err)
+		return
+	}
+
+	receipts, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Error listing receipts", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing receipts", "error", err)
+		return
+	}
+	reassigned := 0
+	for _, receipt := range receipts {
+		if receipt.Tenant != tenant || receipt.UserID != userID {
+			continue
+		}
+		receipt.UserID = request.Into
+		if err := store.Put(r.Context(), receipt); err != nil {
+			http.Error(w, "Error storing receipt", http.StatusInternalServerError)
+			slog.ErrorContext(r.Context(), "Error reassigning receipt", "receipt_id", receipt.ID, "into", request.Into, "error", err)
+			return
+		}
+		reassigned++
+	}
+
+	slog.InfoContext(r.Context(), "Merged user", "user_id", userID, "into", request.Into, "points", entry.Amount, "reassigned", reassigned)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"userId":             userID,
+		"mergedInto":         request.Into,
+		"pointsTransferred":  entry.Amount,
+		"receiptsReassigned": reassigned,
+		"entry":              entry,
+	})
+}
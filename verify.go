@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+)
+
+type Discrepancy struct {
+	ID             string
+	StoredPoints   int
+	ExpectedPoints int
+	StoredVersion  string
+	Reason         string
+}
+
+// Re-score every stored receipt and report those whose recorded points or breakdown no longer match
+func verifyReceipts(ctx context.Context, s Store) (int, []Discrepancy, error) {
+	receipts, err := s.List(ctx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("listing receipts: %w", err)
+	}
+
+	var discrepancies []Discrepancy
+	for _, receipt := range receipts {
+		points, breakdown := calculatePoints(receipt)
+		points, breakdown = withExternalResults(points, breakdown, receipt.Breakdown)
+		discrepancy := Discrepancy{
+			ID:             receipt.ID,
+			StoredPoints:   receipt.Points,
+			ExpectedPoints: points,
+			StoredVersion:  receipt.RulesVersion,
+		}
+
+		switch {
+		case receipt.RulesVersion != rulesVersion:
+			// Expected drift: the receipt was scored by a different rules version
+			if points != receipt.Points {
+				discrepancy.Reason = fmt.Sprintf("scored with rules version %q, current version %q awards different points", receipt.RulesVersion, rulesVersion)
+			}
+		case points != receipt.Points:
+			discrepancy.Reason = "points differ from a re-score under the same rules version"
+		case !sameBreakdown(breakdown, receipt.Breakdown):
+			discrepancy.Reason = "breakdown differs from a re-score under the same rules version"
+		}
+
+		if discrepancy.Reason != "" {
+			discrepancies = append(discrepancies, discrepancy)
+		}
+	}
+	return len(receipts), discrepancies, nil
+}
+
+func sameBreakdown(a, b []RuleResult) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// server verify [--backend=<backend> --dsn=<dsn>]
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	backend := flags.String("backend", config.StorageBackend, "storage backend to verify")
+	dsn := flags.String("dsn", config.StorageDSN, "storage DSN")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s, err := openStore(*backend, *dsn)
+	if err != nil {
+		return fmt.Errorf("opening storage: %w", err)
+	}
+	defer s.Close()
+
+	checked, discrepancies, err := verifyReceipts(context.Background(), s)
+	if err != nil {
+		return err
+	}
+	for _, d := range discrepancies {
+		fmt.Printf("%s: stored %d points, re-scored %d (rules version %q): %s\n", d.ID, d.StoredPoints, d.ExpectedPoints, d.StoredVersion, d.Reason)
+	}
+
+	slog.Info("Verified receipts", "checked", checked, "rules_version", rulesVersion, "discrepancies", len(discrepancies))
+	if len(discrepancies) > 0 {
+		return fmt.Errorf("%d of %d receipts have discrepancies", len(discrepancies), checked)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A named, shared filter over receipts
+type View struct {
+	Name        string    `json:"name"`
+	Filter      string    `json:"filter"`
+	Description string    `json:"description,omitempty"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	filter      Filter
+}
+
+// Fields of a matching receipt listed by a view
+type ReceiptSummary struct {
+	ID         string    `json:"id"`
+	Retailer   string    `json:"retailer"`
+	Total      string    `json:"total"`
+	Points     int       `json:"points"`
+	Quality    int       `json:"quality"`
+	Warnings   []Warning `json:"warnings,omitempty"`
+	UserID     string    `json:"userId,omitempty"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+var viewNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+var views = make(map[string]View)
+var viewsMutex = &sync.RWMutex{}
+
+func listViews() []View {
+	viewsMutex.RLock()
+	defer viewsMutex.RUnlock()
+
+	list := make([]View, 0, len(views))
+	for _, view := range views {
+		list = append(list, view)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// /admin/views and /admin/views/{name}
+func handleViews(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, listViews())
+	case name != "" && r.Method == http.MethodPut:
+		putView(w, r, name)
+	case name != "" && r.Method == http.MethodDelete:
+		viewsMutex.Lock()
+		_, found := views[name]
+		delete(views, name)
+		viewsMutex.Unlock()
+		if !found {
+			http.Error(w, "View not found", http.StatusNotFound)
+			slog.WarnContext(r.Context(), "View not found", "view", name)
+			return
+		}
+		slog.InfoContext(r.Context(), "Deleted view", "view", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Invalid endpoint", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "Invalid view request", "method", r.Method, "path", r.URL.Path)
+	}
+}
+
+func putView(w http.ResponseWriter, r *http.Request, name string) {
+	if !viewNamePattern.MatchString(name) {
+		http.Error(w, "View names must be lowercase letters, digits, '-' or '_'", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid view name", "view", name)
+		return
+	}
+
+	var view View
+	if err := json.NewDecoder(r.Body).Decode(&view); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Error decoding view", "error", err)
+		return
+	}
+	filter, err := parseFilter(view.Filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filter: %v", err), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid filter for view", "view", name, "error", err)
+		return
+	}
+	view.Name, view.filter, view.UpdatedAt = name, filter, time.Now().UTC()
+
+	viewsMutex.Lock()
+	views[name] = view
+	viewsMutex.Unlock()
+
+	slog.InfoContext(r.Context(), "Saved view", "view", name, "filter", view.Filter)
+	writeJSON(w, http.StatusOK, view)
+}
+
+func listViewReceipts(w http.ResponseWriter, r *http.Request, name string) {
+	viewsMutex.RLock()
+	view, found := views[name]
+	viewsMutex.RUnlock()
+	if !found {
+		http.Error(w, "View not found", http.StatusNotFound)
+		slog.WarnContext(r.Context(), "View not found", "view", name)
+		return
+	}
+
+	limit, offset, err := parsePagination(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Invalid view pagination", "error", err)
+		return
+	}
+
+	receipts, err := store.List(r.Context())
+	if err != nil {
+		http.Error(w, "Error reading receipts", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error listing receipts for view", "view", name, "error", err)
+		return
+	}
+
+	now := time.Now()
+	matches := []ReceiptSummary{}
+	for _, receipt := range receipts {
+		if view.filter.Match(receipt, now) {
+			matches = append(matches, ReceiptSummary{
+				ID:         receipt.ID,
+				Retailer:   receipt.Retailer,
+				Total:      receipt.Total,
+				Points:     receipt.Points,
+				Quality:    receipt.Quality.Score,
+				Warnings:   receipt.Warnings,
+				UserID:     receipt.UserID,
+				ReceivedAt: receipt.ReceivedAt,
+			})
+		}
+	}
+	// Newest first
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].ReceivedAt.After(matches[j].ReceivedAt) })
+
+	total := len(matches)
+	page := matches[min(offset, total):]
+	if limit > 0 {
+		page = page[:min(limit, len(page))]
+	}
+	slog.InfoContext(r.Context(), "View matched receipts", "view", name, "total", total)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"view": view, "total": total, "receipts": page})
+}
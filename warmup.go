@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Read endpoints requested during warmup unless WARMUP_PATHS is set
+var defaultWarmupPaths = []string{
+	apiVersion + "/stats",
+	apiVersion + "/stats/heatmap",
+	apiVersion + "/stats/items/top",
+	apiVersion + "/receipts/summary",
+	apiVersion + "/receipts",
+}
+
+type WarmupStep struct {
+	Step       string `json:"step"`
+	OK         bool   `json:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+type WarmupStatus struct {
+	// Whether warmup has finished, successfully or not, so /readyz can report ready
+	Done        bool         `json:"done"`
+	StartedAt   time.Time    `json:"startedAt"`
+	CompletedAt *time.Time   `json:"completedAt,omitempty"`
+	Steps       []WarmupStep `json:"steps"`
+}
+
+// Nil unless WARMUP is enabled
+var warmupStatus *WarmupStatus
+var warmupMutex = &sync.RWMutex{}
+
+func currentWarmup() *WarmupStatus {
+	warmupMutex.RLock()
+	defer warmupMutex.RUnlock()
+	if warmupStatus == nil {
+		return nil
+	}
+	status := *warmupStatus
+	status.Steps = append([]WarmupStep{}, warmupStatus.Steps...)
+	return &status
+}
+
+// Prime the storage backend's caches and the request paths before the first requests
+// after a deploy arrive. Called before the server starts listening, so /readyz reports
+// the instance as warming up from its first request. A step that fails or times out
+// doesn't keep the instance out of rotation; it becomes ready once WARMUP_TIMEOUT is up.
+func startWarmup() {
+	if !config.Warmup {
+		return
+	}
+	warmupMutex.Lock()
+	warmupStatus = &WarmupStatus{StartedAt: time.Now().UTC(), Steps: []WarmupStep{}}
+	warmupMutex.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), config.WarmupTimeout)
+		defer cancel()
+		slog.Info("Warming up", "timeout", config.WarmupTimeout)
+
+		runWarmupStep(ctx, "scoring", func() error {
+			receipt, err := prepareReceipt(ctx, []byte(selfTestFixture), FeatureSubject{}, Source{})
+			if points := pointsWithoutBonuses(receipt.Breakdown); err == nil && points != selfTestPoints {
+				err = fmt.Errorf("fixture scored %d points, expected %d", points, selfTestPoints)
+			}
+			return err
+		})
+		runWarmupStep(ctx, "recent_receipts", func() error {
+			since := time.Now().UTC().Add(-config.WarmupWindow).Format("2006-01-02")
+			receipts, err := store.ListPurchased(ctx, since, "")
+			if err == nil {
+				slog.Info("Warmup read recent receipts", "receipts", len(receipts), "since", since)
+			}
+			return err
+		})
+		paths := config.WarmupPaths
+		if len(paths) == 0 {
+			paths = defaultWarmupPaths
+		}
+		for _, path := range paths {
+			runWarmupStep(ctx, "GET "+path, func() error { return warmPath(ctx, path) })
+		}
+
+		completedAt := time.Now().UTC()
+		warmupMutex.Lock()
+		warmupStatus.Done, warmupStatus.CompletedAt = true, &completedAt
+		took := completedAt.Sub(warmupStatus.StartedAt)
+		warmupMutex.Unlock()
+		slog.Info("Warmup completed", "took", took.Round(time.Millisecond))
+	}()
+}
+
+func runWarmupStep(ctx context.Context, name string, run func() error) {
+	start := time.Now()
+	err := ctx.Err()
+	if err == nil {
+		err = run()
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = errors.New("WARMUP_TIMEOUT reached")
+	}
+	step := WarmupStep{Step: name, OK: err == nil, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		step.Error = err.Error()
+		slog.WarnContext(ctx, "Warmup step failed", "step", name, "error", err)
+	}
+	warmupMutex.Lock()
+	warmupStatus.Steps = append(warmupStatus.Steps, step)
+	warmupMutex.Unlock()
+}
+
+// Call the route's handler directly, so warmup requests skip the middleware and
+// don't count towards metrics, SLOs or client IP filters
+func warmPath(ctx context.Context, path string) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	matched, _, _ := matchRoute(request.URL.Path)
+	// Without the mux, path values have to be set from the route's pattern
+	segments := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+	for i, part := range strings.Split(strings.Trim(matched.path, "/"), "/") {
+		if name, ok := strings.CutPrefix(part, "{"); ok {
+			request.SetPathValue(strings.TrimSuffix(name, "}"), segments[i])
+		}
+	}
+	recorder := &jobRecorder{header: make(http.Header), status: http.StatusOK}
+	matched.handler(recorder, request)
+	if recorder.status >= http.StatusBadRequest {
+		return fmt.Errorf("answered %d: %s", recorder.status, strings.TrimSpace(recorder.body.String()))
+	}
+	return nil
+}
+
+func validateWarmupConfig(cfg Config) []error {
+	var errs []error
+	if cfg.WarmupTimeout <= 0 {
+		errs = append(errs, errors.New("WARMUP_TIMEOUT must be positive"))
+	}
+	if cfg.WarmupWindow < 0 {
+		errs = append(errs, errors.New("WARMUP_WINDOW must not be negative"))
+	}
+	for _, path := range cfg.WarmupPaths {
+		route, query, _ := strings.Cut(path, "?")
+		matched, canonical, found := matchRoute(route)
+		if _, err := url.ParseQuery(query); err != nil || !found || canonical != route || isAdminPath(route) || !slices.Contains(matched.methods, http.MethodGet) {
+			errs = append(errs, fmt.Errorf("WARMUP_PATHS entry %q is not a public GET endpoint such as %s", path, apiVersion+"/stats"))
+		}
+	}
+	return errs
+}
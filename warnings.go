@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// A non-fatal data-quality issue found while processing a receipt
+type Warning struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// Warning codes
+const (
+	warningPriceNormalized     = "price_normalized"
+	warningTimeNormalized      = "time_normalized"
+	warningPurchasedAtOverride = "purchased_at_override"
+	warningDescriptionTrimmed  = "description_trimmed"
+	warningTotalMismatch       = "total_mismatch"
+	warningDuplicateReceipt    = "duplicate_receipt"
+	warningExternalRuleSkipped = "external_rule_skipped"
+)
+
+// Check a validated receipt for issues that don't block processing
+func receiptWarnings(receipt Receipt) []Warning {
+	var warnings []Warning
+
+	itemSum := int64(0)
+	sumKnown := true
+	for index, item := range receipt.Items {
+		if trimmed := strings.TrimSpace(item.ShortDescription); trimmed != item.ShortDescription {
+			warnings = append(warnings, Warning{
+				Code:    warningDescriptionTrimmed,
+				Field:   fmt.Sprintf("items[%d].shortDescription", index),
+				Message: fmt.Sprintf("shortDescription has surrounding whitespace, scored as %q", trimmed),
+			})
+		}
+		cents, ok := parseCents(item.Price)
+		sumKnown = sumKnown && ok
+		itemSum += cents
+	}
+
+	if total, ok := parseCents(receipt.Total); ok && sumKnown {
+		if difference := total - itemSum; difference > config.TotalToleranceCents || -difference > config.TotalToleranceCents {
+			warnings = append(warnings, Warning{
+				Code:    warningTotalMismatch,
+				Field:   "total",
+				Message: fmt.Sprintf("total %s differs from the sum of item prices %s", receipt.Total, formatCents(itemSum)),
+			})
+		}
+	}
+	return warnings
+}
+
+// Parse a validated "dollars.cents" amount into integer cents
+func parseCents(amount string) (int64, bool) {
+	value, ok := parseBigCents(amount)
+	if !ok || !value.IsInt64() {
+		return 0, false
+	}
+	return value.Int64(), true
+}
+
+// Parse an amount of any magnitude into exact cents
+func parseBigCents(amount string) (*big.Int, bool) {
+	dollars, cents, found := strings.Cut(amount, ".")
+	if !found || len(cents) != 2 || dollars == "" || strings.ContainsAny(dollars+cents, "+-") {
+		return nil, false
+	}
+	value, ok := new(big.Int).SetString(dollars+cents, 10)
+	if !ok {
+		return nil, false
+	}
+	return value, true
+}
+
+// Whether an amount, however large, is at most max cents
+func withinLimit(amount string, max int64) bool {
+	value, ok := parseBigCents(amount)
+	return ok && value.Cmp(big.NewInt(max)) <= 0
+}
+
+func formatCents(cents int64) string {
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Receipt lifecycle events delivered to webhook subscriptions
+const (
+	eventReceiptProcessed    = "receipt.processed"
+	eventReceiptRecalculated = "receipt.recalculated"
+	eventReceiptUpdated      = "receipt.updated"
+	eventReceiptVoided       = "receipt.voided"
+	eventReceiptFlagged      = "receipt.flagged"
+	eventReceiptApproved     = "receipt.approved"
+	eventReceiptExpired      = "receipt.expired"
+)
+
+var webhookEventTypes = []string{eventReceiptProcessed, eventReceiptRecalculated, eventReceiptUpdated, eventReceiptVoided, eventReceiptFlagged, eventReceiptApproved, eventReceiptExpired}
+
+type WebhookSubscription struct {
+	ID  string `json:"id"`
+	URL string `json:"url"`
+	// Event types to deliver; empty means every event
+	Events []string `json:"events"`
+	// Only returned when the subscription is created
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (s WebhookSubscription) wants(eventType string) bool {
+	return len(s.Events) == 0 || slices.Contains(s.Events, eventType)
+}
+
+type WebhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"createdAt"`
+	Receipt   Receipt   `json:"receipt"`
+	Reason    string    `json:"reason,omitempty"`
+	// For recalculations and updates, the points before re-scoring
+	PreviousPoints *int `json:"previousPoints,omitempty"`
+	// For expirations, the points taken back from the user
+	ExpiredPoints int `json:"expiredPoints,omitempty"`
+}
+
+var webhooks = make(map[string]WebhookSubscription)
+var webhooksMutex = &sync.RWMutex{}
+
+// Deliver an event to every subscription that wants it, in the background
+func publishWebhook(event WebhookEvent) {
+	event.ID = uuid.NewString()
+	event.CreatedAt = time.Now().UTC()
+
+	webhooksMutex.RLock()
+	var subscriptions []WebhookSubscription
+	for _, subscription := range webhooks {
+		if subscription.wants(event.Type) {
+			subscriptions = append(subscriptions, subscription)
+		}
+	}
+	webhooksMutex.RUnlock()
+	if len(subscriptions) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding webhook", "type", event.Type, "receipt_id", event.Receipt.ID, "error", err)
+		return
+	}
+	for _, subscription := range subscriptions {
+		go deliverWebhook(subscription, event, body)
+	}
+}
+
+// Post with a few retries; receivers verify X-Webhook-Signature, the hex HMAC-SHA256 of the body keyed by the subscription secret
+func deliverWebhook(subscription WebhookSubscription, event WebhookEvent, body []byte) {
+	mac := hmac.New(sha256.New, []byte(subscription.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	var err error
+	for attempt := 1; attempt <= config.WebhookAttempts; attempt++ {
+		if err = postWebhook(subscription.URL, event, body, signature); err == nil {
+			return
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	slog.Error("Giving up on webhook", "type", event.Type, "event_id", event.ID, "url", subscription.URL, "attempts", config.WebhookAttempts, "error", err)
+}
+
+func postWebhook(target string, event WebhookEvent, body []byte, signature string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), notifyClient.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-ID", event.ID)
+	req.Header.Set("X-Webhook-Signature", signature)
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", target, resp.Status)
+	}
+	return nil
+}
+
+// Subscribe the WEBHOOK_URLS to WEBHOOK_EVENTS, signed with WEBHOOK_SECRET. They can be
+// deleted like any other subscription, but come back on the next start.
+func startWebhooks() {
+	now := time.Now().UTC()
+	webhooksMutex.Lock()
+	defer webhooksMutex.Unlock()
+	for i, target := range config.WebhookURLs {
+		subscription := WebhookSubscription{
+			ID:        fmt.Sprintf("config-%d", i+1),
+			URL:       target,
+			Events:    config.WebhookEvents,
+			Secret:    config.WebhookSecret,
+			CreatedAt: now,
+		}
+		webhooks[subscription.ID] = subscription
+		slog.Info("Subscribed configured webhook", "subscription_id", subscription.ID, "url", target, "events", subscription.Events)
+	}
+}
+
+func isWebhookURL(value string) bool {
+	target, err := url.Parse(value)
+	return err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != ""
+}
+
+func newWebhookSecret() string {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return hex.EncodeToString(secret)
+}
+
+func listWebhooks() []WebhookSubscription {
+	webhooksMutex.RLock()
+	defer webhooksMutex.RUnlock()
+	subscriptions := make([]WebhookSubscription, 0, len(webhooks))
+	for _, subscription := range webhooks {
+		subscription.Secret = ""
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt) })
+	return subscriptions
+}
+
+// GET and POST /admin/webhooks, DELETE /admin/webhooks/{id}
+func handleWebhooks(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id != "" {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Only DELETE method is allowed", http.StatusMethodNotAllowed)
+			slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "DELETE")
+			return
+		}
+		webhooksMutex.Lock()
+		_, found := webhooks[id]
+		delete(webhooks, id)
+		webhooksMutex.Unlock()
+		if !found {
+			http.Error(w, "Webhook subscription not found", http.StatusNotFound)
+			slog.WarnContext(r.Context(), "Webhook subscription not found", "subscription_id", id)
+			return
+		}
+		slog.InfoContext(r.Context(), "Deleted webhook subscription", "subscription_id", id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"webhooks": listWebhooks(), "eventTypes": webhookEventTypes})
+	case http.MethodPost:
+		var request struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Error decoding webhook subscription", "error", err)
+			return
+		}
+		if !isWebhookURL(request.URL) {
+			http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+			slog.WarnContext(r.Context(), "Invalid webhook URL", "url", request.URL)
+			return
+		}
+		for _, eventType := range request.Events {
+			if !slices.Contains(webhookEventTypes, eventType) {
+				http.Error(w, fmt.Sprintf("unknown event type %q", eventType), http.StatusBadRequest)
+				slog.WarnContext(r.Context(), "Invalid webhook event type", "event_type", eventType)
+				return
+			}
+		}
+		if request.Events == nil {
+			request.Events = []string{}
+		}
+
+		subscription := WebhookSubscription{
+			ID:        uuid.NewString(),
+			URL:       request.URL,
+			Events:    request.Events,
+			Secret:    newWebhookSecret(),
+			CreatedAt: time.Now().UTC(),
+		}
+		webhooksMutex.Lock()
+		webhooks[subscription.ID] = subscription
+		webhooksMutex.Unlock()
+		slog.InfoContext(r.Context(), "Created webhook subscription", "subscription_id", subscription.ID, "url", subscription.URL, "events", subscription.Events)
+		writeJSON(w, http.StatusCreated, subscription)
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		slog.WarnContext(r.Context(), "Invalid method", "method", r.Method, "allowed", "GET and POST")
+	}
+}
+
+func validateWebhookConfig(cfg Config) []error {
+	var errs []error
+	for _, target := range cfg.WebhookURLs {
+		if !isWebhookURL(target) {
+			errs = append(errs, fmt.Errorf("WEBHOOK_URLS entries must be absolute http or https URLs, got %q", target))
+		}
+	}
+	for _, eventType := range cfg.WebhookEvents {
+		if !slices.Contains(webhookEventTypes, eventType) {
+			errs = append(errs, fmt.Errorf("WEBHOOK_EVENTS has unknown event type %q; known types are %s", eventType, strings.Join(webhookEventTypes, ", ")))
+		}
+	}
+	if len(cfg.WebhookURLs) > 0 && len(cfg.WebhookSecret) < 16 {
+		errs = append(errs, errors.New("WEBHOOK_SECRET of at least 16 characters is required with WEBHOOK_URLS"))
+	}
+	if cfg.WebhookAttempts < 1 {
+		errs = append(errs, fmt.Errorf("WEBHOOK_ATTEMPTS must be at least 1, got %d", cfg.WebhookAttempts))
+	}
+	return errs
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Appended to Sec-WebSocket-Key to compute Sec-WebSocket-Accept (RFC 6455 section 1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	websocketPingInterval = 30 * time.Second
+	websocketWriteTimeout = 10 * time.Second
+	// Largest message a client may send, e.g. a retailer filter
+	websocketMaxMessage = 4096
+)
+
+// Frame opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// Close status codes
+const (
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+	wsCloseUnsupported = 1003
+	wsCloseInvalid     = 1007
+	wsCloseTooBig      = 1009
+)
+
+// A server side WebSocket connection. Writes are serialized so pongs and the close
+// handshake can be answered while events are being sent.
+type websocketConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+// An error the client caused, closing the connection with code
+type websocketError struct {
+	code   int
+	reason string
+}
+
+func (e *websocketError) Error() string {
+	return e.reason
+}
+
+// Complete the opening handshake and take over the connection. Reports false, having
+// answered the request, when it isn't a valid WebSocket upgrade.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, bool) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "This endpoint only speaks WebSocket", http.StatusUpgradeRequired)
+		slog.WarnContext(r.Context(), "Rejected request without a WebSocket upgrade")
+		return nil, false
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Only WebSocket version 13 is supported", http.StatusUpgradeRequired)
+		slog.WarnContext(r.Context(), "Rejected unsupported WebSocket version", "version", r.Header.Get("Sec-WebSocket-Version"))
+		return nil, false
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Sec-WebSocket-Key must be 16 base64-encoded bytes", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Rejected invalid Sec-WebSocket-Key")
+		return nil, false
+	}
+	// Browsers don't apply CORS to WebSockets, so other origins are turned away here
+	if origin := r.Header.Get("Origin"); origin != "" && !isSameOrigin(origin, r.Host) {
+		if _, allowed := corsAllowOrigin(origin); !allowed {
+			http.Error(w, "Origin is not allowed", http.StatusForbidden)
+			slog.WarnContext(r.Context(), "Rejected WebSocket from an origin that isn't allowed", "origin", origin)
+			return nil, false
+		}
+	}
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket upgrade is not available", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error taking over connection for WebSocket", "error", err)
+		return nil, false
+	}
+	// The server's read and write deadlines don't apply to a hijacked connection
+	conn.SetDeadline(time.Time{})
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(buffered, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(accept[:]))
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		slog.InfoContext(r.Context(), "WebSocket closed during handshake", "error", err)
+		return nil, false
+	}
+	return &websocketConn{conn: conn, reader: buffered.Reader}, true
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, candidate := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(candidate), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isSameOrigin(origin, host string) bool {
+	parsed, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(parsed.Host, host)
+}
+
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		header = append(header, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(len(payload)))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *websocketConn) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsText, data)
+}
+
+func (c *websocketConn) close(code int, reason string) {
+	c.writeFrame(wsClose, append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...))
+	c.conn.Close()
+}
+
+// Read the next text message, answering pings on the way. Returns io.EOF once the client
+// closes the connection, or a *websocketError for a frame the server won't accept.
+func (c *websocketConn) readMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+			return nil, err
+		}
+		final, opcode := head[0]&0x80 != 0, head[0]&0x0F
+		if head[0]&0x70 != 0 {
+			return nil, &websocketError{wsCloseProtocol, "reserved bits set"}
+		}
+		// Clients must mask every frame they send
+		if head[1]&0x80 == 0 {
+			return nil, &websocketError{wsCloseProtocol, "frame not masked"}
+		}
+		length := uint64(head[1] & 0x7F)
+		switch length {
+		case 126:
+			var extended [2]byte
+			if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+				return nil, err
+			}
+			length = uint64(binary.BigEndian.Uint16(extended[:]))
+		case 127:
+			var extended [8]byte
+			if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+				return nil, err
+			}
+			length = binary.BigEndian.Uint64(extended[:])
+		}
+		if opcode >= wsClose && (length > 125 || !final) {
+			return nil, &websocketError{wsCloseProtocol, "invalid control frame"}
+		}
+		if length > websocketMaxMessage || uint64(len(message))+length > websocketMaxMessage {
+			return nil, &websocketError{wsCloseTooBig, fmt.Sprintf("messages are limited to %d bytes", websocketMaxMessage)}
+		}
+		var mask [4]byte
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return nil, err
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+
+		switch opcode {
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.close(code, "")
+			return nil, io.EOF
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsBinary:
+			return nil, &websocketError{wsCloseUnsupported, "only text messages are accepted"}
+		case wsText:
+			if fragmented {
+				return nil, &websocketError{wsCloseProtocol, "new message before the last one was finished"}
+			}
+		case wsContinuation:
+			if !fragmented {
+				return nil, &websocketError{wsCloseProtocol, "continuation without a message"}
+			}
+		default:
+			return nil, &websocketError{wsCloseProtocol, "unknown opcode"}
+		}
+		message = append(message, payload...)
+		if final {
+			return message, nil
+		}
+		fragmented = true
+	}
+}
+
+// A processed receipt, as pushed to live points feed clients
+type LivePoints struct {
+	ID       string `json:"id"`
+	Retailer string `json:"retailer"`
+	Points   int    `json:"points"`
+}
+
+// The receipt a change scored, if it did: a new receipt that didn't wait for enrichment,
+// or a captured receipt that has just been finalized
+func processedReceipt(event ChangeEvent) (*Receipt, bool) {
+	if event.After == nil || receiptStatus(*event.After) == statusNeedsEnrichment {
+		return nil, false
+	}
+	if event.Before != nil && receiptStatus(*event.Before) != statusNeedsEnrichment {
+		return nil, false
+	}
+	return event.After, true
+}
+
+// The retailers a connection is interested in, all of them when empty, matched ignoring case
+type retailerFilter struct {
+	mu        sync.Mutex
+	retailers []string
+}
+
+func (f *retailerFilter) set(retailers []string) {
+	cleaned := []string{}
+	for _, retailer := range retailers {
+		if retailer = strings.TrimSpace(retailer); retailer != "" {
+			cleaned = append(cleaned, retailer)
+		}
+	}
+	f.mu.Lock()
+	f.retailers = cleaned
+	f.mu.Unlock()
+}
+
+func (f *retailerFilter) match(retailer string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.retailers) == 0 || slices.ContainsFunc(f.retailers, func(r string) bool { return strings.EqualFold(r, retailer) })
+}
+
+// GET /v1/receipts/live?retailer=...: a WebSocket pushing the tenant's receipts as they
+// are processed, only for the given retailers if any. Clients change their filter by
+// sending {"retailers": [...]}, and an empty list follows every retailer again.
+func liveReceipts(w http.ResponseWriter, r *http.Request) {
+	filter := &retailerFilter{}
+	filter.set(r.URL.Query()["retailer"])
+	conn, ok := upgradeWebsocket(w, r)
+	if !ok {
+		return
+	}
+	slog.InfoContext(r.Context(), "Live points feed opened", "retailers", filter.retailers)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			message, err := conn.readMessage()
+			var clientErr *websocketError
+			if errors.As(err, &clientErr) {
+				conn.close(clientErr.code, clientErr.reason)
+				slog.WarnContext(r.Context(), "Closed live points feed after an invalid frame", "error", err)
+				return
+			}
+			if err != nil {
+				return
+			}
+			var update struct {
+				Retailers *[]string `json:"retailers"`
+			}
+			if err := json.Unmarshal(message, &update); err != nil || update.Retailers == nil {
+				conn.close(wsCloseInvalid, `messages must be {"retailers": [...]}`)
+				slog.WarnContext(r.Context(), "Closed live points feed after an invalid message")
+				return
+			}
+			filter.set(*update.Retailers)
+			slog.InfoContext(r.Context(), "Live points feed filter changed", "retailers", *update.Retailers)
+		}
+	}()
+	defer conn.conn.Close()
+
+	tenant := r.Header.Get("X-Tenant-ID")
+	ping := time.NewTicker(websocketPingInterval)
+	defer ping.Stop()
+	for seq := changes.latest(); ; {
+		events, ok, appended := changes.since(seq)
+		if !ok {
+			// Fell behind the retained change log; carry on from now
+			seq = changes.latest()
+			continue
+		}
+		for _, event := range events {
+			seq = event.Seq
+			receipt, processed := processedReceipt(event)
+			if !processed || receipt.Tenant != tenant || !ownsReceipt(r, *receipt) || !filter.match(receipt.Retailer) {
+				continue
+			}
+			if err := conn.writeJSON(LivePoints{ID: receipt.ID, Retailer: receipt.Retailer, Points: receipt.Points}); err != nil {
+				slog.InfoContext(r.Context(), "Live points feed closed", "error", err)
+				return
+			}
+		}
+
+		select {
+		case <-appended:
+		case <-ping.C:
+			if err := conn.writeFrame(wsPing, nil); err != nil {
+				slog.InfoContext(r.Context(), "Live points feed closed", "error", err)
+				return
+			}
+		case <-done:
+			slog.InfoContext(r.Context(), "Live points feed closed", "sequence", seq)
+			return
+		}
+	}
+}